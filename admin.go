@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// WithAdminAddr serves the admin API on a separate listener. The admin API is
+// disabled when addr is empty.
+func WithAdminAddr(addr string) Option {
+	return func(s *Server) { s.adminAddr = addr }
+}
+
+func (s *Server) adminServer(ctx context.Context, addr string) error {
+	return s.serve(ctx, ListenerAdmin, addr, s.mux(ListenerAdmin))
+}
+
+func (s *Server) supervisorHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.supervisor.Status())
+}
+
+// configHandler reports the effective configuration with secrets redacted.
+func (s *Server) configHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.config.Redacted())
+}
+
+// writeJSON encodes v into a pooled buffer first, so encoding errors can
+// still become a 500 and the response carries a Content-Length.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// assetHashLen is the number of hex digits of the content hash put in
+// fingerprinted names.
+const assetHashLen = 12
+
+// immutableCacheControl is sent with fingerprinted assets: their content
+// cannot change without their name changing.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// AssetManifest maps the files of a static directory to content-hashed
+// names, such as css/app.css to css/app.3f2a9c1b7d4e.css, so pages can
+// link assets that are cached forever yet refreshed on every deploy.
+type AssetManifest struct {
+	prefix   string
+	byName   map[string]string
+	byHashed map[string]string
+}
+
+// NewAssetManifest hashes every file under dir, to be served under prefix.
+// The manifest is a snapshot: files changed afterwards keep their old names
+// until it is rebuilt.
+func NewAssetManifest(dir, prefix string) (*AssetManifest, error) {
+	m := &AssetManifest{
+		prefix:   "/" + strings.Trim(prefix, "/") + "/",
+		byName:   make(map[string]string),
+		byHashed: make(map[string]string),
+	}
+	fsys := os.DirFS(dir)
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		f, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		hashed := fingerprintName(p, hex.EncodeToString(h.Sum(nil))[:assetHashLen])
+		m.byName[p] = hashed
+		m.byHashed[hashed] = p
+		return nil
+	})
+	return m, err
+}
+
+// fingerprintName inserts hash before name's extension.
+func fingerprintName(name, hash string) string {
+	ext := path.Ext(name)
+	if ext == path.Base(name) {
+		// Dotfiles such as .htaccess have no extension to keep.
+		ext = ""
+	}
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// URL returns the fingerprinted URL of the asset name, a path relative to
+// the static directory. Unknown names get their plain URL, so a missing
+// asset shows up as a 404 rather than a broken template.
+func (m *AssetManifest) URL(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if hashed, ok := m.byName[name]; ok {
+		return m.prefix + hashed
+	}
+	return m.prefix + name
+}
+
+// MarshalJSON encodes the manifest as an object of name to fingerprinted
+// URL.
+func (m *AssetManifest) MarshalJSON() ([]byte, error) {
+	out := make(map[string]string, len(m.byName))
+	for name := range m.byName {
+		out[name] = m.URL(name)
+	}
+	return json.Marshal(out)
+}
+
+// middleware serves fingerprinted names from the original files, marked
+// immutable. Plain names still work but get no caching headers.
+func (m *AssetManifest) middleware() Middleware {
+	return Middleware{Name: "assets", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rel, ok := strings.CutPrefix(r.URL.Path, m.prefix)
+			if name, found := m.byHashed[rel]; ok && found {
+				u := *r.URL
+				u.Path, u.RawPath = m.prefix+name, ""
+				r2 := *r
+				r2.URL = &u
+				w.Header().Set("Cache-Control", immutableCacheControl)
+				r = &r2
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// assetURL is the template helper for static asset links: the fingerprinted
+// URL when fingerprinting is on, else the plain one.
+func (s *Server) assetURL(name string) string {
+	if s.assets != nil {
+		return s.assets.URL(name)
+	}
+	return "/" + strings.Trim(s.config.StaticPrefix, "/") + "/" + strings.TrimPrefix(name, "/")
+}
+
+// Assets returns the static asset manifest, or nil when static_fingerprint
+// is off.
+func (s *Server) Assets() *AssetManifest {
+	return s.assets
+}
+
+// assetsHandler serves GET /admin/assets.
+func (s *Server) assetsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.assets)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// banList holds temporarily banned client addresses. Expired bans are
+// swept as new ones are added, so the list stays bounded by the ban rate.
+type banList struct {
+	mu        sync.Mutex
+	bans      map[netip.Addr]Ban
+	lastSweep time.Time
+}
+
+// Ban is an entry of the ban list, as listed by GET /admin/bans.
+type Ban struct {
+	Addr   netip.Addr `json:"addr"`
+	Reason string     `json:"reason"`
+	Until  time.Time  `json:"until"`
+}
+
+func newBanList() *banList {
+	return &banList{bans: make(map[netip.Addr]Ban)}
+}
+
+// add bans addr for d, extending any existing ban.
+func (b *banList) add(addr netip.Addr, d time.Duration, reason string) Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Sub(b.lastSweep) > time.Minute {
+		b.lastSweep = now
+		maps.DeleteFunc(b.bans, func(_ netip.Addr, ban Ban) bool { return now.After(ban.Until) })
+	}
+	ban := Ban{Addr: addr, Reason: reason, Until: now.Add(d)}
+	if old, ok := b.bans[addr]; ok && old.Until.After(ban.Until) {
+		ban.Until = old.Until
+	}
+	b.bans[addr] = ban
+	return ban
+}
+
+func (b *banList) remove(addr netip.Addr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.bans[addr]
+	delete(b.bans, addr)
+	return ok
+}
+
+func (b *banList) banned(addr netip.Addr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ban, ok := b.bans[addr]
+	if ok && time.Now().After(ban.Until) {
+		delete(b.bans, addr)
+		return false
+	}
+	return ok
+}
+
+// list returns the active bans, soonest expiry first.
+func (b *banList) list() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	maps.DeleteFunc(b.bans, func(_ netip.Addr, ban Ban) bool { return now.After(ban.Until) })
+	return slices.SortedFunc(maps.Values(b.bans), func(a, b Ban) int { return a.Until.Compare(b.Until) })
+}
+
+// Ban blocks the client behind r for d. Trusted proxy addresses are never
+// banned, since that would lock out everyone behind the proxy; it reports
+// whether a ban was placed.
+func (s *Server) Ban(r *http.Request, d time.Duration, reason string) bool {
+	addr, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	if isTrustedProxy(addr) {
+		slog.Warn("Not banning trusted proxy address", "addr", addr, "reason", reason)
+		return false
+	}
+	ban := s.bans.add(addr, d, reason)
+	s.metrics.Add("server_bans_total", 1, "reason", reason)
+	s.events.Publish(ClientBanned{Addr: addr, Reason: reason, Until: ban.Until, Time: time.Now()})
+	slog.Info("Banned client", "addr", addr, "reason", reason, "until", ban.Until)
+	return true
+}
+
+// rejectBanned answers requests from banned clients with 403, or holds them
+// in the tarpit when one is configured and has room.
+func (s *Server) rejectBanned() Middleware {
+	return Middleware{Name: "bans", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if addr, err := netip.ParseAddr(clientIP(r)); err == nil && s.bans.banned(addr.Unmap()) {
+				s.metrics.Add("server_banned_requests_total", 1)
+				if s.tarpit != nil && s.tarpit.hold(w) {
+					return
+				}
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+func (s *Server) bansHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.bans.list())
+}
+
+func (s *Server) unbanHandler(w http.ResponseWriter, r *http.Request) {
+	addr, err := netip.ParseAddr(r.PathValue("addr"))
+	if err != nil {
+		http.Error(w, "invalid address", http.StatusBadRequest)
+		return
+	}
+	if !s.bans.remove(addr.Unmap()) {
+		http.Error(w, "not banned", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// honeypotHandler serves decoy paths that only scanners request: the client
+// is banned and sees an ordinary 404, so nothing hints at the trap.
+func (s *Server) honeypotHandler(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.metrics.Add("server_honeypot_hits_total", 1, "path", path)
+		s.Ban(r, s.config.BanDuration, "honeypot")
+		http.NotFound(w, r)
+	}
+}
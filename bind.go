@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BindQuery fills the struct v points to from r's query parameters and
+// validates it. Fields are bound by their query tag and may also carry:
+//
+//	default:"10"       used when the parameter is absent
+//	required:"true"    the parameter must be present
+//	min:"1" max:"100"  bounds for numbers
+//	oneof:"asc desc"   the allowed values of strings
+//
+// Supported types are strings, bools, integers, floats, time.Duration,
+// time.Time (RFC 3339) and slices of them, bound from repeated
+// parameters. When anything fails, BindQuery answers with a 400 problem
+// listing every failure and returns false. v must be a pointer to a
+// struct.
+func BindQuery(w http.ResponseWriter, r *http.Request, v any) bool {
+	if errs := bindValues("query", r.URL.Query(), v); len(errs) > 0 {
+		writeProblem(w, http.StatusBadRequest, "invalid query parameters", errs)
+		return false
+	}
+	return true
+}
+
+// bindValues binds values to the fields of v tagged in, collecting a
+// paramError for each one that fails.
+func bindValues(in string, values url.Values, v any) []paramError {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("binding %s: %T is not a pointer to a struct", in, v))
+	}
+	rv = rv.Elem()
+	t := rv.Type()
+	var errs []paramError
+	fail := func(name, detail string) {
+		errs = append(errs, paramError{In: in, schemaError: schemaError{Pointer: "/" + name, Detail: detail}})
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get(in)
+		if name == "" || name == "-" || !f.IsExported() || f.Type == fileHeaderType || f.Type == fileHeadersType {
+			// Uploaded files are bound by bindFiles.
+			continue
+		}
+		raw := values[name]
+		if len(raw) == 0 {
+			def, ok := f.Tag.Lookup("default")
+			if !ok {
+				if f.Tag.Get("required") == "true" {
+					fail(name, "is required")
+				}
+				continue
+			}
+			raw = []string{def}
+			if f.Type.Kind() == reflect.Slice {
+				raw = strings.Split(def, ",")
+			}
+		}
+		if err := setParam(rv.Field(i), raw); err != nil {
+			fail(name, err.Error())
+			continue
+		}
+		if err := checkParam(f, rv.Field(i)); err != nil {
+			fail(name, err.Error())
+		}
+	}
+	return errs
+}
+
+// setParam sets v from raw, all of it for slices and the first value
+// otherwise.
+func setParam(v reflect.Value, raw []string) error {
+	if v.Kind() != reflect.Slice {
+		return setScalarParam(v, raw[0])
+	}
+	s := reflect.MakeSlice(v.Type(), len(raw), len(raw))
+	for i, r := range raw {
+		if err := setScalarParam(s.Index(i), r); err != nil {
+			return err
+		}
+	}
+	v.Set(s)
+	return nil
+}
+
+func setScalarParam(v reflect.Value, raw string) error {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("must be a duration, not %q", raw)
+		}
+		v.SetInt(int64(d))
+	case v.Type() == reflect.TypeOf(time.Time{}):
+		ts, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return fmt.Errorf("must be an RFC 3339 time, not %q", raw)
+		}
+		v.Set(reflect.ValueOf(ts))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("must be a boolean, not %q", raw)
+		}
+		v.SetBool(b)
+	case v.CanInt():
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be an integer, not %q", raw)
+		}
+		v.SetInt(n)
+	case v.CanUint():
+		n, err := strconv.ParseUint(raw, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be a non-negative integer, not %q", raw)
+		}
+		v.SetUint(n)
+	case v.CanFloat():
+		f, err := strconv.ParseFloat(raw, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be a number, not %q", raw)
+		}
+		v.SetFloat(f)
+	default:
+		panic(fmt.Sprintf("binding: unsupported field type %s", v.Type()))
+	}
+	return nil
+}
+
+// checkParam applies the min, max and oneof tags of f to v, or to each
+// element of a slice.
+func checkParam(f reflect.StructField, v reflect.Value) error {
+	if v.Kind() == reflect.Slice {
+		for i := 0; i < v.Len(); i++ {
+			if err := checkParam(f, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var n float64
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		return nil
+	case v.CanInt():
+		n = float64(v.Int())
+	case v.CanUint():
+		n = float64(v.Uint())
+	case v.CanFloat():
+		n = v.Float()
+	case v.Kind() == reflect.String:
+		if oneof := f.Tag.Get("oneof"); oneof != "" && !slices.Contains(strings.Fields(oneof), v.String()) {
+			return fmt.Errorf("must be one of %s", strings.Join(strings.Fields(oneof), ", "))
+		}
+		return nil
+	default:
+		return nil
+	}
+	if lo, err := strconv.ParseFloat(f.Tag.Get("min"), 64); err == nil && n < lo {
+		return fmt.Errorf("must be >= %s", f.Tag.Get("min"))
+	}
+	if hi, err := strconv.ParseFloat(f.Tag.Get("max"), 64); err == nil && n > hi {
+		return fmt.Errorf("must be <= %s", f.Tag.Get("max"))
+	}
+	return nil
+}
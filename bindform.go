@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+)
+
+// Form binding limits used when FormOptions leaves them zero.
+const (
+	defaultFormMaxBytes  = 10 << 20
+	defaultFormMaxMemory = 1 << 20
+)
+
+var (
+	fileHeaderType  = reflect.TypeOf((*multipart.FileHeader)(nil))
+	fileHeadersType = reflect.TypeOf([]*multipart.FileHeader(nil))
+)
+
+// FormOptions configures BindForm.
+type FormOptions struct {
+	// MaxBytes bounds the request body; larger ones get a 413 problem.
+	MaxBytes int64
+	// MaxMemory is how much of a multipart body is held in memory before
+	// files spill to temporary files.
+	MaxMemory int64
+	// OnFile, when set, is called for every uploaded file bound to a
+	// field, before the handler runs. An error rejects the file, so it
+	// can enforce sizes or types or stream the file elsewhere.
+	OnFile func(field string, fh *multipart.FileHeader) error
+}
+
+// BindForm fills the struct v points to from a URL-encoded or multipart
+// form body, with the tags and validation of BindQuery under the form
+// tag. Fields of type *multipart.FileHeader or []*multipart.FileHeader
+// receive uploaded files. When anything fails, BindForm answers with a
+// problem in the format of the other binders and returns false.
+func BindForm(w http.ResponseWriter, r *http.Request, v any, opts FormOptions) bool {
+	maxBytes := opts.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultFormMaxBytes
+	}
+	maxMemory := opts.MaxMemory
+	if maxMemory <= 0 {
+		maxMemory = defaultFormMaxMemory
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		err = r.ParseMultipartForm(maxMemory)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			writeProblem(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxBytes), nil)
+			return false
+		}
+		writeProblem(w, http.StatusBadRequest, "invalid form: "+err.Error(), nil)
+		return false
+	}
+
+	errs := bindValues("form", r.PostForm, v)
+	errs = append(errs, bindFiles(r.MultipartForm, v, opts.OnFile)...)
+	if len(errs) > 0 {
+		writeProblem(w, http.StatusBadRequest, "invalid form fields", errs)
+		return false
+	}
+	return true
+}
+
+// bindFiles sets the file fields of v from form, which is nil for
+// URL-encoded bodies.
+func bindFiles(form *multipart.Form, v any, onFile func(string, *multipart.FileHeader) error) []paramError {
+	rv := reflect.ValueOf(v).Elem()
+	t := rv.Type()
+	var errs []paramError
+	fail := func(name, detail string) {
+		errs = append(errs, paramError{In: "form", schemaError: schemaError{Pointer: "/" + name, Detail: detail}})
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("form")
+		if name == "" || name == "-" || !f.IsExported() || f.Type != fileHeaderType && f.Type != fileHeadersType {
+			continue
+		}
+		var files []*multipart.FileHeader
+		if form != nil {
+			files = form.File[name]
+		}
+		if len(files) == 0 {
+			if f.Tag.Get("required") == "true" {
+				fail(name, "is required")
+			}
+			continue
+		}
+		if onFile != nil {
+			if err := eachFile(files, func(fh *multipart.FileHeader) error { return onFile(name, fh) }); err != nil {
+				fail(name, err.Error())
+				continue
+			}
+		}
+		if f.Type == fileHeaderType {
+			rv.Field(i).Set(reflect.ValueOf(files[0]))
+		} else {
+			rv.Field(i).Set(reflect.ValueOf(files))
+		}
+	}
+	return errs
+}
+
+// eachFile calls fn for every file, stopping at the first it rejects.
+func eachFile(files []*multipart.FileHeader, fn func(*multipart.FileHeader) error) error {
+	for _, fh := range files {
+		if err := fn(fh); err != nil {
+			return fmt.Errorf("%s: %w", fh.Filename, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Blue/green colours.
+const (
+	ColorBlue  = "blue"
+	ColorGreen = "green"
+)
+
+// BlueGreenOptions configures automatic rollback after a switch.
+type BlueGreenOptions struct {
+	// RollbackErrorRate is the share of 5xx responses, observed during
+	// RollbackWindow after a switch, that triggers a switch back. Zero
+	// disables rollback.
+	RollbackErrorRate float64
+	RollbackWindow    time.Duration
+	// RollbackMinRequests avoids rolling back on a handful of requests.
+	RollbackMinRequests int
+}
+
+// blueGreen serves traffic from one of two handlers, switched atomically
+// through the admin API.
+type blueGreen struct {
+	handlers map[string]http.Handler
+	opts     BlueGreenOptions
+	active   atomic.Pointer[string]
+
+	mu         sync.Mutex
+	previous   string
+	switchedAt time.Time
+	watching   bool // whether the current colour may still be rolled back
+	requests   int
+	errors     int
+}
+
+func newBlueGreen(blue, green http.Handler, opts BlueGreenOptions) *blueGreen {
+	bg := &blueGreen{handlers: map[string]http.Handler{ColorBlue: blue, ColorGreen: green}, opts: opts}
+	active := ColorBlue
+	bg.active.Store(&active)
+	return bg
+}
+
+// switchTo makes color active. Operator switches start a rollback window;
+// rollbacks do not, so a failing pair cannot flip back and forth.
+func (bg *blueGreen) switchTo(color string, watch bool) (from string) {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	from = *bg.active.Load()
+	if from == color {
+		return from
+	}
+	bg.previous, bg.switchedAt, bg.watching = from, time.Now(), watch
+	bg.requests, bg.errors = 0, 0
+	bg.active.Store(&color)
+	return from
+}
+
+// observe counts a response served after a switch and reports whether the
+// error rate calls for a rollback to the previous colour.
+func (bg *blueGreen) observe(color string, status int) (rollback bool) {
+	if bg.opts.RollbackErrorRate <= 0 {
+		return false
+	}
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	if !bg.watching || color != *bg.active.Load() || time.Since(bg.switchedAt) > bg.opts.RollbackWindow {
+		return false
+	}
+	bg.requests++
+	if status >= 500 {
+		bg.errors++
+	}
+	if bg.requests < bg.opts.RollbackMinRequests {
+		return false
+	}
+	return float64(bg.errors)/float64(bg.requests) > bg.opts.RollbackErrorRate
+}
+
+// BlueGreen serves requests from whichever of blue and green is active.
+// Blue is active initially; the server has a single switch, shared by every
+// handler built from it.
+func (s *Server) BlueGreen(blue, green http.Handler, opts BlueGreenOptions) http.Handler {
+	if s.blueGreen == nil {
+		s.blueGreen = newBlueGreen(blue, green, opts)
+	}
+	bg := s.blueGreen
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		color := *bg.active.Load()
+		rec := NewInstrumentedWriter(w)
+		bg.handlers[color].ServeHTTP(rec, r)
+		s.metrics.Add("server_bluegreen_requests_total", 1, "color", color)
+
+		if bg.observe(color, rec.Status()) {
+			bg.mu.Lock()
+			previous := bg.previous
+			bg.mu.Unlock()
+			if bg.switchTo(previous, false) == color {
+				slog.Warn("Rolling back blue/green switch on error rate", "from", color, "to", previous)
+				s.metrics.Add("server_bluegreen_rollbacks_total", 1)
+				s.events.Publish(TrafficSwitched{From: color, To: previous, Rollback: true, Time: time.Now()})
+			}
+		}
+	})
+}
+
+// blueGreenHandler serves GET /admin/bluegreen.
+func (s *Server) blueGreenHandler(w http.ResponseWriter, r *http.Request) {
+	bg := s.blueGreen
+	bg.mu.Lock()
+	resp := map[string]any{"active": *bg.active.Load(), "previous": bg.previous}
+	if !bg.switchedAt.IsZero() {
+		resp["switched_at"] = bg.switchedAt
+	}
+	bg.mu.Unlock()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// switchBlueGreenHandler serves PUT /admin/bluegreen with {"active":"green"}.
+func (s *Server) switchBlueGreenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Active string `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Active != ColorBlue && req.Active != ColorGreen {
+		http.Error(w, fmt.Sprintf("active must be %q or %q", ColorBlue, ColorGreen), http.StatusBadRequest)
+		return
+	}
+	if from := s.blueGreen.switchTo(req.Active, true); from != req.Active {
+		slog.Warn("Blue/green switched", "from", from, "to", req.Active)
+		s.events.Publish(TrafficSwitched{From: from, To: req.Active, Time: time.Now()})
+	}
+	s.blueGreenHandler(w, r)
+}
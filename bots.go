@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Bot rule actions.
+const (
+	BotBlock     = "block"
+	BotChallenge = "challenge"
+	BotTag       = "tag"
+)
+
+// botChallengeCookie carries the answer to a challenge. Clients that keep
+// cookies pass on their next request; most scrapers do not.
+const botChallengeCookie = "bot_challenge"
+
+// BotRule classifies requests by User-Agent or TLS fingerprint.
+type BotRule struct {
+	Action string
+	Class  string
+	// Substrings are matched case-insensitively against the User-Agent,
+	// except that "ja3:HASH" and "ja4:FINGERPRINT" match the client's TLS
+	// fingerprint exactly. A rule without any matches requests that send no
+	// User-Agent.
+	Substrings []string
+}
+
+func (b BotRule) match(r *http.Request) bool {
+	ua := r.UserAgent()
+	if len(b.Substrings) == 0 {
+		return ua == ""
+	}
+	ua = strings.ToLower(ua)
+	fp, hasFP := ClientTLSFingerprint(r.Context())
+	for _, s := range b.Substrings {
+		if hash, ok := strings.CutPrefix(s, "ja3:"); ok {
+			if hasFP && hash == fp.JA3Hash {
+				return true
+			}
+		} else if id, ok := strings.CutPrefix(s, "ja4:"); ok {
+			if hasFP && id == fp.JA4 {
+				return true
+			}
+		} else if strings.Contains(ua, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBotRules parses "action:class=substr|substr" entries.
+func parseBotRules(entries []string) ([]BotRule, error) {
+	var rules []BotRule
+	for _, e := range entries {
+		head, list, ok := strings.Cut(strings.TrimSpace(e), "=")
+		action, class, ok2 := strings.Cut(head, ":")
+		if !ok || !ok2 || class == "" {
+			return nil, fmt.Errorf("invalid bot rule %q: want action:class=substr|substr", e)
+		}
+		switch action {
+		case BotBlock, BotChallenge, BotTag:
+		default:
+			return nil, fmt.Errorf("invalid bot rule %q: unknown action %q", e, action)
+		}
+		rule := BotRule{Action: action, Class: class}
+		for _, s := range strings.Split(list, "|") {
+			if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+				rule.Substrings = append(rule.Substrings, s)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+type botClassKey struct{}
+
+// BotClass returns the class of the first bot rule the request matched.
+func BotClass(ctx context.Context) (string, bool) {
+	c, ok := ctx.Value(botClassKey{}).(string)
+	return c, ok
+}
+
+// botFilter classifies requests by the first matching rule: block rejects
+// them with 403, challenge lets them through only with a valid challenge
+// cookie, and tag just records the class for later middleware, such as
+// botRateLimit. Requests matching no rule are counted as class "none".
+func botFilter(rules []BotRule, m *Metrics) Middleware {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+
+	return Middleware{Name: "bot-filter", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			i := 0
+			for i < len(rules) && !rules[i].match(r) {
+				i++
+			}
+			if i == len(rules) {
+				m.Add("server_bot_requests_total", 1, "class", "none", "action", "none")
+				next.ServeHTTP(w, r)
+				return
+			}
+			rule := rules[i]
+
+			action := rule.Action
+			switch rule.Action {
+			case BotBlock:
+				m.Add("server_bot_requests_total", 1, "class", rule.Class, "action", action)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			case BotChallenge:
+				answer := botChallengeAnswer(key, r)
+				if c, err := r.Cookie(botChallengeCookie); err != nil || !hmac.Equal([]byte(c.Value), []byte(answer)) {
+					m.Add("server_bot_requests_total", 1, "class", rule.Class, "action", action)
+					botChallenge(w, r, answer)
+					return
+				}
+				action = "challenge_passed"
+			}
+			m.Add("server_bot_requests_total", 1, "class", rule.Class, "action", action)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), botClassKey{}, rule.Class)))
+		})
+	}}
+}
+
+// botChallengeAnswer binds the challenge cookie to the client address and
+// User-Agent, so a solved cookie cannot be shared across a scraper fleet.
+func botChallengeAnswer(key []byte, r *http.Request) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(clientIP(r) + "\n" + r.UserAgent()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// botChallenge sets the challenge cookie and sends safe requests back to
+// the same URL; other methods cannot be retried transparently and are
+// refused until the client has passed a challenge.
+func botChallenge(w http.ResponseWriter, r *http.Request, answer string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     botChallengeCookie,
+		Value:    answer,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+// botRateLimit limits requests tagged with a bot class to that class's rate.
+// The bucket is shared by every client in the class, so scrapers rotating
+// through addresses are throttled as one; untagged requests pass through.
+func botRateLimit(limits map[string]RateLimit, m *Metrics) Middleware {
+	limiter := make(map[string]*rateLimiter)
+	for class, l := range limits {
+		limiter[class] = newRateLimiter(l.Rate, max(l.Burst, 1))
+	}
+	return Middleware{Name: "bot-rate-limit", Wrap: func(next http.Handler) http.Handler {
+		if len(limiter) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			class, _ := BotClass(r.Context())
+			if l := limiter[class]; l != nil {
+				if ok, wait := l.allow(class); !ok {
+					m.Add("server_bot_requests_total", 1, "class", class, "action", "rate_limited")
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+					http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
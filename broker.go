@@ -0,0 +1,285 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// brokerMaxTopics caps the topics a single client may subscribe to.
+const brokerMaxTopics = 16
+
+// brokerMaxTopicLen caps topic names taken from subscription requests.
+const brokerMaxTopicLen = 128
+
+// BrokerMessage is one published message. IDs increase across all topics,
+// so a reconnecting client can resume with the last ID it saw.
+type BrokerMessage struct {
+	ID    uint64          `json:"id"`
+	Topic string          `json:"topic"`
+	Data  json.RawMessage `json:"data"`
+	Time  time.Time       `json:"time"`
+}
+
+type brokerTopic struct {
+	subs map[*brokerSub]struct{}
+	// recent holds the last messages published to the topic, oldest first,
+	// for clients resuming after a disconnect.
+	recent []BrokerMessage
+}
+
+// brokerSub is one connected client. Its queue is bounded: a client that
+// falls that far behind is evicted instead of slowing down publishers.
+type brokerSub struct {
+	topics  []string
+	queue   chan BrokerMessage
+	evicted chan struct{}
+	once    sync.Once
+}
+
+// Broker fans messages published by handlers out to the SSE and WebSocket
+// clients subscribed to their topic.
+type Broker struct {
+	topicBuffer int
+	subBuffer   int
+	metrics     *Metrics
+
+	// ctx is cancelled when the server shuts down. WebSocket connections
+	// are hijacked, so http.Server.Shutdown does not know about them.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	topics  map[string]*brokerTopic
+	sockets map[*wsConn]struct{}
+	lastID  uint64
+	subs    int
+}
+
+func newBroker(topicBuffer, subBuffer int, m *Metrics) *Broker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Broker{topicBuffer: topicBuffer, subBuffer: subBuffer, metrics: m, ctx: ctx, cancel: cancel, topics: make(map[string]*brokerTopic), sockets: make(map[*wsConn]struct{})}
+}
+
+// close sends WebSocket subscribers a going-away close frame and waits for
+// it to be written; SSE subscribers are ended by the stream registry.
+func (b *Broker) close() {
+	b.cancel()
+	b.mu.Lock()
+	sockets := slices.Collect(maps.Keys(b.sockets))
+	b.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, ws := range sockets {
+		wg.Go(func() { ws.close(wsCloseGoingAway, "server shutting down") })
+	}
+	wg.Wait()
+}
+
+// Publish sends data, encoded as JSON, to the subscribers of topic and
+// keeps it for clients that resume later. It never blocks on a subscriber.
+func (b *Broker) Publish(topic string, data any) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastID++
+	msg := BrokerMessage{ID: b.lastID, Topic: topic, Data: raw, Time: time.Now()}
+	b.metrics.Add("server_broker_messages_total", 1, "topic", topic)
+	if _, ok := b.topics[topic]; !ok && b.topicBuffer == 0 {
+		return nil
+	}
+	t := b.topic(topic)
+	if b.topicBuffer > 0 {
+		if len(t.recent) == b.topicBuffer {
+			t.recent = slices.Delete(t.recent, 0, 1)
+		}
+		t.recent = append(t.recent, msg)
+	}
+	for sub := range t.subs {
+		select {
+		case sub.queue <- msg:
+		default:
+			b.evict(sub)
+		}
+	}
+	return nil
+}
+
+// topic returns the named topic, creating it. b.mu must be held.
+func (b *Broker) topic(name string) *brokerTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &brokerTopic{subs: make(map[*brokerSub]struct{})}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// subscribe registers a client for topics. Retained messages newer than
+// after are queued first, up to the client's buffer, so a resuming client
+// sees them in order before live ones.
+func (b *Broker) subscribe(topics []string, after uint64) *brokerSub {
+	sub := &brokerSub{topics: topics, queue: make(chan BrokerMessage, b.subBuffer), evicted: make(chan struct{})}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var backlog []BrokerMessage
+	for _, name := range topics {
+		t := b.topic(name)
+		t.subs[sub] = struct{}{}
+		if after > 0 {
+			for _, msg := range t.recent {
+				if msg.ID > after {
+					backlog = append(backlog, msg)
+				}
+			}
+		}
+	}
+	slices.SortFunc(backlog, func(a, b BrokerMessage) int { return cmp.Compare(a.ID, b.ID) })
+	if len(backlog) > b.subBuffer {
+		backlog = backlog[len(backlog)-b.subBuffer:]
+	}
+	for _, msg := range backlog {
+		sub.queue <- msg
+	}
+	b.subs++
+	b.metrics.Set("server_broker_subscribers", float64(b.subs))
+	return sub
+}
+
+// unsubscribe removes sub; topics left with neither subscribers nor
+// retained messages are forgotten, so clients cannot grow the topic map.
+func (b *Broker) unsubscribe(sub *brokerSub) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, name := range sub.topics {
+		t := b.topics[name]
+		delete(t.subs, sub)
+		if len(t.subs) == 0 && len(t.recent) == 0 {
+			delete(b.topics, name)
+		}
+	}
+	b.subs--
+	b.metrics.Set("server_broker_subscribers", float64(b.subs))
+}
+
+// evict signals a subscriber that it is too slow; its handler disconnects
+// it. b.mu must be held.
+func (b *Broker) evict(sub *brokerSub) {
+	sub.once.Do(func() {
+		close(sub.evicted)
+		b.metrics.Add("server_broker_evictions_total", 1)
+	})
+}
+
+// subscribeHandler streams the topics named by repeated topic parameters
+// to the client, over WebSocket when it asks to upgrade and SSE otherwise.
+// Clients resume with Last-Event-ID or the last_event_id parameter.
+func (s *Server) subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	topics := slices.Compact(slices.Sorted(slices.Values(r.URL.Query()["topic"])))
+	if len(topics) == 0 || len(topics) > brokerMaxTopics || slices.ContainsFunc(topics, func(t string) bool { return t == "" || len(t) > brokerMaxTopicLen }) {
+		http.Error(w, "between 1 and "+strconv.Itoa(brokerMaxTopics)+" topic parameters are required", http.StatusBadRequest)
+		return
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	after, _ := strconv.ParseUint(lastID, 10, 64)
+
+	if isWebSocketUpgrade(r) {
+		s.serveBrokerWebSocket(w, r, topics, after)
+		return
+	}
+
+	sub := s.broker.subscribe(topics, after)
+	defer s.broker.unsubscribe(sub)
+	sse, ctx := s.OpenSSE(w, r)
+	defer sse.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sub.evicted:
+			_ = sse.Send("evicted", "{}")
+			return
+		case msg := <-sub.queue:
+			if err := sse.SendID(strconv.FormatUint(msg.ID, 10), msg.Topic, string(msg.Data)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveBrokerWebSocket sends each message as a JSON text frame. The client
+// only needs to answer pings; anything it sends is ignored.
+func (s *Server) serveBrokerWebSocket(w http.ResponseWriter, r *http.Request, topics []string, after uint64) {
+	ws, err := acceptWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	sub := s.broker.subscribe(topics, after)
+	defer s.broker.unsubscribe(sub)
+	s.broker.mu.Lock()
+	s.broker.sockets[ws] = struct{}{}
+	s.broker.mu.Unlock()
+	defer func() {
+		s.broker.mu.Lock()
+		delete(s.broker.sockets, ws)
+		s.broker.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(s.broker.ctx)
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := ws.readMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			ws.close(wsCloseNormal, "")
+			return
+		case <-sub.evicted:
+			ws.close(wsCloseTryAgainLater, "slow consumer")
+			return
+		case msg := <-sub.queue:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+			if err := ws.writeFrame(wsText, data); err != nil {
+				ws.close(wsCloseGoingAway, "")
+				return
+			}
+		}
+	}
+}
+
+// publishHandler serves POST /admin/broker/{topic}, publishing the JSON
+// request body, so operators and scripts can push to clients.
+func (s *Server) publishHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, wsMaxMessage+1))
+	if err != nil || len(body) > wsMaxMessage || !json.Valid(body) {
+		http.Error(w, "body must be a JSON value of at most "+strconv.Itoa(wsMaxMessage)+" bytes", http.StatusBadRequest)
+		return
+	}
+	if err := s.broker.Publish(r.PathValue("topic"), json.RawMessage(body)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBuffer keeps unusually large buffers out of the pool so one big
+// response does not pin its memory for the life of the process.
+const maxPooledBuffer = 64 << 10
+
+// bufferPool holds the scratch buffers that JSON, metrics, templates and the
+// other buffered renderers encode into before writing. The server neither
+// compresses responses nor writes access logs, so those have nothing to pool.
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from the pool. Return it with putBuffer
+// once nothing references its bytes any more.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
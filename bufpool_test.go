@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// writeJSONUnpooled is writeJSON with a fresh buffer per call, the baseline
+// BenchmarkWriteJSON compares against.
+func writeJSONUnpooled(w http.ResponseWriter, status int, v any) {
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
+
+func BenchmarkWriteJSON(b *testing.B) {
+	v := make([]drainResult, 50)
+	for i := range v {
+		v[i] = drainResult{Listener: "listener-" + strconv.Itoa(i), Drained: i%2 == 0, InFlight: i}
+	}
+	w := discardWriter{header: make(http.Header)}
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			writeJSON(w, http.StatusOK, v)
+		}
+	})
+	b.Run("nopool", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			writeJSONUnpooled(w, http.StatusOK, v)
+		}
+	})
+}
+
+func BenchmarkMetricsWriteTo(b *testing.B) {
+	m := NewMetrics()
+	for i := range 200 {
+		route := "/route/" + strconv.Itoa(i)
+		m.Add("server_http_requests_total", float64(i), "route", route, "code", "200")
+		m.Observe("server_http_request_duration_seconds", 0.01, "route", route)
+	}
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			_, _ = m.WriteTo(io.Discard)
+		}
+	})
+	b.Run("nopool", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			buf := new(bytes.Buffer)
+			m.render(buf)
+			_, _ = buf.WriteTo(io.Discard)
+		}
+	})
+}
+
+func TestWriteJSON(t *testing.T) {
+	for range 2 {
+		rec := httptest.NewRecorder()
+		writeJSON(rec, http.StatusAccepted, map[string]int{"n": 1})
+		if rec.Code != http.StatusAccepted || rec.Body.String() != "{\"n\":1}\n" || rec.Header().Get("Content-Length") != "8" {
+			t.Errorf("%d %q %v", rec.Code, rec.Body.String(), rec.Header())
+		}
+	}
+	rec := httptest.NewRecorder()
+	writeJSON(rec, http.StatusOK, func() {})
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("unencodable value: %d, want 500", rec.Code)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// BulkheadOptions sizes a bulkhead.
+type BulkheadOptions struct {
+	// MaxConcurrent is how many requests of the group are served at once.
+	MaxConcurrent int
+	// MaxQueue is how many more may wait for a slot; beyond that requests
+	// are rejected at once.
+	MaxQueue int
+	// QueueTimeout bounds the wait for a slot; zero means 1s.
+	QueueTimeout time.Duration
+}
+
+// bulkhead gives a group of routes its own concurrency budget, so a slow
+// group cannot tie up every connection and starve the others.
+type bulkhead struct {
+	name    string
+	opts    BulkheadOptions
+	slots   chan struct{}
+	queue   chan struct{}
+	metrics *Metrics
+	// serviceTime is a moving average of how long admitted requests take,
+	// in nanoseconds, for estimating when a rejected client should retry.
+	serviceTime atomic.Int64
+}
+
+// Bulkhead returns middleware admitting requests to the named group of
+// routes within opts. Routes wrapped with the same name share one budget;
+// the options of the first call for a name apply. Requests that find the
+// group full and its queue full, or that wait longer than the queue
+// timeout, get 503 with a Retry-After estimated from the queue depth and
+// recent service times. It must be called before Run.
+func (s *Server) Bulkhead(name string, opts BulkheadOptions) Middleware {
+	b, ok := s.bulkheads[name]
+	if !ok {
+		if opts.QueueTimeout <= 0 {
+			opts.QueueTimeout = time.Second
+		}
+		b = &bulkhead{
+			name:    name,
+			opts:    opts,
+			slots:   make(chan struct{}, max(opts.MaxConcurrent, 1)),
+			queue:   make(chan struct{}, max(opts.MaxQueue, 0)),
+			metrics: s.metrics,
+		}
+		s.bulkheads[name] = b
+	}
+	return Middleware{Name: "bulkhead", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if reason := b.acquire(r); reason != "" {
+				b.metrics.Add("server_bulkhead_rejected_total", 1, "group", b.name, "reason", reason)
+				setRetryAfter(w, b.retryAfter(), b.metrics, "bulkhead", "group", b.name)
+				http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+				return
+			}
+			start := time.Now()
+			defer func() { b.release(time.Since(start)) }()
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// acquire takes a slot, queueing for one if need be. It returns why the
+// request was refused, or "" once it holds a slot.
+func (b *bulkhead) acquire(r *http.Request) string {
+	select {
+	case b.slots <- struct{}{}:
+		b.metrics.Set("server_bulkhead_in_flight", float64(len(b.slots)), "group", b.name)
+		return ""
+	default:
+	}
+	select {
+	case b.queue <- struct{}{}:
+	default:
+		return "queue_full"
+	}
+	b.metrics.Set("server_bulkhead_queued", float64(len(b.queue)), "group", b.name)
+	defer func() {
+		<-b.queue
+		b.metrics.Set("server_bulkhead_queued", float64(len(b.queue)), "group", b.name)
+	}()
+
+	timer := time.NewTimer(b.opts.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		b.metrics.Set("server_bulkhead_in_flight", float64(len(b.slots)), "group", b.name)
+		return ""
+	case <-timer.C:
+		return "timeout"
+	case <-r.Context().Done():
+		return "canceled"
+	}
+}
+
+func (b *bulkhead) release(took time.Duration) {
+	for {
+		old := b.serviceTime.Load()
+		avg := int64(took)
+		if old > 0 {
+			avg = old + (int64(took)-old)/5
+		}
+		if b.serviceTime.CompareAndSwap(old, avg) {
+			break
+		}
+	}
+	<-b.slots
+	b.metrics.Set("server_bulkhead_in_flight", float64(len(b.slots)), "group", b.name)
+}
+
+// retryAfter estimates when a slot will be free for a new request: every
+// queued request, and this one, needs a turn on one of MaxConcurrent
+// slots. Before any request has finished, the queue timeout stands in
+// for the service time.
+func (b *bulkhead) retryAfter() time.Duration {
+	avg := time.Duration(b.serviceTime.Load())
+	if avg <= 0 {
+		avg = b.opts.QueueTimeout
+	}
+	turns := (len(b.queue) + cap(b.slots)) / cap(b.slots)
+	return time.Duration(turns) * avg
+}
+
+// parseBulkheadGroups parses "name=max_concurrent[/max_queue]" entries.
+func parseBulkheadGroups(entries []string) (map[string]BulkheadOptions, error) {
+	out := make(map[string]BulkheadOptions, len(entries))
+	for _, e := range entries {
+		name, spec, ok := strings.Cut(strings.TrimSpace(e), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid bulkhead group %q: want name=max_concurrent[/max_queue]", e)
+		}
+		concStr, queueStr, hasQueue := strings.Cut(spec, "/")
+		var opts BulkheadOptions
+		var err error
+		if opts.MaxConcurrent, err = strconv.Atoi(concStr); err != nil || opts.MaxConcurrent < 1 {
+			return nil, fmt.Errorf("invalid bulkhead group %q: bad max_concurrent", e)
+		}
+		if hasQueue {
+			if opts.MaxQueue, err = strconv.Atoi(queueStr); err != nil || opts.MaxQueue < 0 {
+				return nil, fmt.Errorf("invalid bulkhead group %q: bad max_queue", e)
+			}
+		}
+		out[name] = opts
+	}
+	return out, nil
+}
+
+// parseBulkheadRoutes parses "pattern=group" entries, checking that each
+// group is defined in groups.
+func parseBulkheadRoutes(entries []string, groups map[string]BulkheadOptions) (map[string]string, error) {
+	out := make(map[string]string, len(entries))
+	for _, e := range entries {
+		pattern, group, ok := strings.Cut(e, "=")
+		pattern, group = strings.TrimSpace(pattern), strings.TrimSpace(group)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid bulkhead route %q: want pattern=group", e)
+		}
+		if _, ok := groups[group]; !ok {
+			return nil, fmt.Errorf("bulkhead route %q: unknown group %q", e, group)
+		}
+		out[pattern] = group
+	}
+	return out, nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheOptions configures the response cache middleware.
+type CacheOptions struct {
+	// MaxEntries bounds the LRU; the least recently used entry is evicted.
+	MaxEntries int
+	// MaxBodyBytes skips caching responses larger than this.
+	MaxBodyBytes int
+	// TTL applies when the response carries no max-age.
+	TTL time.Duration
+	// StaleWhileRevalidate serves expired entries for this long while one
+	// request refreshes them in the background.
+	StaleWhileRevalidate time.Duration
+}
+
+// responseCache is an in-memory LRU of GET/HEAD responses keyed by method,
+// scheme, Host, URL, the listener and the request headers named in the
+// response's Vary. Responses to requests carrying credentials are only
+// stored, and only served to such requests, when marked public.
+type responseCache struct {
+	opts    CacheOptions
+	metrics *Metrics
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recent at front
+	entries map[string]*list.Element
+}
+
+// cacheEntry is a stored response, or, when vary is set, the marker stored
+// under a request base whose responses Vary on the named headers. Markers
+// live in the LRU with the responses, so they are evicted and purged alike.
+type cacheEntry struct {
+	key        string
+	uri        string
+	vary       []string
+	public     bool
+	status     int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	expires    time.Time
+	refreshing bool
+}
+
+func newResponseCache(opts CacheOptions, m *Metrics) *responseCache {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 1024
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = 1 << 20
+	}
+	return &responseCache{
+		opts:    opts,
+		metrics: m,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *responseCache) middleware() Middleware {
+	return Middleware{Name: "cache", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if (r.Method != http.MethodGet && r.Method != http.MethodHead) || hasDirective(r.Header.Get("Cache-Control"), "no-store") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			base := requestBase(r)
+			credentialed := hasCredentials(r)
+			noCache := hasDirective(r.Header.Get("Cache-Control"), "no-cache")
+			now := time.Now()
+
+			c.mu.Lock()
+			key := c.key(base, r)
+			var hit *cacheEntry
+			if el, ok := c.entries[key]; ok && (el.Value.(*cacheEntry).public || !credentialed) {
+				hit = el.Value.(*cacheEntry)
+				c.lru.MoveToFront(el)
+			}
+			stale := hit != nil && now.After(hit.expires)
+			usable := hit != nil && !noCache && (!stale || now.Before(hit.expires.Add(c.opts.StaleWhileRevalidate)))
+			// Only a request that is served the stale entry starts its
+			// refresh, so one that bypasses the entry cannot wedge it.
+			revalidate := usable && stale && !hit.refreshing
+			if revalidate {
+				hit.refreshing = true
+			}
+			c.mu.Unlock()
+
+			if usable {
+				if revalidate {
+					c.metrics.Add("server_cache_requests_total", 1, "result", "stale")
+					go c.refresh(next, r.Clone(context.WithoutCancel(r.Context())), base, hit)
+				} else {
+					c.metrics.Add("server_cache_requests_total", 1, "result", "hit")
+				}
+				c.write(w, hit, now)
+				return
+			}
+
+			c.metrics.Add("server_cache_requests_total", 1, "result", "miss")
+			rec := &cacheRecorder{ResponseWriter: w, status: http.StatusOK, limit: c.opts.MaxBodyBytes}
+			next.ServeHTTP(rec, r)
+			c.store(base, r, rec)
+		})
+	}}
+}
+
+// requestBase identifies the resource r asks for: its method, scheme, Host
+// and URI, and the listener it arrived on, so neither virtual hosts nor the
+// HTTP and HTTPS listeners share responses.
+func requestBase(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	listener := ""
+	if srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok {
+		listener = srv.Addr
+	}
+	return r.Method + " " + listener + " " + scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// varyNames returns the header names listed in header's Vary.
+func varyNames(header http.Header) []string {
+	var names []string
+	for _, part := range strings.Split(strings.Join(header.Values("Vary"), ","), ",") {
+		if name := http.CanonicalHeaderKey(strings.TrimSpace(part)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// hasCredentials reports whether r authenticates its client, so a response
+// to it may be personal.
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != ""
+}
+
+// key must be called with c.mu held. Looking up a Vary marker keeps it
+// ahead of its responses in the LRU.
+func (c *responseCache) key(base string, r *http.Request) string {
+	el, ok := c.entries[base]
+	if !ok || el.Value.(*cacheEntry).vary == nil {
+		return base
+	}
+	c.lru.MoveToFront(el)
+	var sb strings.Builder
+	sb.WriteString(base)
+	for _, name := range el.Value.(*cacheEntry).vary {
+		sb.WriteString("\x00")
+		sb.WriteString(r.Header.Get(name))
+	}
+	return sb.String()
+}
+
+// refresh re-runs the handler for a stale entry without a client attached.
+func (c *responseCache) refresh(next http.Handler, r *http.Request, base string, stale *cacheEntry) {
+	rec := &cacheRecorder{ResponseWriter: discardWriter{header: make(http.Header)}, status: http.StatusOK, limit: c.opts.MaxBodyBytes}
+	next.ServeHTTP(rec, r)
+	c.store(base, r, rec)
+
+	// If the fresh response was not cacheable, let a later request retry.
+	c.mu.Lock()
+	stale.refreshing = false
+	c.mu.Unlock()
+}
+
+func (c *responseCache) store(base string, r *http.Request, rec *cacheRecorder) {
+	ttl, ok := c.ttl(rec)
+	if !ok {
+		return
+	}
+	// RFC 9111 section 3.5: a response to an authenticated request is only
+	// shared when it says so.
+	public := hasDirective(rec.Header().Get("Cache-Control"), "public")
+	if hasCredentials(r) && !public {
+		return
+	}
+
+	now := time.Now()
+	header := rec.Header().Clone()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if names := varyNames(header); len(names) > 0 {
+		c.put(&cacheEntry{key: base, uri: r.URL.RequestURI(), vary: names})
+	}
+	c.put(&cacheEntry{key: c.key(base, r), uri: r.URL.RequestURI(), public: public, status: rec.status, header: header, body: rec.buf.Bytes(), stored: now, expires: now.Add(ttl)})
+}
+
+// put adds or replaces e and evicts down to MaxEntries; it must be called
+// with c.mu held.
+func (c *responseCache) put(e *cacheEntry) {
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[e.key] = c.lru.PushFront(e)
+	}
+	for c.lru.Len() > c.opts.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// ttl decides whether a response may be cached and for how long, following
+// the response's Cache-Control where present.
+func (c *responseCache) ttl(rec *cacheRecorder) (time.Duration, bool) {
+	if rec.overflow || rec.status != http.StatusOK || rec.Header().Get("Set-Cookie") != "" || rec.Header().Get("Vary") == "*" {
+		return 0, false
+	}
+	cc := rec.Header().Get("Cache-Control")
+	if hasDirective(cc, "no-store") || hasDirective(cc, "private") || hasDirective(cc, "no-cache") {
+		return 0, false
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if v, ok := directiveValue(cc, name); ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return 0, false
+			}
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	return c.opts.TTL, c.opts.TTL > 0
+}
+
+func (c *responseCache) write(w http.ResponseWriter, e *cacheEntry, now time.Time) {
+	for k, v := range e.header {
+		w.Header()[k] = slices.Clone(v)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(now.Sub(e.stored).Seconds())))
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(e.status)
+	_, _ = w.Write(e.body)
+}
+
+// purge removes entries whose URL starts with prefix, on any host, along
+// with the Vary they were stored under; an empty prefix clears the cache. It
+// returns the number of responses removed.
+func (c *responseCache) purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, el := range c.entries {
+		if e := el.Value.(*cacheEntry); strings.HasPrefix(e.uri, prefix) {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+			if e.vary == nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// cacheRecorder tees the response to the client while buffering it for the
+// cache, giving up on buffering once limit is exceeded or the handler
+// streams or hijacks.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status   int
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+// stopBuffering gives up on caching the response.
+func (r *cacheRecorder) stopBuffering() {
+	r.overflow = true
+	r.buf = bytes.Buffer{}
+}
+
+// WriteHeader records the final status; informational responses such as
+// 103 Early Hints pass through without replacing it.
+func (r *cacheRecorder) WriteHeader(status int) {
+	if status >= 200 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *cacheRecorder) Write(p []byte) (int, error) {
+	if !r.overflow {
+		if r.buf.Len()+len(p) > r.limit {
+			r.stopBuffering()
+		} else {
+			r.buf.Write(p)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *cacheRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// FlushError marks the response as a stream, which is never stored: what
+// was captured is only a prefix of it.
+func (r *cacheRecorder) FlushError() error {
+	r.stopBuffering()
+	return http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+func (r *cacheRecorder) Flush() {
+	_ = r.FlushError()
+}
+
+func (r *cacheRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.stopBuffering()
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+type discardWriter struct {
+	header http.Header
+}
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (d discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d discardWriter) WriteHeader(int)             {}
+
+func hasDirective(cc, name string) bool {
+	_, ok := directiveValue(cc, name)
+	return ok
+}
+
+func directiveValue(cc, name string) (string, bool) {
+	for _, part := range strings.Split(cc, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if strings.EqualFold(k, name) {
+			return strings.Trim(v, `"`), true
+		}
+	}
+	return "", false
+}
+
+// purgeCacheHandler serves POST /admin/cache/purge?prefix=/path.
+func (s *Server) purgeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	n := s.cache.purge(r.URL.Query().Get("prefix"))
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
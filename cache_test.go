@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler answers with the request's Host and a call count.
+func countingHandler(calls *atomic.Int32, cacheControl string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		fmt.Fprintf(w, "%s %d", r.Host, n)
+	})
+}
+
+func cacheGet(h http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestCacheKeysOnHost(t *testing.T) {
+	var calls atomic.Int32
+	c := newResponseCache(CacheOptions{TTL: time.Minute}, NewMetrics())
+	h := c.middleware().Wrap(countingHandler(&calls, ""))
+
+	if got := cacheGet(h, "http://a.example/page", nil).Body.String(); got != "a.example 1" {
+		t.Fatalf("first response %q", got)
+	}
+	if got := cacheGet(h, "http://a.example/page", nil).Body.String(); got != "a.example 1" {
+		t.Errorf("repeat on the same host = %q, want the cached response", got)
+	}
+	if got := cacheGet(h, "http://b.example/page", nil).Body.String(); got != "b.example 2" {
+		t.Errorf("other host = %q, want its own response", got)
+	}
+}
+
+func TestCacheCredentialedRequests(t *testing.T) {
+	for _, header := range []http.Header{
+		{"Authorization": {"Bearer secret"}},
+		{"Cookie": {"session=abc"}},
+	} {
+		var calls atomic.Int32
+		c := newResponseCache(CacheOptions{TTL: time.Minute}, NewMetrics())
+		h := c.middleware().Wrap(countingHandler(&calls, ""))
+
+		cacheGet(h, "/me", header)
+		if got := cacheGet(h, "/me", nil).Body.String(); got != "example.com 2" {
+			t.Errorf("%v: anonymous request got %q, want a fresh response", header, got)
+		}
+		// The anonymous response is stored, but not served to a client
+		// presenting credentials.
+		if got := cacheGet(h, "/me", header).Body.String(); got != "example.com 3" {
+			t.Errorf("%v: credentialed request got %q, want a fresh response", header, got)
+		}
+	}
+}
+
+func TestCacheStoresPublicCredentialedResponse(t *testing.T) {
+	var calls atomic.Int32
+	c := newResponseCache(CacheOptions{}, NewMetrics())
+	h := c.middleware().Wrap(countingHandler(&calls, "public, max-age=60"))
+	auth := http.Header{"Authorization": {"Bearer secret"}}
+
+	cacheGet(h, "/shared", auth)
+	if got := cacheGet(h, "/shared", auth).Body.String(); got != "example.com 1" {
+		t.Errorf("got %q, want the public response from the cache", got)
+	}
+}
+
+func TestCacheNoCacheDoesNotWedgeStaleEntry(t *testing.T) {
+	var calls atomic.Int32
+	c := newResponseCache(CacheOptions{TTL: time.Millisecond, StaleWhileRevalidate: time.Hour}, NewMetrics())
+	h := c.middleware().Wrap(countingHandler(&calls, ""))
+
+	cacheGet(h, "/page", nil)
+	time.Sleep(5 * time.Millisecond)
+	cacheGet(h, "/page", http.Header{"Cache-Control": {"no-cache"}})
+
+	c.mu.Lock()
+	for _, el := range c.entries {
+		if e := el.Value.(*cacheEntry); e.refreshing {
+			t.Errorf("entry %q left refreshing by a no-cache request", e.key)
+		}
+	}
+	c.mu.Unlock()
+}
+
+func TestCacheHitDoesNotShareHeaders(t *testing.T) {
+	var calls atomic.Int32
+	c := newResponseCache(CacheOptions{TTL: time.Minute}, NewMetrics())
+	h := c.middleware().Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("X-Token", "original")
+	}))
+	cacheGet(h, "/page", nil)
+
+	mutate := Middleware{Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r)
+			if v := w.Header()["X-Token"]; len(v) > 0 {
+				v[0] = "changed"
+			}
+		})
+	}}
+	cacheGet(mutate.Wrap(h), "/page", nil)
+	if got := cacheGet(h, "/page", nil).Header().Get("X-Token"); got != "original" {
+		t.Errorf("X-Token = %q after a client's copy was changed", got)
+	}
+}
+
+func TestCacheHitRunsRouteGuards(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.CacheEnabled = true
+		c.CacheTTL = time.Minute
+	})
+	var allow atomic.Bool
+	guard := Middleware{Name: "guard", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !allow.Load() {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+	var calls atomic.Int32
+	s.Handle(ListenerHTTP, "GET /guarded", countingHandler(&calls, ""), guard)
+
+	allow.Store(true)
+	if rec := serveListener(s, ListenerHTTP, httptest.NewRequest(http.MethodGet, "/guarded", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("allowed request: %d", rec.Code)
+	}
+	allow.Store(false)
+	rec := serveListener(s, ListenerHTTP, httptest.NewRequest(http.MethodGet, "/guarded", nil))
+	if rec.Code != http.StatusForbidden || strings.Contains(rec.Body.String(), "example.com") {
+		t.Errorf("guarded request after caching: %d %q, want 403 from the guard", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCacheHitRejectsExpiredSignedURL(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, func(c *Config) {
+		c.CacheEnabled = true
+		c.CacheTTL = time.Hour
+		c.StaticDir = dir
+		c.StaticSigningKey = "signing key"
+	})
+
+	// Valid until the end of the current second.
+	target := SignURL([]byte("signing key"), "/static/file.txt", time.Now())
+	if rec := serveListener(s, ListenerHTTP, httptest.NewRequest(http.MethodGet, target, nil)); rec.Code != http.StatusOK {
+		t.Fatalf("signed request: %d %q", rec.Code, rec.Body.String())
+	}
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second + 10*time.Millisecond)))
+	if rec := serveListener(s, ListenerHTTP, httptest.NewRequest(http.MethodGet, target, nil)); rec.Code != http.StatusGone {
+		t.Errorf("expired signed URL: %d %q, want 410", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	var calls atomic.Int32
+	c := newResponseCache(CacheOptions{TTL: time.Minute, MaxEntries: 4}, NewMetrics())
+	h := c.middleware().Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprintf(w, "%s %d", r.Header.Get("Accept-Language"), calls.Add(1))
+	}))
+	en, de := http.Header{"Accept-Language": {"en"}}, http.Header{"Accept-Language": {"de"}}
+
+	cacheGet(h, "/page", en)
+	cacheGet(h, "/page", de)
+	if got := cacheGet(h, "/page", en).Body.String(); got != "en 1" {
+		t.Errorf("en = %q, want the cached variant", got)
+	}
+	if got := cacheGet(h, "/page", de).Body.String(); got != "de 2" {
+		t.Errorf("de = %q, want the cached variant", got)
+	}
+
+	if n := c.purge("/page"); n != 2 {
+		t.Errorf("purged %d responses, want 2", n)
+	}
+	if len(c.entries) != 0 || c.lru.Len() != 0 {
+		t.Errorf("%d entries left after purge, want none", len(c.entries))
+	}
+
+	// Vary markers count towards MaxEntries, so many URIs cannot grow the
+	// cache beyond it.
+	for i := range 10 {
+		cacheGet(h, fmt.Sprintf("/page?i=%d", i), en)
+	}
+	if len(c.entries) != 4 || c.lru.Len() != 4 {
+		t.Errorf("%d entries, want MaxEntries", len(c.entries))
+	}
+}
+
+func TestCacheIgnoresInformationalStatus(t *testing.T) {
+	var calls atomic.Int32
+	c := newResponseCache(CacheOptions{TTL: time.Minute}, NewMetrics())
+	h := c.middleware().Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		fmt.Fprintf(w, "page %d", calls.Add(1))
+	}))
+
+	cacheGet(h, "/page", nil)
+	rec := cacheGet(h, "/page", nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "page 1" {
+		t.Errorf("second request: %d %q, want the cached 200", rec.Code, rec.Body.String())
+	}
+}
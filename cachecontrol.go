@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControlRule sets Cache-Control on responses whose path matches
+// pattern.
+type cacheControlRule struct {
+	pattern string
+	value   string
+}
+
+// Cache-Control directives accepted in rules, and whether each takes a
+// duration.
+var cacheDirectives = map[string]bool{
+	"public":                 false,
+	"private":                false,
+	"no-cache":               false,
+	"no-store":               false,
+	"no-transform":           false,
+	"immutable":              false,
+	"must-revalidate":        false,
+	"proxy-revalidate":       false,
+	"max-age":                true,
+	"s-maxage":               true,
+	"stale-while-revalidate": true,
+	"stale-if-error":         true,
+}
+
+// parseCacheControlRules parses "glob=directive+directive" entries such as
+// "/static/**=public+max-age=8760h+immutable". Durations are Go durations
+// or seconds. Globs match like path.Match per segment, and a "**" segment
+// matches any number of segments. Rules are kept in order; the first match
+// wins.
+func parseCacheControlRules(entries []string) ([]cacheControlRule, error) {
+	var out []cacheControlRule
+	for _, e := range entries {
+		pattern, spec, ok := strings.Cut(e, "=")
+		pattern, spec = strings.TrimSpace(pattern), strings.TrimSpace(spec)
+		if !ok || !strings.HasPrefix(pattern, "/") || spec == "" {
+			return nil, fmt.Errorf("invalid cache-control rule %q: want /glob=directive[+directive...]", e)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("cache-control rule %q: %w", e, err)
+		}
+		var directives []string
+		for _, d := range strings.Split(spec, "+") {
+			name, raw, hasValue := strings.Cut(strings.TrimSpace(d), "=")
+			name = strings.ToLower(name)
+			takesValue, known := cacheDirectives[name]
+			if !known {
+				return nil, fmt.Errorf("cache-control rule %q: unknown directive %q", e, name)
+			}
+			if !takesValue {
+				if hasValue {
+					return nil, fmt.Errorf("cache-control rule %q: directive %q takes no value", e, name)
+				}
+				directives = append(directives, name)
+				continue
+			}
+			secs, err := cacheSeconds(raw)
+			if err != nil {
+				return nil, fmt.Errorf("cache-control rule %q: %s: %w", e, name, err)
+			}
+			directives = append(directives, name+"="+strconv.Itoa(secs))
+		}
+		out = append(out, cacheControlRule{pattern: pattern, value: strings.Join(directives, ", ")})
+	}
+	return out, nil
+}
+
+// cacheSeconds parses a whole number of seconds or a Go duration.
+func cacheSeconds(raw string) (int, error) {
+	if n, err := strconv.Atoi(raw); err == nil && n >= 0 {
+		return n, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", raw)
+	}
+	return int(d / time.Second), nil
+}
+
+// matchPathGlob reports whether p matches pattern segment by segment.
+func matchPathGlob(pattern, p string) bool {
+	return matchSegments(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(strings.Trim(p, "/"), "/"))
+}
+
+func matchSegments(pattern, segs []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(segs); i >= 0; i-- {
+				if matchSegments(pattern[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segs[0]); !ok {
+			return false
+		}
+		pattern, segs = pattern[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// cacheControl sets Cache-Control from the first rule matching the request
+// path, unless the handler set one itself. Error responses are left alone,
+// so a 404 under an immutable prefix is not cached for a year.
+func cacheControl(rules []cacheControlRule) Middleware {
+	return Middleware{Name: "cache-control", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, rule := range rules {
+				if matchPathGlob(rule.pattern, r.URL.Path) {
+					w = &cacheControlWriter{ResponseWriter: w, value: rule.value}
+					break
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// cacheControlWriter adds Cache-Control when the final status is written.
+type cacheControlWriter struct {
+	http.ResponseWriter
+	value       string
+	wroteHeader bool
+}
+
+func (c *cacheControlWriter) WriteHeader(status int) {
+	if !c.wroteHeader && status >= 200 {
+		c.wroteHeader = true
+		if status < 400 && c.Header().Get("Cache-Control") == "" {
+			c.Header().Set("Cache-Control", c.value)
+		}
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *cacheControlWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *cacheControlWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// FlushError sets Cache-Control before a flush sends the headers.
+func (c *cacheControlWriter) FlushError() error {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+func (c *cacheControlWriter) Flush() {
+	_ = c.FlushError()
+}
+
+func (c *cacheControlWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(c.ResponseWriter).Hijack()
+}
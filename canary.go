@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Canary variants, as carried in the sticky cookie and override header.
+const (
+	variantStable = "stable"
+	variantCanary = "canary"
+)
+
+// CanaryOptions configures a weighted split between a stable and a canary
+// handler.
+type CanaryOptions struct {
+	// Percent of new clients routed to the canary.
+	Percent float64
+	// Cookie pins a client to the variant it was first assigned. Empty
+	// disables stickiness.
+	Cookie string
+	// Header lets a client choose a variant explicitly by sending "stable"
+	// or "canary"; it takes precedence over the cookie.
+	Header string
+}
+
+// Canary routes opts.Percent of traffic to canary and the rest to stable.
+// Handler versions can be split directly; Proxy uses it to split upstreams.
+func (s *Server) Canary(stable, canary http.Handler, opts CanaryOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		variant := ""
+		if opts.Header != "" {
+			variant = validVariant(r.Header.Get(opts.Header))
+		}
+		if variant == "" && opts.Cookie != "" {
+			if c, err := r.Cookie(opts.Cookie); err == nil {
+				variant = validVariant(c.Value)
+			}
+		}
+		if variant == "" {
+			variant = variantStable
+			if roll(opts.Percent) {
+				variant = variantCanary
+			}
+			if opts.Cookie != "" {
+				http.SetCookie(w, &http.Cookie{Name: opts.Cookie, Value: variant, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+			}
+		}
+
+		s.metrics.Add("server_canary_requests_total", 1, "variant", variant)
+		w.Header().Set("X-Served-By", variant)
+		if variant == variantCanary {
+			canary.ServeHTTP(w, r)
+			return
+		}
+		stable.ServeHTTP(w, r)
+	})
+}
+
+func validVariant(v string) string {
+	if v == variantStable || v == variantCanary {
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Ways a non-canonical path is served, for path_canonical_mode.
+const (
+	CanonicalRedirect = "redirect"
+	CanonicalRewrite  = "rewrite"
+)
+
+// CanonicalOptions configures path canonicalization.
+type CanonicalOptions struct {
+	// Mode is CanonicalRedirect or CanonicalRewrite.
+	Mode string
+	// TrailingSlash routes /a/ to a route registered as /a, and the
+	// reverse.
+	TrailingSlash bool
+	// CaseInsensitive routes paths that only match a route lowercased.
+	CaseInsensitive bool
+	// CollapseSlashes turns runs of slashes into one.
+	CollapseSlashes bool
+}
+
+// canonicalPaths serves requests for a variant of a registered route as
+// the route, so it need not be registered twice. A variant is only used
+// when the path itself matches nothing more specific than a subtree, such
+// as the "GET /" catch-all, and the variant matches a different route.
+func canonicalPaths(mux *http.ServeMux, opts CanonicalOptions, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if opts.CollapseSlashes {
+			p = collapseSlashes(p)
+		}
+		if p2, ok := routedVariant(mux, r, p, opts); ok {
+			p = p2
+		}
+		if p == r.URL.Path {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if opts.Mode == CanonicalRewrite {
+			next.ServeHTTP(w, withPath(r, p, r.URL.RawQuery))
+			return
+		}
+		u := url.URL{Path: p, RawQuery: r.URL.RawQuery}
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, u.String(), status)
+	})
+}
+
+// routedVariant returns the first variant of p that routes somewhere p
+// does not.
+func routedVariant(mux *http.ServeMux, r *http.Request, p string, opts CanonicalOptions) (string, bool) {
+	pattern := routePattern(mux, r, p)
+	if pattern != "" && !strings.HasSuffix(pattern, "/") {
+		return "", false
+	}
+	var variants []string
+	if opts.CaseInsensitive {
+		if lower := strings.ToLower(p); lower != p {
+			variants = append(variants, lower)
+		}
+	}
+	if opts.TrailingSlash && p != "/" {
+		for _, v := range append([]string{p}, variants...) {
+			if t, ok := strings.CutSuffix(v, "/"); ok {
+				variants = append(variants, t)
+			} else {
+				variants = append(variants, v+"/")
+			}
+		}
+	}
+	for _, v := range variants {
+		if vp := routePattern(mux, r, v); vp != "" && vp != pattern {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// routePattern returns the pattern mux routes r to with path p, or "" when
+// none matches.
+func routePattern(mux *http.ServeMux, r *http.Request, p string) string {
+	_, pattern := mux.Handler(withPath(r, p, r.URL.RawQuery))
+	return pattern
+}
+
+func collapseSlashes(p string) string {
+	for strings.Contains(p, "//") {
+		p = strings.ReplaceAll(p, "//", "/")
+	}
+	return p
+}
+
+// withPath returns a shallow copy of r for path p and query, as
+// http.StripPrefix makes.
+func withPath(r *http.Request, p, query string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = p
+	r2.URL.RawPath = ""
+	r2.URL.RawQuery = query
+	// The pattern is the old path's; the mux sets the new one.
+	r2.Pattern = ""
+	return r2
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+)
+
+// CBOR major types (RFC 8949).
+const (
+	cborUint   = 0 << 5
+	cborNegint = 1 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborSimple = 7 << 5
+)
+
+// encodeCBOR writes v as CBOR, using definite lengths throughout.
+func encodeCBOR(w io.Writer, v any) error {
+	return transcodeJSON(w, v, cborFormat{})
+}
+
+type cborFormat struct{}
+
+// head writes a major type with its argument in the shortest form.
+func (cborFormat) head(buf *bytes.Buffer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		buf.WriteByte(major | byte(arg))
+	case arg <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(arg))
+	case arg <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(arg)))
+	case arg <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(arg)))
+	default:
+		buf.WriteByte(major | 27)
+		buf.Write(binary.BigEndian.AppendUint64(nil, arg))
+	}
+}
+
+func (f cborFormat) container(buf *bytes.Buffer, object bool, n int) {
+	if object {
+		f.head(buf, cborMap, uint64(n))
+	} else {
+		f.head(buf, cborArray, uint64(n))
+	}
+}
+
+func (f cborFormat) str(buf *bytes.Buffer, s string) {
+	f.head(buf, cborText, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// number writes integers as CBOR integers and anything else as a float64.
+func (f cborFormat) number(buf *bytes.Buffer, n json.Number) error {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		if i >= 0 {
+			f.head(buf, cborUint, uint64(i))
+		} else {
+			f.head(buf, cborNegint, uint64(-1-i))
+		}
+		return nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		f.head(buf, cborUint, u)
+		return nil
+	}
+	v, err := n.Float64()
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(cborSimple | 27)
+	buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+	return nil
+}
+
+func (cborFormat) boolean(buf *bytes.Buffer, b bool) {
+	if b {
+		buf.WriteByte(cborSimple | 21)
+	} else {
+		buf.WriteByte(cborSimple | 20)
+	}
+}
+
+func (cborFormat) null(buf *bytes.Buffer) { buf.WriteByte(cborSimple | 22) }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestEncodeCBOR checks the examples of RFC 8949 Appendix A that encoding
+// JSON can produce.
+func TestEncodeCBOR(t *testing.T) {
+	tests := []struct {
+		json string
+		want string
+	}{
+		{"0", "00"},
+		{"1", "01"},
+		{"10", "0a"},
+		{"23", "17"},
+		{"24", "1818"},
+		{"25", "1819"},
+		{"100", "1864"},
+		{"1000", "1903e8"},
+		{"1000000", "1a000f4240"},
+		{"1000000000000", "1b000000e8d4a51000"},
+		{"18446744073709551615", "1bffffffffffffffff"},
+		{"-1", "20"},
+		{"-10", "29"},
+		{"-100", "3863"},
+		{"-1000", "3903e7"},
+		{"1.1", "fb3ff199999999999a"},
+		{"1.0e+300", "fb7e37e43c8800759c"},
+		{"-4.1", "fbc010666666666666"},
+		{"false", "f4"},
+		{"true", "f5"},
+		{"null", "f6"},
+		{`""`, "60"},
+		{`"a"`, "6161"},
+		{`"IETF"`, "6449455446"},
+		{`"\"\\"`, "62225c"},
+		{`"ü"`, "62c3bc"},
+		{`"水"`, "63e6b0b4"},
+		{`"𐅑"`, "64f0908591"},
+		{"[]", "80"},
+		{"[1, 2, 3]", "83010203"},
+		{"[1, [2, 3], [4, 5]]", "8301820203820405"},
+		{"[1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25]",
+			"98190102030405060708090a0b0c0d0e0f101112131415161718181819"},
+		{"{}", "a0"},
+		{`{"a": 1, "b": [2, 3]}`, "a26161016162820203"},
+		{`["a", {"b": "c"}]`, "826161a161626163"},
+		{`{"a": "A", "b": "B", "c": "C", "d": "D", "e": "E"}`, "a56161614161626142616361436164614461656145"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := encodeCBOR(&buf, json.RawMessage(tt.json)); err != nil {
+			t.Errorf("%s: %v", tt.json, err)
+			continue
+		}
+		if got := hex.EncodeToString(buf.Bytes()); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.json, got, tt.want)
+		}
+	}
+	if err := encodeCBOR(&bytes.Buffer{}, json.RawMessage("-1e400")); err == nil {
+		t.Error("encoded a number out of float64 range")
+	}
+}
+
+// decodeCBOR decodes the subset of CBOR encodeCBOR writes.
+func decodeCBOR(b []byte) (any, []byte, error) {
+	errShort := errors.New("short buffer")
+	if len(b) == 0 {
+		return nil, nil, errShort
+	}
+	major, info := b[0]&0xe0, b[0]&0x1f
+	b = b[1:]
+	if major == cborSimple {
+		switch info {
+		case 20, 21:
+			return info == 21, b, nil
+		case 22:
+			return nil, b, nil
+		case 27:
+			if len(b) < 8 {
+				return nil, nil, errShort
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), b[8:], nil
+		}
+		return nil, nil, errors.New("unexpected simple value")
+	}
+	arg := uint64(info)
+	if info >= 24 {
+		if info > 27 {
+			return nil, nil, errors.New("indefinite or reserved length")
+		}
+		n := 1 << (info - 24)
+		if len(b) < n {
+			return nil, nil, errShort
+		}
+		arg = 0
+		for _, c := range b[:n] {
+			arg = arg<<8 | uint64(c)
+		}
+		b = b[n:]
+	}
+	switch major {
+	case cborUint:
+		if arg <= math.MaxInt64 {
+			return int64(arg), b, nil
+		}
+		return arg, b, nil
+	case cborNegint:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("negative integer out of int64 range")
+		}
+		return -1 - int64(arg), b, nil
+	case cborText:
+		if uint64(len(b)) < arg {
+			return nil, nil, errShort
+		}
+		return string(b[:arg]), b[arg:], nil
+	case cborArray:
+		a := []any{}
+		for range arg {
+			v, rest, err := decodeCBOR(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			a, b = append(a, v), rest
+		}
+		return a, b, nil
+	case cborMap:
+		m := map[string]any{}
+		for range arg {
+			k, rest, err := decodeCBOR(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, nil, errors.New("non-text map key")
+			}
+			if m[key], b, err = decodeCBOR(rest); err != nil {
+				return nil, nil, err
+			}
+		}
+		return m, b, nil
+	}
+	return nil, nil, errors.New("unexpected major type")
+}
+
+func FuzzEncodeCBOR(f *testing.F) {
+	f.Add(`{"a": [0, 23, 24, -24, -25, 65536, 1.5, 18446744073709551615, -9223372036854775808], "b": {"c": null, "d": false}}`)
+	f.Add(`"` + strings.Repeat("ü", 200) + `"`)
+	f.Fuzz(func(t *testing.T, doc string) {
+		if _, err := decodeJSONValue([]byte(doc)); err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if err := encodeCBOR(&buf, json.RawMessage(doc)); err != nil {
+			return // e.g. numbers beyond float64
+		}
+		got, rest, err := decodeCBOR(buf.Bytes())
+		if err != nil || len(rest) != 0 {
+			t.Fatalf("%s: decoding %x: %v, %d bytes left", doc, buf.Bytes(), err, len(rest))
+		}
+		raw, _ := json.Marshal(json.RawMessage(doc))
+		want, _ := decodeJSONValue(raw)
+		if want = msgpackNormalize(want); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: round trip %#v, want %#v", doc, got, want)
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often the certificate files are checked for
+// changes.
+const certReloadInterval = 30 * time.Second
+
+// certReloader serves the HTTPS listener's certificate, replacing it when
+// the certificate or key file changes so renewals need no restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	events   *EventBus
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string, events *EventBus) *certReloader {
+	return &certReloader{certFile: certFile, keyFile: keyFile, events: events}
+}
+
+// modified returns the later modification time of the two files.
+func (c *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Load reads the key pair. On error the current certificate stays in use.
+// Replacing an already loaded certificate publishes CertRenewed.
+func (c *certReloader) Load() error {
+	modTime, err := c.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	renewed := c.cert != nil
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+
+	if renewed && cert.Leaf != nil {
+		domain := cert.Leaf.Subject.CommonName
+		if len(cert.Leaf.DNSNames) > 0 {
+			domain = cert.Leaf.DNSNames[0]
+		}
+		c.events.Publish(CertRenewed{Domain: domain, NotAfter: cert.Leaf.NotAfter, Time: time.Now()})
+	}
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// watch reloads the key pair whenever either file's modification time
+// changes.
+func (c *certReloader) watch(ctx context.Context) error {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		modTime, err := c.modified()
+		if err != nil {
+			continue
+		}
+		c.mu.RLock()
+		changed := !modTime.Equal(c.modTime)
+		c.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := c.Load(); err != nil {
+			slog.Warn("Failed to reload TLS certificate", "cert", c.certFile, "error", err)
+			continue
+		}
+		slog.Info("Reloaded TLS certificate", "cert", c.certFile)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed key pair for domain to certFile and
+// keyFile.
+func writeTestCert(t *testing.T, certFile, keyFile, domain string, notAfter time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloaderPublishesRenewal(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "example.test", time.Now().Add(24*time.Hour))
+
+	bus := NewEventBus()
+	events, cancel := bus.Subscribe(4)
+	defer cancel()
+	c := newCertReloader(certFile, keyFile, bus)
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("initial load published %v", e)
+	default:
+	}
+
+	notAfter := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	writeTestCert(t, certFile, keyFile, "example.test", notAfter)
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		renewed, ok := e.(CertRenewed)
+		if !ok || renewed.Domain != "example.test" || !renewed.NotAfter.Equal(notAfter) {
+			t.Fatalf("got %#v, want CertRenewed for example.test until %v", e, notAfter)
+		}
+	default:
+		t.Fatal("renewal published no event")
+	}
+	cert, _ := c.GetCertificate(nil)
+	if !cert.Leaf.NotAfter.Equal(notAfter) {
+		t.Errorf("serving certificate valid until %v, want the renewed one", cert.Leaf.NotAfter)
+	}
+}
+
+func TestCertReloaderKeepsCertOnError(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "example.test", time.Now().Add(time.Hour))
+	c := newCertReloader(certFile, keyFile, NewEventBus())
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Load(); err == nil {
+		t.Fatal("loading a corrupt key succeeded")
+	}
+	if cert, _ := c.GetCertificate(nil); cert == nil {
+		t.Fatal("certificate dropped after a failed reload")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cgiPath is the only PATH CGI scripts see.
+const cgiPath = "/usr/local/bin:/usr/bin:/bin"
+
+// cgiEnv returns the CGI/1.1 meta-variables for r, shared by the CGI
+// executor and FastCGI upstreams.
+func cgiEnv(r *http.Request, scriptName, pathInfo, scriptFilename string) map[string]string {
+	host := cmp.Or(r.Host, r.Header.Get("X-Forwarded-Host"), r.URL.Host)
+	https := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+	serverName, serverPort, err := net.SplitHostPort(host)
+	if err != nil {
+		serverName, serverPort = host, "80"
+		if https {
+			serverPort = "443"
+		}
+	}
+	remoteAddr, remotePort, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+	env := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "serverConcurrent",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       serverName,
+		"SERVER_PORT":       serverPort,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"QUERY_STRING":      r.URL.RawQuery,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   scriptFilename,
+		"PATH_INFO":         pathInfo,
+		"REMOTE_ADDR":       remoteAddr,
+		"REMOTE_PORT":       remotePort,
+		"HTTP_HOST":         host,
+	}
+	if https {
+		env["HTTPS"] = "on"
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		env["CONTENT_TYPE"] = ct
+	}
+	if r.ContentLength > 0 {
+		env["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	for k, v := range r.Header {
+		switch k {
+		case "Content-Type", "Content-Length", "Host":
+			continue
+		case "Proxy":
+			// HTTP_PROXY would point the script's own HTTP clients at
+			// whatever the client names (httpoxy).
+			continue
+		}
+		env["HTTP_"+strings.ReplaceAll(strings.ToUpper(k), "-", "_")] = strings.Join(v, ", ")
+	}
+	return env
+}
+
+// readCGIResponse reads the header block of a CGI response, returning the
+// status it names: the Status header, 302 for a bare Location, or 200.
+func readCGIResponse(br *bufio.Reader) (int, http.Header, error) {
+	mh, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading CGI headers: %w", err)
+	}
+	h := http.Header(mh)
+	status := http.StatusOK
+	if st := h.Get("Status"); st != "" {
+		code, _, _ := strings.Cut(st, " ")
+		n, err := strconv.Atoi(code)
+		if err != nil || n < 100 || n > 999 {
+			return 0, nil, fmt.Errorf("invalid CGI status %q", st)
+		}
+		status = n
+		h.Del("Status")
+	} else if h.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	return status, h, nil
+}
+
+// cgiStderr logs what a script writes to stderr.
+type cgiStderr struct {
+	script string
+}
+
+func (e cgiStderr) Write(p []byte) (int, error) {
+	if msg := strings.TrimSpace(string(p)); msg != "" {
+		slog.Warn("CGI script stderr", "script", e.script, "output", msg)
+	}
+	return len(p), nil
+}
+
+// CGIOptions restricts the CGI executor.
+type CGIOptions struct {
+	// Dir holds the scripts. Only regular, executable files directly in
+	// it run; symlinks and subdirectories do not.
+	Dir     string
+	Timeout time.Duration
+	// MaxConcurrent bounds running scripts; requests beyond it get 503.
+	MaxConcurrent int
+}
+
+// CGI returns a handler running scripts from opts.Dir, for legacy
+// applications that cannot be proxied. A request for prefix+"name/rest"
+// runs name with PATH_INFO /rest. Scripts get the CGI variables and a
+// fixed PATH but none of the server's environment, and are killed at
+// opts.Timeout.
+func (s *Server) CGI(prefix string, opts CGIOptions) http.Handler {
+	prefix = "/" + strings.Trim(prefix, "/") + "/"
+	sem := make(chan struct{}, max(opts.MaxConcurrent, 1))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, prefix)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		name, pathInfo, hasInfo := strings.Cut(rest, "/")
+		if hasInfo {
+			pathInfo = "/" + pathInfo
+		}
+		script := filepath.Join(opts.Dir, name)
+		info, err := os.Lstat(script)
+		if name == "" || strings.HasPrefix(name, ".") || err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+		default:
+			s.metrics.Add("server_cgi_requests_total", 1, "script", name, "result", "busy")
+			http.Error(w, "too many CGI requests", http.StatusServiceUnavailable)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), opts.Timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, script)
+		cmd.Dir = opts.Dir
+		cmd.Env = []string{"PATH=" + cgiPath}
+		for k, v := range cgiEnv(r, prefix+name, pathInfo, script) {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+		if r.ContentLength != 0 {
+			cmd.Stdin = r.Body
+		}
+		cmd.Stderr = cgiStderr{script: name}
+		cmd.WaitDelay = time.Second
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			slog.Error("CGI script failed to start", "script", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		start := time.Now()
+		br := bufio.NewReader(stdout)
+		status, header, err := readCGIResponse(br)
+		if err != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			s.metrics.Add("server_cgi_requests_total", 1, "script", name, "result", "error")
+			slog.Error("CGI script failed", "script", name, "error", cgiError(err, ctx.Err()))
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(status)
+		_, copyErr := io.Copy(w, br)
+		if copyErr != nil {
+			_ = cmd.Process.Kill()
+		}
+		result := "ok"
+		if err := cmd.Wait(); err != nil && copyErr == nil {
+			result = "error"
+			slog.Warn("CGI script exited with error", "script", name, "error", cgiError(err, ctx.Err()))
+		}
+		s.metrics.Add("server_cgi_requests_total", 1, "script", name, "result", result)
+		s.metrics.Observe("server_cgi_request_seconds", time.Since(start).Seconds(), "script", name)
+	})
+}
+
+// cgiError notes when err was caused by the script timing out.
+func cgiError(err, ctxErr error) error {
+	if errors.Is(ctxErr, context.DeadlineExceeded) {
+		return fmt.Errorf("timed out: %w", err)
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ChaosSettings selects which faults the chaos middleware injects. Each
+// percentage is evaluated independently per request.
+type ChaosSettings struct {
+	Enabled bool `json:"enabled"`
+
+	LatencyPercent float64 `json:"latency_percent"`
+	LatencyMS      int     `json:"latency_ms"`
+
+	ErrorPercent float64 `json:"error_percent"`
+	ErrorStatus  int     `json:"error_status"`
+
+	DropPercent float64 `json:"drop_percent"`
+
+	TruncatePercent float64 `json:"truncate_percent"`
+	TruncateBytes   int     `json:"truncate_bytes"`
+}
+
+// chaos holds the live settings; the middleware reads them on every request
+// so changes through the admin API apply immediately.
+type chaos struct {
+	settings atomic.Pointer[ChaosSettings]
+	metrics  *Metrics
+}
+
+func newChaos(m *Metrics) *chaos {
+	c := &chaos{metrics: m}
+	c.settings.Store(&ChaosSettings{})
+	return c
+}
+
+func roll(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+func (c *chaos) middleware() Middleware {
+	return Middleware{Name: "chaos", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cs := c.settings.Load()
+			if !cs.Enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if roll(cs.LatencyPercent) {
+				c.metrics.Add("server_chaos_injected_total", 1, "fault", "latency")
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(time.Duration(cs.LatencyMS) * time.Millisecond):
+				}
+			}
+
+			if roll(cs.DropPercent) {
+				c.metrics.Add("server_chaos_injected_total", 1, "fault", "drop")
+				if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+					_ = conn.Close()
+					return
+				}
+				// HTTP/2 cannot be hijacked; aborting resets the stream instead.
+				panic(http.ErrAbortHandler)
+			}
+
+			if roll(cs.ErrorPercent) {
+				c.metrics.Add("server_chaos_injected_total", 1, "fault", "error")
+				status := cs.ErrorStatus
+				if status == 0 {
+					status = http.StatusInternalServerError
+				}
+				http.Error(w, "chaos: injected error", status)
+				return
+			}
+
+			if roll(cs.TruncatePercent) {
+				c.metrics.Add("server_chaos_injected_total", 1, "fault", "truncate")
+				w = &truncatingWriter{ResponseWriter: w, remaining: cs.TruncateBytes}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// truncatingWriter passes through the first remaining bytes of the body and
+// then aborts the response, leaving the client with a short read.
+type truncatingWriter struct {
+	http.ResponseWriter
+	remaining int
+}
+
+func (t *truncatingWriter) Write(p []byte) (int, error) {
+	if len(p) <= t.remaining {
+		t.remaining -= len(p)
+		return t.ResponseWriter.Write(p)
+	}
+	_, _ = t.ResponseWriter.Write(p[:t.remaining])
+	_ = http.NewResponseController(t.ResponseWriter).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+func (t *truncatingWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+func (t *truncatingWriter) FlushError() error {
+	return http.NewResponseController(t.ResponseWriter).Flush()
+}
+
+func (t *truncatingWriter) Flush() {
+	_ = t.FlushError()
+}
+
+func (t *truncatingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(t.ResponseWriter).Hijack()
+}
+
+func (s *Server) chaosHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.chaos.settings.Load())
+}
+
+// setChaosHandler replaces the chaos settings with the JSON body.
+func (s *Server) setChaosHandler(w http.ResponseWriter, r *http.Request) {
+	var cs ChaosSettings
+	if err := json.NewDecoder(r.Body).Decode(&cs); err != nil {
+		http.Error(w, "invalid chaos settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cs.ErrorStatus != 0 && (cs.ErrorStatus < 400 || cs.ErrorStatus > 599) {
+		http.Error(w, "error_status must be between 400 and 599", http.StatusBadRequest)
+		return
+	}
+	s.chaos.settings.Store(&cs)
+	slog.Warn("Chaos settings changed", "settings", cs)
+	writeJSON(w, http.StatusOK, cs)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// coalesceHeaders are the negotiation headers always part of the coalescing
+// key: followers join before the first response, which names the route's
+// Vary, is back.
+var coalesceHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+// maxCoalescedBody caps how much of a response is held for followers; a
+// longer one streams to the leader and the followers run the handler
+// themselves.
+const maxCoalescedBody = 1 << 20
+
+// coalesce deduplicates concurrent identical GET requests: the first request
+// for a URL runs the handler and every request that arrives while it is in
+// flight receives a copy of the same response. Requests are identical when
+// their method, Host, URI, negotiation headers and any further headers the
+// route's responses Vary on match. Requests with credentials are never
+// coalesced, and followers do not share a response that sets cookies or
+// exceeds maxCoalescedBody, but only use it on handlers whose response does
+// not otherwise depend on per-client state.
+func coalesce(m *Metrics) Middleware {
+	var (
+		group singleflight.Group
+		mu    sync.Mutex
+		vary  = make(map[string][]string) // route pattern to Vary header names
+	)
+	return Middleware{Name: "coalesce", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || hasCredentials(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mu.Lock()
+			names := vary[r.Pattern]
+			mu.Unlock()
+			if slices.Contains(names, "*") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			var key strings.Builder
+			key.WriteString(requestBase(r))
+			for _, name := range slices.Concat(coalesceHeaders, names) {
+				key.WriteString("\x00")
+				key.WriteString(strings.Join(r.Header.Values(name), ","))
+			}
+
+			leader := false
+			v, _, _ := group.Do(key.String(), func() (any, error) {
+				leader = true
+				// Detach from the leader's client so its disconnect does not
+				// fail every follower.
+				rec := newBufferedResponse(w, maxCoalescedBody)
+				next.ServeHTTP(rec, r.Clone(context.WithoutCancel(r.Context())))
+				if names := varyNames(rec.header); len(names) > 0 {
+					mu.Lock()
+					for _, name := range names {
+						if !slices.Contains(vary[r.Pattern], name) {
+							vary[r.Pattern] = append(vary[r.Pattern], name)
+						}
+					}
+					mu.Unlock()
+				}
+				return rec, nil
+			})
+			rec := v.(*bufferedResponse)
+			switch {
+			case leader && rec.streamed:
+				// Already written to w.
+			case leader:
+				rec.replay(w)
+			case rec.streamed || rec.header.Get("Set-Cookie") != "":
+				next.ServeHTTP(w, r)
+			default:
+				m.Add("server_coalesced_requests_total", 1, "route", r.Pattern)
+				rec.replay(w)
+			}
+		})
+	}}
+}
+
+// bufferedResponse captures a complete response in memory. Once the body
+// exceeds limit or the handler flushes, it streams to w, the leader's
+// writer, instead.
+type bufferedResponse struct {
+	w        http.ResponseWriter
+	limit    int
+	streamed bool
+
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse(w http.ResponseWriter, limit int) *bufferedResponse {
+	return &bufferedResponse{w: w, limit: limit, header: make(http.Header), status: http.StatusOK}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	if b.streamed {
+		return b.w.Header()
+	}
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if !b.streamed && b.body.Len()+len(p) > b.limit {
+		b.stream()
+	}
+	if b.streamed {
+		return b.w.Write(p)
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if status >= 200 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) FlushError() error {
+	if !b.streamed {
+		b.stream()
+	}
+	return http.NewResponseController(b.w).Flush()
+}
+
+func (b *bufferedResponse) Flush() {
+	_ = b.FlushError()
+}
+
+// stream writes what was captured to the leader and switches to passing
+// writes through.
+func (b *bufferedResponse) stream() {
+	b.replay(b.w)
+	b.streamed = true
+	b.body = bytes.Buffer{}
+}
+
+// replay writes the captured response to w. It is safe to call from several
+// goroutines at once as it only reads b.
+func (b *bufferedResponse) replay(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.WriteHeader(b.status)
+	_, _ = w.Write(b.body.Bytes())
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingHandler echoes the request's Host and negotiation headers once
+// release is closed, setting vary on its response, and cookie and padding
+// the body to pad bytes when set.
+type blockingHandler struct {
+	calls   atomic.Int32
+	entered chan struct{}
+	release chan struct{}
+	vary    string
+	cookie  string
+	pad     int
+}
+
+func newBlockingHandler(vary string) *blockingHandler {
+	return &blockingHandler{entered: make(chan struct{}, 16), release: make(chan struct{}), vary: vary}
+}
+
+func (h *blockingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.calls.Add(1)
+	h.entered <- struct{}{}
+	<-h.release
+	if h.vary != "" {
+		w.Header().Set("Vary", h.vary)
+	}
+	if h.cookie != "" {
+		w.Header().Set("Set-Cookie", h.cookie)
+	}
+	body := r.Host + " " + r.Header.Get("Accept") + " " + r.Header.Get("X-Tenant")
+	_, _ = w.Write([]byte(body + strings.Repeat(".", max(h.pad-len(body), 0))))
+}
+
+// coalesceConcurrently sends reqs through h at once, holding the handler
+// until every request has either reached it or had time to join another's
+// flight, and returns the bodies in order.
+func coalesceConcurrently(t *testing.T, h http.Handler, bh *blockingHandler, reqs ...*http.Request) []string {
+	t.Helper()
+	bodies := make([]string, len(reqs))
+	var wg sync.WaitGroup
+	for i, r := range reqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			bodies[i] = rec.Body.String()
+		}()
+		if i == 0 {
+			<-bh.entered
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(bh.release)
+	wg.Wait()
+	return bodies
+}
+
+func getWith(target string, header ...string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	return r
+}
+
+func TestCoalesceSharesIdenticalRequests(t *testing.T) {
+	bh := newBlockingHandler("")
+	h := coalesce(NewMetrics()).Wrap(bh)
+
+	bodies := coalesceConcurrently(t, h, bh,
+		getWith("/token", "Accept", "application/json"),
+		getWith("/token", "Accept", "application/json"))
+	if bh.calls.Load() != 1 || bodies[0] != bodies[1] {
+		t.Errorf("%d handler calls, bodies %q; want one shared response", bh.calls.Load(), bodies)
+	}
+}
+
+func TestCoalesceKeepsNegotiatedResponsesApart(t *testing.T) {
+	bh := newBlockingHandler("")
+	h := coalesce(NewMetrics()).Wrap(bh)
+
+	bodies := coalesceConcurrently(t, h, bh,
+		getWith("http://a.example/token", "Accept", "application/json"),
+		getWith("http://a.example/token", "Accept", "text/plain"),
+		getWith("http://b.example/token", "Accept", "application/json"))
+	want := []string{"a.example application/json ", "a.example text/plain ", "b.example application/json "}
+	for i := range want {
+		if bodies[i] != want[i] {
+			t.Errorf("request %d got %q, want %q", i, bodies[i], want[i])
+		}
+	}
+}
+
+func TestCoalesceLearnsVary(t *testing.T) {
+	bh := newBlockingHandler("X-Tenant")
+	h := coalesce(NewMetrics()).Wrap(bh)
+
+	// The first flight teaches the coalescer the route varies on X-Tenant.
+	coalesceConcurrently(t, h, bh, getWith("/report", "X-Tenant", "a"))
+
+	bh.release = make(chan struct{})
+	bodies := coalesceConcurrently(t, h, bh,
+		getWith("/report", "X-Tenant", "a"),
+		getWith("/report", "X-Tenant", "b"))
+	if bodies[0] != "example.com  a" || bodies[1] != "example.com  b" {
+		t.Errorf("bodies %q, want one per tenant", bodies)
+	}
+}
+
+func TestCoalesceLearnsVaryPerRoute(t *testing.T) {
+	bh := newBlockingHandler("X-Tenant")
+	h := coalesce(NewMetrics()).Wrap(bh)
+
+	coalesceConcurrently(t, h, bh, getWith("/report?q=1", "X-Tenant", "a"))
+
+	// A URI the coalescer has not seen yet still varies on X-Tenant.
+	bh.release = make(chan struct{})
+	bodies := coalesceConcurrently(t, h, bh,
+		getWith("/report?q=2", "X-Tenant", "a"),
+		getWith("/report?q=2", "X-Tenant", "b"))
+	if bodies[0] != "example.com  a" || bodies[1] != "example.com  b" {
+		t.Errorf("bodies %q, want one per tenant", bodies)
+	}
+}
+
+func TestCoalesceSkipsPersonalResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie string
+		pad    int
+		header []string
+	}{
+		{"authorization", "", 0, []string{"Authorization", "Bearer x"}},
+		{"cookie", "", 0, []string{"Cookie", "session=x"}},
+		{"set-cookie", "session=y", 0, nil},
+		{"over the cap", "", maxCoalescedBody + 1, nil},
+	}
+	for _, tt := range tests {
+		bh := newBlockingHandler("")
+		bh.cookie, bh.pad = tt.cookie, tt.pad
+		h := coalesce(NewMetrics()).Wrap(bh)
+		bodies := coalesceConcurrently(t, h, bh, getWith("/me", tt.header...), getWith("/me", tt.header...))
+		if bh.calls.Load() != 2 {
+			t.Errorf("%s: %d handler calls, want 2", tt.name, bh.calls.Load())
+		}
+		for i, body := range bodies {
+			if want := max(tt.pad, len("example.com  ")); len(body) != want {
+				t.Errorf("%s: request %d got %d bytes, want %d", tt.name, i, len(body), want)
+			}
+		}
+	}
+}
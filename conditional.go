@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Predicate decides whether conditional middleware applies to a request.
+type Predicate func(*http.Request) bool
+
+// When applies mw only to requests pred matches; the rest go straight to
+// the next handler.
+func When(pred Predicate, mw Middleware) Middleware {
+	return Middleware{Name: "when(" + mw.Name + ")", Wrap: func(next http.Handler) http.Handler {
+		wrapped := mw.Wrap(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if pred(r) {
+				wrapped.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// Unless applies mw to every request pred does not match.
+func Unless(pred Predicate, mw Middleware) Middleware {
+	m := When(Not(pred), mw)
+	m.Name = "unless(" + mw.Name + ")"
+	return m
+}
+
+// Not negates pred.
+func Not(pred Predicate) Predicate {
+	return func(r *http.Request) bool { return !pred(r) }
+}
+
+// AnyOf matches requests any of preds matches.
+func AnyOf(preds ...Predicate) Predicate {
+	return func(r *http.Request) bool {
+		return slices.ContainsFunc(preds, func(p Predicate) bool { return p(r) })
+	}
+}
+
+// PathPrefix matches requests whose path starts with one of prefixes.
+func PathPrefix(prefixes ...string) Predicate {
+	return func(r *http.Request) bool {
+		return slices.ContainsFunc(prefixes, func(p string) bool { return strings.HasPrefix(r.URL.Path, p) })
+	}
+}
+
+// HasHeader matches requests carrying the named header, whatever its value.
+func HasHeader(name string) Predicate {
+	name = http.CanonicalHeaderKey(name)
+	return func(r *http.Request) bool {
+		_, ok := r.Header[name]
+		return ok
+	}
+}
+
+// ClientIn matches requests whose client address, as clientIP resolves it,
+// is in one of prefixes.
+func ClientIn(prefixes ...netip.Prefix) Predicate {
+	return func(r *http.Request) bool {
+		addr, err := netip.ParseAddr(clientIP(r))
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		return slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(addr) })
+	}
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config is the effective runtime configuration. Values are layered as
+// defaults, then the JSON file named by -config or SERVER_CONFIG, then
+// SERVER_* environment variables, then command-line flags.
+//
+// Each field declares its json key, env suffix and flag name through tags.
+// Fields tagged secret:"true" are redacted by Redacted.
+type Config struct {
+	HTTPAddr                     string        `json:"http_addr" env:"HTTP_ADDR" flag:"http-addr" usage:"HTTP listen addresses: comma-separated [tcp|tcp4|tcp6://]host:port"`
+	HTTPSAddr                    string        `json:"https_addr" env:"HTTPS_ADDR" flag:"https-addr" usage:"HTTPS listen addresses, in the same form as http_addr"`
+	TLSCertFile                  string        `json:"tls_cert_file" env:"TLS_CERT_FILE" flag:"tls-cert-file" usage:"PEM certificate chain; with tls_key_file the HTTPS listener terminates TLS itself and fingerprints clients"`
+	TLSKeyFile                   string        `json:"tls_key_file" env:"TLS_KEY_FILE" flag:"tls-key-file" usage:"PEM private key for tls_cert_file"`
+	AdminAddr                    string        `json:"admin_addr" env:"ADMIN_ADDR" flag:"admin-addr" usage:"admin API listen address (disabled when empty)"`
+	AllowedHosts                 []string      `json:"allowed_hosts" env:"ALLOWED_HOSTS" flag:"allowed-hosts" usage:"comma-separated Host names accepted on every listener, *.example.com for subdomains (empty allows any)"`
+	GeoIPDB                      string        `json:"geoip_db" env:"GEOIP_DB" flag:"geoip-db" usage:"MaxMind DB (.mmdb) file used to tag requests with the client country"`
+	GeoIPBlockCountries          []string      `json:"geoip_block_countries" env:"GEOIP_BLOCK_COUNTRIES" flag:"geoip-block-countries" usage:"comma-separated ISO country codes (or unknown) rejected with 403"`
+	GeoIPRateLimits              []string      `json:"geoip_rate_limits" env:"GEOIP_RATE_LIMITS" flag:"geoip-rate-limits" usage:"comma-separated CC=rate[/burst] per-client request limits for clients from a country"`
+	BotRules                     []string      `json:"bot_rules" env:"BOT_RULES" flag:"bot-rules" usage:"comma-separated ACTION:CLASS=substr|substr User-Agent rules, first match wins; ACTION is block, challenge or tag, and no substrings matches an empty User-Agent"`
+	BotRateLimits                []string      `json:"bot_rate_limits" env:"BOT_RATE_LIMITS" flag:"bot-rate-limits" usage:"comma-separated CLASS=rate[/burst] limits on /token and /uuid shared by all clients of a bot class"`
+	HoneypotPaths                []string      `json:"honeypot_paths" env:"HONEYPOT_PATHS" flag:"honeypot-paths" usage:"comma-separated decoy paths, e.g. /wp-login.php,/.env; clients requesting them are banned"`
+	BanDuration                  time.Duration `json:"ban_duration" env:"BAN_DURATION" flag:"ban-duration" usage:"how long a banned client is refused"`
+	BanTarpitConns               int           `json:"ban_tarpit_conns" env:"BAN_TARPIT_CONNS" flag:"ban-tarpit-conns" usage:"hold up to this many banned HTTP/1 clients on a response dripped one byte at a time instead of refusing them (0 disables)"`
+	BanTarpitInterval            time.Duration `json:"ban_tarpit_interval" env:"BAN_TARPIT_INTERVAL" flag:"ban-tarpit-interval" usage:"delay between tarpit bytes"`
+	BanTarpitMaxDuration         time.Duration `json:"ban_tarpit_max_duration" env:"BAN_TARPIT_MAX_DURATION" flag:"ban-tarpit-max-duration" usage:"longest a client is held in the tarpit"`
+	WebhookPath                  string        `json:"webhook_path" env:"WEBHOOK_PATH" flag:"webhook-path" usage:"path of the built-in webhook receiver on the public listeners"`
+	WebhookScheme                string        `json:"webhook_scheme" env:"WEBHOOK_SCHEME" flag:"webhook-scheme" usage:"webhook signature scheme: github or stripe"`
+	WebhookSecret                string        `json:"webhook_secret" env:"WEBHOOK_SECRET" flag:"webhook-secret" usage:"HMAC secret; when set, the webhook receiver is enabled" secret:"true"`
+	WebhookMaxBodyBytes          int64         `json:"webhook_max_body_bytes" env:"WEBHOOK_MAX_BODY_BYTES" flag:"webhook-max-body-bytes" usage:"largest webhook payload accepted"`
+	WebhookTolerance             time.Duration `json:"webhook_tolerance" env:"WEBHOOK_TOLERANCE" flag:"webhook-tolerance" usage:"allowed clock skew of signed webhook timestamps, and how long delivery IDs are kept to reject replays"`
+	WebhookTargets               []string      `json:"webhook_targets" env:"WEBHOOK_TARGETS" flag:"webhook-targets" usage:"comma-separated URLs to which server events are POSTed as signed webhooks (disabled when empty)"`
+	WebhookTargetSecret          string        `json:"webhook_target_secret" env:"WEBHOOK_TARGET_SECRET" flag:"webhook-target-secret" usage:"HMAC secret signing outgoing webhooks" secret:"true"`
+	WebhookQueueSize             int           `json:"webhook_queue_size" env:"WEBHOOK_QUEUE_SIZE" flag:"webhook-queue-size" usage:"outgoing webhook deliveries queued before events are dropped"`
+	WebhookMaxAttempts           int           `json:"webhook_max_attempts" env:"WEBHOOK_MAX_ATTEMPTS" flag:"webhook-max-attempts" usage:"delivery attempts per outgoing webhook before it is given up"`
+	JobWorkers                   int           `json:"job_workers" env:"JOB_WORKERS" flag:"job-workers" usage:"background job workers (0 disables the job queue)"`
+	JobQueueSize                 int           `json:"job_queue_size" env:"JOB_QUEUE_SIZE" flag:"job-queue-size" usage:"background jobs queued before Enqueue reports the queue full"`
+	JobMaxAttempts               int           `json:"job_max_attempts" env:"JOB_MAX_ATTEMPTS" flag:"job-max-attempts" usage:"attempts per background job before it goes to the dead-letter log"`
+	JobCheckpointFile            string        `json:"job_checkpoint_file" env:"JOB_CHECKPOINT_FILE" flag:"job-checkpoint-file" usage:"file where jobs unfinished at shutdown are saved and requeued from at startup (empty discards them)"`
+	JobDeadLetterFile            string        `json:"job_dead_letter_file" env:"JOB_DEAD_LETTER_FILE" flag:"job-dead-letter-file" usage:"JSON lines file recording jobs that exhausted their attempts"`
+	BrokerPath                   string        `json:"broker_path" env:"BROKER_PATH" flag:"broker-path" usage:"path on the public listeners where clients subscribe to broker topics over SSE or WebSocket (empty disables the broker)"`
+	BrokerTopicBuffer            int           `json:"broker_topic_buffer" env:"BROKER_TOPIC_BUFFER" flag:"broker-topic-buffer" usage:"messages kept per topic for clients resuming with Last-Event-ID"`
+	BrokerSubscriberBuffer       int           `json:"broker_subscriber_buffer" env:"BROKER_SUBSCRIBER_BUFFER" flag:"broker-subscriber-buffer" usage:"messages queued for a client before it is evicted as a slow consumer"`
+	DegradedRoutes               []string      `json:"degraded_routes" env:"DEGRADED_ROUTES" flag:"degraded-routes" usage:"comma-separated pattern=check[+check...] entries; while a named health check fails, the route serves its last good GET response or 503 instead of calling the dependency"`
+	DegradedRetryAfter           time.Duration `json:"degraded_retry_after" env:"DEGRADED_RETRY_AFTER" flag:"degraded-retry-after" usage:"Retry-After sent by degraded routes"`
+	BulkheadGroups               []string      `json:"bulkhead_groups" env:"BULKHEAD_GROUPS" flag:"bulkhead-groups" usage:"comma-separated name=max_concurrent[/max_queue] route groups with their own concurrency budget"`
+	BulkheadRoutes               []string      `json:"bulkhead_routes" env:"BULKHEAD_ROUTES" flag:"bulkhead-routes" usage:"comma-separated pattern=group entries assigning routes to bulkhead groups; other routes are not limited"`
+	TenantSource                 string        `json:"tenant_source" env:"TENANT_SOURCE" flag:"tenant-source" usage:"how requests are attributed to tenants: header:NAME, apikey:NAME or jwt:CLAIM (disabled when empty)"`
+	TenantAPIKeys                []string      `json:"tenant_api_keys" env:"TENANT_API_KEYS" flag:"tenant-api-keys" usage:"comma-separated key=tenant entries for the apikey tenant source" secret:"true"`
+	TenantJWTSecret              string        `json:"tenant_jwt_secret" env:"TENANT_JWT_SECRET" flag:"tenant-jwt-secret" usage:"HS256 key verifying tokens for the jwt tenant source" secret:"true"`
+	TenantQuotas                 []string      `json:"tenant_quotas" env:"TENANT_QUOTAS" flag:"tenant-quotas" usage:"comma-separated tenant=requests[/bytes] entries per tenant_quota_window; * sets the default, 0 is unlimited"`
+	TenantQuotaWindow            time.Duration `json:"tenant_quota_window" env:"TENANT_QUOTA_WINDOW" flag:"tenant-quota-window" usage:"period tenant quotas reset over"`
+	TenantRateLimits             []string      `json:"tenant_rate_limits" env:"TENANT_RATE_LIMITS" flag:"tenant-rate-limits" usage:"comma-separated tenant=rate[/burst] entries in requests per second; * sets the default"`
+	AdmissionMaxConcurrent       int           `json:"admission_max_concurrent" env:"ADMISSION_MAX_CONCURRENT" flag:"admission-max-concurrent" usage:"requests served at once on the public listeners; beyond this they queue and are admitted by priority (0 disables)"`
+	AdmissionMaxQueue            int           `json:"admission_max_queue" env:"ADMISSION_MAX_QUEUE" flag:"admission-max-queue" usage:"requests waiting for admission; when full, lower-priority waiters are displaced"`
+	AdmissionQueueTimeout        time.Duration `json:"admission_queue_timeout" env:"ADMISSION_QUEUE_TIMEOUT" flag:"admission-queue-timeout" usage:"longest a request waits for admission before 503"`
+	AdmissionAging               time.Duration `json:"admission_aging" env:"ADMISSION_AGING" flag:"admission-aging" usage:"a waiting request rises one priority class per interval, so low-priority traffic is never starved (0 disables)"`
+	PriorityRoutes               []string      `json:"priority_routes" env:"PRIORITY_ROUTES" flag:"priority-routes" usage:"comma-separated pattern=class entries; classes are low, normal, high and critical"`
+	PriorityClients              []string      `json:"priority_clients" env:"PRIORITY_CLIENTS" flag:"priority-clients" usage:"comma-separated cidr=class entries for routes without a priority"`
+	BulkheadQueueTimeout         time.Duration `json:"bulkhead_queue_timeout" env:"BULKHEAD_QUEUE_TIMEOUT" flag:"bulkhead-queue-timeout" usage:"longest a request waits for a slot in its bulkhead before 503"`
+	DeadlineRoutes               []string      `json:"deadline_routes" env:"DEADLINE_ROUTES" flag:"deadline-routes" usage:"comma-separated pattern=duration time budgets; the request context is cancelled when a route runs out of its budget, and the remainder is forwarded to upstreams in X-Request-Timeout"`
+	WAFRulesFile                 string        `json:"waf_rules_file" env:"WAF_RULES_FILE" flag:"waf-rules-file" usage:"JSON WAF rules file, reloaded when it changes (empty disables the WAF)"`
+	WAFMode                      string        `json:"waf_mode" env:"WAF_MODE" flag:"waf-mode" usage:"what the WAF does with anomalous requests: block or log"`
+	WAFMaxBodyBytes              int           `json:"waf_max_body_bytes" env:"WAF_MAX_BODY_BYTES" flag:"waf-max-body-bytes" usage:"request body bytes inspected by WAF body rules"`
+	GraphQLPath                  string        `json:"graphql_path" env:"GRAPHQL_PATH" flag:"graphql-path" usage:"route the schema registered with WithGraphQL is served on, with a GraphiQL playground outside prod"`
+	UserStoreFile                string        `json:"user_store_file" env:"USER_STORE_FILE" flag:"user-store-file" usage:"JSON file of local accounts checked against Basic-auth credentials and managed under /admin/users (disabled when empty)"`
+	UserBcryptCost               int           `json:"user_bcrypt_cost" env:"USER_BCRYPT_COST" flag:"user-bcrypt-cost" usage:"bcrypt cost of stored password hashes"`
+	LDAPURL                      string        `json:"ldap_url" env:"LDAP_URL" flag:"ldap-url" usage:"ldap:// or ldaps:// directory that Basic-auth and form credentials are checked against (disabled when empty; needs -tags ldap)"`
+	LDAPBindDN                   string        `json:"ldap_bind_dn" env:"LDAP_BIND_DN" flag:"ldap-bind-dn" usage:"service account DN used to look up users (anonymous when empty)"`
+	LDAPBindPassword             string        `json:"ldap_bind_password" env:"LDAP_BIND_PASSWORD" flag:"ldap-bind-password" usage:"service account password" secret:"true"`
+	LDAPBaseDN                   string        `json:"ldap_base_dn" env:"LDAP_BASE_DN" flag:"ldap-base-dn" usage:"subtree users are searched in"`
+	LDAPUserFilter               string        `json:"ldap_user_filter" env:"LDAP_USER_FILTER" flag:"ldap-user-filter" usage:"filter finding a user's entry, %s being the username; (sAMAccountName=%s) for Active Directory"`
+	LDAPGroupAttribute           string        `json:"ldap_group_attribute" env:"LDAP_GROUP_ATTRIBUTE" flag:"ldap-group-attribute" usage:"user attribute listing their groups"`
+	LDAPGroupRoles               []string      `json:"ldap_group_roles" env:"LDAP_GROUP_ROLES" flag:"ldap-group-roles" usage:"comma-separated group=role[+role...] entries mapping group names (the first RDN value of group DNs) to RBAC roles"`
+	LDAPPoolSize                 int           `json:"ldap_pool_size" env:"LDAP_POOL_SIZE" flag:"ldap-pool-size" usage:"idle directory connections kept open"`
+	LDAPTimeout                  time.Duration `json:"ldap_timeout" env:"LDAP_TIMEOUT" flag:"ldap-timeout" usage:"deadline for dialing and each directory operation"`
+	LDAPCacheTTL                 time.Duration `json:"ldap_cache_ttl" env:"LDAP_CACHE_TTL" flag:"ldap-cache-ttl" usage:"how long successful binds are reused without asking the directory (0 disables)"`
+	LDAPFormPath                 string        `json:"ldap_form_path" env:"LDAP_FORM_PATH" flag:"ldap-form-path" usage:"path whose POSTed username and password form fields are authenticated (disabled when empty)"`
+	RBACPolicyFile               string        `json:"rbac_policy_file" env:"RBAC_POLICY_FILE" flag:"rbac-policy-file" usage:"JSON role policy checked against authenticated identities, reloaded when it changes (empty disables RBAC)"`
+	RBACLogDecisions             bool          `json:"rbac_log_decisions" env:"RBAC_LOG_DECISIONS" flag:"rbac-log-decisions" usage:"log allowed requests as well as denied ones"`
+	RewriteRulesFile             string        `json:"rewrite_rules_file" env:"REWRITE_RULES_FILE" flag:"rewrite-rules-file" usage:"JSON redirect and rewrite rules applied before routing, reloaded when they change"`
+	PathCanonicalMode            string        `json:"path_canonical_mode" env:"PATH_CANONICAL_MODE" flag:"path-canonical-mode" usage:"how requests for a variant of a route's path are served: redirect or rewrite (empty disables canonicalization)"`
+	PathTrailingSlash            bool          `json:"path_trailing_slash" env:"PATH_TRAILING_SLASH" flag:"path-trailing-slash" usage:"serve /a/ from a route registered as /a, and the reverse"`
+	PathCaseInsensitive          bool          `json:"path_case_insensitive" env:"PATH_CASE_INSENSITIVE" flag:"path-case-insensitive" usage:"serve paths that match no route from the route their lowercase form matches"`
+	PathCollapseSlashes          bool          `json:"path_collapse_slashes" env:"PATH_COLLAPSE_SLASHES" flag:"path-collapse-slashes" usage:"collapse repeated slashes in request paths"`
+	RequestSchemasFile           string        `json:"request_schemas_file" env:"REQUEST_SCHEMAS_FILE" flag:"request-schemas-file" usage:"JSON file mapping route patterns to JSON Schemas for their body, query and path parameters"`
+	ProfilingURL                 string        `json:"profiling_url" env:"PROFILING_URL" flag:"profiling-url" usage:"Pyroscope server continuous CPU and heap profiles are pushed to (disabled when empty)"`
+	ProfilingAuthToken           string        `json:"profiling_auth_token" env:"PROFILING_AUTH_TOKEN" flag:"profiling-auth-token" usage:"bearer token for profiling_url" secret:"true"`
+	ProfilingAppName             string        `json:"profiling_app_name" env:"PROFILING_APP_NAME" flag:"profiling-app-name" usage:"application name profiles are pushed under"`
+	ProfilingInstance            string        `json:"profiling_instance" env:"PROFILING_INSTANCE" flag:"profiling-instance" usage:"instance label of pushed profiles (defaults to the hostname)"`
+	ProfilingLabels              []string      `json:"profiling_labels" env:"PROFILING_LABELS" flag:"profiling-labels" usage:"comma-separated key=value labels added to pushed profiles, besides version and instance"`
+	ProfilingInterval            time.Duration `json:"profiling_interval" env:"PROFILING_INTERVAL" flag:"profiling-interval" usage:"length of each pushed CPU profile, and how often heap profiles are pushed"`
+	ProfilingPprof               bool          `json:"profiling_pprof" env:"PROFILING_PPROF" flag:"profiling-pprof" usage:"serve runtime profiles under /debug/pprof/ on the admin listener, for Parca and other scraping profilers"`
+	MetricsRouteGroups           []string      `json:"metrics_route_groups" env:"METRICS_ROUTE_GROUPS" flag:"metrics-route-groups" usage:"comma-separated pattern=group entries reporting several routes' request metrics under one route label"`
+	MetricsExcludeRoutes         []string      `json:"metrics_exclude_routes" env:"METRICS_EXCLUDE_ROUTES" flag:"metrics-exclude-routes" usage:"comma-separated route patterns left out of per-route request metrics"`
+	MetricsPushURL               string        `json:"metrics_push_url" env:"METRICS_PUSH_URL" flag:"metrics-push-url" usage:"Pushgateway URL for the final metrics snapshot" secret:"true"`
+	ShutdownTimeout              time.Duration `json:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"maximum time to drain listeners"`
+	FeatureFlagsFile             string        `json:"feature_flags_file" env:"FEATURE_FLAGS_FILE" flag:"feature-flags-file" usage:"JSON file of feature flags, reloaded on change"`
+	Mode                         string        `json:"mode" env:"MODE" flag:"mode" usage:"run mode: prod, dev or chaos"`
+	TokenRate                    float64       `json:"token_rate" env:"TOKEN_RATE" flag:"token-rate" usage:"per-client /token requests per second"`
+	TokenBurst                   int           `json:"token_burst" env:"TOKEN_BURST" flag:"token-burst" usage:"per-client /token burst size"`
+	ConnMaxAge                   time.Duration `json:"conn_max_age" env:"CONN_MAX_AGE" flag:"conn-max-age" usage:"close keep-alive connections older than this (0 disables)"`
+	ConnMaxRequests              int           `json:"conn_max_requests" env:"CONN_MAX_REQUESTS" flag:"conn-max-requests" usage:"close keep-alive connections after this many requests (0 disables)"`
+	ConnReapInterval             time.Duration `json:"conn_reap_interval" env:"CONN_REAP_INTERVAL" flag:"conn-reap-interval" usage:"how often idle connections are reaped (0 disables)"`
+	IdleTimeout                  time.Duration `json:"idle_timeout" env:"IDLE_TIMEOUT" flag:"idle-timeout" usage:"keep-alive idle timeout for HTTP/1.1 and HTTP/2 connections"`
+	H2C                          bool          `json:"h2c" env:"H2C" flag:"h2c" usage:"accept unencrypted HTTP/2 (prior knowledge) on the public listeners"`
+	TCPOptions                   []string      `json:"tcp_options" env:"TCP_OPTIONS" flag:"tcp-options" usage:"comma-separated listener.option=value socket tuning; listener is http, https, admin or *, option is keepalive, nodelay or backlog"`
+	TSNetStateDir                string        `json:"tsnet_state_dir" env:"TSNET_STATE_DIR" flag:"tsnet-state-dir" usage:"state directory for tsnet:// listeners (one subdirectory per node)"`
+	TSNetAuthKey                 string        `json:"tsnet_auth_key" env:"TSNET_AUTH_KEY" flag:"tsnet-auth-key" usage:"Tailscale auth key used when a tsnet node first joins" secret:"true"`
+	TSNetAllowedLogins           []string      `json:"tsnet_allowed_logins" env:"TSNET_ALLOWED_LOGINS" flag:"tsnet-allowed-logins" usage:"comma-separated tailnet logins allowed to connect to tsnet listeners (empty allows the whole tailnet)"`
+	TunnelProvider               string        `json:"tunnel_provider" env:"TUNNEL_PROVIDER" flag:"tunnel-provider" usage:"expose the HTTP listener through an outbound tunnel: cloudflared or ngrok (disabled when empty)"`
+	TunnelToken                  string        `json:"tunnel_token" env:"TUNNEL_TOKEN" flag:"tunnel-token" usage:"cloudflared tunnel token or ngrok authtoken" secret:"true"`
+	TunnelBinary                 string        `json:"tunnel_binary" env:"TUNNEL_BINARY" flag:"tunnel-binary" usage:"path to the tunnel client (defaults to the provider name on PATH)"`
+	MDNSName                     string        `json:"mdns_name" env:"MDNS_NAME" flag:"mdns-name" usage:"advertise the HTTP listener as NAME.local over mDNS (dev and chaos modes only)"`
+	StaticDir                    string        `json:"static_dir" env:"STATIC_DIR" flag:"static-dir" usage:"directory served under static_prefix (disabled when empty)"`
+	StaticPrefix                 string        `json:"static_prefix" env:"STATIC_PREFIX" flag:"static-prefix" usage:"URL prefix for static files"`
+	StaticHints                  []string      `json:"static_hints" env:"STATIC_HINTS" flag:"static-hints" usage:"comma-separated asset URLs sent as 103 Early Hints for static pages"`
+	StaticFingerprint            bool          `json:"static_fingerprint" env:"STATIC_FINGERPRINT" flag:"static-fingerprint" usage:"hash static_dir at startup and serve content-hashed names, linked with the asset template helper, as immutable"`
+	StaticSigningKey             string        `json:"static_signing_key" env:"STATIC_SIGNING_KEY" flag:"static-signing-key" usage:"HMAC key; when set, static files require a signed, expiring URL" secret:"true"`
+	TemplatesDir                 string        `json:"templates_dir" env:"TEMPLATES_DIR" flag:"templates-dir" usage:"directory of html/template pages, with shared layouts/ and partials/; reloaded on change outside prod (disabled when empty)"`
+	TemplateLayout               string        `json:"template_layout" env:"TEMPLATE_LAYOUT" flag:"template-layout" usage:"layout pages are rendered in, relative to templates_dir"`
+	I18nDir                      string        `json:"i18n_dir" env:"I18N_DIR" flag:"i18n-dir" usage:"directory of message catalogs named by language, such as en.json; responses are localized from Accept-Language (disabled when empty)"`
+	I18nDefaultLanguage          string        `json:"i18n_default_language" env:"I18N_DEFAULT_LANGUAGE" flag:"i18n-default-language" usage:"language used when a client accepts none in i18n_dir"`
+	WellKnownDocuments           []string      `json:"well_known_documents" env:"WELL_KNOWN_DOCUMENTS" flag:"well-known-documents" usage:"comma-separated name=file entries served at /.well-known/name"`
+	SecurityContacts             []string      `json:"security_contacts" env:"SECURITY_CONTACTS" flag:"security-contacts" usage:"comma-separated mailto: or https: contacts published in /.well-known/security.txt (disabled when empty)"`
+	SecurityPolicyURL            string        `json:"security_policy_url" env:"SECURITY_POLICY_URL" flag:"security-policy-url" usage:"vulnerability disclosure policy linked from security.txt"`
+	SecurityTxtExpiry            time.Duration `json:"security_txt_expiry" env:"SECURITY_TXT_EXPIRY" flag:"security-txt-expiry" usage:"how far ahead security.txt's Expires field lies"`
+	ChangePasswordURL            string        `json:"change_password_url" env:"CHANGE_PASSWORD_URL" flag:"change-password-url" usage:"target of the /.well-known/change-password redirect (disabled when empty)"`
+	RobotsTxt                    string        `json:"robots_txt" env:"ROBOTS_TXT" flag:"robots-txt" usage:"robots.txt content (defaults to allowing all crawlers in prod and none elsewhere)"`
+	RobotsTxtFile                string        `json:"robots_txt_file" env:"ROBOTS_TXT_FILE" flag:"robots-txt-file" usage:"file served as robots.txt, overriding robots_txt"`
+	FaviconFile                  string        `json:"favicon_file" env:"FAVICON_FILE" flag:"favicon-file" usage:"file served as /favicon.ico (defaults to a blank icon)"`
+	WASMPlugins                  []string      `json:"wasm_plugins" env:"WASM_PLUGINS" flag:"wasm-plugins" usage:"comma-separated name=file.wasm entries run in order as sandboxed request middleware, and offered as wasm:name route handlers; reloaded on change (needs -tags wazero)"`
+	WASMPluginTimeout            time.Duration `json:"wasm_plugin_timeout" env:"WASM_PLUGIN_TIMEOUT" flag:"wasm-plugin-timeout" usage:"how long a WASM plugin may run per request before it is aborted"`
+	WASMPluginMaxMemoryMiB       int           `json:"wasm_plugin_max_memory_mib" env:"WASM_PLUGIN_MAX_MEMORY_MIB" flag:"wasm-plugin-max-memory-mib" usage:"memory limit of each WASM plugin instance in MiB"`
+	LuaScripts                   []string      `json:"lua_scripts" env:"LUA_SCRIPTS" flag:"lua-scripts" usage:"comma-separated name=file.lua entries whose on_request and on_response hooks run in order on every request; reloaded on change (needs -tags lua)"`
+	LuaTimeout                   time.Duration `json:"lua_timeout" env:"LUA_TIMEOUT" flag:"lua-timeout" usage:"how long a Lua hook may run before it is aborted"`
+	ExtAuthzURL                  string        `json:"ext_authz_url" env:"EXT_AUTHZ_URL" flag:"ext-authz-url" usage:"authorization service consulted before each request: an http(s):// base URL the request path is appended to, or grpc://host:port (disabled when empty)"`
+	ExtAuthzTimeout              time.Duration `json:"ext_authz_timeout" env:"EXT_AUTHZ_TIMEOUT" flag:"ext-authz-timeout" usage:"deadline for each authorization check"`
+	ExtAuthzFailOpen             bool          `json:"ext_authz_fail_open" env:"EXT_AUTHZ_FAIL_OPEN" flag:"ext-authz-fail-open" usage:"let requests through when the authorization service cannot decide, instead of answering 503"`
+	ExtAuthzCacheTTL             time.Duration `json:"ext_authz_cache_ttl" env:"EXT_AUTHZ_CACHE_TTL" flag:"ext-authz-cache-ttl" usage:"how long decisions are reused for requests with the same method, path and forwarded headers (0 disables)"`
+	ExtAuthzHeaders              []string      `json:"ext_authz_headers" env:"EXT_AUTHZ_HEADERS" flag:"ext-authz-headers" usage:"comma-separated request headers sent to the authorization service"`
+	ExtAuthzUpstreamHeaders      []string      `json:"ext_authz_upstream_headers" env:"EXT_AUTHZ_UPSTREAM_HEADERS" flag:"ext-authz-upstream-headers" usage:"comma-separated headers the authorization service may set on allowed requests; clients cannot send them"`
+	Extensions                   []string      `json:"extensions" env:"EXTENSIONS" flag:"extensions" usage:"comma-separated name=executable entries started as gRPC plugin processes that authorize and enrich requests, restarted when they crash (needs -tags goplugin)"`
+	ExtensionTimeout             time.Duration `json:"extension_timeout" env:"EXTENSION_TIMEOUT" flag:"extension-timeout" usage:"deadline for each call to an extension"`
+	UploadDir                    string        `json:"upload_dir" env:"UPLOAD_DIR" flag:"upload-dir" usage:"directory multipart uploads are stored in (disabled when empty)"`
+	UploadMaxBytes               int64         `json:"upload_max_bytes" env:"UPLOAD_MAX_BYTES" flag:"upload-max-bytes" usage:"maximum upload request size in bytes"`
+	UploadAllowedTypes           []string      `json:"upload_allowed_types" env:"UPLOAD_ALLOWED_TYPES" flag:"upload-allowed-types" usage:"comma-separated sniffed content types accepted for upload (empty allows any)"`
+	UploadTimeout                time.Duration `json:"upload_timeout" env:"UPLOAD_TIMEOUT" flag:"upload-timeout" usage:"read and write deadline for a single upload request"`
+	StorageBackend               string        `json:"storage_backend" env:"STORAGE_BACKEND" flag:"storage-backend" usage:"where static_dir and upload_dir live: fs, or s3 (they become key prefixes in s3_bucket)"`
+	S3Endpoint                   string        `json:"s3_endpoint" env:"S3_ENDPOINT" flag:"s3-endpoint" usage:"S3-compatible endpoint URL"`
+	S3Region                     string        `json:"s3_region" env:"S3_REGION" flag:"s3-region" usage:"S3 signing region"`
+	S3Bucket                     string        `json:"s3_bucket" env:"S3_BUCKET" flag:"s3-bucket" usage:"S3 bucket name"`
+	S3AccessKey                  string        `json:"s3_access_key" env:"S3_ACCESS_KEY" flag:"s3-access-key" usage:"S3 access key ID" secret:"true"`
+	S3SecretKey                  string        `json:"s3_secret_key" env:"S3_SECRET_KEY" flag:"s3-secret-key" usage:"S3 secret access key" secret:"true"`
+	S3PathStyle                  bool          `json:"s3_path_style" env:"S3_PATH_STYLE" flag:"s3-path-style" usage:"address the bucket as a path segment instead of a subdomain"`
+	CacheEnabled                 bool          `json:"cache_enabled" env:"CACHE_ENABLED" flag:"cache" usage:"cache cacheable GET responses in memory"`
+	CacheMaxEntries              int           `json:"cache_max_entries" env:"CACHE_MAX_ENTRIES" flag:"cache-max-entries" usage:"response cache size in entries"`
+	CacheControlRules            []string      `json:"cache_control_rules" env:"CACHE_CONTROL_RULES" flag:"cache-control-rules" usage:"comma-separated /glob=directive[+directive...] entries, e.g. /static/**=public+max-age=8760h+immutable; the first matching rule sets Cache-Control on responses whose handler did not"`
+	CacheTTL                     time.Duration `json:"cache_ttl" env:"CACHE_TTL" flag:"cache-ttl" usage:"TTL for responses without max-age (0 caches only explicit max-age)"`
+	CacheStaleWhileRevalidate    time.Duration `json:"cache_stale_while_revalidate" env:"CACHE_STALE_WHILE_REVALIDATE" flag:"cache-stale-while-revalidate" usage:"serve expired entries this long while refreshing"`
+	IdempotencyEnabled           bool          `json:"idempotency_enabled" env:"IDEMPOTENCY_ENABLED" flag:"idempotency" usage:"replay stored responses to POST and PUT requests retried with the same Idempotency-Key"`
+	IdempotencyTTL               time.Duration `json:"idempotency_ttl" env:"IDEMPOTENCY_TTL" flag:"idempotency-ttl" usage:"how long responses are kept for Idempotency-Key retries"`
+	IdempotencyMaxBodyBytes      int64         `json:"idempotency_max_body_bytes" env:"IDEMPOTENCY_MAX_BODY_BYTES" flag:"idempotency-max-body-bytes" usage:"largest request or response body of an idempotent request"`
+	ETagPatterns                 []string      `json:"etag_patterns" env:"ETAG_PATTERNS" flag:"etag-patterns" usage:"comma-separated route patterns whose GET responses get a content-hash ETag and If-None-Match support"`
+	ETagMaxBytes                 int           `json:"etag_max_bytes" env:"ETAG_MAX_BYTES" flag:"etag-max-bytes" usage:"largest response buffered to compute an ETag; bigger ones are streamed without"`
+	CoalescePatterns             []string      `json:"coalesce_patterns" env:"COALESCE_PATTERNS" flag:"coalesce-patterns" usage:"comma-separated route patterns whose concurrent identical GETs are coalesced"`
+	NoAutoHeadPatterns           []string      `json:"no_auto_head_patterns" env:"NO_AUTO_HEAD_PATTERNS" flag:"no-auto-head-patterns" usage:"comma-separated GET route patterns that answer HEAD with 405 instead of running the handler"`
+	ThrottleConnRate             int64         `json:"throttle_conn_rate" env:"THROTTLE_CONN_RATE" flag:"throttle-conn-rate" usage:"per-connection response bytes per second (0 disables)"`
+	ThrottleRoutes               []string      `json:"throttle_routes" env:"THROTTLE_ROUTES" flag:"throttle-routes" usage:"comma-separated pattern=bytes_per_second response rate caps"`
+	HARDir                       string        `json:"har_dir" env:"HAR_DIR" flag:"har-dir" usage:"record sampled requests and responses as HAR files in this directory (disabled when empty)"`
+	Tracing                      bool          `json:"tracing" env:"TRACING" flag:"tracing" usage:"give requests W3C trace context, propagated to outbound calls, and log sampled spans"`
+	TraceSamplePercent           float64       `json:"trace_sample_percent" env:"TRACE_SAMPLE_PERCENT" flag:"trace-sample-percent" usage:"percentage of requests traced when the caller made no sampling decision"`
+	TraceSampleRoutes            []string      `json:"trace_sample_routes" env:"TRACE_SAMPLE_ROUTES" flag:"trace-sample-routes" usage:"comma-separated pattern=percent overrides of trace_sample_percent"`
+	TraceRespectParent           bool          `json:"trace_respect_parent" env:"TRACE_RESPECT_PARENT" flag:"trace-respect-parent" usage:"follow the sampled flag of an incoming traceparent instead of sampling again"`
+	TraceSampleErrors            bool          `json:"trace_sample_errors" env:"TRACE_SAMPLE_ERRORS" flag:"trace-sample-errors" usage:"also keep spans the head decision dropped when the request ends in a 5xx"`
+	HARSamplePercent             float64       `json:"har_sample_percent" env:"HAR_SAMPLE_PERCENT" flag:"har-sample-percent" usage:"percentage of requests recorded to har_dir"`
+	HARMaxBodyBytes              int           `json:"har_max_body_bytes" env:"HAR_MAX_BODY_BYTES" flag:"har-max-body-bytes" usage:"request and response bodies are truncated to this many bytes in HAR recordings"`
+	HARRedactHeaders             []string      `json:"har_redact_headers" env:"HAR_REDACT_HEADERS" flag:"har-redact-headers" usage:"comma-separated headers whose values are redacted in HAR recordings"`
+	ProxyUpstream                []string      `json:"proxy_upstream" env:"PROXY_UPSTREAM" flag:"proxy-upstream" usage:"comma-separated upstream URLs for requests under proxy_prefix; several are picked by consistent hash of proxy_hash_key (disabled when empty)"`
+	ClientTimeout                time.Duration `json:"client_timeout" env:"CLIENT_TIMEOUT" flag:"client-timeout" usage:"overall timeout for outbound requests on the shared client (the proxy is exempt)"`
+	ClientDialTimeout            time.Duration `json:"client_dial_timeout" env:"CLIENT_DIAL_TIMEOUT" flag:"client-dial-timeout" usage:"outbound connection dial timeout"`
+	ClientIdleConnTimeout        time.Duration `json:"client_idle_conn_timeout" env:"CLIENT_IDLE_CONN_TIMEOUT" flag:"client-idle-conn-timeout" usage:"how long idle outbound connections are kept pooled"`
+	ClientMaxIdleConnsPerHost    int           `json:"client_max_idle_conns_per_host" env:"CLIENT_MAX_IDLE_CONNS_PER_HOST" flag:"client-max-idle-conns-per-host" usage:"pooled idle connections kept per upstream host"`
+	ClientMaxConnsPerHost        int           `json:"client_max_conns_per_host" env:"CLIENT_MAX_CONNS_PER_HOST" flag:"client-max-conns-per-host" usage:"maximum outbound connections per host (0 is unlimited)"`
+	DNSCache                     bool          `json:"dns_cache" env:"DNS_CACHE" flag:"dns-cache" usage:"cache upstream DNS answers for their record TTL"`
+	DNSMinTTL                    time.Duration `json:"dns_min_ttl" env:"DNS_MIN_TTL" flag:"dns-min-ttl" usage:"lower bound on cached DNS TTLs"`
+	DNSMaxTTL                    time.Duration `json:"dns_max_ttl" env:"DNS_MAX_TTL" flag:"dns-max-ttl" usage:"upper bound on cached DNS TTLs"`
+	DNSNegativeTTL               time.Duration `json:"dns_negative_ttl" env:"DNS_NEGATIVE_TTL" flag:"dns-negative-ttl" usage:"how long failed DNS lookups are cached"`
+	DNSOverrides                 []string      `json:"dns_overrides" env:"DNS_OVERRIDES" flag:"dns-overrides" usage:"comma-separated host=addr|addr entries resolved without DNS"`
+	ProxyHashKey                 string        `json:"proxy_hash_key" env:"PROXY_HASH_KEY" flag:"proxy-hash-key" usage:"sticky key for multiple upstreams: ip, cookie:NAME or header:NAME"`
+	ProxyHedgeAfter              time.Duration `json:"proxy_hedge_after" env:"PROXY_HEDGE_AFTER" flag:"proxy-hedge-after" usage:"with several proxy_upstream, also send a proxied GET or HEAD to the next upstream when the first has not answered within this time, using whichever answers first (0 disables)"`
+	ProxyPrefix                  string        `json:"proxy_prefix" env:"PROXY_PREFIX" flag:"proxy-prefix" usage:"URL prefix forwarded to proxy_upstream"`
+	ProxyShadowUpstream          string        `json:"proxy_shadow_upstream" env:"PROXY_SHADOW_UPSTREAM" flag:"proxy-shadow-upstream" usage:"mirror a share of proxied requests to this URL, discarding its responses"`
+	ProxyShadowPercent           float64       `json:"proxy_shadow_percent" env:"PROXY_SHADOW_PERCENT" flag:"proxy-shadow-percent" usage:"percentage of proxied requests mirrored to proxy_shadow_upstream"`
+	ProxyShadowMaxBody           int64         `json:"proxy_shadow_max_body" env:"PROXY_SHADOW_MAX_BODY" flag:"proxy-shadow-max-body" usage:"requests with larger bodies are not mirrored"`
+	ProxyCanaryUpstream          string        `json:"proxy_canary_upstream" env:"PROXY_CANARY_UPSTREAM" flag:"proxy-canary-upstream" usage:"route proxy_canary_percent of proxied clients to this URL instead of proxy_upstream"`
+	ProxyCanaryPercent           float64       `json:"proxy_canary_percent" env:"PROXY_CANARY_PERCENT" flag:"proxy-canary-percent" usage:"percentage of new clients assigned to the canary upstream"`
+	ProxyCanaryCookie            string        `json:"proxy_canary_cookie" env:"PROXY_CANARY_COOKIE" flag:"proxy-canary-cookie" usage:"cookie pinning clients to their canary assignment (empty disables stickiness)"`
+	ProxyCanaryHeader            string        `json:"proxy_canary_header" env:"PROXY_CANARY_HEADER" flag:"proxy-canary-header" usage:"request header that selects stable or canary explicitly"`
+	ProxyGreenUpstream           string        `json:"proxy_green_upstream" env:"PROXY_GREEN_UPSTREAM" flag:"proxy-green-upstream" usage:"green upstream; proxy_upstream becomes blue and /admin/bluegreen switches between them"`
+	BlueGreenRollbackErrorRate   float64       `json:"bluegreen_rollback_error_rate" env:"BLUEGREEN_ROLLBACK_ERROR_RATE" flag:"bluegreen-rollback-error-rate" usage:"5xx share after a blue/green switch that triggers rollback (0 disables)"`
+	BlueGreenRollbackWindow      time.Duration `json:"bluegreen_rollback_window" env:"BLUEGREEN_ROLLBACK_WINDOW" flag:"bluegreen-rollback-window" usage:"how long after a switch errors are watched for rollback"`
+	BlueGreenRollbackMinRequests int           `json:"bluegreen_rollback_min_requests" env:"BLUEGREEN_ROLLBACK_MIN_REQUESTS" flag:"bluegreen-rollback-min-requests" usage:"requests needed after a switch before rollback is considered"`
+	FastCGIRoot                  string        `json:"fastcgi_root" env:"FASTCGI_ROOT" flag:"fastcgi-root" usage:"document root on the FastCGI server for fastcgi://host:port proxy upstreams, such as php-fpm"`
+	FastCGIIndex                 string        `json:"fastcgi_index" env:"FASTCGI_INDEX" flag:"fastcgi-index" usage:"front controller for FastCGI paths that name no script; its extension marks script paths"`
+	FastCGISocket                string        `json:"fastcgi_socket" env:"FASTCGI_SOCKET" flag:"fastcgi-socket" usage:"unix socket dialed for fastcgi:// upstreams instead of their host"`
+	CGIDir                       string        `json:"cgi_dir" env:"CGI_DIR" flag:"cgi-dir" usage:"run executables directly in this directory as CGI scripts under cgi_prefix (disabled when empty)"`
+	CGIPrefix                    string        `json:"cgi_prefix" env:"CGI_PREFIX" flag:"cgi-prefix" usage:"URL prefix of CGI scripts"`
+	CGITimeout                   time.Duration `json:"cgi_timeout" env:"CGI_TIMEOUT" flag:"cgi-timeout" usage:"CGI scripts running longer are killed"`
+	CGIMaxConcurrent             int           `json:"cgi_max_concurrent" env:"CGI_MAX_CONCURRENT" flag:"cgi-max-concurrent" usage:"CGI scripts run at once; further requests get 503"`
+
+	HTTP2MaxConcurrentStreams      int           `json:"http2_max_concurrent_streams" env:"HTTP2_MAX_CONCURRENT_STREAMS" flag:"http2-max-concurrent-streams" usage:"HTTP/2 streams per connection (0 uses the Go default)"`
+	HTTP2MaxReceiveBufferPerConn   int           `json:"http2_max_receive_buffer_per_conn" env:"HTTP2_MAX_RECEIVE_BUFFER_PER_CONN" flag:"http2-max-receive-buffer-per-conn" usage:"HTTP/2 connection flow-control window in bytes"`
+	HTTP2MaxReceiveBufferPerStream int           `json:"http2_max_receive_buffer_per_stream" env:"HTTP2_MAX_RECEIVE_BUFFER_PER_STREAM" flag:"http2-max-receive-buffer-per-stream" usage:"HTTP/2 initial stream flow-control window in bytes"`
+	HTTP2SendPingTimeout           time.Duration `json:"http2_send_ping_timeout" env:"HTTP2_SEND_PING_TIMEOUT" flag:"http2-send-ping-timeout" usage:"send an HTTP/2 health-check ping after this long without frames (0 disables)"`
+	HTTP2PingTimeout               time.Duration `json:"http2_ping_timeout" env:"HTTP2_PING_TIMEOUT" flag:"http2-ping-timeout" usage:"close an HTTP/2 connection whose ping is not answered within this time"`
+}
+
+// Run modes. Debug and fault-injection endpoints only exist outside prod.
+const (
+	ModeProd  = "prod"
+	ModeDev   = "dev"
+	ModeChaos = "chaos"
+)
+
+// envPrefix is prepended to every env tag.
+const envPrefix = "SERVER_"
+
+func DefaultConfig() Config {
+	return Config{
+		HTTPAddr:                     ":8081",
+		HTTPSAddr:                    ":8082",
+		ShutdownTimeout:              shutdownTimeout,
+		Mode:                         ModeProd,
+		TokenRate:                    5,
+		TokenBurst:                   20,
+		ConnReapInterval:             10 * time.Second,
+		IdleTimeout:                  15 * time.Second,
+		StaticPrefix:                 "/static/",
+		TemplateLayout:               "layouts/base.html",
+		I18nDefaultLanguage:          "en",
+		SecurityTxtExpiry:            180 * 24 * time.Hour,
+		WASMPluginTimeout:            100 * time.Millisecond,
+		WASMPluginMaxMemoryMiB:       16,
+		LuaTimeout:                   50 * time.Millisecond,
+		ExtensionTimeout:             200 * time.Millisecond,
+		ExtAuthzTimeout:              200 * time.Millisecond,
+		ExtAuthzCacheTTL:             5 * time.Second,
+		ExtAuthzHeaders:              []string{"Authorization", "Cookie"},
+		ExtAuthzUpstreamHeaders:      []string{"X-Auth-Subject", "X-Auth-Roles"},
+		CacheMaxEntries:              1024,
+		ETagMaxBytes:                 64 << 10,
+		IdempotencyTTL:               24 * time.Hour,
+		IdempotencyMaxBodyBytes:      1 << 20,
+		UploadMaxBytes:               32 << 20,
+		UploadTimeout:                10 * time.Minute,
+		StorageBackend:               StorageFS,
+		S3Region:                     "us-east-1",
+		ProfilingAppName:             "serverConcurrent",
+		ProfilingInterval:            15 * time.Second,
+		TraceSamplePercent:           1,
+		TraceRespectParent:           true,
+		TraceSampleErrors:            true,
+		HARSamplePercent:             1,
+		HARMaxBodyBytes:              64 << 10,
+		WAFMode:                      WAFBlock,
+		BanDuration:                  time.Hour,
+		BanTarpitInterval:            10 * time.Second,
+		BanTarpitMaxDuration:         10 * time.Minute,
+		WebhookPath:                  "/webhooks",
+		WebhookScheme:                WebhookGitHub,
+		WebhookMaxBodyBytes:          1 << 20,
+		WebhookTolerance:             5 * time.Minute,
+		WebhookQueueSize:             1000,
+		WebhookMaxAttempts:           5,
+		JobWorkers:                   4,
+		JobQueueSize:                 1000,
+		JobMaxAttempts:               3,
+		BrokerTopicBuffer:            100,
+		BrokerSubscriberBuffer:       64,
+		DegradedRetryAfter:           5 * time.Second,
+		BulkheadGroups:               []string{"uploads=16/32"},
+		BulkheadRoutes:               []string{"POST /upload=uploads"},
+		BulkheadQueueTimeout:         time.Second,
+		TenantQuotaWindow:            24 * time.Hour,
+		AdmissionMaxQueue:            256,
+		AdmissionQueueTimeout:        2 * time.Second,
+		AdmissionAging:               2 * time.Second,
+		PriorityRoutes:               []string{"GET /readyz=critical"},
+		WAFMaxBodyBytes:              64 << 10,
+		GraphQLPath:                  "/graphql",
+		UserBcryptCost:               bcrypt.DefaultCost,
+		LDAPUserFilter:               "(uid=%s)",
+		LDAPGroupAttribute:           "memberOf",
+		LDAPPoolSize:                 4,
+		LDAPTimeout:                  5 * time.Second,
+		LDAPCacheTTL:                 5 * time.Minute,
+		HARRedactHeaders:             []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"},
+		ClientTimeout:                30 * time.Second,
+		ClientDialTimeout:            5 * time.Second,
+		ClientIdleConnTimeout:        90 * time.Second,
+		ClientMaxIdleConnsPerHost:    32,
+		DNSMinTTL:                    5 * time.Second,
+		DNSMaxTTL:                    5 * time.Minute,
+		DNSNegativeTTL:               5 * time.Second,
+		ProxyHashKey:                 "ip",
+		ProxyPrefix:                  "/proxy/",
+		ProxyShadowMaxBody:           1 << 20,
+		ProxyCanaryCookie:            "canary",
+		ProxyCanaryHeader:            "X-Canary",
+		BlueGreenRollbackErrorRate:   0.05,
+		BlueGreenRollbackWindow:      5 * time.Minute,
+		BlueGreenRollbackMinRequests: 20,
+		FastCGIIndex:                 "index.php",
+		CGIPrefix:                    "/cgi-bin/",
+		CGITimeout:                   30 * time.Second,
+		CGIMaxConcurrent:             8,
+	}
+}
+
+// LoadConfig merges the configuration sources for the given arguments
+// (without the program name) and returns the remaining positional arguments.
+func LoadConfig(args []string) (Config, []string, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("serverConcurrent", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "path to a JSON config file")
+	set := make(map[string]*rawFlag)
+	eachField(&cfg, func(f reflect.StructField, v reflect.Value) {
+		name := f.Tag.Get("flag")
+		set[name] = &rawFlag{isBool: v.Kind() == reflect.Bool}
+		fs.Var(set[name], name, f.Tag.Get("usage"))
+	})
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("reading config: %w", err)
+		}
+		if err := cfg.mergeJSON(data); err != nil {
+			return cfg, nil, fmt.Errorf("parsing config %s: %w", *configPath, err)
+		}
+	}
+
+	var err error
+	eachField(&cfg, func(f reflect.StructField, v reflect.Value) {
+		if err != nil {
+			return
+		}
+		if raw, ok := os.LookupEnv(envPrefix + f.Tag.Get("env")); ok {
+			err = setField(v, raw, envPrefix+f.Tag.Get("env"))
+		}
+	})
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	fs.Visit(func(fl *flag.Flag) {
+		if err != nil || fl.Name == "config" {
+			return
+		}
+		eachField(&cfg, func(f reflect.StructField, v reflect.Value) {
+			if f.Tag.Get("flag") == fl.Name {
+				err = setField(v, set[fl.Name].raw, "-"+fl.Name)
+			}
+		})
+	})
+	if err != nil {
+		return cfg, nil, err
+	}
+	return cfg, fs.Args(), cfg.Validate()
+}
+
+// Validate checks settings that cannot be checked while parsing a single value.
+func (c Config) Validate() error {
+	if _, err := parseThrottleRoutes(c.ThrottleRoutes); err != nil {
+		return err
+	}
+	if _, err := parseTCPOptions(c.TCPOptions); err != nil {
+		return err
+	}
+	if _, err := parseDegradedRoutes(c.DegradedRoutes); err != nil {
+		return err
+	}
+	if _, err := parseMetricRoutes(c.MetricsRouteGroups, c.MetricsExcludeRoutes); err != nil {
+		return err
+	}
+	if c.ProfilingURL != "" {
+		if parsed, err := url.Parse(c.ProfilingURL); err != nil || parsed.Host == "" || parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return fmt.Errorf("invalid profiling_url %q", c.ProfilingURL)
+		}
+		if c.ProfilingInterval <= 0 {
+			return fmt.Errorf("profiling_interval must be positive")
+		}
+	}
+	if _, err := parseProfilingLabels(c.ProfilingLabels); err != nil {
+		return err
+	}
+	if _, err := parseTraceRoutes(c.TraceSampleRoutes); err != nil {
+		return err
+	}
+	if _, err := parseDeadlineRoutes(c.DeadlineRoutes); err != nil {
+		return err
+	}
+	if c.TenantSource != "" {
+		if _, err := parseTenantSource(c.TenantSource, c.TenantAPIKeys, c.TenantJWTSecret); err != nil {
+			return err
+		}
+	}
+	if _, err := parseTenantQuotas(c.TenantQuotas); err != nil {
+		return err
+	}
+	if _, err := parseRateLimits("tenant rate limit", c.TenantRateLimits); err != nil {
+		return err
+	}
+	if c.TenantQuotaWindow <= 0 {
+		return fmt.Errorf("tenant_quota_window must be positive")
+	}
+	if _, err := parsePriorityRoutes(c.PriorityRoutes); err != nil {
+		return err
+	}
+	if _, err := parsePriorityClients(c.PriorityClients); err != nil {
+		return err
+	}
+	if _, err := parseCacheControlRules(c.CacheControlRules); err != nil {
+		return err
+	}
+	if _, err := parseWellKnownDocuments(c.WellKnownDocuments); err != nil {
+		return err
+	}
+	if _, err := parsePluginFiles("WASM plugin", c.WASMPlugins); err != nil {
+		return err
+	}
+	if c.WASMPluginTimeout <= 0 {
+		return fmt.Errorf("wasm_plugin_timeout must be positive")
+	}
+	if c.WASMPluginMaxMemoryMiB <= 0 {
+		return fmt.Errorf("wasm_plugin_max_memory_mib must be positive")
+	}
+	if _, err := parsePluginFiles("Lua script", c.LuaScripts); err != nil {
+		return err
+	}
+	if c.LuaTimeout <= 0 {
+		return fmt.Errorf("lua_timeout must be positive")
+	}
+	if !strings.HasPrefix(c.GraphQLPath, "/") || strings.ContainsAny(c.GraphQLPath, " {}") {
+		return fmt.Errorf("invalid graphql_path %q", c.GraphQLPath)
+	}
+	if c.UserBcryptCost < bcrypt.MinCost || c.UserBcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("user_bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if c.LDAPURL != "" {
+		if !strings.HasPrefix(c.LDAPURL, "ldap://") && !strings.HasPrefix(c.LDAPURL, "ldaps://") {
+			return fmt.Errorf("invalid ldap_url %q: want ldap:// or ldaps://", c.LDAPURL)
+		}
+		if c.LDAPBaseDN == "" {
+			return fmt.Errorf("ldap_url needs ldap_base_dn")
+		}
+		if strings.Count(c.LDAPUserFilter, "%s") != 1 {
+			return fmt.Errorf("ldap_user_filter must contain %%s once")
+		}
+		if c.LDAPPoolSize < 0 || c.LDAPTimeout <= 0 {
+			return fmt.Errorf("ldap_pool_size must not be negative and ldap_timeout must be positive")
+		}
+	}
+	if _, err := parseLDAPGroupRoles(c.LDAPGroupRoles); err != nil {
+		return err
+	}
+	if c.ExtAuthzURL != "" {
+		if _, err := parseExtAuthzURL(c.ExtAuthzURL); err != nil {
+			return err
+		}
+		if c.ExtAuthzTimeout <= 0 {
+			return fmt.Errorf("ext_authz_timeout must be positive")
+		}
+	}
+	if _, err := parsePluginFiles("extension", c.Extensions); err != nil {
+		return err
+	}
+	if c.ExtensionTimeout <= 0 {
+		return fmt.Errorf("extension_timeout must be positive")
+	}
+	groups, err := parseBulkheadGroups(c.BulkheadGroups)
+	if err != nil {
+		return err
+	}
+	if _, err := parseBulkheadRoutes(c.BulkheadRoutes, groups); err != nil {
+		return err
+	}
+	for _, u := range append([]string{c.ProxyShadowUpstream, c.ProxyCanaryUpstream, c.ProxyGreenUpstream}, c.ProxyUpstream...) {
+		if u == "" {
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Host == "" {
+			return fmt.Errorf("invalid proxy upstream %q", u)
+		}
+		if parsed.Scheme == "fastcgi" && c.FastCGIRoot == "" {
+			return fmt.Errorf("FastCGI upstream %q needs fastcgi_root", u)
+		}
+	}
+	for _, addr := range []string{c.HTTPAddr, c.HTTPSAddr, c.AdminAddr} {
+		if addr == c.AdminAddr && addr == "" {
+			continue
+		}
+		if _, err := parseBindAddrs(addr); err != nil {
+			return err
+		}
+	}
+	if _, err := parseDNSOverrides(c.DNSOverrides); err != nil {
+		return err
+	}
+	if _, err := parseRateLimits("geoip rate limit", c.GeoIPRateLimits); err != nil {
+		return err
+	}
+	if c.CGIDir != "" && (c.CGITimeout <= 0 || c.CGIMaxConcurrent <= 0) {
+		return fmt.Errorf("cgi_timeout and cgi_max_concurrent must be positive")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("tls_cert_file and tls_key_file must be set together")
+	}
+	if c.RequestSchemasFile != "" {
+		if _, err := loadRequestSchemas(c.RequestSchemasFile); err != nil {
+			return err
+		}
+	}
+	switch c.PathCanonicalMode {
+	case "", CanonicalRedirect, CanonicalRewrite:
+	default:
+		return fmt.Errorf("unknown path_canonical_mode %q", c.PathCanonicalMode)
+	}
+	switch c.WAFMode {
+	case WAFBlock, WAFLog:
+	default:
+		return fmt.Errorf("unknown waf_mode %q", c.WAFMode)
+	}
+	for _, p := range c.HoneypotPaths {
+		if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, " {}") {
+			return fmt.Errorf("invalid honeypot path %q", p)
+		}
+	}
+	for _, u := range c.WebhookTargets {
+		if parsed, err := url.Parse(u); err != nil || parsed.Host == "" || parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return fmt.Errorf("invalid webhook target %q", u)
+		}
+	}
+	if len(c.WebhookTargets) > 0 && c.WebhookTargetSecret == "" {
+		return fmt.Errorf("webhook_targets require webhook_target_secret")
+	}
+	if c.WebhookQueueSize < 1 || c.WebhookMaxAttempts < 1 {
+		return fmt.Errorf("webhook_queue_size and webhook_max_attempts must be positive")
+	}
+	if c.JobWorkers < 0 || c.JobWorkers > 0 && (c.JobQueueSize < 1 || c.JobMaxAttempts < 1) {
+		return fmt.Errorf("job_workers must not be negative, and job_queue_size and job_max_attempts must be positive")
+	}
+	if c.BrokerPath != "" && (!strings.HasPrefix(c.BrokerPath, "/") || strings.ContainsAny(c.BrokerPath, " {}")) {
+		return fmt.Errorf("invalid broker_path %q", c.BrokerPath)
+	}
+	if c.BrokerTopicBuffer < 0 || c.BrokerSubscriberBuffer < 1 {
+		return fmt.Errorf("broker_topic_buffer must not be negative and broker_subscriber_buffer must be positive")
+	}
+	if c.WebhookSecret != "" {
+		if !strings.HasPrefix(c.WebhookPath, "/") || strings.ContainsAny(c.WebhookPath, " {}") {
+			return fmt.Errorf("invalid webhook_path %q", c.WebhookPath)
+		}
+		switch c.WebhookScheme {
+		case WebhookGitHub, WebhookStripe:
+		default:
+			return fmt.Errorf("unknown webhook_scheme %q", c.WebhookScheme)
+		}
+	}
+	if _, err := parseBotRules(c.BotRules); err != nil {
+		return err
+	}
+	if _, err := parseRateLimits("bot rate limit", c.BotRateLimits); err != nil {
+		return err
+	}
+	if c.GeoIPDB == "" && (len(c.GeoIPBlockCountries) > 0 || len(c.GeoIPRateLimits) > 0) {
+		return fmt.Errorf("geoip_block_countries and geoip_rate_limits require geoip_db")
+	}
+	if kind, name, _ := strings.Cut(c.ProxyHashKey, ":"); !(kind == "ip" || (kind == "cookie" || kind == "header") && name != "") {
+		return fmt.Errorf("invalid proxy_hash_key %q: want ip, cookie:NAME or header:NAME", c.ProxyHashKey)
+	}
+	switch c.TunnelProvider {
+	case "", TunnelCloudflared, TunnelNgrok:
+	default:
+		return fmt.Errorf("unknown tunnel_provider %q", c.TunnelProvider)
+	}
+	switch c.StorageBackend {
+	case StorageFS:
+	case StorageS3:
+		if c.S3Endpoint == "" || c.S3Bucket == "" {
+			return fmt.Errorf("storage_backend s3 requires s3_endpoint and s3_bucket")
+		}
+	default:
+		return fmt.Errorf("unknown storage_backend %q", c.StorageBackend)
+	}
+	return nil
+}
+
+// rawFlag holds a flag's text until the lower-precedence sources have been
+// applied. Boolean fields accept the bare -name form.
+type rawFlag struct {
+	raw    string
+	isBool bool
+}
+
+func (f *rawFlag) String() string     { return f.raw }
+func (f *rawFlag) Set(v string) error { f.raw = v; return nil }
+func (f *rawFlag) IsBoolFlag() bool   { return f.isBool }
+
+// mergeJSON overlays the keys present in data. String values are parsed the
+// same way as env and flag values, so durations can be written as "30s".
+func (c *Config) mergeJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	var err error
+	eachField(c, func(f reflect.StructField, v reflect.Value) {
+		key, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		msg, ok := raw[key]
+		if !ok || err != nil {
+			return
+		}
+		var str string
+		if v.Kind() != reflect.String && json.Unmarshal(msg, &str) == nil {
+			err = setField(v, str, key)
+			return
+		}
+		if uerr := json.Unmarshal(msg, v.Addr().Interface()); uerr != nil {
+			err = fmt.Errorf("%s: %w", key, uerr)
+		}
+	})
+	return err
+}
+
+// Redacted returns the configuration as a map keyed by json name with
+// secret values masked, suitable for exposing on the admin API.
+func (c Config) Redacted() map[string]any {
+	out := make(map[string]any)
+	eachField(&c, func(f reflect.StructField, v reflect.Value) {
+		key, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case f.Tag.Get("secret") == "true" && !v.IsZero():
+			out[key] = "REDACTED"
+		case v.Type() == reflect.TypeOf(time.Duration(0)):
+			out[key] = v.Interface().(time.Duration).String()
+		default:
+			out[key] = v.Interface()
+		}
+	})
+	return out
+}
+
+func eachField(cfg *Config, fn func(reflect.StructField, reflect.Value)) {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		fn(t.Field(i), v.Field(i))
+	}
+}
+
+func setField(v reflect.Value, raw, source string) error {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var parts []string
+		for _, p := range strings.Split(raw, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				parts = append(parts, p)
+			}
+		}
+		v.Set(reflect.ValueOf(parts))
+	default:
+		return fmt.Errorf("%s: unsupported config type %s", source, v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestTimeoutHeader carries a caller's remaining time budget, in
+// milliseconds, or as a Go duration such as "1.5s".
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// parseRequestTimeout reads a budget from an X-Request-Timeout value.
+func parseRequestTimeout(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, ms > 0
+	}
+	d, err := time.ParseDuration(v)
+	return d, err == nil && d > 0
+}
+
+// withDeadline runs next with its context bounded by budget, counting
+// requests that run out of it. An earlier deadline already on the request
+// is left to whoever set it.
+func withDeadline(w http.ResponseWriter, r *http.Request, next http.Handler, budget time.Duration, source string, m *Metrics) {
+	if d, ok := r.Context().Deadline(); ok && time.Until(d) <= budget {
+		next.ServeHTTP(w, r)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), budget)
+	defer cancel()
+	next.ServeHTTP(w, r.WithContext(ctx))
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		m.Add("server_request_deadline_exceeded_total", 1, "source", source)
+	}
+}
+
+// requestTimeout honours a client's X-Request-Timeout, so work done for a
+// caller that has already given up is cancelled. A budget can only shorten
+// the request: the listener's timeouts still apply.
+func requestTimeout(m *Metrics) Middleware {
+	return Middleware{Name: "request-timeout", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			budget, ok := parseRequestTimeout(r.Header.Get(requestTimeoutHeader))
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			withDeadline(w, r, next, budget, "header", m)
+		})
+	}}
+}
+
+// routeDeadline bounds every request on a route by budget. A shorter
+// deadline already on the request, such as one from X-Request-Timeout,
+// still applies.
+func routeDeadline(budget time.Duration, m *Metrics) Middleware {
+	return Middleware{Name: "deadline", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			withDeadline(w, r, next, budget, "route", m)
+		})
+	}}
+}
+
+// parseDeadlineRoutes parses "pattern=duration" entries.
+func parseDeadlineRoutes(entries []string) (map[string]time.Duration, error) {
+	out := make(map[string]time.Duration, len(entries))
+	for _, e := range entries {
+		pattern, raw, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("deadline route %q: expected pattern=duration", e)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("deadline route %q: invalid duration", e)
+		}
+		out[strings.TrimSpace(pattern)] = d
+	}
+	return out, nil
+}
+
+// propagateDeadline sets X-Request-Timeout on an outbound request to what
+// is left of its context's deadline, so upstreams can stop work the caller
+// will not wait for. It returns the request unchanged when there is no
+// deadline, and an error when the budget is already spent.
+func propagateDeadline(req *http.Request) (*http.Request, error) {
+	deadline, ok := req.Context().Deadline()
+	if !ok {
+		return req, nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set(requestTimeoutHeader, strconv.FormatInt(max(remaining.Milliseconds(), 1), 10))
+	return req, nil
+}
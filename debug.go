@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxDebugDelay caps /debug/delay so it cannot pin a connection indefinitely.
+const maxDebugDelay = 2 * time.Minute
+
+// maxEchoBody caps how much of the request body /debug/echo reflects.
+const maxEchoBody = 1 << 20
+
+type echoTLS struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+	Protocol    string `json:"negotiated_protocol,omitempty"`
+	Resumed     bool   `json:"resumed"`
+
+	Fingerprint *TLSFingerprint `json:"fingerprint,omitempty"`
+}
+
+type echoResponse struct {
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	Proto      string              `json:"proto"`
+	Host       string              `json:"host"`
+	RemoteAddr string              `json:"remote_addr"`
+	ClientIP   string              `json:"client_ip"`
+	Country    string              `json:"country,omitempty"`
+	Headers    map[string][]string `json:"headers"`
+	Query      map[string][]string `json:"query"`
+	Body       string              `json:"body,omitempty"`
+	BodyBase64 []byte              `json:"body_base64,omitempty"`
+	Truncated  bool                `json:"body_truncated,omitempty"`
+	TLS        *echoTLS            `json:"tls,omitempty"`
+}
+
+// echoHandler reflects the request back as JSON, for checking what actually
+// arrives after proxies and load balancers have had their way with it.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEchoBody+1))
+	if err != nil {
+		http.Error(w, "reading body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := echoResponse{
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		Proto:      r.Proto,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		ClientIP:   clientIP(r),
+		Headers:    r.Header,
+		Query:      r.URL.Query(),
+	}
+	resp.Country, _ = GeoCountry(r.Context())
+	if len(body) > maxEchoBody {
+		body, resp.Truncated = body[:maxEchoBody], true
+	}
+	if utf8.Valid(body) {
+		resp.Body = string(body)
+	} else {
+		resp.BodyBase64 = body
+	}
+	if cs := r.TLS; cs != nil {
+		resp.TLS = &echoTLS{
+			Version:     tls.VersionName(cs.Version),
+			CipherSuite: tls.CipherSuiteName(cs.CipherSuite),
+			ServerName:  cs.ServerName,
+			Protocol:    cs.NegotiatedProtocol,
+			Resumed:     cs.DidResume,
+		}
+		if fp, ok := ClientTLSFingerprint(r.Context()); ok {
+			resp.TLS.Fingerprint = &fp
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// delayHandler waits for the requested number of milliseconds before
+// answering, or until the client goes away.
+func delayHandler(w http.ResponseWriter, r *http.Request) {
+	ms, err := strconv.Atoi(r.PathValue("ms"))
+	if err != nil || ms < 0 {
+		http.Error(w, "delay must be a non-negative number of milliseconds", http.StatusBadRequest)
+		return
+	}
+	delay := min(time.Duration(ms)*time.Millisecond, maxDebugDelay)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-r.Context().Done():
+		return
+	case <-timer.C:
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"delayed": delay.String()})
+}
+
+// statusHandler answers with the requested status code.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	code, err := strconv.Atoi(r.PathValue("code"))
+	if err != nil || code < 200 || code > 599 {
+		http.Error(w, "status must be between 200 and 599", http.StatusBadRequest)
+		return
+	}
+	if code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	if code != http.StatusNoContent && code != http.StatusNotModified {
+		_, _ = io.WriteString(w, http.StatusText(code))
+	}
+}
+
+// clientIP resolves the address of the client. Forwarding headers are only
+// trusted when the direct peer is a loopback or private address, i.e. a
+// proxy we run ourselves; the rightmost untrusted X-Forwarded-For hop wins.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !isTrustedProxy(peer) {
+		return host
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			if !isTrustedProxy(hop) || i == 0 {
+				return hop.String()
+			}
+		}
+	}
+	if real, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return real.String()
+	}
+	return host
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate()
+}
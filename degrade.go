@@ -0,0 +1,169 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on the last good responses a degraded route keeps.
+const (
+	degradeMaxEntries   = 256
+	degradeMaxBodyBytes = 1 << 20
+)
+
+// DegradeOptions configures the degraded mode middleware.
+type DegradeOptions struct {
+	// Checks names the health checks the routes depend on; the routes are
+	// degraded while any of them fails.
+	Checks []string
+	// RetryAfter is sent with 503 responses; zero means 5s.
+	RetryAfter time.Duration
+	// Stale serves the last successful response to a GET or HEAD while
+	// degraded, marked with a Warning header, before falling back.
+	Stale bool
+	// Fallback answers degraded requests that no stale response covers;
+	// nil means 503 with Retry-After.
+	Fallback http.Handler
+}
+
+// degrader keeps the last good responses of a group of routes and answers
+// for them while a dependency is down, so requests fail fast instead of
+// timing out against it.
+type degrader struct {
+	opts DegradeOptions
+	// checks is resolved on first use, since checks for resources opened
+	// by Run are only registered then.
+	checks func() []*healthCheck
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recent at front
+	entries map[string]*list.Element
+}
+
+// Degrade returns middleware that switches the routes it wraps into
+// degraded mode while any of opts.Checks fails. Health results are read
+// from the checks' cache; an expired result is refreshed in the background,
+// so a request never waits on a check.
+func (s *Server) Degrade(opts DegradeOptions) Middleware {
+	if opts.RetryAfter <= 0 {
+		opts.RetryAfter = 5 * time.Second
+	}
+	d := &degrader{opts: opts, lru: list.New(), entries: make(map[string]*list.Element)}
+	d.checks = sync.OnceValue(func() []*healthCheck {
+		var out []*healthCheck
+		for _, name := range opts.Checks {
+			i := slices.IndexFunc(s.healthChecks, func(hc *healthCheck) bool { return hc.name == name })
+			if i < 0 {
+				slog.Warn("Degraded routes depend on an unknown health check", "check", name)
+				continue
+			}
+			out = append(out, s.healthChecks[i])
+		}
+		return out
+	})
+	return Middleware{Name: "degrade", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cacheable := d.opts.Stale && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+			key := r.Method + " " + r.URL.RequestURI()
+			failing := d.failing()
+			if failing == "" {
+				if !cacheable {
+					next.ServeHTTP(w, r)
+					return
+				}
+				rec := &cacheRecorder{ResponseWriter: w, status: http.StatusOK, limit: degradeMaxBodyBytes}
+				next.ServeHTTP(rec, r)
+				d.store(key, rec)
+				return
+			}
+
+			if cacheable {
+				if e := d.lookup(key); e != nil {
+					s.metrics.Add("server_degraded_requests_total", 1, "check", failing, "result", "stale")
+					for k, v := range e.header {
+						w.Header()[k] = v
+					}
+					w.Header().Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+					w.Header().Set("Warning", `110 - "Response is Stale"`)
+					w.WriteHeader(e.status)
+					_, _ = w.Write(e.body)
+					return
+				}
+			}
+			if d.opts.Fallback != nil {
+				s.metrics.Add("server_degraded_requests_total", 1, "check", failing, "result", "fallback")
+				d.opts.Fallback.ServeHTTP(w, r)
+				return
+			}
+			s.metrics.Add("server_degraded_requests_total", 1, "check", failing, "result", "unavailable")
+			setRetryAfter(w, d.opts.RetryAfter, s.metrics, "degrade", "check", failing)
+			http.Error(w, fmt.Sprintf("temporarily unavailable: %s is failing", failing), http.StatusServiceUnavailable)
+		})
+	}}
+}
+
+// failing returns the name of the first dependency currently failing, or
+// "" when all pass.
+func (d *degrader) failing() string {
+	for _, hc := range d.checks() {
+		if !hc.healthy() {
+			return hc.name
+		}
+	}
+	return ""
+}
+
+func (d *degrader) lookup(key string) *cacheEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	el, ok := d.entries[key]
+	if !ok {
+		return nil
+	}
+	d.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+// store keeps a successful response for serving while degraded. Responses
+// that must not be shared are skipped, as in the response cache.
+func (d *degrader) store(key string, rec *cacheRecorder) {
+	cc := rec.Header().Get("Cache-Control")
+	if rec.overflow || rec.status != http.StatusOK || rec.Header().Get("Set-Cookie") != "" || hasDirective(cc, "no-store") || hasDirective(cc, "private") {
+		return
+	}
+	e := &cacheEntry{key: key, status: rec.status, header: rec.Header().Clone(), body: rec.buf.Bytes(), stored: time.Now()}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if el, ok := d.entries[key]; ok {
+		el.Value = e
+		d.lru.MoveToFront(el)
+	} else {
+		d.entries[key] = d.lru.PushFront(e)
+	}
+	for d.lru.Len() > degradeMaxEntries {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// parseDegradedRoutes parses "pattern=check+check" entries.
+func parseDegradedRoutes(entries []string) (map[string][]string, error) {
+	out := make(map[string][]string, len(entries))
+	for _, e := range entries {
+		pattern, raw, ok := strings.Cut(e, "=")
+		checks := strings.FieldsFunc(raw, func(r rune) bool { return r == '+' || r == ' ' })
+		if !ok || strings.TrimSpace(pattern) == "" || len(checks) == 0 {
+			return nil, fmt.Errorf("degraded route %q: expected pattern=check[+check...]", e)
+		}
+		out[strings.TrimSpace(pattern)] = checks
+	}
+	return out, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/martinsre/serverConcurrent/randutil"
+)
+
+// Delivery retry backoff, doubled after each failed attempt.
+const (
+	webhookInitialBackoff = time.Second
+	webhookMaxBackoff     = time.Minute
+)
+
+// webhookWorkers is how many deliveries are in flight at once, so one slow
+// subscriber does not hold up the others.
+const webhookWorkers = 4
+
+// webhookIDGenerator produces the id field of outgoing payloads.
+var webhookIDGenerator = randutil.MustNew(randutil.Base62)
+
+// webhookPayload is the body POSTed to subscribers. It carries id and type
+// at the top level, as Stripe events do, so receivers can deduplicate
+// retries and verify it with the stripe scheme of WebhookReceiver.
+type webhookPayload struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Created time.Time `json:"created"`
+	Data    Event     `json:"data"`
+}
+
+type webhookJob struct {
+	target *url.URL
+	body   []byte
+}
+
+// WebhookDispatcher delivers the server's events to subscriber URLs. Each
+// payload is signed like Stripe-Signature with the shared secret and
+// retried with backoff until it is accepted or the attempts run out. On
+// shutdown the queue is drained for up to drainTimeout.
+type WebhookDispatcher struct {
+	targets      []*url.URL
+	secret       []byte
+	maxAttempts  int
+	drainTimeout time.Duration
+	client       *http.Client
+	bus          *EventBus
+	metrics      *Metrics
+	queue        chan webhookJob
+}
+
+func newWebhookDispatcher(targets []*url.URL, secret []byte, queueSize, maxAttempts int, drainTimeout time.Duration, client *http.Client, bus *EventBus, m *Metrics) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		targets:      targets,
+		secret:       secret,
+		maxAttempts:  maxAttempts,
+		drainTimeout: drainTimeout,
+		client:       client,
+		bus:          bus,
+		metrics:      m,
+		queue:        make(chan webhookJob, queueSize),
+	}
+}
+
+// enqueue queues e for every target. Events are dropped rather than
+// blocking the publisher when the queue is full.
+func (d *WebhookDispatcher) enqueue(e Event) {
+	id, err := webhookIDGenerator.String(24)
+	if err != nil {
+		slog.Error("Failed to generate webhook ID", "error", err)
+		return
+	}
+	body, err := json.Marshal(webhookPayload{ID: "evt_" + id, Type: e.EventName(), Created: time.Now().UTC(), Data: e})
+	if err != nil {
+		slog.Error("Failed to encode webhook payload", "event", e.EventName(), "error", err)
+		return
+	}
+	for _, target := range d.targets {
+		select {
+		case d.queue <- webhookJob{target: target, body: body}:
+		default:
+			d.metrics.Add("server_webhook_deliveries_total", 1, "target", target.Host, "result", "dropped")
+		}
+	}
+}
+
+// run forwards events from the bus until ctx is cancelled, then finishes
+// the queued deliveries, giving up on those still pending after
+// drainTimeout.
+func (d *WebhookDispatcher) run(ctx context.Context) error {
+	events, unsubscribe := d.bus.Subscribe(cap(d.queue))
+	defer unsubscribe()
+
+	// Deliveries outlive ctx so that the queue can drain.
+	deliverCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	draining := make(chan struct{})
+	var wg sync.WaitGroup
+	for range webhookWorkers {
+		wg.Go(func() { d.work(deliverCtx, draining) })
+	}
+
+forward:
+	for {
+		select {
+		case e := <-events:
+			d.enqueue(e)
+		case <-ctx.Done():
+			break forward
+		}
+	}
+	// Pick up what was published on the way down, such as ShutdownBegan.
+	for len(events) > 0 {
+		d.enqueue(<-events)
+	}
+
+	slog.Info("Draining webhook deliveries", "queued", len(d.queue))
+	close(draining)
+	timer := time.AfterFunc(d.drainTimeout, cancel)
+	defer timer.Stop()
+	wg.Wait()
+	return nil
+}
+
+// work delivers queued jobs; once draining is closed it empties the queue
+// and returns.
+func (d *WebhookDispatcher) work(ctx context.Context, draining <-chan struct{}) {
+	for {
+		select {
+		case job := <-d.queue:
+			d.deliver(ctx, job)
+		case <-draining:
+			for {
+				select {
+				case job := <-d.queue:
+					d.deliver(ctx, job)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver posts job until the target accepts it, answers with an error
+// that retrying will not fix, or the attempts run out.
+func (d *WebhookDispatcher) deliver(ctx context.Context, job webhookJob) {
+	backoff := webhookInitialBackoff
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			d.metrics.Add("server_webhook_deliveries_total", 1, "target", job.target.Host, "result", "abandoned")
+			slog.Warn("Webhook delivery abandoned at shutdown", "target", job.target.Host, "attempts", attempt-1)
+			return
+		}
+		retry, err := d.post(ctx, job)
+		if err == nil {
+			d.metrics.Add("server_webhook_deliveries_total", 1, "target", job.target.Host, "result", "delivered")
+			return
+		}
+		if !retry || attempt >= d.maxAttempts {
+			d.metrics.Add("server_webhook_deliveries_total", 1, "target", job.target.Host, "result", "failed")
+			slog.Warn("Webhook delivery failed", "target", job.target.Host, "attempts", attempt, "error", err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+// post makes one delivery attempt and reports whether a failure is worth
+// retrying. The signature is made afresh each time, as it covers the
+// timestamp that receivers check against their tolerance.
+func (d *WebhookDispatcher) post(ctx context.Context, job webhookJob) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.target.String(), bytes.NewReader(job.body))
+	if err != nil {
+		return false, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", "t="+ts+",v1="+webhookSignature(d.secret, ts+".", job.body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("status %s", resp.Status)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// listenerHandle gives the admin API control over a running listener.
+type listenerHandle struct {
+	name    string
+	addr    string
+	srv     *http.Server
+	ln      net.Listener
+	tracker *activityTracker
+	drained atomic.Bool
+}
+
+// drain stops accepting new connections and waits for in-flight requests to
+// finish. The listener stays registered so the final Shutdown still runs.
+func (h *listenerHandle) drain(ctx context.Context) error {
+	if h.drained.CompareAndSwap(false, true) {
+		h.srv.SetKeepAlivesEnabled(false)
+		if err := h.ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if h.tracker.inFlight() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+type listenerRegistry struct {
+	mu        sync.Mutex
+	listeners map[string]*listenerHandle
+}
+
+func (r *listenerRegistry) add(h *listenerHandle) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.listeners == nil {
+		r.listeners = make(map[string]*listenerHandle)
+	}
+	r.listeners[h.name] = h
+}
+
+func (r *listenerRegistry) remove(h *listenerHandle) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.listeners[h.name] == h {
+		delete(r.listeners, h.name)
+	}
+}
+
+func (r *listenerRegistry) get(name string) (*listenerHandle, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.listeners[name]
+	return h, ok
+}
+
+// names returns every registered listener except the admin listener itself.
+func (r *listenerRegistry) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []string
+	for name := range r.listeners {
+		if name != "admin" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+type drainRequest struct {
+	Listeners []string `json:"listeners"`
+	Timeout   string   `json:"timeout"`
+}
+
+type drainResult struct {
+	Listener string `json:"listener"`
+	Drained  bool   `json:"drained"`
+	InFlight int    `json:"in_flight"`
+	Error    string `json:"error,omitempty"`
+}
+
+// drainHandler serves POST /admin/drain. With an empty body every public
+// listener is drained using the default shutdown timeout.
+func (s *Server) drainHandler(w http.ResponseWriter, r *http.Request) {
+	var req drainRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid drain request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	timeout := s.shutdownTimeout
+	if req.Timeout != "" {
+		d, err := time.ParseDuration(req.Timeout)
+		if err != nil {
+			http.Error(w, "invalid timeout: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+	if len(req.Listeners) == 0 {
+		req.Listeners = s.listeners.names()
+	}
+	for _, name := range req.Listeners {
+		if _, ok := s.listeners.get(name); !ok {
+			valid := s.listeners.names()
+			slices.Sort(valid)
+			http.Error(w, fmt.Sprintf("unknown listener %q; valid listeners: %s", name, strings.Join(valid, ", ")), http.StatusNotFound)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	results := make([]drainResult, len(req.Listeners))
+	var wg sync.WaitGroup
+	for i, name := range req.Listeners {
+		results[i].Listener = name
+		h, ok := s.listeners.get(name)
+		if !ok {
+			// Stopped since it was checked above.
+			results[i].Error = "unknown listener"
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := h.drain(ctx); err != nil {
+				results[i].Error = err.Error()
+			}
+			results[i].InFlight = h.tracker.inFlight()
+			results[i].Drained = results[i].InFlight == 0
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	for _, res := range results {
+		if !res.Drained {
+			status = http.StatusAccepted
+		}
+	}
+	writeJSON(w, status, results)
+}
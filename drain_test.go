@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDrainUnknownListener(t *testing.T) {
+	s := &Server{}
+	known := &listenerHandle{name: ListenerHTTPS}
+	s.listeners.add(known)
+	s.listeners.add(&listenerHandle{name: ListenerHTTP})
+	s.listeners.add(&listenerHandle{name: ListenerAdmin})
+
+	rec := httptest.NewRecorder()
+	body := `{"listeners":["https","htps"]}`
+	s.drainHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/drain", strings.NewReader(body)))
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", rec.Code)
+	}
+	if got := rec.Body.String(); !strings.Contains(got, `"htps"`) || !strings.Contains(got, "valid listeners: http, https") {
+		t.Errorf("body = %q, want the unknown name and the valid ones", got)
+	}
+	if known.drained.Load() {
+		t.Error("a known listener was drained although the request was rejected")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// etag gives GET and HEAD responses of up to maxBytes a strong ETag hashed
+// from the body, and answers a matching If-None-Match with 304, so polling
+// clients only download a response when it changed. The handler still runs
+// on every request; only the transfer is saved. Larger responses, and
+// handlers that flush, are streamed through untouched.
+func etag(maxBytes int, m *Metrics) Middleware {
+	return Middleware{Name: "etag", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			rec := &etagRecorder{ResponseWriter: w, status: http.StatusOK, limit: maxBytes}
+			next.ServeHTTP(rec, r)
+			if rec.passthrough {
+				m.Add("server_etag_responses_total", 1, "result", "skipped")
+				return
+			}
+			rec.finish(r, m)
+		})
+	}}
+}
+
+// etagRecorder holds back the response until it is complete, unless it
+// grows past limit.
+type etagRecorder struct {
+	http.ResponseWriter
+	status      int
+	buf         bytes.Buffer
+	limit       int
+	passthrough bool
+}
+
+func (e *etagRecorder) WriteHeader(status int) {
+	if e.passthrough || status < 200 {
+		e.ResponseWriter.WriteHeader(status)
+		return
+	}
+	e.status = status
+}
+
+func (e *etagRecorder) Write(p []byte) (int, error) {
+	if !e.passthrough && e.buf.Len()+len(p) <= e.limit {
+		return e.buf.Write(p)
+	}
+	if err := e.release(); err != nil {
+		return 0, err
+	}
+	return e.ResponseWriter.Write(p)
+}
+
+// FlushError is called through http.ResponseController; a handler that
+// flushes wants its output sent now, so buffering stops.
+func (e *etagRecorder) FlushError() error {
+	if err := e.release(); err != nil {
+		return err
+	}
+	return http.NewResponseController(e.ResponseWriter).Flush()
+}
+
+func (e *etagRecorder) Flush() {
+	_ = e.FlushError()
+}
+
+// Hijack hands the connection over; nothing is written once it succeeds.
+func (e *etagRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(e.ResponseWriter).Hijack()
+	if err == nil {
+		e.passthrough = true
+	}
+	return conn, rw, err
+}
+
+func (e *etagRecorder) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+// release switches to streaming, writing out what was held back.
+func (e *etagRecorder) release() error {
+	if e.passthrough {
+		return nil
+	}
+	e.passthrough = true
+	e.ResponseWriter.WriteHeader(e.status)
+	_, err := e.ResponseWriter.Write(e.buf.Bytes())
+	e.buf = bytes.Buffer{}
+	return err
+}
+
+// finish writes the buffered response, or 304 if the client's copy is
+// current. A handler's own ETag is kept and compared instead.
+func (e *etagRecorder) finish(r *http.Request, m *Metrics) {
+	h := e.Header()
+	if e.status != http.StatusOK {
+		e.ResponseWriter.WriteHeader(e.status)
+		_, _ = e.ResponseWriter.Write(e.buf.Bytes())
+		return
+	}
+	tag := h.Get("ETag")
+	if tag == "" {
+		sum := sha256.Sum256(e.buf.Bytes())
+		tag = `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+		h.Set("ETag", tag)
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), tag) {
+		m.Add("server_etag_responses_total", 1, "result", "not_modified")
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+		e.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+	m.Add("server_etag_responses_total", 1, "result", "modified")
+	h.Set("Content-Length", strconv.Itoa(e.buf.Len()))
+	e.ResponseWriter.WriteHeader(http.StatusOK)
+	_, _ = e.ResponseWriter.Write(e.buf.Bytes())
+}
+
+// etagMatches applies If-None-Match's weak comparison: tags match when
+// equal apart from a W/ prefix.
+func etagMatches(ifNoneMatch, tag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
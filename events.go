@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Event is a server lifecycle transition published on the EventBus.
+type Event interface {
+	EventName() string
+}
+
+// ListenerStarted is published once a listener is bound and accepting.
+type ListenerStarted struct {
+	Addr string
+	Time time.Time
+}
+
+// ShutdownBegan is published when the server starts draining.
+type ShutdownBegan struct {
+	Reason StopReason
+	Time   time.Time
+}
+
+// TaskFailed is published when a task in the server's group returns an error.
+type TaskFailed struct {
+	Task string
+	Err  error
+	Time time.Time
+}
+
+// CertRenewed is published when a TLS certificate has been replaced.
+type CertRenewed struct {
+	Domain   string
+	NotAfter time.Time
+	Time     time.Time
+}
+
+// TrafficSwitched is published when blue/green traffic moves between
+// colours, either through the admin API or by automatic rollback.
+type TrafficSwitched struct {
+	From     string
+	To       string
+	Rollback bool
+	Time     time.Time
+}
+
+// ClientBanned is published when a client address is banned.
+type ClientBanned struct {
+	Addr   netip.Addr
+	Reason string
+	Until  time.Time
+	Time   time.Time
+}
+
+// MarshalJSON renders Err as its message, which encoding/json would
+// otherwise drop.
+func (e TaskFailed) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Task string
+		Err  string
+		Time time.Time
+	}{e.Task, e.Err.Error(), e.Time})
+}
+
+func (ListenerStarted) EventName() string { return "listener_started" }
+func (ShutdownBegan) EventName() string   { return "shutdown_began" }
+func (TaskFailed) EventName() string      { return "task_failed" }
+func (CertRenewed) EventName() string     { return "cert_renewed" }
+func (TrafficSwitched) EventName() string { return "traffic_switched" }
+func (ClientBanned) EventName() string    { return "client_banned" }
+
+// EventBus fans lifecycle events out to subscribers. Publishing never blocks:
+// a subscriber whose buffer is full misses the event rather than stalling the
+// server.
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[int]chan Event
+	next int
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[int]chan Event)}
+}
+
+// Subscribe returns a channel receiving future events and a function that
+// unsubscribes and closes it.
+func (b *EventBus) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	b.mu.Lock()
+	id := b.next
+	b.next++
+	b.subs[id] = ch
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (b *EventBus) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
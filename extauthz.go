@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// extAuthzMaxBody bounds the denial body relayed from the authorization
+// service.
+const extAuthzMaxBody = 64 << 10
+
+// extAuthzCacheMax is how many decisions are cached before expired ones
+// are swept.
+const extAuthzCacheMax = 10000
+
+// authzDecision is an external authorization service's answer.
+type authzDecision struct {
+	allowed bool
+	// upstream holds headers the service set for an allowed request; those
+	// named in ext_authz_upstream_headers are added to it.
+	upstream http.Header
+	// status, header and body form the response to a denied one.
+	status int
+	header http.Header
+	body   []byte
+}
+
+// authzChecker asks an authorization service about a request. An error
+// means the service could not decide.
+type authzChecker interface {
+	check(ctx context.Context, r *http.Request, forward []string) (*authzDecision, error)
+}
+
+// httpAuthzChecker checks requests like Envoy's HTTP ext_authz: the
+// request's method and path are sent to the service with the forwarded
+// headers, and a 2xx answer allows it. Any other answer below 500 denies
+// it and is relayed to the client.
+type httpAuthzChecker struct {
+	base   *url.URL
+	client *http.Client
+}
+
+func (c *httpAuthzChecker) check(ctx context.Context, r *http.Request, forward []string) (*authzDecision, error) {
+	u := *c.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+	u.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequestWithContext(ctx, r.Method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range forward {
+		if v := r.Header.Values(k); len(v) > 0 {
+			req.Header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	req.Header.Set("X-Forwarded-For", clientIP(r))
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("authorization service returned %s", resp.Status)
+	}
+	if resp.StatusCode < 300 && resp.StatusCode >= 200 {
+		return &authzDecision{allowed: true, upstream: resp.Header}, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, extAuthzMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	header := resp.Header.Clone()
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+	header.Del("Connection")
+	return &authzDecision{status: resp.StatusCode, header: header, body: body}, nil
+}
+
+// extAuthz consults an authorization service before each request, caching
+// its decisions briefly.
+type extAuthz struct {
+	checker  authzChecker
+	forward  []string
+	upstream []string
+	ttl      time.Duration
+	timeout  time.Duration
+	failOpen bool
+	metrics  *Metrics
+
+	mu    sync.Mutex
+	cache map[string]extAuthzEntry
+}
+
+type extAuthzEntry struct {
+	decision *authzDecision
+	expires  time.Time
+}
+
+// cacheKey identifies requests the service would decide alike: same
+// method, path and forwarded headers.
+func (a *extAuthz) cacheKey(r *http.Request) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", r.Method, r.URL.RequestURI())
+	for _, k := range a.forward {
+		fmt.Fprintf(h, "%s\x00%s\x00", k, strings.Join(r.Header.Values(k), "\x01"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (a *extAuthz) cached(key string, now time.Time) *authzDecision {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e, ok := a.cache[key]; ok && now.Before(e.expires) {
+		return e.decision
+	}
+	return nil
+}
+
+func (a *extAuthz) store(key string, d *authzDecision, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.cache) >= extAuthzCacheMax {
+		for k, e := range a.cache {
+			if !now.Before(e.expires) {
+				delete(a.cache, k)
+			}
+		}
+		if len(a.cache) >= extAuthzCacheMax {
+			clear(a.cache)
+		}
+	}
+	a.cache[key] = extAuthzEntry{decision: d, expires: now.Add(a.ttl)}
+}
+
+// decide returns the cached or fresh decision for r.
+func (a *extAuthz) decide(r *http.Request) (*authzDecision, error) {
+	now := time.Now()
+	var key string
+	if a.ttl > 0 {
+		key = a.cacheKey(r)
+		if d := a.cached(key, now); d != nil {
+			a.metrics.Add("server_ext_authz_cache_hits_total", 1)
+			return d, nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.timeout)
+	defer cancel()
+	start := time.Now()
+	d, err := a.checker.check(ctx, r, a.forward)
+	a.metrics.Observe("server_ext_authz_check_seconds", time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	if a.ttl > 0 {
+		a.store(key, d, now)
+	}
+	return d, nil
+}
+
+// middleware allows, denies or, when the service cannot decide, applies
+// the failure policy to each request. Upstream headers sent by the client
+// are always dropped, so only the service can set them. An allowed request
+// whose answer names a subject is authenticated as it.
+func (a *extAuthz) middleware() Middleware {
+	return Middleware{Name: "ext-authz", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = r.Clone(r.Context())
+			for _, k := range a.upstream {
+				r.Header.Del(k)
+			}
+			d, err := a.decide(r)
+			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					return
+				}
+				slog.Warn("External authorization failed", "error", err, "fail_open", a.failOpen)
+				if !a.failOpen {
+					a.metrics.Add("server_ext_authz_decisions_total", 1, "result", "error")
+					http.Error(w, "authorization unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				a.metrics.Add("server_ext_authz_decisions_total", 1, "result", "fail_open")
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !d.allowed {
+				a.metrics.Add("server_ext_authz_decisions_total", 1, "result", "denied")
+				for k, v := range d.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(d.status)
+				_, _ = w.Write(d.body)
+				return
+			}
+			a.metrics.Add("server_ext_authz_decisions_total", 1, "result", "allowed")
+			for _, k := range a.upstream {
+				if v := d.upstream.Values(k); len(v) > 0 {
+					r.Header[http.CanonicalHeaderKey(k)] = v
+				}
+			}
+			if subject := d.upstream.Get(identitySubjectHeader); subject != "" {
+				r = r.WithContext(WithIdentity(r.Context(), &Identity{
+					Subject: subject,
+					Roles:   splitRoles(d.upstream.Get(identityRolesHeader)),
+					Source:  "ext_authz",
+				}))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// parseExtAuthzURL parses an http(s):// or grpc:// service URL.
+func parseExtAuthzURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ext_authz_url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "grpc":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid ext_authz_url %q: missing host", raw)
+		}
+		return u, nil
+	}
+	return nil, fmt.Errorf("invalid ext_authz_url %q: want http, https or grpc", raw)
+}
+
+// brokenAuthzChecker stands in for a service that could not be set up, so
+// the failure policy still applies rather than authorization being skipped.
+type brokenAuthzChecker struct {
+	err error
+}
+
+func (b brokenAuthzChecker) check(context.Context, *http.Request, []string) (*authzDecision, error) {
+	return nil, b.err
+}
+
+// newExtAuthz builds the ext_authz middleware from the configuration.
+func (s *Server) newExtAuthz() *extAuthz {
+	var checker authzChecker
+	u, err := parseExtAuthzURL(s.config.ExtAuthzURL)
+	switch {
+	case err != nil:
+	case u.Scheme == "grpc":
+		checker, err = newGRPCAuthzChecker(u.Host)
+	default:
+		checker = &httpAuthzChecker{base: u, client: s.client}
+	}
+	if err != nil {
+		slog.Error("External authorization unavailable", "error", err, "fail_open", s.config.ExtAuthzFailOpen)
+		checker = brokenAuthzChecker{err: err}
+	}
+	return &extAuthz{
+		checker:  checker,
+		forward:  s.config.ExtAuthzHeaders,
+		upstream: s.config.ExtAuthzUpstreamHeaders,
+		ttl:      s.config.ExtAuthzCacheTTL,
+		timeout:  s.config.ExtAuthzTimeout,
+		failOpen: s.config.ExtAuthzFailOpen,
+		metrics:  s.metrics,
+		cache:    make(map[string]extAuthzEntry),
+	}
+}
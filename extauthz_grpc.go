@@ -0,0 +1,51 @@
+//go:build grpc
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// grpcAuthzChecker asks a service implementing the extension Authorize
+// method, so one service can back both.
+type grpcAuthzChecker struct {
+	cc *grpc.ClientConn
+}
+
+func newGRPCAuthzChecker(target string) (authzChecker, error) {
+	cc, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcAuthzChecker{cc: cc}, nil
+}
+
+func (c *grpcAuthzChecker) check(ctx context.Context, r *http.Request, forward []string) (*authzDecision, error) {
+	req := newPluginRequest(r)
+	req.Header = make(map[string][]string, len(forward))
+	for _, k := range forward {
+		if v := r.Header.Values(k); len(v) > 0 {
+			req.Header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	var d PluginDecision
+	if err := invokeStruct(ctx, c.cc, extensionService+"Authorize", req, &d); err != nil {
+		return nil, err
+	}
+	if d.Status != 0 {
+		header := make(http.Header, len(d.ResponseHeader))
+		for k, v := range d.ResponseHeader {
+			header.Set(k, v)
+		}
+		return &authzDecision{status: d.Status, header: header, body: []byte(d.Body)}, nil
+	}
+	upstream := make(http.Header, len(d.SetHeader))
+	for k, v := range d.SetHeader {
+		upstream.Set(k, v)
+	}
+	return &authzDecision{allowed: true, upstream: upstream}, nil
+}
@@ -0,0 +1,9 @@
+//go:build !grpc
+
+package main
+
+import "errors"
+
+func newGRPCAuthzChecker(target string) (authzChecker, error) {
+	return nil, errors.New("gRPC ext_authz requires building with -tags grpc")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// extensionService is the gRPC service extensions serve. Its Authorize and
+// Enrich methods take and return a google.protobuf.Struct holding the JSON
+// form of PluginRequest and PluginDecision, so extensions can be written in
+// any language without generated code beyond the well-known types. An
+// extension leaves a method Unimplemented to skip that hook.
+const extensionService = "/serverconcurrent.extension.v1.Extension/"
+
+// errExtensionUnsupported reports that an extension does not serve a hook.
+var errExtensionUnsupported = errors.New("extension does not serve this hook")
+
+// extensionConn is a running extension process. authorize decides whether
+// a request may proceed, answering it when the decision has a status;
+// enrich returns headers to add. Either returns errExtensionUnsupported
+// when the plugin does not serve it.
+type extensionConn interface {
+	authorize(ctx context.Context, req *PluginRequest) (*PluginDecision, error)
+	enrich(ctx context.Context, req *PluginRequest) (*PluginDecision, error)
+	// exited is closed when the process dies.
+	exited() <-chan struct{}
+	kill()
+}
+
+// extension runs an out-of-process plugin under the server's supervisor,
+// which restarts it when it crashes. Authorization fails closed while it is
+// down; enrichment is skipped.
+type extension struct {
+	name    string
+	path    string
+	timeout time.Duration
+	metrics *Metrics
+
+	conn atomic.Pointer[extensionConn]
+}
+
+// run starts the process and waits for it to exit or for shutdown.
+func (e *extension) run(ctx context.Context) error {
+	conn, err := startExtension(e.name, e.path)
+	if err != nil {
+		return err
+	}
+	defer conn.kill()
+	e.conn.Store(&conn)
+	defer e.conn.Store(nil)
+	slog.Info("Extension started", "extension", e.name)
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-conn.exited():
+		e.metrics.Add("server_extension_exits_total", 1, "extension", e.name)
+		return errors.New("extension process exited")
+	}
+}
+
+// call runs a hook with the extension's timeout. It returns nil when the
+// extension does not serve the hook.
+func (e *extension) call(ctx context.Context, hook string, fn func(extensionConn, context.Context) (*PluginDecision, error)) (*PluginDecision, error) {
+	conn := e.conn.Load()
+	if conn == nil {
+		return nil, errors.New("extension not running")
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	start := time.Now()
+	d, err := fn(*conn, ctx)
+	if errors.Is(err, errExtensionUnsupported) {
+		return nil, nil
+	}
+	e.metrics.Observe("server_extension_call_seconds", time.Since(start).Seconds(), "extension", e.name, "hook", hook)
+	if err != nil {
+		e.metrics.Add("server_extension_errors_total", 1, "extension", e.name, "hook", hook)
+		return nil, err
+	}
+	return d, nil
+}
+
+// middleware asks the extension to authorize each request, then to enrich
+// it with headers.
+func (e *extension) middleware() Middleware {
+	return Middleware{Name: "extension:" + e.name, Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req := newPluginRequest(r)
+			d, err := e.call(r.Context(), "authorize", func(c extensionConn, ctx context.Context) (*PluginDecision, error) {
+				return c.authorize(ctx, &req)
+			})
+			if err != nil {
+				slog.Warn("Extension authorization failed", "extension", e.name, "error", err)
+				http.Error(w, "authorization unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if d != nil {
+				if r = d.apply(w, r); r == nil {
+					return
+				}
+			}
+			d, err = e.call(r.Context(), "enrich", func(c extensionConn, ctx context.Context) (*PluginDecision, error) {
+				return c.enrich(ctx, &req)
+			})
+			if err != nil {
+				slog.Warn("Extension enrichment failed", "extension", e.name, "error", err)
+			} else if d != nil {
+				// Enrichment only adds to the request; it cannot answer it.
+				d.Status = 0
+				r = d.apply(w, r)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// loadExtensions starts the configured extension processes and runs them,
+// in order, as listener middleware.
+func (s *Server) loadExtensions() {
+	files, err := parsePluginFiles("extension", s.config.Extensions)
+	if err != nil {
+		slog.Warn("Ignoring invalid extensions", "error", err)
+		return
+	}
+	for _, f := range files {
+		e := &extension{name: f[0], path: f[1], timeout: s.config.ExtensionTimeout, metrics: s.metrics}
+		s.Use(e.middleware())
+		s.Supervise("extension-"+e.name, RestartPolicy{Mode: RestartAlways}, e.run)
+	}
+}
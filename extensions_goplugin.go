@@ -0,0 +1,102 @@
+//go:build goplugin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// extensionHandshake must match the extension's. The cookie only keeps
+// extensions from being started by hand; it is not a security measure.
+var extensionHandshake = plugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "SERVER_EXTENSION",
+	MagicCookieValue: "serverconcurrent",
+}
+
+// extensionExitPoll is how often extension processes are checked for exit.
+const extensionExitPoll = time.Second
+
+// grpcExtensionPlugin hands out the client connection to the extension.
+type grpcExtensionPlugin struct {
+	plugin.NetRPCUnsupportedPlugin
+}
+
+func (grpcExtensionPlugin) GRPCServer(*plugin.GRPCBroker, *grpc.Server) error {
+	return errors.New("extensions are served by the plugin process")
+}
+
+func (grpcExtensionPlugin) GRPCClient(ctx context.Context, _ *plugin.GRPCBroker, cc *grpc.ClientConn) (any, error) {
+	return cc, nil
+}
+
+type goPluginConn struct {
+	client *plugin.Client
+	cc     *grpc.ClientConn
+	done   chan struct{}
+}
+
+func startExtension(name, path string) (extensionConn, error) {
+	client := plugin.NewClient(&plugin.ClientConfig{
+		HandshakeConfig:  extensionHandshake,
+		Plugins:          plugin.PluginSet{"extension": grpcExtensionPlugin{}},
+		Cmd:              exec.Command(path),
+		AllowedProtocols: []plugin.Protocol{plugin.ProtocolGRPC},
+		Logger:           hclog.New(&hclog.LoggerOptions{Name: "extension." + name, Output: os.Stderr, Level: hclog.Info}),
+	})
+	rpc, err := client.Client()
+	if err != nil {
+		client.Kill()
+		return nil, err
+	}
+	raw, err := rpc.Dispense("extension")
+	if err != nil {
+		client.Kill()
+		return nil, err
+	}
+	c := &goPluginConn{client: client, cc: raw.(*grpc.ClientConn), done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		for !client.Exited() {
+			time.Sleep(extensionExitPoll)
+		}
+	}()
+	return c, nil
+}
+
+func (c *goPluginConn) authorize(ctx context.Context, req *PluginRequest) (*PluginDecision, error) {
+	return c.invoke(ctx, "Authorize", req)
+}
+
+func (c *goPluginConn) enrich(ctx context.Context, req *PluginRequest) (*PluginDecision, error) {
+	return c.invoke(ctx, "Enrich", req)
+}
+
+func (c *goPluginConn) invoke(ctx context.Context, method string, req *PluginRequest) (*PluginDecision, error) {
+	var d PluginDecision
+	if err := invokeStruct(ctx, c.cc, extensionService+method, req, &d); err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			return nil, errExtensionUnsupported
+		}
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (c *goPluginConn) exited() <-chan struct{} {
+	return c.done
+}
+
+func (c *goPluginConn) kill() {
+	c.client.Kill()
+}
@@ -0,0 +1,9 @@
+//go:build !goplugin
+
+package main
+
+import "errors"
+
+func startExtension(name, path string) (extensionConn, error) {
+	return nil, errors.New("extensions require building with -tags goplugin")
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FastCGI record types and the responder role, from the FastCGI 1.0
+// specification.
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+	fcgiMaxContent   = 65535
+)
+
+// fcgiMaxBufferedBody bounds request bodies of unknown length, which are
+// read in full because FastCGI needs CONTENT_LENGTH up front.
+const fcgiMaxBufferedBody = 32 << 20
+
+// FastCGIOptions configures requests to fastcgi:// upstreams, such as
+// php-fpm.
+type FastCGIOptions struct {
+	// Root is the document root on the FastCGI server; SCRIPT_FILENAME is
+	// the script name under it.
+	Root string
+	// Index is the front controller run for paths that name no script.
+	// Paths with a segment ending in its extension name a script, with
+	// the rest of the path as PATH_INFO.
+	Index string
+	// Socket, when set, is a unix socket dialed instead of the upstream's
+	// host.
+	Socket string
+}
+
+// fastCGITransport sends requests to a FastCGI responder over a fresh
+// connection each, decoding its CGI response. It is registered on the
+// shared transport for the fastcgi scheme, so fastcgi://host:port works as
+// any proxy upstream.
+type fastCGITransport struct {
+	opts FastCGIOptions
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// script splits a request path into the script name and path info.
+func (t *fastCGITransport) script(p string) (string, string) {
+	p = path.Clean("/" + p)
+	if ext := path.Ext(t.opts.Index); ext != "" {
+		for i := 0; i < len(p); {
+			j := strings.IndexByte(p[i+1:], '/')
+			end := len(p)
+			if j >= 0 {
+				end = i + 1 + j
+			}
+			if strings.HasSuffix(p[i:end], ext) {
+				return p[:end], p[end:]
+			}
+			i = end
+		}
+	}
+	return "/" + strings.TrimPrefix(t.opts.Index, "/"), p
+}
+
+func (t *fastCGITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := []byte(nil)
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, fcgiMaxBufferedBody+1))
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > fcgiMaxBufferedBody {
+			return nil, errors.New("fastcgi: request body too large")
+		}
+	}
+
+	network, addr := "tcp", req.URL.Host
+	if t.opts.Socket != "" {
+		network, addr = "unix", t.opts.Socket
+	} else if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "9000")
+	}
+	conn, err := t.dial(req.Context(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(req.Context(), func() { _ = conn.Close() })
+	fail := func(err error) (*http.Response, error) {
+		stop()
+		_ = conn.Close()
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+
+	scriptName, pathInfo := t.script(req.URL.Path)
+	env := cgiEnv(req, scriptName, pathInfo, path.Join(t.opts.Root, scriptName))
+	env["DOCUMENT_ROOT"] = t.opts.Root
+	delete(env, "CONTENT_LENGTH")
+	if len(body) > 0 {
+		env["CONTENT_LENGTH"] = strconv.Itoa(len(body))
+	}
+
+	w := bufio.NewWriter(conn)
+	begin := [8]byte{0, fcgiResponder, 0}
+	writeFCGIRecord(w, fcgiBeginRequest, begin[:])
+	var params bytes.Buffer
+	for k, v := range env {
+		writeFCGILength(&params, len(k))
+		writeFCGILength(&params, len(v))
+		params.WriteString(k)
+		params.WriteString(v)
+	}
+	writeFCGIStream(w, fcgiParams, params.Bytes())
+	writeFCGIStream(w, fcgiStdin, body)
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+
+	stdout := &fcgiReader{br: bufio.NewReader(conn), upstream: addr}
+	br := bufio.NewReader(stdout)
+	status, header, err := readCGIResponse(br)
+	if err != nil {
+		return fail(err)
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body: &fcgiBody{Reader: br, close: func() error {
+			stop()
+			return conn.Close()
+		}},
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+// writeFCGIRecord appends one record with content to w; errors surface on
+// Flush.
+func writeFCGIRecord(w *bufio.Writer, typ byte, content []byte) {
+	pad := -len(content) & 7
+	hdr := [8]byte{fcgiVersion, typ, 0, 1, 0, 0, byte(pad), 0}
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(content)))
+	_, _ = w.Write(hdr[:])
+	_, _ = w.Write(content)
+	_, _ = w.Write(make([]byte, pad))
+}
+
+// writeFCGIStream writes data as a stream of records, ended by an empty
+// one.
+func writeFCGIStream(w *bufio.Writer, typ byte, data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), fcgiMaxContent)
+		writeFCGIRecord(w, typ, data[:n])
+		data = data[n:]
+	}
+	writeFCGIRecord(w, typ, nil)
+}
+
+// writeFCGILength encodes a name-value pair length: one byte below 128,
+// four with the top bit set otherwise.
+func writeFCGILength(b *bytes.Buffer, n int) {
+	if n < 128 {
+		b.WriteByte(byte(n))
+		return
+	}
+	_ = binary.Write(b, binary.BigEndian, uint32(n)|1<<31)
+}
+
+// fcgiReader reads the stdout stream of a response, logging stderr, until
+// the end-request record.
+type fcgiReader struct {
+	br       *bufio.Reader
+	upstream string
+	left     int // unread stdout bytes in the current record
+	pad      int
+	done     bool
+}
+
+func (f *fcgiReader) Read(p []byte) (int, error) {
+	for f.left == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		if _, err := f.br.Discard(f.pad); err != nil {
+			return 0, err
+		}
+		var hdr [8]byte
+		if _, err := io.ReadFull(f.br, hdr[:]); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n, pad := int(binary.BigEndian.Uint16(hdr[4:])), int(hdr[6])
+		switch hdr[1] {
+		case fcgiStdout:
+			f.left, f.pad = n, pad
+		case fcgiStderr:
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(f.br, msg); err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+			f.pad = pad
+			_, _ = cgiStderr{script: f.upstream}.Write(msg)
+		case fcgiEndRequest:
+			f.done = true
+			f.pad = 0
+		default:
+			if _, err := f.br.Discard(n + pad); err != nil {
+				return 0, err
+			}
+			f.pad = 0
+		}
+	}
+	n, err := f.br.Read(p[:min(len(p), f.left)])
+	f.left -= n
+	return n, err
+}
+
+// fcgiBody closes the connection once, when the proxy is done with it.
+type fcgiBody struct {
+	io.Reader
+	once  sync.Once
+	close func() error
+	err   error
+}
+
+func (b *fcgiBody) Close() error {
+	b.once.Do(func() { b.err = b.close() })
+	return b.err
+}
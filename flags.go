@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flagEnvPrefix marks environment variables that override feature flags,
+// e.g. SERVER_FEATURE_NEW_TOKENS=true enables "new_tokens".
+const flagEnvPrefix = envPrefix + "FEATURE_"
+
+// flagReloadInterval is how often the flags file is checked for changes.
+const flagReloadInterval = 5 * time.Second
+
+// FeatureFlags is a hot-reloadable set of boolean flags. File values are
+// overridden by environment variables, which are overridden by values set at
+// runtime through the admin API.
+type FeatureFlags struct {
+	path string
+
+	mu        sync.RWMutex
+	file      map[string]bool
+	overrides map[string]bool
+	modTime   time.Time
+}
+
+func NewFeatureFlags(path string) *FeatureFlags {
+	return &FeatureFlags{path: path, file: make(map[string]bool), overrides: make(map[string]bool)}
+}
+
+// Load reads the flags file (a JSON object of name to bool) and the environment.
+func (f *FeatureFlags) Load() error {
+	flags := make(map[string]bool)
+	var modTime time.Time
+	if f.path != "" {
+		info, err := os.Stat(f.path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			data, err := os.ReadFile(f.path)
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(data, &flags); err != nil {
+				return err
+			}
+			modTime = info.ModTime()
+		}
+	}
+
+	for _, kv := range os.Environ() {
+		key, val, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(key, flagEnvPrefix)
+		if !ok {
+			continue
+		}
+		if on, err := strconv.ParseBool(val); err == nil {
+			flags[strings.ToLower(name)] = on
+		}
+	}
+
+	f.mu.Lock()
+	f.file = flags
+	f.modTime = modTime
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *FeatureFlags) Enabled(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if on, ok := f.overrides[name]; ok {
+		return on
+	}
+	return f.file[name]
+}
+
+// Set overrides a flag until the process restarts.
+func (f *FeatureFlags) Set(name string, on bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.overrides[name] = on
+}
+
+// All returns the effective value of every known flag.
+func (f *FeatureFlags) All() map[string]bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	out := maps.Clone(f.file)
+	maps.Copy(out, f.overrides)
+	return out
+}
+
+// watch reloads the flags file whenever its modification time changes.
+func (f *FeatureFlags) watch(ctx context.Context) error {
+	ticker := time.NewTicker(flagReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(f.path)
+		if err != nil {
+			continue
+		}
+		f.mu.RLock()
+		changed := !info.ModTime().Equal(f.modTime)
+		f.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := f.Load(); err != nil {
+			slog.Warn("Failed to reload feature flags", "path", f.path, "error", err)
+			continue
+		}
+		slog.Info("Reloaded feature flags", "path", f.path)
+	}
+}
+
+type flagsKey struct{}
+
+// Middleware makes the flags available to handlers through FlagEnabled.
+func (f *FeatureFlags) Middleware() Middleware {
+	return Middleware{Name: "feature-flags", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), flagsKey{}, f)))
+		})
+	}}
+}
+
+// FlagEnabled reports whether the named flag is on for the request context.
+func FlagEnabled(ctx context.Context, name string) bool {
+	f, ok := ctx.Value(flagsKey{}).(*FeatureFlags)
+	return ok && f.Enabled(name)
+}
+
+func (s *Server) flagsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.flags.All())
+}
+
+// setFlagHandler serves PUT /admin/flags/{name} with a body of {"enabled": bool}.
+func (s *Server) setFlagHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+		http.Error(w, `expected {"enabled": true|false}`, http.StatusBadRequest)
+		return
+	}
+	name := r.PathValue("name")
+	s.flags.Set(name, *body.Enabled)
+	slog.Info("Feature flag changed", "flag", name, "enabled", *body.Enabled)
+	writeJSON(w, http.StatusOK, map[string]bool{name: *body.Enabled})
+}
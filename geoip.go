@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// geoIPReloadInterval is how often the database file is checked for changes,
+// so databases refreshed by geoipupdate are picked up without a restart.
+const geoIPReloadInterval = time.Minute
+
+// GeoIP looks up the country of client addresses in a MaxMind DB (.mmdb)
+// file such as GeoLite2-Country or GeoIP2-City.
+type GeoIP struct {
+	path string
+
+	db      atomic.Pointer[mmdb]
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// NewGeoIP returns a GeoIP for the database at path. Nothing is read until
+// Load is called.
+func NewGeoIP(path string) *GeoIP {
+	return &GeoIP{path: path}
+}
+
+// Load (re)reads the database file.
+func (g *GeoIP) Load() error {
+	info, err := os.Stat(g.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(g.path)
+	if err != nil {
+		return err
+	}
+	db, err := parseMMDB(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", g.path, err)
+	}
+	g.db.Store(db)
+	g.mu.Lock()
+	g.modTime = info.ModTime()
+	g.mu.Unlock()
+	return nil
+}
+
+// watch reloads the database when the file changes.
+func (g *GeoIP) watch(ctx context.Context) error {
+	ticker := time.NewTicker(geoIPReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(g.path)
+		if err != nil {
+			continue
+		}
+		g.mu.Lock()
+		changed := !info.ModTime().Equal(g.modTime)
+		g.mu.Unlock()
+		if !changed {
+			continue
+		}
+		if err := g.Load(); err != nil {
+			slog.Warn("Failed to reload GeoIP database", "path", g.path, "error", err)
+			continue
+		}
+		slog.Info("Reloaded GeoIP database", "path", g.path)
+	}
+}
+
+// Country returns the ISO 3166-1 alpha-2 code for addr, or "" if the
+// database has no country for it. The registered country is used for
+// addresses without a located one, such as anycast ranges.
+func (g *GeoIP) Country(addr netip.Addr) string {
+	db := g.db.Load()
+	if db == nil {
+		return ""
+	}
+	off, ok := db.lookup(addr)
+	if !ok {
+		return ""
+	}
+	for _, field := range []string{"country", "registered_country"} {
+		if v, ok := db.valueAt(off, field, "iso_code").(string); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+type geoCountryKey struct{}
+
+// GeoCountry returns the client country recorded by the GeoIP middleware.
+func GeoCountry(ctx context.Context) (string, bool) {
+	c, ok := ctx.Value(geoCountryKey{}).(string)
+	return c, ok
+}
+
+// GeoOptions configures country-based access control.
+type GeoOptions struct {
+	// Block rejects clients from these countries with 403.
+	Block []string
+	// RateLimits limits each client IP from a country to its rate.
+	RateLimits map[string]RateLimit
+}
+
+// geoUnknown labels clients the database has no country for.
+const geoUnknown = "unknown"
+
+// geoIP tags each request with the client's country, counts requests per
+// country and applies opts. Clients with no known country are labelled
+// "unknown", which may also be listed in opts.
+func geoIP(g *GeoIP, opts GeoOptions, m *Metrics) Middleware {
+	blocked := make(map[string]bool)
+	for _, c := range opts.Block {
+		blocked[normalizeCountry(c)] = true
+	}
+	limiters := make(map[string]*rateLimiter)
+	for c, l := range opts.RateLimits {
+		limiters[normalizeCountry(c)] = newRateLimiter(l.Rate, max(l.Burst, 1))
+	}
+
+	return Middleware{Name: "geoip", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+			country := geoUnknown
+			if addr, err := netip.ParseAddr(ip); err == nil {
+				if c := g.Country(addr); c != "" {
+					country = c
+				}
+			}
+			m.Add("server_requests_by_country_total", 1, "country", country)
+
+			if blocked[country] {
+				m.Add("server_geoip_rejected_total", 1, "country", country, "reason", "blocked")
+				slog.Debug("Blocked request by country", "client", ip, "country", country, "path", r.URL.Path)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			if l := limiters[country]; l != nil {
+				if ok, wait := l.allow(ip); !ok {
+					m.Add("server_geoip_rejected_total", 1, "country", country, "reason", "rate_limited")
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+					http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+					return
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), geoCountryKey{}, country)))
+		})
+	}}
+}
+
+func normalizeCountry(c string) string {
+	c = strings.TrimSpace(c)
+	if strings.EqualFold(c, geoUnknown) {
+		return geoUnknown
+	}
+	return strings.ToUpper(c)
+}
+
+// mmdb is a parsed MaxMind DB file: a binary search tree over address bits
+// whose leaves point into a data section of typed, self-describing values.
+// See https://maxmind.github.io/MaxMind-DB/.
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // node reached after the 96 zero bits of ::/96
+}
+
+var (
+	mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+	errMMDBCorrupt     = errors.New("mmdb: corrupt database")
+)
+
+// MaxMind DB data types.
+const (
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+// mmdbMaxDepth bounds nesting and pointer chains in corrupt files.
+const mmdbMaxDepth = 32
+
+func parseMMDB(b []byte) (*mmdb, error) {
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("mmdb: metadata not found")
+	}
+	v, _, err := mmdbDecode(b[i+len(mmdbMetadataMarker):], 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, errMMDBCorrupt
+	}
+	uintField := func(name string) uint {
+		n, _ := meta[name].(uint64)
+		return uint(n)
+	}
+	db := &mmdb{
+		nodeCount:  uintField("node_count"),
+		recordSize: uintField("record_size"),
+		ipVersion:  uintField("ip_version"),
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", db.recordSize)
+	}
+	if db.nodeCount > uint(i) {
+		return nil, errMMDBCorrupt // would overflow the tree size
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errMMDBCorrupt
+	}
+	db.tree = b[:treeSize]
+	db.data = b[treeSize+16 : i]
+	if db.ipVersion == 6 {
+		for n := 0; n < 96 && db.ipv4Start < db.nodeCount; n++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *mmdb) record(node, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		p := db.tree[node*6+bit*3:]
+		return uint(p[0])<<16 | uint(p[1])<<8 | uint(p[2])
+	case 28:
+		p := db.tree[node*7:]
+		if bit == 0 {
+			return uint(p[3]&0xf0)<<20 | uint(p[0])<<16 | uint(p[1])<<8 | uint(p[2])
+		}
+		return uint(p[3]&0x0f)<<24 | uint(p[4])<<16 | uint(p[5])<<8 | uint(p[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[node*8+bit*4:]))
+	}
+}
+
+// lookup walks the tree for addr and returns the data section offset of its
+// record.
+func (db *mmdb) lookup(addr netip.Addr) (int, bool) {
+	addr = addr.Unmap()
+	node := uint(0)
+	if addr.Is4() && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if addr.Is6() && db.ipVersion == 4 {
+		return 0, false
+	}
+	ip := addr.AsSlice()
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(ip[i/8]>>(7-i%8)&1))
+	}
+	if node <= db.nodeCount {
+		return 0, false // no data, or the tree is deeper than the address
+	}
+	off := int(node-db.nodeCount) - 16
+	return off, off >= 0 && off < len(db.data)
+}
+
+// valueAt decodes the value found by following the map keys in path from
+// the record at off, or returns nil. Values off the path are skipped
+// rather than decoded, which keeps per-request lookups allocation-light.
+func (db *mmdb) valueAt(off int, path ...string) any {
+	for depth := 0; depth < mmdbMaxDepth; depth++ {
+		typ, size, next, err := mmdbCtrl(db.data, off)
+		if err != nil {
+			return nil
+		}
+		if typ == mmdbPointer {
+			off = size
+			continue
+		}
+		if len(path) == 0 {
+			v, _, err := mmdbDecode(db.data, off, 0)
+			if err != nil {
+				return nil
+			}
+			return v
+		}
+		if typ != mmdbMap {
+			return nil
+		}
+		off = next
+		found := false
+		for range size {
+			key, err := mmdbKey(db.data, off)
+			if err != nil {
+				return nil
+			}
+			if off, err = mmdbSkip(db.data, off, 0); err != nil {
+				return nil
+			}
+			if key == path[0] {
+				found = true
+				break
+			}
+			if off, err = mmdbSkip(db.data, off, 0); err != nil {
+				return nil
+			}
+		}
+		if !found {
+			return nil
+		}
+		path = path[1:]
+	}
+	return nil
+}
+
+// mmdbCtrl reads the control byte(s) at off and returns the field's type,
+// its size and the offset of its payload. For pointers, size is the target
+// offset and next the offset just past the pointer.
+func mmdbCtrl(d []byte, off int) (typ, size, next int, err error) {
+	if off < 0 || off >= len(d) {
+		return 0, 0, 0, errMMDBCorrupt
+	}
+	ctrl := d[off]
+	off++
+	typ = int(ctrl >> 5)
+	if typ == mmdbPointer {
+		ss := int(ctrl>>3) & 3
+		if off+ss+1 > len(d) {
+			return 0, 0, 0, errMMDBCorrupt
+		}
+		p := 0
+		if ss < 3 {
+			p = int(ctrl & 7)
+		}
+		for _, c := range d[off : off+ss+1] {
+			p = p<<8 | int(c)
+		}
+		p += [...]int{0, 2048, 526336, 0}[ss]
+		return typ, p, off + ss + 1, nil
+	}
+	if typ == 0 {
+		if off >= len(d) {
+			return 0, 0, 0, errMMDBCorrupt
+		}
+		typ = 7 + int(d[off])
+		off++
+	}
+	size = int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > len(d) {
+			return 0, 0, 0, errMMDBCorrupt
+		}
+		v := 0
+		for _, c := range d[off : off+n] {
+			v = v<<8 | int(c)
+		}
+		size = [...]int{29, 285, 65821}[n-1] + v
+		off += n
+	}
+	return typ, size, off, nil
+}
+
+// mmdbKey returns the map key at off, following a pointer if needed.
+func mmdbKey(d []byte, off int) (string, error) {
+	typ, size, next, err := mmdbCtrl(d, off)
+	if err != nil {
+		return "", err
+	}
+	if typ == mmdbPointer {
+		if typ, size, next, err = mmdbCtrl(d, size); err != nil {
+			return "", err
+		}
+	}
+	if typ != mmdbString || next+size > len(d) {
+		return "", errMMDBCorrupt
+	}
+	return string(d[next : next+size]), nil
+}
+
+// mmdbSkip returns the offset just past the value at off.
+func mmdbSkip(d []byte, off, depth int) (int, error) {
+	if depth > mmdbMaxDepth {
+		return 0, errMMDBCorrupt
+	}
+	typ, size, next, err := mmdbCtrl(d, off)
+	if err != nil {
+		return 0, err
+	}
+	switch typ {
+	case mmdbPointer, mmdbBool:
+		return next, nil
+	case mmdbMap, mmdbArray:
+		n := size
+		if typ == mmdbMap {
+			n *= 2
+		}
+		for range n {
+			if next, err = mmdbSkip(d, next, depth+1); err != nil {
+				return 0, err
+			}
+		}
+		return next, nil
+	default:
+		if next+size > len(d) {
+			return 0, errMMDBCorrupt
+		}
+		return next + size, nil
+	}
+}
+
+// mmdbDecode decodes the value at off into Go values: strings, uint64 for
+// unsigned types, int64, float64, bool, []byte, []any and map[string]any.
+// uint128 values are returned as their big-endian bytes.
+func mmdbDecode(d []byte, off, depth int) (any, int, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errMMDBCorrupt
+	}
+	typ, size, next, err := mmdbCtrl(d, off)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case mmdbPointer:
+		v, _, err := mmdbDecode(d, size, depth+1)
+		return v, next, err
+	case mmdbMap:
+		// Every entry takes at least two bytes and every array element
+		// one, so larger counts are corrupt rather than worth allocating.
+		if size > (len(d)-next)/2 {
+			return nil, 0, errMMDBCorrupt
+		}
+		m := make(map[string]any, size)
+		for range size {
+			key, err := mmdbKey(d, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			if next, err = mmdbSkip(d, next, depth+1); err != nil {
+				return nil, 0, err
+			}
+			if m[key], next, err = mmdbDecode(d, next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, next, nil
+	case mmdbArray:
+		if size > len(d)-next {
+			return nil, 0, errMMDBCorrupt
+		}
+		a := make([]any, size)
+		for i := range a {
+			if a[i], next, err = mmdbDecode(d, next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, next, nil
+	case mmdbBool:
+		return size != 0, next, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, 0, errMMDBCorrupt
+	}
+
+	if next+size > len(d) {
+		return nil, 0, errMMDBCorrupt
+	}
+	p := d[next : next+size]
+	next += size
+	switch typ {
+	case mmdbString:
+		return string(p), next, nil
+	case mmdbBytes, mmdbUint128:
+		return bytes.Clone(p), next, nil
+	case mmdbDouble, mmdbFloat:
+		switch {
+		case typ == mmdbDouble && size == 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(p)), next, nil
+		case typ == mmdbFloat && size == 4:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(p))), next, nil
+		}
+		return nil, 0, errMMDBCorrupt
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		var v uint64
+		for _, c := range p {
+			v = v<<8 | uint64(c)
+		}
+		return v, next, nil
+	case mmdbInt32:
+		var v uint32
+		for _, c := range p {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), next, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unknown type %d", typ)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/netip"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// mmdbPtr encodes as a pointer to a data section offset.
+type mmdbPtr int
+
+// mmdbEncode encodes v in the MaxMind DB data format. It supports the types
+// mmdbDecode produces, sizes below 285 and pointers below 2048.
+func mmdbEncode(v any) []byte {
+	ctrl := func(typ, size int) []byte {
+		var b []byte
+		if typ < 8 {
+			b = []byte{byte(typ << 5)}
+		} else {
+			b = []byte{0, byte(typ - 7)}
+		}
+		if size < 29 {
+			b[0] |= byte(size)
+		} else {
+			b[0] |= 29
+			b = append(b, byte(size-29))
+		}
+		return b
+	}
+	switch v := v.(type) {
+	case mmdbPtr:
+		return []byte{0x20 | byte(v>>8), byte(v)}
+	case string:
+		return append(ctrl(mmdbString, len(v)), v...)
+	case []byte:
+		return append(ctrl(mmdbBytes, len(v)), v...)
+	case uint64:
+		p := binary.BigEndian.AppendUint64(nil, v)
+		p = bytes.TrimLeft(p, "\x00")
+		return append(ctrl(mmdbUint64, len(p)), p...)
+	case int64:
+		return binary.BigEndian.AppendUint32(ctrl(mmdbInt32, 4), uint32(int32(v)))
+	case float64:
+		return binary.BigEndian.AppendUint64(ctrl(mmdbDouble, 8), math.Float64bits(v))
+	case bool:
+		if v {
+			return ctrl(mmdbBool, 1)
+		}
+		return ctrl(mmdbBool, 0)
+	case []any:
+		b := ctrl(mmdbArray, len(v))
+		for _, e := range v {
+			b = append(b, mmdbEncode(e)...)
+		}
+		return b
+	case map[string]any:
+		b := ctrl(mmdbMap, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			b = append(b, mmdbEncode(k)...)
+			b = append(b, mmdbEncode(v[k])...)
+		}
+		return b
+	}
+	panic("mmdbEncode: unsupported type")
+}
+
+// buildMMDB returns an IPv4 database with 24-bit records mapping each
+// prefix to an offset in data.
+func buildMMDB(data []byte, records map[string]int) []byte {
+	const empty, leaf = -1, -2 // leaf-i refers to data offset i
+	nodes := [][2]int{{empty, empty}}
+	for prefix, off := range records {
+		p := netip.MustParsePrefix(prefix)
+		ip := p.Addr().AsSlice()
+		node := 0
+		for i := range p.Bits() {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == p.Bits()-1 {
+				nodes[node][bit] = leaf - off
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var b []byte
+	for _, n := range nodes {
+		for _, r := range n {
+			v := r
+			switch {
+			case r == empty:
+				v = len(nodes)
+			case r <= leaf:
+				v = len(nodes) + 16 + leaf - r
+			}
+			b = append(b, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	b = append(b, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, mmdbMetadataMarker...)
+	return append(b, mmdbEncode(map[string]any{
+		"node_count":  uint64(len(nodes)),
+		"record_size": uint64(24),
+		"ip_version":  uint64(4),
+	})...)
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	// The JP record is shared through a pointer, as MaxMind's writer does.
+	data := mmdbEncode(map[string]any{"iso_code": "JP"})
+	us := len(data)
+	data = append(data, mmdbEncode(map[string]any{
+		"city":    map[string]any{"names": map[string]any{"en": "Springfield"}},
+		"country": map[string]any{"geoname_id": uint64(6252001), "iso_code": "US"},
+	})...)
+	anycast := len(data)
+	data = append(data, mmdbEncode(map[string]any{"registered_country": mmdbPtr(0)})...)
+
+	db, err := parseMMDB(buildMMDB(data, map[string]int{
+		"203.0.113.0/24":  us,
+		"198.51.100.0/25": anycast,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGeoIP("")
+	g.db.Store(db)
+
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"203.0.113.7", "US"},
+		{"::ffff:203.0.113.7", "US"},
+		{"198.51.100.1", "JP"},
+		{"198.51.100.200", ""},
+		{"192.0.2.1", ""},
+		{"2001:db8::1", ""},
+	}
+	for _, tt := range tests {
+		if got := g.Country(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Country(%s) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+	if got := NewGeoIP("").Country(netip.MustParseAddr("203.0.113.7")); got != "" {
+		t.Errorf("Country without a database = %q", got)
+	}
+}
+
+func TestMMDBDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		d    []byte
+		want any // nil for an error
+	}{
+		{"string", mmdbEncode("héllo"), "héllo"},
+		{"long string", mmdbEncode(string(bytes.Repeat([]byte("x"), 100))), string(bytes.Repeat([]byte("x"), 100))},
+		{"uint16", []byte{0xa2, 0x01, 0x02}, uint64(0x0102)},
+		{"uint64", mmdbEncode(uint64(1 << 40)), uint64(1 << 40)},
+		{"int32", mmdbEncode(int64(-5)), int64(-5)},
+		{"double", mmdbEncode(2.5), 2.5},
+		{"float", []byte{0x04, 0x08, 0x3f, 0xc0, 0, 0}, 1.5},
+		{"bool", mmdbEncode(true), true},
+		{"bytes", mmdbEncode([]byte{1, 2}), []byte{1, 2}},
+		{"array", mmdbEncode([]any{"a", uint64(1)}), []any{"a", uint64(1)}},
+		{"map", mmdbEncode(map[string]any{"a": map[string]any{"b": false}}), map[string]any{"a": map[string]any{"b": false}}},
+		{"pointer", append(mmdbEncode(mmdbPtr(2)), mmdbEncode("x")...), "x"},
+
+		{"empty", nil, nil},
+		{"truncated string", mmdbEncode("hello")[:3], nil},
+		{"truncated size", []byte{0x5d}, nil},
+		{"truncated extended type", []byte{0x01}, nil},
+		{"pointer loop", mmdbEncode(mmdbPtr(0)), nil},
+		{"pointer out of range", mmdbEncode(mmdbPtr(100)), nil},
+		{"double of 4 bytes", []byte{0x64, 0, 0, 0, 0}, nil},
+		{"container", []byte{0x00, 0x05}, nil},
+		{"unknown type", []byte{0x00, 0x20}, nil},
+		{"non-string key", []byte{0xe1, 0xa1, 0x01, 0x41, 'x'}, nil},
+		{"oversized array", []byte{0x1e, 0x04, 0xff, 0xff}, nil},
+		{"oversized map", []byte{0xfe, 0xff, 0xff}, nil},
+	}
+	for _, tt := range tests {
+		v, next, err := mmdbDecode(tt.d, 0, 0)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: decoded %#v, want an error", tt.name, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, tt.want) {
+			t.Errorf("%s: decoded %#v, want %#v", tt.name, v, tt.want)
+		}
+		if tt.name != "pointer" && next != len(tt.d) {
+			t.Errorf("%s: next = %d, want %d", tt.name, next, len(tt.d))
+		}
+	}
+}
+
+func TestParseMMDBErrors(t *testing.T) {
+	meta := func(m map[string]any) []byte {
+		return append(append(make([]byte, 64), mmdbMetadataMarker...), mmdbEncode(m)...)
+	}
+	tests := map[string][]byte{
+		"no metadata":        make([]byte, 64),
+		"metadata not a map": append(append([]byte(nil), mmdbMetadataMarker...), mmdbEncode("x")...),
+		"record size":        meta(map[string]any{"node_count": uint64(1), "record_size": uint64(20), "ip_version": uint64(4)}),
+		"tree past metadata": meta(map[string]any{"node_count": uint64(20), "record_size": uint64(24), "ip_version": uint64(4)}),
+		"overflowing size":   meta(map[string]any{"node_count": uint64(1 << 62), "record_size": uint64(32), "ip_version": uint64(4)}),
+		"truncated metadata": append(append([]byte(nil), mmdbMetadataMarker...), 0xe3),
+	}
+	for name, b := range tests {
+		if _, err := parseMMDB(b); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+func FuzzParseMMDB(f *testing.F) {
+	data := mmdbEncode(map[string]any{"country": map[string]any{"iso_code": "US"}})
+	f.Add(buildMMDB(data, map[string]int{"203.0.113.0/24": 0, "10.0.0.0/8": 0}))
+	f.Add(buildMMDB(append(mmdbEncode(mmdbPtr(2)), data...), map[string]int{"0.0.0.0/1": 0}))
+	addrs := []netip.Addr{
+		netip.MustParseAddr("203.0.113.7"),
+		netip.MustParseAddr("10.1.2.3"),
+		netip.MustParseAddr("2001:db8::1"),
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		db, err := parseMMDB(b)
+		if err != nil {
+			return
+		}
+		g := NewGeoIP("")
+		g.db.Store(db)
+		for _, a := range addrs {
+			g.Country(a)
+		}
+	})
+}
+
+func FuzzMMDBDecode(f *testing.F) {
+	f.Add(mmdbEncode(map[string]any{"a": []any{"b", uint64(7), 1.5, true}}))
+	f.Add(append(mmdbEncode(mmdbPtr(2)), mmdbEncode("x")...))
+	f.Add([]byte{0x1e, 0x04, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, d []byte) {
+		if _, next, err := mmdbDecode(d, 0, 0); err == nil && next > len(d) {
+			t.Fatalf("next = %d past %d bytes", next, len(d))
+		}
+		if next, err := mmdbSkip(d, 0, 0); err == nil && next > len(d) {
+			t.Fatalf("skip to %d past %d bytes", next, len(d))
+		}
+	})
+}
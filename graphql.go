@@ -0,0 +1,130 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// graphqlMaxBody bounds a GraphQL request body.
+const graphqlMaxBody = 1 << 20
+
+// GraphQLRequest is a GraphQL operation as sent over HTTP.
+type GraphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName,omitempty"`
+	Variables     map[string]any `json:"variables,omitempty"`
+}
+
+// GraphQLLocation points into the query text.
+type GraphQLLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// GraphQLError is an entry of a response's errors.
+type GraphQLError struct {
+	Message   string            `json:"message"`
+	Locations []GraphQLLocation `json:"locations,omitempty"`
+	Path      []any             `json:"path,omitempty"`
+}
+
+// GraphQLResponse is the result of executing an operation.
+type GraphQLResponse struct {
+	Data   any            `json:"data,omitempty"`
+	Errors []GraphQLError `json:"errors,omitempty"`
+}
+
+// GraphQLExecutor executes operations against a schema. Resolvers get the
+// request context, with its identity and tenant.
+type GraphQLExecutor interface {
+	Execute(ctx context.Context, req GraphQLRequest) *GraphQLResponse
+}
+
+// WithGraphQL serves exec at graphql_path on the HTTP and HTTPS listeners,
+// behind the same middleware as every other route.
+func WithGraphQL(exec GraphQLExecutor) Option {
+	return func(s *Server) { s.graphql = exec }
+}
+
+// graphqlHandler serves GraphQL over HTTP: queries as GET parameters, and
+// operations as POSTed JSON or application/graphql bodies. Outside prod a
+// browser GET without a query gets the GraphiQL playground.
+func (s *Server) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var req GraphQLRequest
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if req.Query == "" && s.config.Mode != ModeProd && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = io.WriteString(w, graphiQLPage)
+			return
+		}
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "invalid variables", http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		body := http.MaxBytesReader(w, r.Body, graphqlMaxBody)
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/graphql") {
+			raw, err := io.ReadAll(body)
+			if err != nil {
+				http.Error(w, "reading request body", http.StatusBadRequest)
+				return
+			}
+			req.Query = string(raw)
+		} else if err := json.NewDecoder(body).Decode(&req); err != nil {
+			http.Error(w, "invalid GraphQL request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Query == "" {
+		http.Error(w, "missing query", http.StatusBadRequest)
+		return
+	}
+	// GET must not change state, and browsers send it cross-site freely.
+	if r.Method == http.MethodGet && strings.HasPrefix(strings.TrimSpace(req.Query), "mutation") {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "mutations must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	start := time.Now()
+	resp := s.graphql.Execute(r.Context(), req)
+	op := cmp.Or(req.OperationName, "anonymous")
+	result := "ok"
+	if len(resp.Errors) > 0 {
+		result = "error"
+	}
+	s.metrics.Add("server_graphql_operations_total", 1, "operation", op, "result", result)
+	s.metrics.Observe("server_graphql_operation_seconds", time.Since(start).Seconds(), "operation", op)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// graphiQLPage loads GraphiQL from a CDN; it is only served outside prod.
+const graphiQLPage = `<!doctype html>
+<html>
+<head>
+<title>GraphiQL</title>
+<link rel="stylesheet" href="https://unpkg.com/graphiql@3/graphiql.min.css">
+<style>body{margin:0;height:100vh}#graphiql{height:100vh}</style>
+</head>
+<body>
+<div id="graphiql"></div>
+<script src="https://unpkg.com/react@18/umd/react.production.min.js"></script>
+<script src="https://unpkg.com/react-dom@18/umd/react-dom.production.min.js"></script>
+<script src="https://unpkg.com/graphiql@3/graphiql.min.js"></script>
+<script>
+const fetcher = GraphiQL.createFetcher({url: location.pathname});
+ReactDOM.createRoot(document.getElementById('graphiql')).render(React.createElement(GraphiQL, {fetcher}));
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,38 @@
+//go:build graphql
+
+package main
+
+import (
+	"context"
+
+	"github.com/graphql-go/graphql"
+)
+
+// graphqlGoExecutor executes operations with graphql-go.
+type graphqlGoExecutor struct {
+	schema graphql.Schema
+}
+
+// NewGraphQLExecutor adapts a graphql-go schema for WithGraphQL.
+func NewGraphQLExecutor(schema graphql.Schema) GraphQLExecutor {
+	return graphqlGoExecutor{schema: schema}
+}
+
+func (e graphqlGoExecutor) Execute(ctx context.Context, req GraphQLRequest) *GraphQLResponse {
+	res := graphql.Do(graphql.Params{
+		Schema:         e.schema,
+		RequestString:  req.Query,
+		OperationName:  req.OperationName,
+		VariableValues: req.Variables,
+		Context:        ctx,
+	})
+	out := &GraphQLResponse{Data: res.Data}
+	for _, err := range res.Errors {
+		gerr := GraphQLError{Message: err.Message, Path: err.Path}
+		for _, loc := range err.Locations {
+			gerr.Locations = append(gerr.Locations, GraphQLLocation{Line: loc.Line, Column: loc.Column})
+		}
+		out.Errors = append(out.Errors, gerr)
+	}
+	return out
+}
@@ -0,0 +1,344 @@
+//go:build grpc
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// grpcGatewayMaxBody bounds a transcoded request body.
+const grpcGatewayMaxBody = 4 << 20
+
+// RegisterGRPCGateway exposes the methods of a gRPC service that carry
+// google.api.http annotations as JSON endpoints on the HTTP and HTTPS
+// listeners, grpc-gateway style. Calls go to impl in-process, through the
+// same middleware as every other route. desc is the generated ServiceDesc,
+// such as pb.Greeter_ServiceDesc, and impl its implementation. Path
+// templates may use {field}, {field=*} and a trailing {field=**}; methods
+// with other templates are skipped with a warning. It must be called
+// before Run.
+func (s *Server) RegisterGRPCGateway(desc *grpc.ServiceDesc, impl any) error {
+	d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(desc.ServiceName))
+	if err != nil {
+		return fmt.Errorf("grpc gateway: %w", err)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return fmt.Errorf("grpc gateway: %s is not a service", desc.ServiceName)
+	}
+	for _, m := range desc.Methods {
+		md := sd.Methods().ByName(protoreflect.Name(m.MethodName))
+		if md == nil {
+			continue
+		}
+		rule, _ := proto.GetExtension(md.Options(), annotations.E_Http).(*annotations.HttpRule)
+		if rule == nil {
+			continue
+		}
+		for _, r := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+			if err := s.registerGatewayRule(impl, m, r); err != nil {
+				slog.Warn("Not transcoding gRPC method", "method", desc.ServiceName+"/"+m.MethodName, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) registerGatewayRule(impl any, m grpc.MethodDesc, rule *annotations.HttpRule) error {
+	var method, tmpl string
+	switch {
+	case rule.GetGet() != "":
+		method, tmpl = http.MethodGet, rule.GetGet()
+	case rule.GetPost() != "":
+		method, tmpl = http.MethodPost, rule.GetPost()
+	case rule.GetPut() != "":
+		method, tmpl = http.MethodPut, rule.GetPut()
+	case rule.GetDelete() != "":
+		method, tmpl = http.MethodDelete, rule.GetDelete()
+	case rule.GetPatch() != "":
+		method, tmpl = http.MethodPatch, rule.GetPatch()
+	case rule.GetCustom() != nil:
+		method, tmpl = strings.ToUpper(rule.GetCustom().GetKind()), rule.GetCustom().GetPath()
+	default:
+		return fmt.Errorf("http rule has no pattern")
+	}
+	pattern, params, err := gatewayPattern(tmpl)
+	if err != nil {
+		return err
+	}
+	h := &gatewayHandler{impl: impl, method: m, params: params, body: rule.GetBody(), responseBody: rule.GetResponseBody()}
+	for _, listener := range []string{ListenerHTTP, ListenerHTTPS} {
+		s.Handle(listener, method+" "+pattern, h)
+	}
+	return nil
+}
+
+// gatewayPattern converts an http rule path template into a ServeMux
+// pattern, returning the field path each wildcard binds.
+func gatewayPattern(tmpl string) (string, map[string]string, error) {
+	var b strings.Builder
+	params := make(map[string]string)
+	rest := tmpl
+	for {
+		i := strings.IndexByte(rest, '{')
+		if i < 0 {
+			b.WriteString(rest)
+			break
+		}
+		b.WriteString(rest[:i])
+		j := strings.IndexByte(rest[i:], '}')
+		if j < 0 {
+			return "", nil, fmt.Errorf("unterminated variable in %q", tmpl)
+		}
+		field, sub, _ := strings.Cut(rest[i+1:i+j], "=")
+		rest = rest[i+j+1:]
+		if rest != "" && rest[0] != '/' {
+			return "", nil, fmt.Errorf("variable not a whole segment in %q", tmpl)
+		}
+		name := strings.ReplaceAll(field, ".", "_")
+		switch sub {
+		case "", "*":
+			b.WriteString("{" + name + "}")
+		case "**":
+			if rest != "" {
+				return "", nil, fmt.Errorf("** not last in %q", tmpl)
+			}
+			b.WriteString("{" + name + "...}")
+		default:
+			return "", nil, fmt.Errorf("unsupported variable {%s=%s} in %q", field, sub, tmpl)
+		}
+		params[name] = field
+	}
+	if strings.Contains(b.String(), ":") {
+		return "", nil, fmt.Errorf("custom verbs are not supported in %q", tmpl)
+	}
+	return b.String(), params, nil
+}
+
+// gatewayHandler serves one transcoded method.
+type gatewayHandler struct {
+	impl         any
+	method       grpc.MethodDesc
+	params       map[string]string // wildcard name to field path
+	body         string
+	responseBody string
+}
+
+func (h *gatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	if h.body != "" {
+		var err error
+		if body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, grpcGatewayMaxBody)); err != nil {
+			writeGatewayError(w, status.Error(codes.InvalidArgument, "reading request body"))
+			return
+		}
+	}
+	dec := func(v any) error {
+		msg, ok := v.(proto.Message)
+		if !ok {
+			return status.Error(codes.Internal, "request is not a protobuf message")
+		}
+		if err := h.fill(msg.ProtoReflect(), r, body); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil
+	}
+
+	md := metadata.MD{}
+	for k, v := range r.Header {
+		md[strings.ToLower(k)] = v
+	}
+	ctx := metadata.NewIncomingContext(r.Context(), md)
+	resp, err := h.method.Handler(h.impl, ctx, dec, nil)
+	if err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+	out, ok := resp.(proto.Message)
+	if !ok {
+		writeGatewayError(w, status.Error(codes.Internal, "response is not a protobuf message"))
+		return
+	}
+	if h.responseBody != "" {
+		m := out.ProtoReflect()
+		fd := gatewayField(m.Descriptor(), h.responseBody)
+		if fd == nil || fd.Message() == nil || fd.IsList() || fd.IsMap() {
+			writeGatewayError(w, status.Errorf(codes.Internal, "response_body %q is not a message field", h.responseBody))
+			return
+		}
+		out = m.Get(fd).Message().Interface()
+	}
+	raw, err := protojson.Marshal(out)
+	if err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(raw)
+}
+
+// fill sets the request message from the body, then the query string when
+// the body does not carry the whole message, then the path.
+func (h *gatewayHandler) fill(msg protoreflect.Message, r *http.Request, body []byte) error {
+	switch h.body {
+	case "":
+	case "*":
+		if len(body) > 0 {
+			if err := protojson.Unmarshal(body, msg.Interface()); err != nil {
+				return err
+			}
+		}
+	default:
+		fd := gatewayField(msg.Descriptor(), h.body)
+		if fd == nil || fd.Message() == nil || fd.IsList() || fd.IsMap() {
+			return fmt.Errorf("body field %q is not a message", h.body)
+		}
+		if err := protojson.Unmarshal(body, msg.Mutable(fd).Message().Interface()); err != nil {
+			return err
+		}
+	}
+	if h.body != "*" {
+		for k, values := range r.URL.Query() {
+			if err := setGatewayField(msg, k, values); err != nil {
+				return err
+			}
+		}
+	}
+	for name, field := range h.params {
+		if err := setGatewayField(msg, field, []string{r.PathValue(name)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gatewayField finds a field by proto or JSON name.
+func gatewayField(md protoreflect.MessageDescriptor, name string) protoreflect.FieldDescriptor {
+	if fd := md.Fields().ByName(protoreflect.Name(name)); fd != nil {
+		return fd
+	}
+	return md.Fields().ByJSONName(name)
+}
+
+// setGatewayField sets the scalar field at a dotted path from string
+// values, appending them all to a repeated field.
+func setGatewayField(msg protoreflect.Message, path string, values []string) error {
+	parts := strings.Split(path, ".")
+	for _, name := range parts[:len(parts)-1] {
+		fd := gatewayField(msg.Descriptor(), name)
+		if fd == nil || fd.Message() == nil || fd.IsList() || fd.IsMap() {
+			return fmt.Errorf("unknown field %q", path)
+		}
+		msg = msg.Mutable(fd).Message()
+	}
+	fd := gatewayField(msg.Descriptor(), parts[len(parts)-1])
+	if fd == nil || fd.IsMap() || fd.Message() != nil {
+		return fmt.Errorf("cannot set field %q from a string", path)
+	}
+	if fd.IsList() {
+		list := msg.Mutable(fd).List()
+		for _, s := range values {
+			v, err := parseGatewayScalar(fd, s)
+			if err != nil {
+				return fmt.Errorf("field %q: %w", path, err)
+			}
+			list.Append(v)
+		}
+		return nil
+	}
+	v, err := parseGatewayScalar(fd, values[len(values)-1])
+	if err != nil {
+		return fmt.Errorf("field %q: %w", path, err)
+	}
+	msg.Set(fd, v)
+	return nil
+}
+
+func parseGatewayScalar(fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BytesKind:
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			b, err = base64.URLEncoding.DecodeString(s)
+		}
+		return protoreflect.ValueOfBytes(b), err
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(s)
+		return protoreflect.ValueOfBool(b), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		n, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfInt32(int32(n)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		n, err := strconv.ParseInt(s, 10, 64)
+		return protoreflect.ValueOfInt64(n), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		n, err := strconv.ParseUint(s, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(n)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		n, err := strconv.ParseUint(s, 10, 64)
+		return protoreflect.ValueOfUint64(n), err
+	case protoreflect.FloatKind:
+		f, err := strconv.ParseFloat(s, 32)
+		return protoreflect.ValueOfFloat32(float32(f)), err
+	case protoreflect.DoubleKind:
+		f, err := strconv.ParseFloat(s, 64)
+		return protoreflect.ValueOfFloat64(f), err
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		n, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(n)), err
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported kind %s", fd.Kind())
+}
+
+// gatewayStatus maps gRPC codes to HTTP statuses as grpc-gateway does.
+var gatewayStatus = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+// writeGatewayError answers with the HTTP status for err's gRPC code and a
+// {"code", "message"} body.
+func writeGatewayError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	code, ok := gatewayStatus[st.Code()]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	writeJSON(w, code, map[string]any{"code": int(st.Code()), "message": st.Message()})
+}
@@ -0,0 +1,36 @@
+//go:build goplugin || grpc
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// invokeStruct calls a unary method whose request and response are
+// google.protobuf.Struct, converting in and out through their JSON form.
+func invokeStruct(ctx context.Context, cc grpc.ClientConnInterface, method string, in, out any) error {
+	raw, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return err
+	}
+	req, err := structpb.NewStruct(fields)
+	if err != nil {
+		return err
+	}
+	resp := new(structpb.Struct)
+	if err := cc.Invoke(ctx, method, req, resp); err != nil {
+		return err
+	}
+	if raw, err = json.Marshal(resp.AsMap()); err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultHandlerName names the handler a route was registered with.
+const defaultHandlerName = "default"
+
+// namedHandler is a route's current handler and the name it is known by.
+type namedHandler struct {
+	name string
+	http.Handler
+}
+
+// swappableHandler dispatches to a handler that can be replaced while the
+// listeners run. Requests already in the old handler finish there.
+type swappableHandler struct {
+	original http.Handler
+	current  atomic.Pointer[namedHandler]
+}
+
+func newSwappableHandler(h http.Handler) *swappableHandler {
+	s := &swappableHandler{original: h}
+	s.current.Store(&namedHandler{name: defaultHandlerName, Handler: h})
+	return s
+}
+
+func (s *swappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.current.Load().ServeHTTP(w, r)
+}
+
+// handlerRegistry holds handlers that routes can be switched to by name
+// through the admin API.
+type handlerRegistry struct {
+	mu       sync.RWMutex
+	handlers map[string]http.Handler
+}
+
+func (hr *handlerRegistry) get(name string) (http.Handler, bool) {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	h, ok := hr.handlers[name]
+	return h, ok
+}
+
+// RegisterHandler makes h available to PUT /admin/handlers under name, so
+// operators can switch routes to it at runtime. It may be called at any
+// time, for example when a plugin is reloaded.
+func (s *Server) RegisterHandler(name string, h http.Handler) {
+	s.handlerRegistry.mu.Lock()
+	defer s.handlerRegistry.mu.Unlock()
+	if s.handlerRegistry.handlers == nil {
+		s.handlerRegistry.handlers = make(map[string]http.Handler)
+	}
+	s.handlerRegistry.handlers[name] = h
+}
+
+// SwapHandler atomically replaces the handler of the route registered for
+// pattern, on listener or on every listener when listener is "". The
+// route's middleware stays in place. name is what the admin API reports;
+// a nil h restores the handler the route was registered with. It returns
+// the number of routes swapped, and an error if there were none.
+func (s *Server) SwapHandler(listener, pattern, name string, h http.Handler) (int, error) {
+	n := 0
+	for _, rt := range s.routes {
+		if rt.pattern != pattern || (listener != "" && rt.Listener != listener) {
+			continue
+		}
+		sw := rt.handler.(*swappableHandler)
+		if h == nil {
+			sw.current.Store(&namedHandler{name: defaultHandlerName, Handler: sw.original})
+		} else {
+			sw.current.Store(&namedHandler{name: name, Handler: h})
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("no route %q on listener %q", pattern, cmp.Or(listener, "any"))
+	}
+	return n, nil
+}
+
+// unavailableHandler takes a route out of service; it is registered as
+// "unavailable" for PUT /admin/handlers.
+func unavailableHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "temporarily unavailable", http.StatusServiceUnavailable)
+}
+
+// routeHandler is one route's entry in GET /admin/handlers.
+type routeHandler struct {
+	Listener string `json:"listener"`
+	Pattern  string `json:"pattern"`
+	Handler  string `json:"handler"`
+}
+
+// handlersHandler serves GET /admin/handlers, listing the handler each
+// route runs and the registered alternatives.
+func (s *Server) handlersHandler(w http.ResponseWriter, r *http.Request) {
+	routes := make([]routeHandler, len(s.routes))
+	for i, rt := range s.routes {
+		routes[i] = routeHandler{Listener: rt.Listener, Pattern: rt.pattern, Handler: rt.handler.(*swappableHandler).current.Load().name}
+	}
+	s.handlerRegistry.mu.RLock()
+	available := []string{defaultHandlerName}
+	for name := range s.handlerRegistry.handlers {
+		available = append(available, name)
+	}
+	s.handlerRegistry.mu.RUnlock()
+	slices.Sort(available[1:])
+	writeJSON(w, http.StatusOK, map[string]any{"routes": routes, "available": available})
+}
+
+// swapHandlerHandler serves PUT /admin/handlers with
+// {"pattern":"GET /token","handler":"name"} and an optional "listener".
+// The handler "default" restores the one the route was registered with.
+func (s *Server) swapHandlerHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Listener string `json:"listener"`
+		Pattern  string `json:"pattern"`
+		Handler  string `json:"handler"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Pattern == "" || body.Handler == "" {
+		http.Error(w, `expected {"pattern": "...", "handler": "..."}`, http.StatusBadRequest)
+		return
+	}
+
+	var h http.Handler
+	if body.Handler != defaultHandlerName {
+		var ok bool
+		if h, ok = s.handlerRegistry.get(body.Handler); !ok {
+			http.Error(w, fmt.Sprintf("unknown handler %q", body.Handler), http.StatusNotFound)
+			return
+		}
+	}
+	n, err := s.SwapHandler(body.Listener, body.Pattern, body.Handler, h)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	slog.Info("Route handler swapped", "pattern", body.Pattern, "listener", body.Listener, "handler", body.Handler)
+	writeJSON(w, http.StatusOK, map[string]any{"swapped": n})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/martinsre/serverConcurrent/randutil"
+)
+
+// HAROptions configures request/response recording.
+type HAROptions struct {
+	// Dir receives one .har file per recorded request.
+	Dir string
+	// SamplePercent is the share of requests recorded.
+	SamplePercent float64
+	// MaxBodyBytes truncates recorded request and response bodies.
+	MaxBodyBytes int
+	// RedactHeaders are replaced with a placeholder in the recording.
+	RedactHeaders []string
+}
+
+// harRedacted replaces the value of redacted headers.
+const harRedacted = "[REDACTED]"
+
+// HAR 1.2 types, limited to the fields we fill in.
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harRecorder captures a sampled request's response for recordHAR.
+type harRecorder struct {
+	*InstrumentedWriter
+	buf   bytes.Buffer
+	limit int
+}
+
+func (r *harRecorder) Write(p []byte) (int, error) {
+	if room := r.limit - r.buf.Len(); room > 0 {
+		r.buf.Write(p[:min(room, len(p))])
+	}
+	return r.InstrumentedWriter.Write(p)
+}
+
+// cappedBuffer keeps the first limit bytes written to it and counts the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+	total int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if room := b.limit - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// recordHAR writes a sample of requests and their responses to HAR files so
+// production issues can be replayed locally with standard tooling.
+func recordHAR(opts HAROptions) Middleware {
+	redact := make([]string, len(opts.RedactHeaders))
+	for i, h := range opts.RedactHeaders {
+		redact[i] = http.CanonicalHeaderKey(strings.TrimSpace(h))
+	}
+	return Middleware{Name: "har", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !roll(opts.SamplePercent) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			reqBody := &cappedBuffer{limit: opts.MaxBodyBytes}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.TeeReader(r.Body, reqBody), r.Body}
+			}
+			rec := &harRecorder{InstrumentedWriter: NewInstrumentedWriter(w), limit: opts.MaxBodyBytes}
+
+			start := time.Now()
+			next.ServeHTTP(rec, r)
+			elapsed := time.Since(start)
+
+			entry := harEntry{
+				StartedDateTime: start,
+				Time:            float64(elapsed.Microseconds()) / 1000,
+				Request:         harRequestFor(r, reqBody, redact),
+				Response:        harResponseFor(r, rec, redact),
+				Timings:         harTimings{Wait: float64(elapsed.Microseconds()) / 1000},
+			}
+			if err := writeHAR(opts.Dir, entry); err != nil {
+				slog.Warn("Writing HAR recording failed", "error", err)
+			}
+		})
+	}}
+}
+
+func harRequestFor(r *http.Request, body *cappedBuffer, redact []string) harRequest {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	req := harRequest{
+		Method:      r.Method,
+		URL:         scheme + "://" + r.Host + r.URL.RequestURI(),
+		HTTPVersion: r.Proto,
+		Headers:     harHeaders(r.Header, redact),
+		QueryString: []harNameValue{},
+		Cookies:     []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    body.total,
+	}
+	for name, values := range r.URL.Query() {
+		for _, v := range values {
+			req.QueryString = append(req.QueryString, harNameValue{Name: name, Value: v})
+		}
+	}
+	if body.total > 0 {
+		req.PostData = &harPostData{MimeType: r.Header.Get("Content-Type")}
+		switch {
+		case !utf8.Valid(body.Bytes()):
+			req.PostData.Comment = "binary body omitted"
+		case int64(body.Len()) < body.total:
+			req.PostData.Text = body.String()
+			req.PostData.Comment = "body truncated"
+		default:
+			req.PostData.Text = body.String()
+		}
+	}
+	return req
+}
+
+func harResponseFor(r *http.Request, rec *harRecorder, redact []string) harResponse {
+	status := rec.Status()
+	header := rec.Header()
+	resp := harResponse{
+		Status:      status,
+		StatusText:  http.StatusText(status),
+		HTTPVersion: r.Proto,
+		Headers:     harHeaders(header, redact),
+		Cookies:     []harNameValue{},
+		RedirectURL: header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    rec.BytesWritten(),
+		Content:     harContent{Size: rec.BytesWritten(), MimeType: header.Get("Content-Type")},
+	}
+	if utf8.Valid(rec.buf.Bytes()) {
+		resp.Content.Text = rec.buf.String()
+	} else {
+		resp.Content.Text = base64.StdEncoding.EncodeToString(rec.buf.Bytes())
+		resp.Content.Encoding = "base64"
+	}
+	if int64(rec.buf.Len()) < rec.BytesWritten() {
+		resp.Content.Comment = "body truncated"
+	}
+	return resp
+}
+
+func harHeaders(h http.Header, redact []string) []harNameValue {
+	out := []harNameValue{}
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		for _, v := range h[name] {
+			if slices.Contains(redact, name) {
+				v = harRedacted
+			}
+			out = append(out, harNameValue{Name: name, Value: v})
+		}
+	}
+	return out
+}
+
+func writeHAR(dir string, entry harEntry) error {
+	var doc harLog
+	doc.Log.Version = "1.2"
+	doc.Log.Creator = harCreator{Name: "serverConcurrent", Version: "1"}
+	doc.Log.Entries = []harEntry{entry}
+
+	suffix, err := randutil.String(6, randutil.Base62)
+	if err != nil {
+		return err
+	}
+	name := entry.StartedDateTime.UTC().Format("20060102T150405.000") + "-" + suffix + ".har"
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	enc := json.NewEncoder(buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0o600)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"hash/crc32"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// hashRingReplicas is the number of points each member gets on the ring;
+// more points spread keys more evenly.
+const hashRingReplicas = 128
+
+// hashRing maps keys to members by consistent hashing, so adding or removing
+// a member only moves the keys that member owned.
+type hashRing struct {
+	points []uint32
+	owners map[uint32]int
+}
+
+func newHashRing(members []string) *hashRing {
+	h := &hashRing{owners: make(map[uint32]int)}
+	for i, m := range members {
+		for r := range hashRingReplicas {
+			p := crc32.ChecksumIEEE([]byte(m + "#" + strconv.Itoa(r)))
+			if _, taken := h.owners[p]; taken {
+				continue
+			}
+			h.owners[p] = i
+			h.points = append(h.points, p)
+		}
+	}
+	slices.Sort(h.points)
+	return h
+}
+
+// get returns the index of the member owning key.
+func (h *hashRing) get(key string) int {
+	p := crc32.ChecksumIEEE([]byte(key))
+	i, _ := slices.BinarySearch(h.points, p)
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.owners[h.points[i]]
+}
+
+// hashKeyFunc returns the request key for a spec of "ip", "cookie:NAME" or
+// "header:NAME". Requests without the cookie or header fall back to the
+// client IP.
+func hashKeyFunc(spec string) func(*http.Request) string {
+	kind, name, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "cookie":
+		return func(r *http.Request) string {
+			if c, err := r.Cookie(name); err == nil && c.Value != "" {
+				return c.Value
+			}
+			return clientIP(r)
+		}
+	case "header":
+		return func(r *http.Request) string {
+			if v := r.Header.Get(name); v != "" {
+				return v
+			}
+			return clientIP(r)
+		}
+	default:
+		return clientIP
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// NoAutoHEAD opts a GET route out of answering HEAD: passed to Handle, or
+// named by no_auto_head_patterns, it answers HEAD with 405.
+var NoAutoHEAD = Middleware{Name: "no-auto-head", Wrap: func(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Allow", "GET, OPTIONS")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}}
+
+// autoHEAD is added to every GET route not opted out. The handler runs as
+// for GET, but its body is counted and dropped, so the response carries the
+// Content-Length the GET would have.
+var autoHEAD = Middleware{Name: "auto-head", Wrap: func(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hw := &headWriter{ResponseWriter: w}
+		next.ServeHTTP(hw, r)
+		hw.sendHeader()
+	})
+}}
+
+// headMiddleware returns the HEAD handling for a route registered with
+// pattern and mw.
+func (s *Server) headMiddleware(pattern string, mw []Middleware) (Middleware, bool) {
+	if slices.ContainsFunc(mw, func(m Middleware) bool { return m.Name == NoAutoHEAD.Name }) {
+		return Middleware{}, false
+	}
+	if slices.Contains(s.config.NoAutoHeadPatterns, pattern) {
+		return NoAutoHEAD, true
+	}
+	return autoHEAD, true
+}
+
+// headWriter holds back the headers of a HEAD response until the handler is
+// done, counting the body it discards.
+type headWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	sent   bool
+}
+
+func (h *headWriter) WriteHeader(status int) {
+	if status < 200 {
+		h.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if h.status == 0 {
+		h.status = status
+	}
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+	h.bytes += int64(len(p))
+	return len(p), nil
+}
+
+// sendHeader writes the held-back headers, with the Content-Length of the
+// discarded body unless the handler set one or streamed.
+func (h *headWriter) sendHeader() {
+	if h.sent {
+		return
+	}
+	h.sent = true
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+	header := h.Header()
+	if header.Get("Content-Length") == "" && header.Get("Transfer-Encoding") == "" && h.bytes > 0 {
+		header.Set("Content-Length", strconv.FormatInt(h.bytes, 10))
+	}
+	h.ResponseWriter.WriteHeader(h.status)
+}
+
+// FlushError sends the headers early, as the handler is streaming; the
+// length is unknown then.
+func (h *headWriter) FlushError() error {
+	if !h.sent {
+		h.sent = true
+		if h.status == 0 {
+			h.status = http.StatusOK
+		}
+		h.ResponseWriter.WriteHeader(h.status)
+	}
+	return http.NewResponseController(h.ResponseWriter).Flush()
+}
+
+func (h *headWriter) Flush() {
+	_ = h.FlushError()
+}
+
+func (h *headWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(h.ResponseWriter).Hijack()
+	if err == nil {
+		h.sent = true
+	}
+	return conn, rw, err
+}
+
+func (h *headWriter) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
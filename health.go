@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for health checks registered without options.
+const (
+	healthCheckTimeout  = 2 * time.Second
+	healthCheckCacheTTL = 5 * time.Second
+)
+
+// Health check and readiness states reported by /readyz.
+const (
+	HealthOK      = "ok"
+	HealthFailing = "failing"
+	ReadyOK       = "ready"
+	ReadyDegraded = "degraded"
+	ReadyNotReady = "not_ready"
+	ReadyStopping = "shutting_down"
+)
+
+// HealthCheckOptions tunes a health check.
+type HealthCheckOptions struct {
+	// Timeout bounds one run of the check; zero means 2s.
+	Timeout time.Duration
+	// CacheTTL is how long a result is reused, so frequent probes do not
+	// hammer dependencies; zero means 5s.
+	CacheTTL time.Duration
+	// NonCritical checks are reported but do not make the server unready;
+	// a failing one turns the status to degraded.
+	NonCritical bool
+}
+
+// HealthResult is one check's entry in the /readyz response.
+type HealthResult struct {
+	Status     string    `json:"status"`
+	Critical   bool      `json:"critical"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+	opts  HealthCheckOptions
+
+	// mu is held while the check runs, so concurrent probes share a run.
+	mu   sync.Mutex
+	last HealthResult
+	err  error
+
+	// failing and expires mirror last for readers that must not wait on a
+	// running check; refreshing guards the background refresh they start.
+	failing    atomic.Bool
+	expires    atomic.Int64
+	refreshing atomic.Bool
+}
+
+// HealthCheck registers a named dependency check aggregated into /readyz.
+// Managed resources that implement Pinger are registered automatically.
+// It must be called before Run.
+func (s *Server) HealthCheck(name string, check func(ctx context.Context) error, opts HealthCheckOptions) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = healthCheckTimeout
+	}
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = healthCheckCacheTTL
+	}
+	s.healthChecks = append(s.healthChecks, &healthCheck{name: name, check: check, opts: opts})
+}
+
+// run returns the cached result, or runs the check when it has expired.
+func (hc *healthCheck) run(ctx context.Context) (HealthResult, error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if !hc.last.CheckedAt.IsZero() && time.Since(hc.last.CheckedAt) < hc.opts.CacheTTL {
+		return hc.last, hc.err
+	}
+	// The probe's own context is not used: a client hanging up must not
+	// cache a failure for everyone else.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), hc.opts.Timeout)
+	defer cancel()
+	start := time.Now()
+	err := hc.check(ctx)
+	hc.last = HealthResult{Status: HealthOK, Critical: !hc.opts.NonCritical, DurationMS: time.Since(start).Milliseconds(), CheckedAt: start}
+	if err != nil {
+		hc.last.Status = HealthFailing
+	}
+	hc.err = err
+	hc.failing.Store(err != nil)
+	hc.expires.Store(start.Add(hc.opts.CacheTTL).UnixNano())
+	return hc.last, err
+}
+
+// healthy reports the last result without blocking. A check that has not
+// run yet counts as healthy; an expired result is refreshed in the
+// background.
+func (hc *healthCheck) healthy() bool {
+	if time.Now().UnixNano() >= hc.expires.Load() && hc.refreshing.CompareAndSwap(false, true) {
+		go func() {
+			defer hc.refreshing.Store(false)
+			_, _ = hc.run(context.Background())
+		}()
+	}
+	return !hc.failing.Load()
+}
+
+// DiskSpaceCheck fails when the filesystem holding path has less than
+// minFree bytes available.
+func DiskSpaceCheck(path string, minFree uint64) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		free, err := freeDiskSpace(path)
+		if err != nil {
+			return err
+		}
+		if free < minFree {
+			return fmt.Errorf("%d bytes free on %s, want at least %d", free, path, minFree)
+		}
+		return nil
+	}
+}
+
+// HTTPCheck fails unless a GET of url with client answers below 500, so an
+// upstream that is reachable but rejects the probe still counts as up.
+func HTTPCheck(client *http.Client, url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("%s answered %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// readyzHandler reports whether the server should receive traffic: it
+// answers 503 once shutdown has begun or while a critical check fails.
+// Checks run concurrently. With detail, failures carry their error; the
+// public listeners only report each check's status.
+func (s *Server) readyzHandler(detail bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.shuttingDown.Load() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": ReadyStopping})
+			return
+		}
+		results := make(map[string]HealthResult, len(s.healthChecks))
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, hc := range s.healthChecks {
+			wg.Go(func() {
+				res, err := hc.run(r.Context())
+				if err != nil && detail {
+					res.Error = err.Error()
+				}
+				mu.Lock()
+				results[hc.name] = res
+				mu.Unlock()
+			})
+		}
+		wg.Wait()
+
+		code, status := http.StatusOK, ReadyOK
+		for name, res := range results {
+			up := 1.0
+			if res.Status != HealthOK {
+				up = 0
+				switch {
+				case res.Critical:
+					code, status = http.StatusServiceUnavailable, ReadyNotReady
+				case status == ReadyOK:
+					status = ReadyDegraded
+				}
+			}
+			s.metrics.Set("server_health_check_up", up, "check", name)
+		}
+		writeJSON(w, code, map[string]any{"status": status, "checks": results})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// hedgedTransport sends a proxied GET or HEAD that has not been answered
+// within after to a second upstream as well, and returns whichever
+// response arrives first, cancelling the other. A request that fails
+// before then is hedged at once. Requests with bodies and upgrades are
+// never hedged.
+type hedgedTransport struct {
+	base      http.RoundTripper
+	primary   *url.URL
+	alternate *url.URL
+	after     time.Duration
+	metrics   *Metrics
+}
+
+type hedgeResult struct {
+	resp  *http.Response
+	err   error
+	hedge bool
+}
+
+func (t *hedgedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || (req.Body != nil && req.Body != http.NoBody) || req.Header.Get("Upgrade") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	results := make(chan hedgeResult, 2)
+	var cancels [2]context.CancelFunc
+	send := func(r *http.Request, hedge bool) {
+		ctx, cancel := context.WithCancel(req.Context())
+		if hedge {
+			cancels[1] = cancel
+		} else {
+			cancels[0] = cancel
+		}
+		go func() {
+			resp, err := t.base.RoundTrip(r.WithContext(ctx))
+			results <- hedgeResult{resp: resp, err: err, hedge: hedge}
+		}()
+	}
+	send(req, false)
+	timer := time.NewTimer(t.after)
+	defer timer.Stop()
+
+	pending, hedged := 1, false
+	hedge := func() {
+		if hedged || req.Context().Err() != nil {
+			return
+		}
+		hedged = true
+		pending++
+		send(t.hedgeRequest(req), true)
+	}
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			hedge()
+		case res := <-results:
+			pending--
+			winner, loser := 0, 1
+			if res.hedge {
+				winner, loser = 1, 0
+			}
+			if res.err != nil {
+				cancels[winner]()
+				if firstErr == nil {
+					firstErr = res.err
+				}
+				hedge()
+				if pending == 0 {
+					return nil, firstErr
+				}
+				continue
+			}
+			if hedged {
+				result := "primary"
+				if res.hedge {
+					result = "hedge"
+				}
+				t.metrics.Add("server_proxy_hedges_total", 1, "result", result)
+			}
+			if pending > 0 {
+				cancels[loser]()
+				go func() {
+					if late := <-results; late.resp != nil {
+						late.resp.Body.Close()
+					}
+				}()
+			}
+			res.resp.Body = &cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[winner]}
+			return res.resp, nil
+		}
+	}
+}
+
+// hedgeRequest rewrites req, already aimed at the primary upstream, for the
+// alternate one.
+func (t *hedgedTransport) hedgeRequest(req *http.Request) *http.Request {
+	out := req.Clone(req.Context())
+	rest := strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(t.primary.Path, "/"))
+	target := t.alternate.JoinPath(rest)
+	target.RawQuery = req.URL.RawQuery
+	out.URL = target
+	out.Host = ""
+	return out
+}
+
+// cancelOnClose releases the winning attempt's context once the proxy has
+// finished reading its body.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
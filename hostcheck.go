@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// allowHosts rejects requests whose Host is not in hosts with 421
+// Misdirected Request. Entries are exact names or "*.example.com" for any
+// subdomain; ports are ignored. Pinning the accepted names defeats DNS
+// rebinding, where a hostile name is pointed at this server's address, and
+// keeps injected Host values out of generated URLs.
+func allowHosts(hosts []string) Middleware {
+	var exact []string
+	var suffixes []string
+	for _, h := range hosts {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if rest, ok := strings.CutPrefix(h, "*."); ok {
+			suffixes = append(suffixes, "."+rest)
+		} else if h != "" {
+			exact = append(exact, h)
+		}
+	}
+	allowed := func(host string) bool {
+		for _, e := range exact {
+			if host == e {
+				return true
+			}
+		}
+		for _, s := range suffixes {
+			if strings.HasSuffix(host, s) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return Middleware{Name: "allow-hosts", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+			if !allowed(host) {
+				http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
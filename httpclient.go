@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ClientOptions configures the shared outbound HTTP client.
+type ClientOptions struct {
+	// Timeout bounds a whole request on the shared client. The proxy uses
+	// the transport directly, as proxied responses may stream indefinitely.
+	Timeout             time.Duration
+	DialTimeout         time.Duration
+	IdleConnTimeout     time.Duration
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost caps connections to one upstream; 0 means no limit.
+	MaxConnsPerHost int
+	// Resolver, when set, replaces the system resolver for dials.
+	Resolver *Resolver
+	// FastCGI configures fastcgi:// upstreams.
+	FastCGI FastCGIOptions
+}
+
+// newTransport returns a pooled transport instrumented with m. It also
+// speaks FastCGI to fastcgi:// URLs.
+func newTransport(opts ClientOptions, m *Metrics) http.RoundTripper {
+	dialer := &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: 30 * time.Second}
+	dial := dialer.DialContext
+	if opts.Resolver != nil {
+		dial = opts.Resolver.DialContext(dialer)
+	}
+	base := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	base.RegisterProtocol("fastcgi", &fastCGITransport{opts: opts.FastCGI, dial: dial})
+	return &instrumentedTransport{metrics: m, base: base}
+}
+
+// instrumentedTransport records per-host request counts and latency.
+// Requests carry their caller's context, so an inbound request that is
+// cancelled also cancels the outbound calls made on its behalf, and what is
+// left of its deadline is forwarded in X-Request-Timeout.
+type instrumentedTransport struct {
+	base    http.RoundTripper
+	metrics *Metrics
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, err := propagateDeadline(req)
+	if err != nil {
+		return nil, err
+	}
+	req = propagateTrace(req)
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	t.metrics.Add("server_client_requests_total", 1, "host", req.URL.Host, "code", code)
+	t.metrics.Observe("server_client_request_duration_seconds", time.Since(start).Seconds(), "host", req.URL.Host)
+	return resp, err
+}
+
+// HTTPClient returns the shared outbound client. Handlers should use it
+// rather than http.DefaultClient so calls are pooled, bounded and measured.
+func (s *Server) HTTPClient() *http.Client {
+	return s.client
+}
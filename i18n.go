@@ -0,0 +1,204 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Catalog holds translated messages, one JSON object of key to message per
+// language, read from files named like en.json or pt-BR.json. Messages are
+// fmt format strings.
+type Catalog struct {
+	fsys     fs.FS
+	fallback string
+
+	mu       sync.RWMutex
+	messages map[string]map[string]string // by lower-cased language tag
+	tags     []string                     // as named by the files
+}
+
+// NewCatalog returns a catalog reading fsys; fallback is the language used
+// when the client accepts none of the available ones.
+func NewCatalog(fsys fs.FS, fallback string) *Catalog {
+	return &Catalog{fsys: fsys, fallback: fallback}
+}
+
+// Load reads every catalog file. On error the previous messages stay in use.
+func (c *Catalog) Load() error {
+	messages := make(map[string]map[string]string)
+	var tags []string
+	entries, err := fs.ReadDir(c.fsys, ".")
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		tag, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		data, err := fs.ReadFile(c.fsys, e.Name())
+		if err != nil {
+			return err
+		}
+		m := make(map[string]string)
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("parsing catalog %s: %w", path.Base(e.Name()), err)
+		}
+		messages[strings.ToLower(tag)] = m
+		tags = append(tags, tag)
+	}
+	c.mu.Lock()
+	c.messages = messages
+	c.tags = tags
+	c.mu.Unlock()
+	return nil
+}
+
+// Languages returns the available language tags.
+func (c *Catalog) Languages() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Clone(c.tags)
+}
+
+// Match picks the available language best matching an Accept-Language
+// header. Each range is tried in order of preference: exactly, then with
+// subtags removed (en-US finds en), then as a prefix (en finds en-GB).
+func (c *Catalog) Match(acceptLanguage string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, lr := range parseAcceptLanguage(acceptLanguage) {
+		if lr == "*" {
+			break
+		}
+		for r := lr; r != ""; {
+			if i := slices.IndexFunc(c.tags, func(t string) bool { return strings.EqualFold(t, r) }); i >= 0 {
+				return c.tags[i]
+			}
+			i := strings.LastIndexByte(r, '-')
+			if i < 0 {
+				break
+			}
+			r = r[:i]
+		}
+		if i := slices.IndexFunc(c.tags, func(t string) bool { return strings.HasPrefix(strings.ToLower(t), strings.ToLower(lr)+"-") }); i >= 0 {
+			return c.tags[i]
+		}
+	}
+	return c.fallback
+}
+
+// Translate formats the message for key in lang with args. A key missing
+// from lang is looked up in its base language, then in the fallback
+// language; if it is missing everywhere the key itself is used.
+func (c *Catalog) Translate(lang, key string, args ...any) string {
+	c.mu.RLock()
+	msg, ok := "", false
+	for l := strings.ToLower(lang); l != "" && !ok; {
+		msg, ok = c.messages[l][key]
+		i := strings.LastIndexByte(l, '-')
+		if i < 0 {
+			break
+		}
+		l = l[:i]
+	}
+	if !ok {
+		msg, ok = c.messages[strings.ToLower(c.fallback)][key]
+	}
+	c.mu.RUnlock()
+	if !ok {
+		msg = key
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// parseAcceptLanguage returns the language ranges of an Accept-Language
+// header, most preferred first, leaving out those with q=0.
+func parseAcceptLanguage(h string) []string {
+	type langRange struct {
+		tag string
+		q   float64
+	}
+	var ranges []langRange
+	for _, part := range strings.Split(h, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f > 1 {
+				continue
+			}
+			q = f
+		}
+		if q > 0 {
+			ranges = append(ranges, langRange{tag, q})
+		}
+	}
+	slices.SortStableFunc(ranges, func(a, b langRange) int { return cmp.Compare(b.q, a.q) })
+	out := make([]string, len(ranges))
+	for i, r := range ranges {
+		out[i] = r.tag
+	}
+	return out
+}
+
+type localeKey struct{}
+
+type locale struct {
+	catalog *Catalog
+	lang    string
+}
+
+// Middleware negotiates each request's language from Accept-Language and
+// makes it available through Language and T. A lang query parameter naming
+// an available language takes precedence, so users can override their
+// browser.
+func (c *Catalog) Middleware() Middleware {
+	return Middleware{Name: "i18n", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lang := c.Match(r.Header.Get("Accept-Language"))
+			if q := r.URL.Query().Get("lang"); q != "" && slices.ContainsFunc(c.Languages(), func(t string) bool { return strings.EqualFold(t, q) }) {
+				lang = c.Match(q)
+			}
+			w.Header().Add("Vary", "Accept-Language")
+			w.Header().Set("Content-Language", lang)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localeKey{}, locale{catalog: c, lang: lang})))
+		})
+	}}
+}
+
+// Language returns the language negotiated for the request context, or ""
+// when no catalog is configured.
+func Language(ctx context.Context) string {
+	l, _ := ctx.Value(localeKey{}).(locale)
+	return l.lang
+}
+
+// T translates key into the request's language. Without a catalog it
+// formats key itself with args.
+func T(ctx context.Context, key string, args ...any) string {
+	l, ok := ctx.Value(localeKey{}).(locale)
+	if !ok {
+		if len(args) == 0 {
+			return key
+		}
+		return fmt.Sprintf(key, args...)
+	}
+	return l.catalog.Translate(l.lang, key, args...)
+}
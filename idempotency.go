@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyMaxKeyLen caps Idempotency-Key values.
+const idempotencyMaxKeyLen = 255
+
+// IdempotentResponse is a stored response, or a reservation for a request
+// still in flight when Status is 0.
+type IdempotentResponse struct {
+	// Fingerprint identifies the request the key was first used with, so a
+	// key reused for a different request is refused.
+	Fingerprint string
+	Status      int
+	Header      http.Header
+	Body        []byte
+}
+
+// IdempotencyStore keeps responses to requests that carried an
+// Idempotency-Key. Implementations must be safe for concurrent use; a
+// shared store, such as one backed by Redis, lets replicas answer each
+// other's retries.
+type IdempotencyStore interface {
+	// Begin reserves key with a Status 0 entry holding fingerprint for ttl.
+	// If the key is already taken it returns the existing entry instead.
+	Begin(ctx context.Context, key, fingerprint string, ttl time.Duration) (*IdempotentResponse, error)
+	// Finish stores the response for key for ttl.
+	Finish(ctx context.Context, key string, resp *IdempotentResponse, ttl time.Duration) error
+	// Abort drops the reservation for key so the request can be retried.
+	Abort(ctx context.Context, key string) error
+}
+
+// WithIdempotencyStore replaces the in-memory idempotency store.
+func WithIdempotencyStore(store IdempotencyStore) Option {
+	return func(s *Server) { s.idempotencyStore = store }
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore local to the process.
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]memoryIdempotencyEntry
+	lastSweep time.Time
+}
+
+type memoryIdempotencyEntry struct {
+	resp    *IdempotentResponse
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore returns an empty store; expired entries are
+// swept as new keys arrive.
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{entries: make(map[string]memoryIdempotencyEntry), lastSweep: time.Now()}
+}
+
+func (m *MemoryIdempotencyStore) Begin(_ context.Context, key, fingerprint string, ttl time.Duration) (*IdempotentResponse, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.lastSweep) > time.Minute {
+		for k, e := range m.entries {
+			if now.After(e.expires) {
+				delete(m.entries, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	if e, ok := m.entries[key]; ok && now.Before(e.expires) {
+		return e.resp, nil
+	}
+	m.entries[key] = memoryIdempotencyEntry{resp: &IdempotentResponse{Fingerprint: fingerprint}, expires: now.Add(ttl)}
+	return nil, nil
+}
+
+func (m *MemoryIdempotencyStore) Finish(_ context.Context, key string, resp *IdempotentResponse, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = memoryIdempotencyEntry{resp: resp, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *MemoryIdempotencyStore) Abort(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// idempotency replays the stored response to a POST or PUT retried with
+// the same Idempotency-Key, so the handler's side effects happen once. Keys
+// are scoped to the caller's Authorization header. A retry arriving while
+// the first request is still running gets 409; a key reused with a
+// different method, path or body gets 422. Server errors and responses
+// larger than maxBody are not stored, so those requests can be retried.
+func idempotency(store IdempotencyStore, ttl time.Duration, maxBody int64, m *Metrics) Middleware {
+	return Middleware{Name: "idempotency", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPut) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > idempotencyMaxKeyLen {
+				http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+				return
+			}
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+			if err != nil {
+				http.Error(w, "reading request body", http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) > maxBody {
+				http.Error(w, "request body too large for an idempotent request", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			h := sha256.New()
+			h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\x00"))
+			h.Write(body)
+			fingerprint := hex.EncodeToString(h.Sum(nil))
+			scope := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+			storeKey := hex.EncodeToString(scope[:8]) + ":" + key
+
+			existing, err := store.Begin(r.Context(), storeKey, fingerprint, ttl)
+			if err != nil {
+				slog.Warn("Idempotency store failed", "error", err)
+				http.Error(w, "idempotency store unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			switch {
+			case existing == nil:
+			case existing.Fingerprint != fingerprint:
+				m.Add("server_idempotency_requests_total", 1, "result", "mismatch")
+				http.Error(w, "Idempotency-Key was used with a different request", http.StatusUnprocessableEntity)
+				return
+			case existing.Status == 0:
+				m.Add("server_idempotency_requests_total", 1, "result", "in_flight")
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "a request with this Idempotency-Key is in progress", http.StatusConflict)
+				return
+			default:
+				m.Add("server_idempotency_requests_total", 1, "result", "replayed")
+				for k, v := range existing.Header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.Status)
+				_, _ = w.Write(existing.Body)
+				return
+			}
+
+			m.Add("server_idempotency_requests_total", 1, "result", "new")
+			rec := &cacheRecorder{ResponseWriter: w, status: http.StatusOK, limit: int(maxBody)}
+			// A panicking handler must not leave the key reserved.
+			stored := false
+			defer func() {
+				if !stored {
+					_ = store.Abort(context.WithoutCancel(r.Context()), storeKey)
+				}
+			}()
+			next.ServeHTTP(rec, r)
+			if rec.overflow || rec.status >= 500 {
+				return
+			}
+			resp := &IdempotentResponse{Fingerprint: fingerprint, Status: rec.status, Header: rec.Header().Clone(), Body: rec.buf.Bytes()}
+			if err := store.Finish(context.WithoutCancel(r.Context()), storeKey, resp, ttl); err != nil {
+				slog.Warn("Idempotency store failed", "error", err)
+				return
+			}
+			stored = true
+		})
+	}}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+)
+
+// Headers an authorization service sets to name the caller of an allowed
+// request, roles comma-separated.
+const (
+	identitySubjectHeader = "X-Auth-Subject"
+	identityRolesHeader   = "X-Auth-Roles"
+)
+
+// Identity is who a request was authenticated as. The auth middlewares
+// set it and the RBAC policy checks it.
+type Identity struct {
+	Subject string   `json:"subject"`
+	Roles   []string `json:"roles,omitempty"`
+	// Source names the middleware that authenticated the request.
+	Source string `json:"source"`
+}
+
+// HasRole reports whether the identity holds role.
+func (id *Identity) HasRole(role string) bool {
+	return slices.Contains(id.Roles, role)
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a context carrying id.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFrom returns the identity the request was authenticated as, or
+// nil for anonymous requests.
+func IdentityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// splitRoles parses a comma-separated role list.
+func splitRoles(s string) []string {
+	var roles []string
+	for _, r := range strings.Split(s, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
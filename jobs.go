@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/martinsre/serverConcurrent/randutil"
+)
+
+// Retry backoff for failed jobs, doubled after each attempt.
+const (
+	jobInitialBackoff = time.Second
+	jobMaxBackoff     = 30 * time.Second
+)
+
+var (
+	errJobQueueFull   = errors.New("job queue is full")
+	errJobQueueClosed = errors.New("job queue is shut down")
+)
+
+// jobIDGenerator produces job IDs.
+var jobIDGenerator = randutil.MustNew(randutil.Base62)
+
+// Job is a unit of background work. Payloads are JSON so that queued jobs
+// can be checkpointed across restarts.
+type Job struct {
+	ID       string          `json:"id"`
+	Kind     string          `json:"kind"`
+	Payload  json.RawMessage `json:"payload"`
+	Attempts int             `json:"attempts"`
+	Enqueued time.Time       `json:"enqueued"`
+}
+
+// JobFunc runs a job. It should return promptly once ctx is cancelled; the
+// job is then checkpointed rather than counted as failed.
+type JobFunc func(ctx context.Context, job Job) error
+
+// deadJob is a dead-letter log entry.
+type deadJob struct {
+	Job
+	Error  string    `json:"error"`
+	Failed time.Time `json:"failed"`
+}
+
+// JobQueue runs jobs enqueued by handlers on a pool of workers, retrying
+// failures with backoff and logging jobs that exhaust their attempts to
+// the dead-letter file. On shutdown the workers keep going until the queue
+// is empty or drainTimeout passes; jobs still queued or interrupted then
+// are written to the checkpoint file and requeued by the next Load.
+type JobQueue struct {
+	workers        int
+	maxAttempts    int
+	drainTimeout   time.Duration
+	checkpointPath string
+	deadLetterPath string
+	metrics        *Metrics
+	queue          chan Job
+
+	mu          sync.RWMutex
+	handlers    map[string]JobFunc
+	closed      bool
+	interrupted []Job
+
+	deadMu sync.Mutex
+}
+
+func newJobQueue(workers, size, maxAttempts int, drainTimeout time.Duration, checkpointPath, deadLetterPath string, m *Metrics) *JobQueue {
+	return &JobQueue{
+		workers:        workers,
+		maxAttempts:    maxAttempts,
+		drainTimeout:   drainTimeout,
+		checkpointPath: checkpointPath,
+		deadLetterPath: deadLetterPath,
+		metrics:        m,
+		queue:          make(chan Job, size),
+		handlers:       make(map[string]JobFunc),
+	}
+}
+
+// Register sets the function that runs jobs of kind. It must be called
+// before Run so checkpointed jobs find their handler.
+func (q *JobQueue) Register(kind string, fn JobFunc) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[kind] = fn
+}
+
+// Enqueue queues a job of kind with payload encoded as JSON and returns its
+// ID. It never blocks: a full queue is reported as an error, which handlers
+// usually answer with 503.
+func (q *JobQueue) Enqueue(kind string, payload any) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	id, err := jobIDGenerator.String(20)
+	if err != nil {
+		return "", err
+	}
+	job := Job{ID: id, Kind: kind, Payload: data, Enqueued: time.Now()}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if _, ok := q.handlers[kind]; !ok {
+		return "", fmt.Errorf("no handler registered for job kind %q", kind)
+	}
+	if q.closed {
+		return "", errJobQueueClosed
+	}
+	select {
+	case q.queue <- job:
+		q.metrics.Set("server_jobs_queued", float64(len(q.queue)))
+		return id, nil
+	default:
+		q.metrics.Add("server_jobs_total", 1, "kind", kind, "result", "rejected")
+		return "", errJobQueueFull
+	}
+}
+
+// Load requeues the jobs checkpointed by the previous shutdown and removes
+// the checkpoint file.
+func (q *JobQueue) Load() error {
+	if q.checkpointPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(q.checkpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var jobs []Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return fmt.Errorf("%s: %w", q.checkpointPath, err)
+	}
+	for _, job := range jobs {
+		q.mu.RLock()
+		_, ok := q.handlers[job.Kind]
+		q.mu.RUnlock()
+		if !ok {
+			q.deadLetter(job, fmt.Errorf("no handler registered for job kind %q", job.Kind))
+			continue
+		}
+		select {
+		case q.queue <- job:
+		default:
+			return fmt.Errorf("%s: %d jobs do not fit in the queue", q.checkpointPath, len(jobs))
+		}
+	}
+	q.metrics.Set("server_jobs_queued", float64(len(q.queue)))
+	slog.Info("Restored checkpointed jobs", "path", q.checkpointPath, "jobs", len(jobs))
+	return os.Remove(q.checkpointPath)
+}
+
+// run works the queue until ctx is cancelled, then drains and checkpoints it.
+func (q *JobQueue) run(ctx context.Context) error {
+	// Jobs outlive ctx so that the queue can drain.
+	jobCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	draining := make(chan struct{})
+	var wg sync.WaitGroup
+	for range q.workers {
+		wg.Go(func() { q.work(jobCtx, draining) })
+	}
+
+	<-ctx.Done()
+	slog.Info("Draining job queue", "queued", len(q.queue))
+	close(draining)
+	timer := time.AfterFunc(q.drainTimeout, cancel)
+	defer timer.Stop()
+	wg.Wait()
+
+	q.mu.Lock()
+	q.closed = true
+	pending := q.interrupted
+	q.mu.Unlock()
+	for len(q.queue) > 0 {
+		pending = append(pending, <-q.queue)
+	}
+	q.metrics.Set("server_jobs_queued", 0)
+	return q.checkpoint(pending)
+}
+
+// work runs queued jobs; once draining is closed it empties the queue and
+// returns, or returns early when ctx is cancelled.
+func (q *JobQueue) work(ctx context.Context, draining <-chan struct{}) {
+	for {
+		select {
+		case job := <-q.queue:
+			q.process(ctx, job)
+		case <-draining:
+			for ctx.Err() == nil {
+				select {
+				case job := <-q.queue:
+					q.process(ctx, job)
+				default:
+					return
+				}
+			}
+			return
+		}
+	}
+}
+
+// process runs job until it succeeds, exhausts its attempts or is
+// interrupted by shutdown.
+func (q *JobQueue) process(ctx context.Context, job Job) {
+	q.metrics.Set("server_jobs_queued", float64(len(q.queue)))
+	q.mu.RLock()
+	fn := q.handlers[job.Kind]
+	q.mu.RUnlock()
+
+	backoff := jobInitialBackoff
+	for {
+		if ctx.Err() != nil {
+			q.interrupt(job)
+			return
+		}
+		start := time.Now()
+		err := runJob(ctx, fn, job)
+		q.metrics.Observe("server_job_duration_seconds", time.Since(start).Seconds(), "kind", job.Kind)
+		if err == nil {
+			q.metrics.Add("server_jobs_total", 1, "kind", job.Kind, "result", "succeeded")
+			return
+		}
+		if ctx.Err() != nil {
+			q.interrupt(job)
+			return
+		}
+		job.Attempts++
+		if job.Attempts >= q.maxAttempts {
+			q.deadLetter(job, err)
+			return
+		}
+		q.metrics.Add("server_jobs_total", 1, "kind", job.Kind, "result", "retried")
+		slog.Warn("Job failed, retrying", "kind", job.Kind, "id", job.ID, "attempts", job.Attempts, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, jobMaxBackoff)
+	}
+}
+
+// runJob calls fn, turning a panic into an error so one bad job does not
+// take down the worker pool.
+func runJob(ctx context.Context, fn JobFunc, job Job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return fn(ctx, job)
+}
+
+func (q *JobQueue) interrupt(job Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.interrupted = append(q.interrupted, job)
+}
+
+// deadLetter appends job to the dead-letter file, one JSON object per line.
+func (q *JobQueue) deadLetter(job Job, jobErr error) {
+	q.metrics.Add("server_jobs_total", 1, "kind", job.Kind, "result", "dead")
+	slog.Error("Job failed permanently", "kind", job.Kind, "id", job.ID, "attempts", job.Attempts, "error", jobErr)
+	if q.deadLetterPath == "" {
+		return
+	}
+	line, err := json.Marshal(deadJob{Job: job, Error: jobErr.Error(), Failed: time.Now()})
+	if err != nil {
+		slog.Error("Failed to encode dead-letter entry", "id", job.ID, "error", err)
+		return
+	}
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+	f, err := os.OpenFile(q.deadLetterPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		slog.Error("Failed to open dead-letter log", "path", q.deadLetterPath, "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write dead-letter log", "path", q.deadLetterPath, "error", err)
+	}
+}
+
+// checkpoint saves pending jobs for the next start, writing a temp file and
+// renaming it into place so a crash never leaves a partial checkpoint.
+func (q *JobQueue) checkpoint(pending []Job) error {
+	if len(pending) == 0 {
+		return nil
+	}
+	q.metrics.Add("server_jobs_checkpointed_total", float64(len(pending)))
+	if q.checkpointPath == "" {
+		slog.Warn("Discarding unfinished jobs; no checkpoint file is configured", "jobs", len(pending))
+		return nil
+	}
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(q.checkpointPath), ".jobs-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	slog.Info("Checkpointed unfinished jobs", "path", q.checkpointPath, "jobs", len(pending))
+	return os.Rename(tmp.Name(), q.checkpointPath)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ldapCacheMax is how many successful binds are cached before expired ones
+// are swept.
+const ldapCacheMax = 10000
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// LDAPOptions configures the directory users are authenticated against.
+type LDAPOptions struct {
+	// URL is ldap:// or ldaps://host[:port].
+	URL string
+	// BindDN and BindPassword are the service account used to look up
+	// users.
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds a user's entry, with %s replaced by the escaped
+	// username: (uid=%s), or (sAMAccountName=%s) for Active Directory.
+	UserFilter string
+	// GroupAttribute lists the groups on a user's entry.
+	GroupAttribute string
+	PoolSize       int
+	Timeout        time.Duration
+}
+
+// ldapDirectory verifies a user's password, returning their groups, or
+// errInvalidCredentials.
+type ldapDirectory interface {
+	authenticate(username, password string) ([]string, error)
+}
+
+// brokenDirectory stands in for a directory that could not be set up, so
+// requests with credentials fail rather than go through unauthenticated.
+type brokenDirectory struct {
+	err error
+}
+
+func (b brokenDirectory) authenticate(string, string) ([]string, error) {
+	return nil, b.err
+}
+
+// ldapAuth authenticates requests carrying Basic credentials, or form
+// credentials posted to formPath, against an LDAP directory. Requests
+// without credentials pass through anonymously.
+type ldapAuth struct {
+	dir      ldapDirectory
+	roles    map[string][]string // by lower-cased group name
+	ttl      time.Duration
+	formPath string
+	metrics  *Metrics
+
+	mu      sync.Mutex
+	cacheID []byte
+	cache   map[string]ldapCacheEntry
+}
+
+type ldapCacheEntry struct {
+	identity *Identity
+	expires  time.Time
+}
+
+// credentials returns the username and password a request carries.
+func (a *ldapAuth) credentials(r *http.Request) (string, string, bool) {
+	if user, pass, ok := r.BasicAuth(); ok {
+		return user, pass, true
+	}
+	if a.formPath != "" && r.Method == http.MethodPost && r.URL.Path == a.formPath {
+		user, pass := r.PostFormValue("username"), r.PostFormValue("password")
+		return user, pass, user != ""
+	}
+	return "", "", false
+}
+
+// authenticate returns the identity for the credentials, from the cache
+// when they bound successfully within the TTL. Failed binds are not
+// cached, so a corrected password works at once.
+func (a *ldapAuth) authenticate(user, pass string) (*Identity, error) {
+	if user == "" || pass == "" {
+		// An empty password makes an unauthenticated bind, which most
+		// directories accept.
+		return nil, errInvalidCredentials
+	}
+	key := hex.EncodeToString(hmacSHA256(a.cacheID, user+"\x00"+pass))
+	now := time.Now()
+	a.mu.Lock()
+	e, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		a.metrics.Add("server_ldap_binds_total", 1, "result", "cached")
+		return e.identity, nil
+	}
+
+	start := time.Now()
+	groups, err := a.dir.authenticate(user, pass)
+	a.metrics.Observe("server_ldap_bind_seconds", time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	id := &Identity{Subject: user, Roles: a.mapRoles(groups), Source: "ldap"}
+	if a.ttl > 0 {
+		a.mu.Lock()
+		if len(a.cache) >= ldapCacheMax {
+			for k, e := range a.cache {
+				if !now.Before(e.expires) {
+					delete(a.cache, k)
+				}
+			}
+			if len(a.cache) >= ldapCacheMax {
+				clear(a.cache)
+			}
+		}
+		a.cache[key] = ldapCacheEntry{identity: id, expires: now.Add(a.ttl)}
+		a.mu.Unlock()
+	}
+	return id, nil
+}
+
+// mapRoles returns the roles granted by groups, which may be DNs such as
+// cn=admins,ou=groups,dc=example,dc=org or plain names.
+func (a *ldapAuth) mapRoles(groups []string) []string {
+	var roles []string
+	for _, g := range groups {
+		name, _, _ := strings.Cut(g, ",")
+		if _, v, ok := strings.Cut(name, "="); ok {
+			name = v
+		}
+		for _, role := range a.roles[strings.ToLower(strings.TrimSpace(name))] {
+			if !slices.Contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// middleware authenticates requests with credentials, answering 401 when
+// they are wrong and 503 when the directory cannot be reached. Requests an
+// earlier middleware authenticated are left alone.
+func (a *ldapAuth) middleware() Middleware {
+	return Middleware{Name: "ldap", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, pass, ok := a.credentials(r)
+			if !ok || IdentityFrom(r.Context()) != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			id, err := a.authenticate(user, pass)
+			switch {
+			case errors.Is(err, errInvalidCredentials):
+				a.metrics.Add("server_ldap_binds_total", 1, "result", "invalid")
+				slog.Warn("LDAP authentication failed", "user", user, "client", clientIP(r))
+				w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			case err != nil:
+				a.metrics.Add("server_ldap_binds_total", 1, "result", "error")
+				slog.Error("LDAP directory unavailable", "error", err)
+				http.Error(w, "authentication unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			a.metrics.Add("server_ldap_binds_total", 1, "result", "bound")
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+		})
+	}}
+}
+
+// parseLDAPGroupRoles parses "group=role[+role...]" entries, matching
+// group names case-insensitively.
+func parseLDAPGroupRoles(entries []string) (map[string][]string, error) {
+	out := make(map[string][]string, len(entries))
+	for _, e := range entries {
+		group, roles, ok := strings.Cut(e, "=")
+		group = strings.ToLower(strings.TrimSpace(group))
+		if !ok || group == "" || roles == "" {
+			return nil, fmt.Errorf("invalid LDAP group role %q: want group=role[+role...]", e)
+		}
+		for _, role := range strings.Split(roles, "+") {
+			if role = strings.TrimSpace(role); role != "" {
+				out[group] = append(out[group], role)
+			}
+		}
+	}
+	return out, nil
+}
+
+// newLDAPAuth builds the LDAP middleware from the configuration.
+func (s *Server) newLDAPAuth() *ldapAuth {
+	roles, err := parseLDAPGroupRoles(s.config.LDAPGroupRoles)
+	if err != nil {
+		slog.Warn("Ignoring invalid LDAP group roles", "error", err)
+	}
+	dir, err := newLDAPDirectory(LDAPOptions{
+		URL:            s.config.LDAPURL,
+		BindDN:         s.config.LDAPBindDN,
+		BindPassword:   s.config.LDAPBindPassword,
+		BaseDN:         s.config.LDAPBaseDN,
+		UserFilter:     s.config.LDAPUserFilter,
+		GroupAttribute: s.config.LDAPGroupAttribute,
+		PoolSize:       s.config.LDAPPoolSize,
+		Timeout:        s.config.LDAPTimeout,
+	})
+	if err != nil {
+		slog.Error("LDAP authentication unavailable", "error", err)
+		dir = brokenDirectory{err: err}
+	}
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return &ldapAuth{
+		dir:      dir,
+		roles:    roles,
+		ttl:      s.config.LDAPCacheTTL,
+		formPath: s.config.LDAPFormPath,
+		metrics:  s.metrics,
+		cacheID:  key,
+		cache:    make(map[string]ldapCacheEntry),
+	}
+}
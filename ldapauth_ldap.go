@@ -0,0 +1,112 @@
+//go:build ldap
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapPool keeps up to PoolSize connections bound as the service account.
+type ldapPool struct {
+	opts  LDAPOptions
+	conns chan *ldap.Conn
+}
+
+func newLDAPDirectory(opts LDAPOptions) (ldapDirectory, error) {
+	if _, err := ldap.ParseDN(opts.BaseDN); err != nil {
+		return nil, fmt.Errorf("invalid LDAP base DN: %w", err)
+	}
+	return &ldapPool{opts: opts, conns: make(chan *ldap.Conn, opts.PoolSize)}, nil
+}
+
+func (p *ldapPool) dial() (*ldap.Conn, error) {
+	c, err := ldap.DialURL(p.opts.URL, ldap.DialWithDialer(&net.Dialer{Timeout: p.opts.Timeout}))
+	if err != nil {
+		return nil, err
+	}
+	c.SetTimeout(p.opts.Timeout)
+	if err := p.bindService(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *ldapPool) bindService(c *ldap.Conn) error {
+	if p.opts.BindDN == "" {
+		return nil
+	}
+	return c.Bind(p.opts.BindDN, p.opts.BindPassword)
+}
+
+func (p *ldapPool) get() (*ldap.Conn, error) {
+	select {
+	case c := <-p.conns:
+		if !c.IsClosing() {
+			return c, nil
+		}
+		c.Close()
+	default:
+	}
+	return p.dial()
+}
+
+func (p *ldapPool) put(c *ldap.Conn) {
+	select {
+	case p.conns <- c:
+	default:
+		c.Close()
+	}
+}
+
+// userFilter returns UserFilter for username, escaped so that it can only
+// ever match as a value.
+func (p *ldapPool) userFilter(username string) string {
+	return fmt.Sprintf(p.opts.UserFilter, ldap.EscapeFilter(username))
+}
+
+// authenticate finds the user's entry as the service account, then binds
+// as the user to check the password. The connection is bound back to the
+// service account before it returns to the pool.
+func (p *ldapPool) authenticate(username, password string) ([]string, error) {
+	c, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Search(ldap.NewSearchRequest(
+		p.opts.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(p.opts.Timeout.Seconds()), false,
+		p.userFilter(username),
+		[]string{p.opts.GroupAttribute}, nil,
+	))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if len(res.Entries) != 1 {
+		p.put(c)
+		return nil, errInvalidCredentials
+	}
+	entry := res.Entries[0]
+	if err := c.Bind(entry.DN, password); err != nil {
+		if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			c.Close()
+			return nil, err
+		}
+		err = errInvalidCredentials
+		if p.bindService(c) == nil {
+			p.put(c)
+		} else {
+			c.Close()
+		}
+		return nil, err
+	}
+	if p.bindService(c) == nil {
+		p.put(c)
+	} else {
+		c.Close()
+	}
+	return entry.GetAttributeValues(p.opts.GroupAttribute), nil
+}
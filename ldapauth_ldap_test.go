@@ -0,0 +1,56 @@
+//go:build ldap
+
+package main
+
+import (
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestLDAPUserFilter(t *testing.T) {
+	p := &ldapPool{opts: LDAPOptions{UserFilter: "(uid=%s)"}}
+	tests := []struct {
+		username, want string
+	}{
+		{"alice", "(uid=alice)"},
+		{"*", `(uid=\2a)`},
+		{"*)(uid=*))(|(uid=*", `(uid=\2a\29\28uid=\2a\29\29\28|\28uid=\2a)`},
+		{"admin)(&)", `(uid=admin\29\28&\29)`},
+		{`a\2a`, `(uid=a\5c2a)`},
+		{"a\x00b", `(uid=a\00b)`},
+		{"jürgen", `(uid=j\c3\bcrgen)`},
+	}
+	for _, tt := range tests {
+		if got := p.userFilter(tt.username); got != tt.want {
+			t.Errorf("userFilter(%q) = %s, want %s", tt.username, got, tt.want)
+		}
+	}
+}
+
+// FuzzLDAPUserFilter checks that no username changes the structure of the
+// search filter: it always compiles to one equality match on uid whose
+// value is the username.
+func FuzzLDAPUserFilter(f *testing.F) {
+	for _, s := range []string{"alice", "*", "*)(uid=*))(|(uid=*", `\`, "a\x00", "(&(objectClass=*))"} {
+		f.Add(s)
+	}
+	p := &ldapPool{opts: LDAPOptions{UserFilter: "(&(objectClass=person)(uid=%s))"}}
+	f.Fuzz(func(t *testing.T, username string) {
+		filter := p.userFilter(username)
+		packet, err := ldap.CompileFilter(filter)
+		if err != nil {
+			t.Fatalf("%q: filter %s does not compile: %v", username, filter, err)
+		}
+		if packet.Tag != ldap.FilterAnd || len(packet.Children) != 2 {
+			t.Fatalf("%q: filter %s is not a two-term AND", username, filter)
+		}
+		eq := packet.Children[1]
+		if eq.Tag != ldap.FilterEqualityMatch || len(eq.Children) != 2 {
+			t.Fatalf("%q: filter %s does not end in an equality match", username, filter)
+		}
+		if attr, value := eq.Children[0].Data.String(), eq.Children[1].Data.String(); attr != "uid" || value != username {
+			t.Fatalf("%q: filter %s matches %s=%q", username, filter, attr, value)
+		}
+	})
+}
@@ -0,0 +1,9 @@
+//go:build !ldap
+
+package main
+
+import "errors"
+
+func newLDAPDirectory(opts LDAPOptions) (ldapDirectory, error) {
+	return nil, errors.New("LDAP authentication requires building with -tags ldap")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDirectory knows users by password and returns their groups.
+type fakeDirectory struct {
+	passwords map[string]string
+	groups    map[string][]string
+	err       error
+	binds     []string
+}
+
+func (d *fakeDirectory) authenticate(user, pass string) ([]string, error) {
+	d.binds = append(d.binds, user)
+	if d.err != nil {
+		return nil, d.err
+	}
+	if want, ok := d.passwords[user]; !ok || want != pass {
+		return nil, errInvalidCredentials
+	}
+	return d.groups[user], nil
+}
+
+func newTestLDAPAuth(dir ldapDirectory, ttl time.Duration) *ldapAuth {
+	roles, _ := parseLDAPGroupRoles([]string{"Admins=admin+ops", "readers=reader"})
+	return &ldapAuth{
+		dir:      dir,
+		roles:    roles,
+		ttl:      ttl,
+		formPath: "/login",
+		metrics:  NewMetrics(),
+		cacheID:  []byte("cache id"),
+		cache:    make(map[string]ldapCacheEntry),
+	}
+}
+
+func TestLDAPAuthMiddleware(t *testing.T) {
+	dir := &fakeDirectory{
+		passwords: map[string]string{"ann": "pw"},
+		groups:    map[string][]string{"ann": {"cn=admins,ou=groups,dc=example,dc=org", "readers", "cn=other"}},
+	}
+	a := newTestLDAPAuth(dir, time.Minute)
+	h := a.middleware().Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := IdentityFrom(r.Context()); id != nil {
+			_, _ = w.Write([]byte(id.Subject + " " + strings.Join(id.Roles, ",")))
+		}
+	}))
+	basic := func(user, pass string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth(user, pass)
+		return r
+	}
+	form := func(values url.Values) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	tests := []struct {
+		name   string
+		r      *http.Request
+		status int
+		body   string
+	}{
+		{"basic", basic("ann", "pw"), http.StatusOK, "ann admin,ops,reader"},
+		{"cached", basic("ann", "pw"), http.StatusOK, "ann admin,ops,reader"},
+		{"wrong password", basic("ann", "nope"), http.StatusUnauthorized, "Unauthorized\n"},
+		{"empty password", basic("ann", ""), http.StatusUnauthorized, "Unauthorized\n"},
+		{"form", form(url.Values{"username": {"ann"}, "password": {"pw"}}), http.StatusOK, "ann admin,ops,reader"},
+		{"form without username", form(url.Values{"password": {"pw"}}), http.StatusOK, ""},
+		{"anonymous", httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, tt.r)
+		if rec.Code != tt.status || rec.Body.String() != tt.body {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, rec.Code, rec.Body, tt.status, tt.body)
+		}
+	}
+	// Only the first bind and the wrong password reached the directory: the
+	// repeated and form requests were served from the cache, and an empty
+	// password is refused before binding.
+	if want := []string{"ann", "ann"}; !slices.Equal(dir.binds, want) {
+		t.Errorf("binds %q, want %q", dir.binds, want)
+	}
+}
+
+func TestLDAPAuthDirectoryDown(t *testing.T) {
+	a := newTestLDAPAuth(brokenDirectory{err: errors.New("connection refused")}, time.Minute)
+	h := a.middleware().Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Error("request with credentials reached the handler")
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("ann", "pw")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("%d, want 503", rec.Code)
+	}
+}
+
+func TestParseLDAPGroupRoles(t *testing.T) {
+	got, err := parseLDAPGroupRoles([]string{" Admins = admin + ops ", "readers=reader", "readers=auditor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got["admins"], []string{"admin", "ops"}) || !slices.Equal(got["readers"], []string{"reader", "auditor"}) {
+		t.Errorf("roles %v", got)
+	}
+	for _, e := range []string{"admins", "=admin", "admins="} {
+		if _, err := parseLDAPGroupRoles([]string{e}); err == nil {
+			t.Errorf("parsed %q", e)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// parseBindAddrs splits a listener address into its bind entries. An address
+// is a comma-separated list of [network://]host:port, where network is tcp
+// (the default), tcp4, tcp6 or tsnet:
+//
+//	:8081                               all interfaces, dual-stack
+//	tcp4://0.0.0.0:8081,tcp6://[::]:8081 separate IPv4 and IPv6-only sockets
+//	10.0.0.5:8081,192.168.1.5:8081      two specific interfaces
+//	tsnet://myserver:443                on a tailnet only, as node myserver
+//
+// A tcp6 socket on the unspecified address is IPv6-only (IPV6_V6ONLY=1),
+// whereas tcp on [::] also accepts IPv4-mapped connections.
+func parseBindAddrs(spec string) ([][2]string, error) {
+	var binds [][2]string
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		network, addr, ok := strings.Cut(entry, "://")
+		if !ok {
+			network, addr = "tcp", entry
+		}
+		switch network {
+		case "tcp", "tcp4", "tcp6", "tsnet":
+		default:
+			return nil, fmt.Errorf("listen address %q: unsupported network %q", entry, network)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("listen address %q: %w", entry, err)
+		}
+		binds = append(binds, [2]string{network, addr})
+	}
+	if len(binds) == 0 {
+		return nil, fmt.Errorf("empty listen address %q", spec)
+	}
+	return binds, nil
+}
+
+// listen binds every entry of spec and returns them as one listener.
+func (s *Server) listen(ctx context.Context, spec string, opts TCPOptions) (net.Listener, error) {
+	binds, err := parseBindAddrs(spec)
+	if err != nil {
+		return nil, err
+	}
+	lc := &net.ListenConfig{KeepAlive: opts.KeepAlive}
+	var lns []net.Listener
+	for _, b := range binds {
+		var ln net.Listener
+		if b[0] == "tsnet" {
+			ln, err = s.listenTailnet(ctx, b[1])
+		} else if ln, err = lc.Listen(ctx, b[0], b[1]); err == nil {
+			ln, err = tuneListener(ln, opts)
+		}
+		if err != nil {
+			for _, l := range lns {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	if len(lns) == 1 {
+		return lns[0], nil
+	}
+	return newMultiListener(lns), nil
+}
+
+// multiListener merges the connections of several listeners.
+type multiListener struct {
+	lns   []net.Listener
+	conns chan acceptResult
+	done  chan struct{}
+	once  sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(lns []net.Listener) *multiListener {
+	m := &multiListener{lns: lns, conns: make(chan acceptResult), done: make(chan struct{})}
+	for _, ln := range lns {
+		go m.accept(ln)
+	}
+	return m
+}
+
+func (m *multiListener) accept(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		select {
+		case m.conns <- acceptResult{c, err}:
+		case <-m.done:
+			if c != nil {
+				_ = c.Close()
+			}
+			return
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				return
+			}
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-m.conns:
+		return r.conn, r.err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+		for _, ln := range m.lns {
+			if cerr := ln.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the first bound address.
+func (m *multiListener) Addr() net.Addr {
+	return m.lns[0].Addr()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// weightedRequest is one entry of a loadtest request mix.
+type weightedRequest struct {
+	replayRequest
+	weight int
+}
+
+// runLoadtest implements the loadtest subcommand:
+//
+//	loadtest [-target URL] [-concurrency N] [-duration D] [-rate R] [-mix SPEC]
+//
+// SPEC is a comma-separated list of "METHOD /path=weight" entries, e.g.
+// "GET /token=3,GET /uuid=1"; the method and weight are optional.
+func runLoadtest(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	target := fs.String("target", "http://localhost:8081", "base URL requests are sent to")
+	concurrency := fs.Int("concurrency", 16, "concurrent workers")
+	duration := fs.Duration("duration", 10*time.Second, "how long to generate load")
+	rate := fs.Float64("rate", 0, "maximum total requests per second (0 is unlimited)")
+	mix := fs.String("mix", "GET /", "weighted request mix")
+	timeout := fs.Duration("timeout", 30*time.Second, "per-request timeout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	base, err := url.Parse(*target)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return fmt.Errorf("loadtest: invalid target %q", *target)
+	}
+	reqs, err := parseRequestMix(*mix)
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, r := range reqs {
+		total += r.weight
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	var tick <-chan time.Time
+	if *rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer t.Stop()
+		tick = t.C
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: max(*concurrency, 1),
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	stats := newTrafficStats()
+	var wg sync.WaitGroup
+	for range max(*concurrency, 1) {
+		wg.Go(func() {
+			for {
+				if tick != nil {
+					select {
+					case <-ctx.Done():
+						return
+					case <-tick:
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				r := pickWeighted(reqs, total)
+				began := time.Now()
+				status, err := replayOne(ctx, client, base, r.replayRequest)
+				// Requests cut off by the end of the run are not failures.
+				if ctx.Err() != nil && errors.Is(err, context.DeadlineExceeded) {
+					return
+				}
+				stats.record(status, err, time.Since(began))
+			}
+		})
+	}
+	wg.Wait()
+
+	stats.write(out)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil
+	}
+	return ctx.Err()
+}
+
+func pickWeighted(reqs []weightedRequest, total int) weightedRequest {
+	n := rand.IntN(total)
+	for _, r := range reqs {
+		if n < r.weight {
+			return r
+		}
+		n -= r.weight
+	}
+	return reqs[len(reqs)-1]
+}
+
+func parseRequestMix(spec string) ([]weightedRequest, error) {
+	var reqs []weightedRequest
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		r := weightedRequest{replayRequest: replayRequest{method: http.MethodGet}, weight: 1}
+		if i := strings.LastIndexByte(entry, '='); i >= 0 && !strings.Contains(entry[i:], "/") {
+			w, err := strconv.Atoi(entry[i+1:])
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("loadtest: invalid weight in %q", entry)
+			}
+			r.weight, entry = w, strings.TrimSpace(entry[:i])
+		}
+		if method, path, ok := strings.Cut(entry, " "); ok {
+			r.method, entry = method, strings.TrimSpace(path)
+		}
+		if !strings.HasPrefix(entry, "/") {
+			return nil, fmt.Errorf("loadtest: invalid request %q", entry)
+		}
+		r.uri = entry
+		reqs = append(reqs, r)
+	}
+	if len(reqs) == 0 {
+		return nil, errors.New("loadtest: empty request mix")
+	}
+	return reqs, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// longPollMaxTimeout caps the wait a client may ask for on the debug
+// endpoint.
+const longPollMaxTimeout = 2 * time.Minute
+
+// LongPoll answers a long-poll request from the event bus. poll is called
+// once with a nil event as soon as the subscription is in place, so state
+// that is already available is returned at once without racing new
+// events, and then with each published event. The first value it accepts
+// is written as JSON with 200. If timeout passes first the response is 204;
+// if the server shuts down it is 503 with Retry-After; if the client goes
+// away nothing is written.
+//
+// The request is registered as a stream, so it may outlast the listener's
+// WriteTimeout and is ended promptly by shutdown.
+func (s *Server) LongPoll(w http.ResponseWriter, r *http.Request, timeout time.Duration, poll func(e Event) (any, bool)) {
+	events, unsubscribe := s.events.Subscribe(16)
+	defer unsubscribe()
+
+	if v, ok := poll(nil); ok {
+		writeJSON(w, http.StatusOK, v)
+		return
+	}
+
+	st, ctx := s.OpenStream(w, r, func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+	})
+	defer st.Close()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			_ = st.Write(func(w http.ResponseWriter) error {
+				w.WriteHeader(http.StatusNoContent)
+				return nil
+			})
+			return
+		case e := <-events:
+			if v, ok := poll(e); ok {
+				_ = st.Write(func(w http.ResponseWriter) error {
+					writeJSON(w, http.StatusOK, v)
+					return nil
+				})
+				return
+			}
+		}
+	}
+}
+
+// longPollHandler serves GET /debug/longpoll?event=NAME&timeout=30s,
+// waiting for the next bus event of that name; it exists to exercise
+// LongPoll.
+func (s *Server) longPollHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("event")
+	timeout := 30 * time.Second
+	if raw := r.URL.Query().Get("timeout"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 || d > longPollMaxTimeout {
+			http.Error(w, "timeout must be a positive duration of at most "+longPollMaxTimeout.String(), http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+	s.LongPoll(w, r, timeout, func(e Event) (any, bool) {
+		if e == nil || name != "" && e.EventName() != name {
+			return nil, false
+		}
+		return map[string]any{"event": e.EventName(), "data": e}, true
+	})
+}
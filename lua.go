@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PluginResponse is the view of a response passed to response hooks.
+type PluginResponse struct {
+	Status int                 `json:"status"`
+	Header map[string][]string `json:"header"`
+}
+
+// luaProgram is a compiled script. Scripts define on_request(req), whose
+// result is a PluginDecision, and optionally on_response(req, res), whose
+// result may set status and edit the response headers with set_header and
+// del_header. Either may return nil to change nothing.
+type luaProgram interface {
+	onRequest(ctx context.Context, req *PluginRequest) (*PluginDecision, error)
+	onResponse(ctx context.Context, req *PluginRequest, res *PluginResponse) (*PluginDecision, error)
+	hasResponseHook() bool
+}
+
+// luaScript is a Lua script loaded from a file and reloaded when the file
+// changes. A failing hook is logged and changes nothing.
+type luaScript struct {
+	name    string
+	path    string
+	timeout time.Duration
+	metrics *Metrics
+
+	program atomic.Pointer[luaProgram]
+	modTime time.Time
+}
+
+func newLuaScript(name, path string, timeout time.Duration, m *Metrics) (*luaScript, error) {
+	l := &luaScript{name: name, path: path, timeout: timeout, metrics: m}
+	return l, l.load()
+}
+
+// load compiles the script file, replacing the running program on success.
+func (l *luaScript) load() error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	src, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	prog, err := compileLua(l.name, src)
+	if err != nil {
+		return fmt.Errorf("loading Lua script %s: %w", l.name, err)
+	}
+	l.modTime = info.ModTime()
+	l.program.Store(&prog)
+	return nil
+}
+
+// watch reloads the script whenever its modification time changes.
+func (l *luaScript) watch(ctx context.Context) error {
+	ticker := time.NewTicker(pluginReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(l.path)
+		if err != nil || info.ModTime().Equal(l.modTime) {
+			continue
+		}
+		if err := l.load(); err != nil {
+			slog.Warn("Failed to reload Lua script", "script", l.name, "error", err)
+			l.modTime = info.ModTime()
+			continue
+		}
+		slog.Info("Reloaded Lua script", "script", l.name)
+	}
+}
+
+// run calls a hook with the script's timeout, counting failures.
+func (l *luaScript) run(ctx context.Context, phase string, hook func(ctx context.Context) (*PluginDecision, error)) *PluginDecision {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	start := time.Now()
+	d, err := hook(ctx)
+	l.metrics.Observe("server_lua_hook_seconds", time.Since(start).Seconds(), "script", l.name, "phase", phase)
+	if err != nil {
+		l.metrics.Add("server_lua_errors_total", 1, "script", l.name, "phase", phase)
+		slog.Warn("Lua hook failed", "script", l.name, "phase", phase, "error", err)
+		return &PluginDecision{}
+	}
+	if d == nil {
+		return &PluginDecision{}
+	}
+	return d
+}
+
+// middleware runs on_request ahead of routing, and on_response before the
+// response headers are sent.
+func (l *luaScript) middleware() Middleware {
+	return Middleware{Name: "lua:" + l.name, Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			prog := *l.program.Load()
+			req := newPluginRequest(r)
+			d := l.run(r.Context(), "request", func(ctx context.Context) (*PluginDecision, error) {
+				return prog.onRequest(ctx, &req)
+			})
+			if r = d.apply(w, r); r == nil {
+				return
+			}
+			if prog.hasResponseHook() {
+				h := w.Header()
+				w = &luaResponseWriter{ResponseWriter: w, onHeader: func(status int) int {
+					res := PluginResponse{Status: status, Header: h}
+					d := l.run(r.Context(), "response", func(ctx context.Context) (*PluginDecision, error) {
+						return prog.onResponse(ctx, &req, &res)
+					})
+					for _, k := range d.DelHeader {
+						h.Del(k)
+					}
+					for k, v := range d.SetHeader {
+						h.Set(k, v)
+					}
+					if d.Status != 0 {
+						return d.Status
+					}
+					return status
+				}}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// luaResponseWriter runs onHeader once, just before the headers are sent.
+type luaResponseWriter struct {
+	http.ResponseWriter
+	onHeader func(status int) int
+	once     sync.Once
+}
+
+func (l *luaResponseWriter) WriteHeader(status int) {
+	if status < 200 {
+		l.ResponseWriter.WriteHeader(status)
+		return
+	}
+	l.once.Do(func() { status = l.onHeader(status) })
+	l.ResponseWriter.WriteHeader(status)
+}
+
+func (l *luaResponseWriter) Write(p []byte) (int, error) {
+	l.once.Do(func() { l.ResponseWriter.WriteHeader(l.onHeader(http.StatusOK)) })
+	return l.ResponseWriter.Write(p)
+}
+
+func (l *luaResponseWriter) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
+
+// FlushError runs onHeader before a flush sends the headers.
+func (l *luaResponseWriter) FlushError() error {
+	l.once.Do(func() { l.ResponseWriter.WriteHeader(l.onHeader(http.StatusOK)) })
+	return http.NewResponseController(l.ResponseWriter).Flush()
+}
+
+func (l *luaResponseWriter) Flush() {
+	_ = l.FlushError()
+}
+
+func (l *luaResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(l.ResponseWriter).Hijack()
+}
+
+// loadLuaScripts loads the configured scripts as listener middleware, in
+// order.
+func (s *Server) loadLuaScripts() {
+	files, err := parsePluginFiles("Lua script", s.config.LuaScripts)
+	if err != nil {
+		slog.Warn("Ignoring invalid Lua scripts", "error", err)
+		return
+	}
+	for _, f := range files {
+		l, err := newLuaScript(f[0], f[1], s.config.LuaTimeout, s.metrics)
+		if err != nil {
+			slog.Warn("Not loading Lua script", "script", f[0], "error", err)
+			continue
+		}
+		s.Use(l.middleware())
+		s.Supervise("lua-"+l.name, RestartPolicy{Mode: RestartOnFailure}, l.watch)
+	}
+}
@@ -0,0 +1,193 @@
+//go:build lua
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// gopherProgram runs a script on pooled interpreters. Only the base,
+// string, table and math libraries are opened, so scripts cannot reach
+// files, processes or other scripts.
+type gopherProgram struct {
+	proto       *lua.FunctionProto
+	states      sync.Pool
+	hasResponse bool
+}
+
+func compileLua(name string, src []byte) (luaProgram, error) {
+	chunk, err := parse.Parse(bytes.NewReader(src), name)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, err
+	}
+	p := &gopherProgram{proto: proto}
+	L, err := p.newState()
+	if err != nil {
+		return nil, err
+	}
+	if L.GetGlobal("on_request").Type() != lua.LTFunction {
+		return nil, errors.New("script does not define on_request")
+	}
+	p.hasResponse = L.GetGlobal("on_response").Type() == lua.LTFunction
+	p.states.Put(L)
+	return p, nil
+}
+
+func (p *gopherProgram) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		if err := L.CallByParam(lua.P{Fn: L.NewFunction(lib.open), Protect: true}, lua.LString(lib.name)); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.Push(L.NewFunctionFromProto(p.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		return nil, err
+	}
+	return L, nil
+}
+
+func (p *gopherProgram) hasResponseHook() bool {
+	return p.hasResponse
+}
+
+func (p *gopherProgram) onRequest(ctx context.Context, req *PluginRequest) (*PluginDecision, error) {
+	return p.call(ctx, "on_request", req)
+}
+
+func (p *gopherProgram) onResponse(ctx context.Context, req *PluginRequest, res *PluginResponse) (*PluginDecision, error) {
+	return p.call(ctx, "on_response", req, res)
+}
+
+// call runs the hook fn with args converted to tables, decoding its result
+// as a decision. Running past ctx aborts the script.
+func (p *gopherProgram) call(ctx context.Context, fn string, args ...any) (*PluginDecision, error) {
+	L, _ := p.states.Get().(*lua.LState)
+	if L == nil {
+		var err error
+		if L, err = p.newState(); err != nil {
+			return nil, err
+		}
+	}
+	L.SetContext(ctx)
+	largs := make([]lua.LValue, len(args))
+	for i, a := range args {
+		v, err := toLua(L, a)
+		if err != nil {
+			return nil, err
+		}
+		largs[i] = v
+	}
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal(fn), NRet: 1, Protect: true}, largs...)
+	L.RemoveContext()
+	if err != nil {
+		// The interpreter may be mid-call; start over with a fresh one.
+		L.Close()
+		return nil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	p.states.Put(L)
+	if ret == lua.LNil {
+		return nil, nil
+	}
+	raw, err := json.Marshal(fromLua(ret))
+	if err != nil {
+		return nil, err
+	}
+	var d PluginDecision
+	if err := json.Unmarshal(raw, &d); err != nil {
+		return nil, fmt.Errorf("%s returned an invalid decision: %w", fn, err)
+	}
+	return &d, nil
+}
+
+// toLua converts v to Lua through its JSON form, so scripts see the same
+// field names as WASM plugins.
+func toLua(L *lua.LState, v any) (lua.LValue, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic any
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		return nil, err
+	}
+	return luaValue(L, generic), nil
+}
+
+func luaValue(L *lua.LState, v any) lua.LValue {
+	switch v := v.(type) {
+	case string:
+		return lua.LString(v)
+	case float64:
+		return lua.LNumber(v)
+	case bool:
+		return lua.LBool(v)
+	case []any:
+		t := L.NewTable()
+		for _, e := range v {
+			t.Append(luaValue(L, e))
+		}
+		return t
+	case map[string]any:
+		t := L.NewTable()
+		for k, e := range v {
+			t.RawSetString(k, luaValue(L, e))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+// fromLua converts a Lua value to its JSON form; tables with a sequence
+// part become arrays.
+func fromLua(v lua.LValue) any {
+	switch v := v.(type) {
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LBool:
+		return bool(v)
+	case *lua.LTable:
+		if n := v.MaxN(); n > 0 {
+			out := make([]any, 0, n)
+			for i := 1; i <= n; i++ {
+				out = append(out, fromLua(v.RawGetInt(i)))
+			}
+			return out
+		}
+		out := make(map[string]any)
+		v.ForEach(func(k, e lua.LValue) {
+			if s, ok := k.(lua.LString); ok {
+				out[string(s)] = fromLua(e)
+			}
+		})
+		return out
+	}
+	return nil
+}
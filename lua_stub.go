@@ -0,0 +1,9 @@
+//go:build !lua
+
+package main
+
+import "errors"
+
+func compileLua(name string, src []byte) (luaProgram, error) {
+	return nil, errors.New("Lua scripts require building with -tags lua")
+}
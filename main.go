@@ -4,10 +4,48 @@ import (
 	"context"
 	"log/slog"
 	"os"
+	"os/signal"
 )
 
 func main() {
-	serv := NewServer(":8081", ":8082")
+	cfg, args, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+
+	serv := NewServer(cfg.HTTPAddr, cfg.HTTPSAddr, WithConfig(cfg))
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "routes":
+			if err := serv.PrintRoutes(os.Stdout); err != nil {
+				slog.Error(err.Error())
+				os.Exit(1)
+			}
+			return
+		case "replay":
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			if err := runReplay(ctx, args[1:], os.Stdout); err != nil {
+				slog.Error(err.Error())
+				os.Exit(1)
+			}
+			return
+		case "loadtest":
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			if err := runLoadtest(ctx, args[1:], os.Stdout); err != nil {
+				slog.Error(err.Error())
+				os.Exit(1)
+			}
+			return
+		default:
+			slog.Error("unknown command", "command", args[0])
+			os.Exit(2)
+		}
+	}
+
 	if err := serv.Run(context.Background()); err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mdnsGroup is the IPv4 mDNS multicast address (RFC 6762).
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const (
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	mdnsTTL        = 120
+	mdnsCacheFlush = 0x8000
+	mdnsService    = "_http._tcp.local"
+)
+
+// mdnsResponder answers mDNS queries for <name>.local and advertises the
+// HTTP listener as a DNS-SD _http._tcp service, so LAN devices can find a
+// dev server without knowing its IP.
+type mdnsResponder struct {
+	host     string // e.g. myapp.local
+	instance string // e.g. myapp._http._tcp.local
+	port     uint16
+}
+
+func newMDNSResponder(name, httpAddr string) (*mdnsResponder, error) {
+	binds, err := parseBindAddrs(httpAddr)
+	if err != nil {
+		return nil, err
+	}
+	_, portStr, _ := net.SplitHostPort(binds[0][1])
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".local")
+	return &mdnsResponder{host: name + ".local", instance: name + "." + mdnsService, port: uint16(port)}, nil
+}
+
+// run answers queries until ctx is done, announcing on start and sending a
+// goodbye on exit.
+func (m *mdnsResponder) run(ctx context.Context) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	slog.Info("Advertising via mDNS", "host", m.host, "service", m.instance, "port", m.port)
+
+	go func() {
+		for i := range 2 {
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+			}
+			_, _ = conn.WriteToUDP(m.response(0, dnsTypeANY, m.instance, mdnsTTL), mdnsGroup)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		_, _ = conn.WriteToUDP(m.response(0, dnsTypeANY, m.instance, 0), mdnsGroup)
+		_ = conn.Close()
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		m.handle(conn, buf[:n], from)
+	}
+}
+
+func (m *mdnsResponder) handle(conn *net.UDPConn, b []byte, from *net.UDPAddr) {
+	if len(b) < 12 || binary.BigEndian.Uint16(b[2:])&0x8000 != 0 {
+		return // too short, or a response
+	}
+	id := binary.BigEndian.Uint16(b)
+	qd := binary.BigEndian.Uint16(b[4:])
+	off := 12
+	for range qd {
+		name, next, ok := readDNSName(b, off)
+		if !ok || next+4 > len(b) {
+			return
+		}
+		qtype := binary.BigEndian.Uint16(b[next:])
+		off = next + 4
+
+		resp := m.response(id, qtype, strings.ToLower(name), mdnsTTL)
+		if resp == nil {
+			continue
+		}
+		// Legacy unicast resolvers query from an ephemeral port and
+		// expect the answer back there; everyone else listens on the group.
+		dst := mdnsGroup
+		if from.Port != mdnsGroup.Port {
+			dst = from
+		}
+		_, _ = conn.WriteToUDP(resp, dst)
+	}
+}
+
+// response builds the answer for a question, or nil if name is not ours.
+// The service records are always sent together so one query is enough.
+func (m *mdnsResponder) response(id, qtype uint16, name string, ttl uint32) []byte {
+	var answers [][]byte
+	switch {
+	case name == m.host && (qtype == dnsTypeA || qtype == dnsTypeANY):
+		answers = m.addrRecords(ttl)
+	case name == mdnsService && (qtype == dnsTypePTR || qtype == dnsTypeANY),
+		name == m.instance:
+		answers = append(answers,
+			dnsRecord(mdnsService, dnsTypePTR, ttl, appendDNSName(nil, m.instance)),
+			dnsRecord(m.instance, dnsTypeSRV|mdnsCacheFlush<<16, ttl, m.srvData()),
+			dnsRecord(m.instance, dnsTypeTXT|mdnsCacheFlush<<16, ttl, []byte{0}),
+		)
+		answers = append(answers, m.addrRecords(ttl)...)
+	default:
+		return nil
+	}
+	if len(answers) == 0 {
+		return nil
+	}
+
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x84, 0x00, 0, 0) // response, authoritative; no questions
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(answers)))
+	msg = append(msg, 0, 0, 0, 0)
+	for _, a := range answers {
+		msg = append(msg, a...)
+	}
+	return msg
+}
+
+func (m *mdnsResponder) srvData() []byte {
+	data := []byte{0, 0, 0, 0} // priority, weight
+	data = binary.BigEndian.AppendUint16(data, m.port)
+	return appendDNSName(data, m.host)
+}
+
+func (m *mdnsResponder) addrRecords(ttl uint32) [][]byte {
+	var out [][]byte
+	for _, addr := range lanAddrs() {
+		out = append(out, dnsRecord(m.host, dnsTypeA|mdnsCacheFlush<<16, ttl, addr.AsSlice()))
+	}
+	return out
+}
+
+// lanAddrs returns the non-loopback IPv4 addresses of interfaces that are up.
+func lanAddrs() []netip.Addr {
+	var out []netip.Addr
+	ifaces, _ := net.Interfaces()
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if pfx, err := netip.ParsePrefix(a.String()); err == nil && pfx.Addr().Is4() {
+				out = append(out, pfx.Addr())
+			}
+		}
+	}
+	return out
+}
+
+// dnsRecord encodes a resource record of class IN. The upper 16 bits of
+// typ carry extra class bits such as the mDNS cache-flush flag.
+func dnsRecord(name string, typ uint32, ttl uint32, data []byte) []byte {
+	rr := appendDNSName(nil, name)
+	rr = binary.BigEndian.AppendUint16(rr, uint16(typ))
+	rr = binary.BigEndian.AppendUint16(rr, dnsClassIN|uint16(typ>>16))
+	rr = binary.BigEndian.AppendUint32(rr, ttl)
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(data)))
+	return append(rr, data...)
+}
+
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readDNSName decodes the possibly compressed name at off and returns it
+// with the offset just past it.
+func readDNSName(b []byte, off int) (string, int, bool) {
+	var labels []string
+	next := -1
+	for hops := 0; off < len(b) && hops < 16; {
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, true
+		case l&0xc0 == 0xc0:
+			if off+2 > len(b) {
+				return "", 0, false
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+			hops++
+		default:
+			if off+1+l > len(b) {
+				return "", 0, false
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+	return "", 0, false
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestReadDNSName(t *testing.T) {
+	// "myapp.local" at 0, then "_http._tcp" followed by a pointer to
+	// "local" at offset 6.
+	msg := appendDNSName(nil, "myapp.local")
+	ptr := len(msg)
+	msg = append(msg, 5, '_', 'h', 't', 't', 'p', 4, '_', 't', 'c', 'p', 0xc0, 6)
+
+	tests := []struct {
+		name     string
+		b        []byte
+		off      int
+		want     string
+		wantNext int
+		ok       bool
+	}{
+		{"plain", msg, 0, "myapp.local", ptr, true},
+		{"compressed", msg, ptr, "_http._tcp.local", len(msg), true},
+		{"root", []byte{0}, 0, "", 1, true},
+		{"pointer loop", []byte{0xc0, 0}, 0, "", 0, false},
+		{"truncated label", []byte{5, 'a', 'b'}, 0, "", 0, false},
+		{"truncated pointer", []byte{0xc0}, 0, "", 0, false},
+		{"unterminated", []byte{1, 'a'}, 0, "", 0, false},
+		{"offset past end", msg, len(msg), "", 0, false},
+	}
+	for _, tt := range tests {
+		name, next, ok := readDNSName(tt.b, tt.off)
+		if name != tt.want || next != tt.wantNext || ok != tt.ok {
+			t.Errorf("%s: readDNSName = %q, %d, %v; want %q, %d, %v", tt.name, name, next, ok, tt.want, tt.wantNext, tt.ok)
+		}
+	}
+}
+
+func TestMDNSResponse(t *testing.T) {
+	m, err := newMDNSResponder("MyApp", ":8081")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := len(lanAddrs())
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  int // answer records; -1 for no response
+	}{
+		{"_http._tcp.local", dnsTypePTR, 3 + addrs},
+		{"_http._tcp.local", dnsTypeANY, 3 + addrs},
+		{"_http._tcp.local", dnsTypeTXT, -1},
+		{"myapp._http._tcp.local", dnsTypeSRV, 3 + addrs},
+		{"other.local", dnsTypeANY, -1},
+	}
+	for _, tt := range tests {
+		resp := m.response(7, tt.qtype, tt.name, mdnsTTL)
+		if tt.want < 0 {
+			if resp != nil {
+				t.Errorf("%s type %d: answered, want no response", tt.name, tt.qtype)
+			}
+			continue
+		}
+		if len(resp) < 12 {
+			t.Fatalf("%s type %d: response %x", tt.name, tt.qtype, resp)
+		}
+		if id := binary.BigEndian.Uint16(resp); id != 7 {
+			t.Errorf("%s type %d: id %d, want 7", tt.name, tt.qtype, id)
+		}
+		if n := binary.BigEndian.Uint16(resp[6:]); int(n) != tt.want {
+			t.Errorf("%s type %d: %d answers, want %d", tt.name, tt.qtype, n, tt.want)
+		}
+		if name, _, ok := readDNSName(resp, 12); !ok || name != mdnsService {
+			t.Errorf("%s type %d: first answer for %q", tt.name, tt.qtype, name)
+		}
+	}
+
+	resp := m.response(0, dnsTypeA, "myapp.local", mdnsTTL)
+	if resp != nil {
+		if n := binary.BigEndian.Uint16(resp[6:]); int(n) != addrs {
+			t.Errorf("A query: %d answers, want one per LAN address (%d)", n, addrs)
+		}
+	} else if addrs > 0 {
+		t.Error("A query: no response despite LAN addresses")
+	}
+}
+
+func FuzzReadDNSName(f *testing.F) {
+	f.Add(appendDNSName(nil, "myapp._http._tcp.local"), 0)
+	f.Add([]byte{1, 'a', 0xc0, 0}, 2)
+	f.Add([]byte{0xc0, 0}, 0)
+	f.Fuzz(func(t *testing.T, b []byte, off int) {
+		if off < 0 {
+			return
+		}
+		name, next, ok := readDNSName(b, off)
+		if !ok {
+			return
+		}
+		if next <= off || next > len(b) {
+			t.Fatalf("next = %d for off %d in %d bytes", next, off, len(b))
+		}
+		if len(name) > 17*len(b) {
+			t.Fatalf("name of %d bytes from %d input bytes", len(name), len(b))
+		}
+	})
+}
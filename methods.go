@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// standardMethods are probed for paths with method-less routes, which
+// match any method.
+var standardMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// autoMethods answers OPTIONS with 204 and 405s with an Allow header listing
+// what the route table serves for the path, so routes need not register
+// OPTIONS themselves. Routes that do register OPTIONS handle it as usual.
+func (s *Server) autoMethods(listener string, mux *http.ServeMux) http.Handler {
+	methods := []string{http.MethodOptions}
+	for _, rt := range s.routes {
+		if rt.Listener != listener {
+			continue
+		}
+		switch rt.Method {
+		case "*":
+			methods = append(methods, standardMethods...)
+		case http.MethodGet:
+			methods = append(methods, http.MethodGet, http.MethodHead)
+		default:
+			methods = append(methods, rt.Method)
+		}
+	}
+	slices.Sort(methods)
+	methods = slices.Compact(methods)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		allowed := allowedMethods(mux, r, methods)
+		if allowed == nil {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	})
+}
+
+// allowedMethods returns the methods among candidates that some route
+// serves for r's path, with OPTIONS added, or nil when there are none.
+func allowedMethods(mux *http.ServeMux, r *http.Request, candidates []string) []string {
+	var allowed []string
+	probe := *r
+	for _, m := range candidates {
+		probe.Method = m
+		if _, pattern := mux.Handler(&probe); pattern != "" || m == http.MethodOptions {
+			allowed = append(allowed, m)
+		}
+	}
+	if len(allowed) == 1 {
+		return nil
+	}
+	return allowed
+}
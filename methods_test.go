@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAutoMethods(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.NoAutoHeadPatterns = []string{"GET /report"} })
+	page := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("hello, world"))
+	}
+	s.HandleFunc(ListenerHTTP, "GET /page", page)
+	s.HandleFunc(ListenerHTTP, "POST /page", page)
+	s.HandleFunc(ListenerHTTP, "GET /report", page)
+	s.HandleFunc(ListenerHTTP, "GET /export", page, NoAutoHEAD)
+	s.HandleFunc(ListenerHTTP, "OPTIONS /custom", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	tests := []struct {
+		method, target string
+		want           int
+		allow          string
+	}{
+		{http.MethodGet, "/page", http.StatusOK, ""},
+		{http.MethodOptions, "/page", http.StatusNoContent, "GET, HEAD, OPTIONS, POST"},
+		{http.MethodDelete, "/page", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS, POST"},
+		{http.MethodOptions, "/custom", http.StatusTeapot, ""},
+		{http.MethodHead, "/report", http.StatusMethodNotAllowed, "GET, OPTIONS"},
+		{http.MethodHead, "/export", http.StatusMethodNotAllowed, "GET, OPTIONS"},
+	}
+	for _, tt := range tests {
+		rec := serveListener(s, ListenerHTTP, httptest.NewRequest(tt.method, tt.target, nil))
+		if rec.Code != tt.want || rec.Header().Get("Allow") != tt.allow {
+			t.Errorf("%s %s: %d Allow %q, want %d Allow %q", tt.method, tt.target, rec.Code, rec.Header().Get("Allow"), tt.want, tt.allow)
+		}
+	}
+}
+
+func TestAutoHEAD(t *testing.T) {
+	s := newTestServer(t, nil)
+	var ran string
+	s.HandleFunc(ListenerHTTP, "GET /page", func(w http.ResponseWriter, r *http.Request) {
+		ran = r.Method
+		w.Header().Set("X-Page", "1")
+		_, _ = w.Write([]byte("hello, world"))
+	})
+
+	rec := serveListener(s, ListenerHTTP, httptest.NewRequest(http.MethodHead, "/page", nil))
+	if ran != http.MethodHead {
+		t.Errorf("handler saw %q, want the HEAD request", ran)
+	}
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("HEAD: %d with %d body bytes", rec.Code, rec.Body.Len())
+	}
+	if rec.Header().Get("Content-Length") != "12" || rec.Header().Get("X-Page") != "1" {
+		t.Errorf("HEAD headers %v, want the GET's", rec.Header())
+	}
+}
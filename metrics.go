@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics is a small in-process registry that renders in the Prometheus text
+// exposition format. Series are identified by name plus an ordered list of
+// label key/value pairs.
+type Metrics struct {
+	mu     sync.Mutex
+	kinds  map[string]string
+	series map[string]float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{kinds: make(map[string]string), series: make(map[string]float64)}
+}
+
+// Add increments a counter by v.
+func (m *Metrics) Add(name string, v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kinds[name] = "counter"
+	m.series[seriesKey(name, labels)] += v
+}
+
+// Set replaces the value of a gauge.
+func (m *Metrics) Set(name string, v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kinds[name] = "gauge"
+	m.series[seriesKey(name, labels)] = v
+}
+
+// Observe records a sample into a summary, tracked as _sum and _count.
+func (m *Metrics) Observe(name string, v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kinds[name] = "summary"
+	m.series[seriesKey(name+"_sum", labels)] += v
+	m.series[seriesKey(name+"_count", labels)]++
+}
+
+// Value returns the current value of a series, mostly useful for the admin API.
+func (m *Metrics) Value(name string, labels ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.series[seriesKey(name, labels)]
+}
+
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	m.render(buf)
+	return buf.WriteTo(w)
+}
+
+// render writes the exposition text into buf, so the lock is not held while
+// a slow scraper reads it.
+func (m *Metrics) render(buf *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.series))
+	families := make(map[string]string, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+		families[k] = m.family(k)
+	}
+	// Sort by family first so a family's series stay together under its
+	// TYPE line, even where another metric's name sorts between them.
+	sort.Slice(keys, func(i, j int) bool {
+		if fi, fj := families[keys[i]], families[keys[j]]; fi != fj {
+			return fi < fj
+		}
+		return keys[i] < keys[j]
+	})
+
+	family := ""
+	for _, k := range keys {
+		if f := families[k]; f != family {
+			family = f
+			if kind, ok := m.kinds[family]; ok {
+				fmt.Fprintf(buf, "# TYPE %s %s\n", family, kind)
+			}
+		}
+		fmt.Fprintf(buf, "%s %g\n", k, m.series[k])
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = m.WriteTo(w)
+}
+
+// Push sends the current snapshot to a Prometheus Pushgateway style URL,
+// e.g. http://pushgateway:9091/metrics/job/serverConcurrent.
+func (m *Metrics) Push(ctx context.Context, client *http.Client, url string) error {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("pushing metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushing metrics: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func seriesKey(name string, labels []string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%s=%q", labels[i], labels[i+1])
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// family returns the metric family a series key belongs to: its name, less
+// the _sum or _count suffix for summary series.
+func (m *Metrics) family(key string) string {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		key = key[:i]
+	}
+	if _, ok := m.kinds[key]; ok {
+		return key
+	}
+	for _, suffix := range []string{"_sum", "_count"} {
+		if base, ok := strings.CutSuffix(key, suffix); ok && (m.kinds[base] == "summary" || m.kinds[base] == "histogram") {
+			return base
+		}
+	}
+	return key
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricsWriteToGroupsFamilies(t *testing.T) {
+	m := NewMetrics()
+	m.Observe("req_duration", 0.5, "route", "/a")
+	m.Add("retry_count", 3)    // a counter that merely ends in _count
+	m.Add("req_duration_b", 1) // sorts between the summary's series
+	m.Set("queue_count", 7)
+
+	var sb strings.Builder
+	if _, err := m.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	want := `# TYPE queue_count gauge
+queue_count 7
+# TYPE req_duration summary
+req_duration_count{route="/a"} 1
+req_duration_sum{route="/a"} 0.5
+# TYPE req_duration_b counter
+req_duration_b 1
+# TYPE retry_count counter
+retry_count 3
+`
+	if got := sb.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
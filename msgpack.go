@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+)
+
+// encodeMsgPack writes v as MessagePack.
+func encodeMsgPack(w io.Writer, v any) error {
+	return transcodeJSON(w, v, msgpackFormat{})
+}
+
+type msgpackFormat struct{}
+
+// container writes a map or array header in the smallest form: fix (up to
+// 15 elements), 16-bit or 32-bit.
+func (msgpackFormat) container(buf *bytes.Buffer, object bool, n int) {
+	fix, b16, b32 := byte(0x90), byte(0xdc), byte(0xdd)
+	if object {
+		fix, b16, b32 = 0x80, 0xde, 0xdf
+	}
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		buf.WriteByte(b32)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+func (msgpackFormat) str(buf *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		buf.WriteByte(0xdb)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+	buf.WriteString(s)
+}
+
+// number writes integers in the smallest integer form and anything else as
+// a float64.
+func (msgpackFormat) number(buf *bytes.Buffer, n json.Number) error {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		switch {
+		case i >= 0 && i < 128, i >= -32 && i < 0:
+			buf.WriteByte(byte(i))
+		case i >= math.MinInt8 && i <= math.MaxInt8:
+			buf.WriteByte(0xd0)
+			buf.WriteByte(byte(i))
+		case i >= math.MinInt16 && i <= math.MaxInt16:
+			buf.WriteByte(0xd1)
+			buf.Write(binary.BigEndian.AppendUint16(nil, uint16(i)))
+		case i >= math.MinInt32 && i <= math.MaxInt32:
+			buf.WriteByte(0xd2)
+			buf.Write(binary.BigEndian.AppendUint32(nil, uint32(i)))
+		default:
+			buf.WriteByte(0xd3)
+			buf.Write(binary.BigEndian.AppendUint64(nil, uint64(i)))
+		}
+		return nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		buf.WriteByte(0xcf)
+		buf.Write(binary.BigEndian.AppendUint64(nil, u))
+		return nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(0xcb)
+	buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+	return nil
+}
+
+func (msgpackFormat) boolean(buf *bytes.Buffer, b bool) {
+	if b {
+		buf.WriteByte(0xc3)
+	} else {
+		buf.WriteByte(0xc2)
+	}
+}
+
+func (msgpackFormat) null(buf *bytes.Buffer) { buf.WriteByte(0xc0) }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEncodeMsgPack(t *testing.T) {
+	tests := []struct {
+		v    any
+		want string
+	}{
+		{nil, "c0"},
+		{true, "c3"},
+		{false, "c2"},
+		{0, "00"},
+		{127, "7f"},
+		{128, "d1 0080"},
+		{-1, "ff"},
+		{-32, "e0"},
+		{-33, "d0 df"},
+		{-129, "d1 ff7f"},
+		{70000, "d2 00011170"},
+		{int64(math.MinInt64), "d3 8000000000000000"},
+		{uint64(math.MaxUint64), "cf ffffffffffffffff"},
+		{1.5, "cb 3ff8000000000000"},
+		{"", "a0"},
+		{"hi", "a2 6869"},
+		{strings.Repeat("x", 32), "d9 20" + strings.Repeat("78", 32)},
+		{strings.Repeat("x", 256), "da 0100" + strings.Repeat("78", 256)},
+		{[]int{1, 2}, "92 01 02"},
+		{make([]bool, 16), "dc 0010" + strings.Repeat("c2", 16)},
+		{struct {
+			B string `json:"b"`
+			A []any  `json:"a"`
+		}{"x", nil}, "82 a162 a178 a161 c0"},
+		{map[string]any{}, "80"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := encodeMsgPack(&buf, tt.v); err != nil {
+			t.Errorf("%#v: %v", tt.v, err)
+			continue
+		}
+		if got, want := hex.EncodeToString(buf.Bytes()), strings.ReplaceAll(tt.want, " ", ""); got != want {
+			t.Errorf("%#v: %s, want %s", tt.v, got, want)
+		}
+	}
+
+	if err := encodeMsgPack(&bytes.Buffer{}, json.RawMessage("1e400")); err == nil {
+		t.Error("encoded a number out of float64 range")
+	}
+	if err := encodeMsgPack(&bytes.Buffer{}, func() {}); err == nil {
+		t.Error("encoded a func")
+	}
+}
+
+// decodeMsgPack decodes the subset of MessagePack encodeMsgPack writes.
+func decodeMsgPack(b []byte) (any, []byte, error) {
+	errShort := errors.New("short buffer")
+	take := func(n int) ([]byte, error) {
+		if len(b) < n {
+			return nil, errShort
+		}
+		p := b[:n]
+		b = b[n:]
+		return p, nil
+	}
+	size := func(n int) (int, error) {
+		p, err := take(n)
+		if err != nil {
+			return 0, err
+		}
+		var v int
+		for _, c := range p {
+			v = v<<8 | int(c)
+		}
+		return v, nil
+	}
+	if len(b) == 0 {
+		return nil, nil, errShort
+	}
+	c := b[0]
+	b = b[1:]
+	var n int
+	var err error
+	switch {
+	case c < 0x80:
+		return int64(c), b, nil
+	case c >= 0xe0:
+		return int64(int8(c)), b, nil
+	case c == 0xc0:
+		return nil, b, nil
+	case c == 0xc2, c == 0xc3:
+		return c == 0xc3, b, nil
+	case c >= 0xd0 && c <= 0xd3:
+		p, err := take(1 << (c - 0xd0))
+		if err != nil {
+			return nil, nil, err
+		}
+		var u uint64
+		for _, x := range p {
+			u = u<<8 | uint64(x)
+		}
+		shift := 64 - 8*len(p)
+		return int64(u<<shift) >> shift, b, nil
+	case c == 0xcf:
+		p, err := take(8)
+		if err != nil {
+			return nil, nil, err
+		}
+		return binary.BigEndian.Uint64(p), b, nil
+	case c == 0xcb:
+		p, err := take(8)
+		if err != nil {
+			return nil, nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(p)), b, nil
+	case c&0xe0 == 0xa0, c == 0xd9, c == 0xda, c == 0xdb:
+		n = int(c & 0x1f)
+		if c >= 0xd9 {
+			n, err = size(1 << (c - 0xd9))
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		p, err := take(n)
+		return string(p), b, err
+	case c&0xf0 == 0x90, c == 0xdc, c == 0xdd:
+		n = int(c & 0x0f)
+		if c >= 0xdc {
+			n, err = size(2 << (c - 0xdc))
+		}
+		a := []any{}
+		for i := 0; err == nil && i < n; i++ {
+			var v any
+			v, b, err = decodeMsgPack(b)
+			a = append(a, v)
+		}
+		return a, b, err
+	case c&0xf0 == 0x80, c == 0xde, c == 0xdf:
+		n = int(c & 0x0f)
+		if c >= 0xde {
+			n, err = size(2 << (c - 0xde))
+		}
+		m := map[string]any{}
+		for i := 0; err == nil && i < n; i++ {
+			var k, v any
+			if k, b, err = decodeMsgPack(b); err != nil {
+				break
+			}
+			v, b, err = decodeMsgPack(b)
+			m[k.(string)] = v
+		}
+		return m, b, err
+	}
+	return nil, nil, errors.New("unexpected type byte " + strconv.Itoa(int(c)))
+}
+
+// msgpackNormalize converts a value decoded with UseNumber to the types
+// decodeMsgPack returns.
+func msgpackNormalize(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return u
+		}
+		f, _ := v.Float64()
+		return f
+	case []any:
+		for i := range v {
+			v[i] = msgpackNormalize(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = msgpackNormalize(v[k])
+		}
+	}
+	return v
+}
+
+func FuzzEncodeMsgPack(f *testing.F) {
+	f.Add(`{"a": [1, -1, 300, -70000, 1.5, 18446744073709551615, 1e300], "b": {"c": null, "d": true}}`)
+	f.Add(`"` + strings.Repeat("é", 40) + `"`)
+	f.Add(`[` + strings.Repeat(`0,`, 20) + `0]`)
+	f.Fuzz(func(t *testing.T, doc string) {
+		want, err := decodeJSONValue([]byte(doc))
+		if err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if err := encodeMsgPack(&buf, json.RawMessage(doc)); err != nil {
+			return // e.g. numbers beyond float64
+		}
+		got, rest, err := decodeMsgPack(buf.Bytes())
+		if err != nil || len(rest) != 0 {
+			t.Fatalf("%s: decoding %x: %v, %d bytes left", doc, buf.Bytes(), err, len(rest))
+		}
+		// encoding/json re-escapes invalid UTF-8, so compare with what it
+		// would produce.
+		raw, _ := json.Marshal(json.RawMessage(doc))
+		want, _ = decodeJSONValue(raw)
+		if want = msgpackNormalize(want); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: round trip %#v, want %#v", doc, got, want)
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ndjsonWriteTimeout is the default bound on one NDJSON write.
+const ndjsonWriteTimeout = 30 * time.Second
+
+// NDJSONOptions configures a newline-delimited JSON stream.
+type NDJSONOptions struct {
+	// FlushInterval batches records: output is flushed at most this often
+	// instead of after every record. Zero flushes each record.
+	FlushInterval time.Duration
+	// WriteTimeout bounds each write and flush. A client that stops reading
+	// pushes back through TCP until Encode blocks; past this it is
+	// disconnected instead of holding the handler. Zero means 30s.
+	WriteTimeout time.Duration
+	// Final, if non-nil, is written as the last record when the server
+	// shuts down, so clients can tell shutdown from a dropped connection.
+	Final any
+}
+
+// NDJSON wraps a Stream with newline-delimited JSON framing.
+type NDJSON struct {
+	*Stream
+	ctx   context.Context
+	opts  NDJSONOptions
+	dirty bool // records written since the last flush; guarded by Stream.mu
+}
+
+// OpenNDJSON starts a 200 application/x-ndjson response registered as a
+// stream. Handlers write records with Encode and must call Close.
+func (s *Server) OpenNDJSON(w http.ResponseWriter, r *http.Request, opts NDJSONOptions) (*NDJSON, context.Context) {
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = ndjsonWriteTimeout
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	var final func(w http.ResponseWriter)
+	if opts.Final != nil {
+		final = func(w http.ResponseWriter) { _ = json.NewEncoder(w).Encode(opts.Final) }
+	}
+	st, ctx := s.OpenStream(w, r, final)
+	n := &NDJSON{Stream: st, ctx: ctx, opts: opts}
+	if opts.FlushInterval > 0 {
+		go n.flushLoop()
+	}
+	return n, ctx
+}
+
+// Encode writes v as one line. It returns the context's error once the
+// client has gone or the server is shutting down, and a write error if the
+// client stopped reading; the stream is cancelled in that case.
+func (n *NDJSON) Encode(v any) error {
+	if err := n.ctx.Err(); err != nil {
+		return err
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return http.ErrServerClosed
+	}
+	err := n.withDeadline(func() error {
+		if _, err := n.w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		n.dirty = true
+		if n.opts.FlushInterval > 0 {
+			return nil
+		}
+		return n.flushLocked()
+	})
+	if err != nil {
+		n.cancel()
+	}
+	return err
+}
+
+// Close flushes buffered records and unregisters the stream.
+func (n *NDJSON) Close() {
+	n.mu.Lock()
+	if !n.closed {
+		_ = n.withDeadline(n.flushLocked)
+	}
+	n.mu.Unlock()
+	n.Stream.Close()
+}
+
+// withDeadline runs fn with the write deadline set, clearing it afterwards
+// so an idle stream is not cut off. n.mu must be held.
+func (n *NDJSON) withDeadline(fn func() error) error {
+	_ = n.rc.SetWriteDeadline(time.Now().Add(n.opts.WriteTimeout))
+	defer func() { _ = n.rc.SetWriteDeadline(time.Time{}) }()
+	return fn()
+}
+
+// flushLocked flushes if records were written since the last flush. n.mu
+// must be held.
+func (n *NDJSON) flushLocked() error {
+	if !n.dirty {
+		return nil
+	}
+	n.dirty = false
+	return n.rc.Flush()
+}
+
+// flushLoop flushes batched records every FlushInterval.
+func (n *NDJSON) flushLoop() {
+	ticker := time.NewTicker(n.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+			n.mu.Lock()
+			var err error
+			if !n.closed {
+				err = n.withDeadline(n.flushLocked)
+			}
+			n.mu.Unlock()
+			if err != nil {
+				n.cancel()
+				return
+			}
+		}
+	}
+}
+
+// ndjsonHandler serves GET /debug/ndjson?interval=100ms, emitting a
+// numbered token per interval and flushing once a second; it exists to
+// exercise OpenNDJSON.
+func (s *Server) ndjsonHandler(w http.ResponseWriter, r *http.Request) {
+	interval := 100 * time.Millisecond
+	if raw := r.URL.Query().Get("interval"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < time.Millisecond {
+			http.Error(w, "interval must be a duration of at least 1ms", http.StatusBadRequest)
+			return
+		}
+		interval = d
+	}
+	nd, ctx := s.OpenNDJSON(w, r, NDJSONOptions{FlushInterval: time.Second, Final: map[string]string{"event": "shutdown"}})
+	defer nd.Close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for seq := 1; ; seq++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			token, err := helloGenerator.String(10)
+			if err != nil {
+				return
+			}
+			if err := nd.Encode(map[string]any{"seq": seq, "token": token}); err != nil {
+				return
+			}
+		}
+	}
+}
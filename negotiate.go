@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Renderer encodes response values in one media type.
+type Renderer struct {
+	// MediaType is matched against the request's Accept header.
+	MediaType string
+	// ContentType is sent with the response; empty means MediaType.
+	ContentType string
+	Encode      func(w io.Writer, v any) error
+	// Decode reads a request body in MediaType into v; nil means the
+	// renderer only encodes.
+	Decode func(r io.Reader, v any) error
+}
+
+// Built-in renderers. Values are encoded as for encoding/json, except by
+// RenderXML, which follows encoding/xml and so cannot encode maps. The
+// binary formats suit machine-to-machine clients; they are produced by
+// transcoding the JSON encoding, and only JSON and XML decode bodies.
+var (
+	RenderJSON = Renderer{MediaType: "application/json", Encode: func(w io.Writer, v any) error {
+		return json.NewEncoder(w).Encode(v)
+	}, Decode: func(r io.Reader, v any) error {
+		return json.NewDecoder(r).Decode(v)
+	}}
+	RenderXML = Renderer{MediaType: "application/xml", ContentType: "application/xml; charset=utf-8", Encode: func(w io.Writer, v any) error {
+		if _, err := io.WriteString(w, xml.Header); err != nil {
+			return err
+		}
+		return xml.NewEncoder(w).Encode(v)
+	}, Decode: func(r io.Reader, v any) error {
+		return xml.NewDecoder(r).Decode(v)
+	}}
+	RenderMsgPack = Renderer{MediaType: "application/msgpack", Encode: encodeMsgPack}
+	RenderCBOR    = Renderer{MediaType: "application/cbor", Encode: encodeCBOR}
+)
+
+// RenderHTML returns a renderer executing tmpl with the value.
+func RenderHTML(tmpl *template.Template) Renderer {
+	return Renderer{MediaType: "text/html", ContentType: "text/html; charset=utf-8", Encode: func(w io.Writer, v any) error {
+		return tmpl.Execute(w, v)
+	}}
+}
+
+// Negotiator picks a renderer for each request from its Accept header, so
+// one handler can serve the same value in several formats.
+type Negotiator struct {
+	renderers []Renderer
+}
+
+// NewNegotiator returns a negotiator over renderers. The first one is used
+// when the request has no Accept header, and wins ties.
+func NewNegotiator(renderers ...Renderer) *Negotiator {
+	return &Negotiator{renderers: renderers}
+}
+
+// Render encodes v with the renderer the request accepts best and writes
+// it with status. Requests accepting none of the renderers get 406.
+func (n *Negotiator) Render(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Add("Vary", "Accept")
+	rd, ok := n.pick(r.Header.Get("Accept"))
+	if !ok {
+		types := make([]string, len(n.renderers))
+		for i, rd := range n.renderers {
+			types[i] = rd.MediaType
+		}
+		http.Error(w, "not acceptable; available: "+strings.Join(types, ", "), http.StatusNotAcceptable)
+		return
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := rd.Encode(buf, v); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	contentType := rd.ContentType
+	if contentType == "" {
+		contentType = rd.MediaType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// ErrUnsupportedMediaType is returned by Decode for a body in a media type
+// none of the renderers decodes; handlers answer it with 415.
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+// Decode reads the request body into v with the renderer for its
+// Content-Type. A body without one is taken to be in the first renderer's
+// media type.
+func (n *Negotiator) Decode(r *http.Request, v any) error {
+	if len(n.renderers) == 0 {
+		return ErrUnsupportedMediaType
+	}
+	rd := n.renderers[0]
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return ErrUnsupportedMediaType
+		}
+		i := slices.IndexFunc(n.renderers, func(rd Renderer) bool { return rd.MediaType == mt && rd.Decode != nil })
+		if i < 0 {
+			return ErrUnsupportedMediaType
+		}
+		rd = n.renderers[i]
+	}
+	if rd.Decode == nil {
+		return ErrUnsupportedMediaType
+	}
+	return rd.Decode(r.Body, v)
+}
+
+// acceptRange is one media range of an Accept header.
+type acceptRange struct {
+	typ, sub string
+	q        float64
+}
+
+// pick returns the renderer with the highest quality in accept. Each
+// renderer takes the quality of the most specific range matching it.
+func (n *Negotiator) pick(accept string) (Renderer, bool) {
+	if len(n.renderers) == 0 {
+		return Renderer{}, false
+	}
+	ranges := parseAccept(accept)
+	if len(ranges) == 0 {
+		return n.renderers[0], true
+	}
+	best, bestQ := -1, 0.0
+	for i, rd := range n.renderers {
+		typ, sub, _ := strings.Cut(rd.MediaType, "/")
+		q, specificity := 0.0, -1
+		for _, ar := range ranges {
+			s := -1
+			switch {
+			case ar.typ == typ && ar.sub == sub:
+				s = 2
+			case ar.typ == typ && ar.sub == "*":
+				s = 1
+			case ar.typ == "*" && ar.sub == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = ar.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+	if best < 0 {
+		return Renderer{}, false
+	}
+	return n.renderers[best], true
+}
+
+// parseAccept parses the media ranges of an Accept header, skipping ones
+// that do not parse.
+func parseAccept(accept string) []acceptRange {
+	var out []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		typ, sub, ok := strings.Cut(mt, "/")
+		if !ok {
+			continue
+		}
+		ar := acceptRange{typ: typ, sub: sub, q: 1}
+		if raw, ok := params["q"]; ok {
+			if q, err := strconv.ParseFloat(raw, 64); err == nil && q >= 0 && q <= 1 {
+				ar.q = q
+			}
+		}
+		out = append(out, ar)
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiatorPick(t *testing.T) {
+	n := NewNegotiator(RenderJSON, RenderXML, RenderMsgPack, RenderHTML(template.Must(template.New("").Parse(`{{.}}`))))
+	tests := []struct {
+		accept string
+		want   string // "" for 406
+	}{
+		{"", "application/json"},
+		{"garbage;;", "application/json"},
+		{"*/*", "application/json"},
+		{"application/xml", "application/xml"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html"},
+		{"application/*;q=0.5, application/msgpack", "application/msgpack"},
+		{"application/json;q=0.2, application/xml;q=0.4", "application/xml"},
+		{"application/json;q=0.5, application/xml;q=0.5", "application/json"},
+		{"*/*;q=0.1, application/json;q=0", "application/xml"},
+		{"application/json;q=2", "application/json"},
+		{"image/png", ""},
+		{"application/json;q=0", ""},
+	}
+	for _, tt := range tests {
+		rd, ok := n.pick(tt.accept)
+		if got := rd.MediaType; got != tt.want || ok != (tt.want != "") {
+			t.Errorf("Accept %q: picked %q, %v; want %q", tt.accept, got, ok, tt.want)
+		}
+	}
+	if _, ok := NewNegotiator().pick("*/*"); ok {
+		t.Error("empty negotiator picked a renderer")
+	}
+}
+
+func TestNegotiatorRender(t *testing.T) {
+	type item struct {
+		Name string `json:"name" xml:"name"`
+	}
+	n := NewNegotiator(RenderJSON, RenderXML)
+	tests := []struct {
+		accept, contentType, body string
+		status                    int
+	}{
+		{"", "application/json", "{\"name\":\"a\"}\n", http.StatusCreated},
+		{"application/xml", "application/xml; charset=utf-8", "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<item><name>a</name></item>", http.StatusCreated},
+		{"image/png", "text/plain; charset=utf-8", "not acceptable; available: application/json, application/xml\n", http.StatusNotAcceptable},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", tt.accept)
+		rec := httptest.NewRecorder()
+		n.Render(rec, r, http.StatusCreated, item{"a"})
+		if rec.Code != tt.status || rec.Header().Get("Content-Type") != tt.contentType || rec.Body.String() != tt.body {
+			t.Errorf("Accept %q: %d %q %q", tt.accept, rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+		}
+		if rec.Header().Get("Vary") != "Accept" {
+			t.Errorf("Accept %q: Vary %q", tt.accept, rec.Header().Get("Vary"))
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	n.Render(rec, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, func() {})
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("unencodable value: %d, want 500", rec.Code)
+	}
+}
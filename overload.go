@@ -0,0 +1,22 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetryAfter caps computed Retry-After values; past this the estimate
+// says more about a stuck dependency than about when capacity returns.
+const maxRetryAfter = time.Minute
+
+// setRetryAfter sets Retry-After to d in whole seconds, rounded up and
+// clamped to [1s, maxRetryAfter], and records the value as the latest one
+// advertised by source so dashboards show how hard clients are told to
+// back off.
+func setRetryAfter(w http.ResponseWriter, d time.Duration, m *Metrics, source string, labels ...string) {
+	secs := int(math.Ceil(min(max(d, time.Second), maxRetryAfter).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	m.Set("server_retry_after_seconds", float64(secs), append([]string{"source", source}, labels...)...)
+}
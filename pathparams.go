@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PathInt returns the named path wildcard as an integer. When it is not
+// one, PathInt answers with a 400 problem and returns false, so handlers
+// only need to return.
+func PathInt(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	v := r.PathValue(name)
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		writePathProblem(w, name, fmt.Sprintf("must be an integer, not %q", v))
+		return 0, false
+	}
+	return n, true
+}
+
+// PathUUID returns the named path wildcard as a lowercase UUID in its
+// canonical 8-4-4-4-12 form, answering with a 400 problem otherwise.
+func PathUUID(w http.ResponseWriter, r *http.Request, name string) (string, bool) {
+	v := strings.ToLower(r.PathValue(name))
+	if !isUUID(v) {
+		writePathProblem(w, name, fmt.Sprintf("must be a UUID, not %q", r.PathValue(name)))
+		return "", false
+	}
+	return v, true
+}
+
+// PathString returns the named path wildcard once valid accepts it,
+// answering with a 400 problem carrying valid's error otherwise. Empty
+// values are always rejected; valid may be nil.
+func PathString(w http.ResponseWriter, r *http.Request, name string, valid func(string) error) (string, bool) {
+	v := r.PathValue(name)
+	if v == "" {
+		writePathProblem(w, name, "is required")
+		return "", false
+	}
+	if valid != nil {
+		if err := valid(v); err != nil {
+			writePathProblem(w, name, err.Error())
+			return "", false
+		}
+	}
+	return v, true
+}
+
+func writePathProblem(w http.ResponseWriter, name, detail string) {
+	writeProblem(w, http.StatusBadRequest, "invalid path parameter", []paramError{
+		{In: "path", schemaError: schemaError{Pointer: "/" + name, Detail: detail}},
+	})
+}
+
+// isUUID reports whether s is a lowercase hex UUID with dashes.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+//go:build wazero
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// wasmPageSize is the size of a WebAssembly memory page.
+const wasmPageSize = 64 << 10
+
+// wazeroModule runs a plugin in its own wazero runtime. A plugin exports
+// memory, alloc(size) returning a pointer to size free bytes, and
+// handle_request(ptr, len), which reads the request JSON there and returns
+// its decision as the pointer in the upper 32 bits and the length in the
+// lower. WASI is provided for toolchains that need it, without files,
+// environment or network.
+type wazeroModule struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+func compileWASMPlugin(ctx context.Context, src []byte, opts WASMPluginOptions) (pluginModule, error) {
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(opts.MaxMemoryMiB<<20/wasmPageSize)).
+		WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+		_ = rt.Close(ctx)
+		return nil, err
+	}
+	compiled, err := rt.CompileModule(ctx, src)
+	if err != nil {
+		_ = rt.Close(ctx)
+		return nil, err
+	}
+	for _, name := range []string{"alloc", "handle_request"} {
+		if _, ok := compiled.ExportedFunctions()[name]; !ok {
+			_ = rt.Close(ctx)
+			return nil, fmt.Errorf("module does not export %s", name)
+		}
+	}
+	return &wazeroModule{runtime: rt, compiled: compiled}, nil
+}
+
+// call runs the request in a fresh instance, so requests run concurrently
+// and no state leaks from one to the next.
+func (m *wazeroModule) call(ctx context.Context, req []byte) ([]byte, error) {
+	mod, err := m.runtime.InstantiateModule(ctx, m.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, err
+	}
+	defer mod.Close(context.Background())
+	mem := mod.Memory()
+	if mem == nil {
+		return nil, errors.New("module exports no memory")
+	}
+
+	res, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(req)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(res[0])
+	if !mem.Write(ptr, req) {
+		return nil, errors.New("alloc returned memory out of range")
+	}
+	res, err = mod.ExportedFunction("handle_request").Call(ctx, uint64(ptr), uint64(len(req)))
+	if err != nil {
+		return nil, err
+	}
+	out, ok := mem.Read(uint32(res[0]>>32), uint32(res[0]))
+	if !ok {
+		return nil, errors.New("decision out of memory range")
+	}
+	// out aliases the instance's memory, which is freed on return.
+	return append([]byte(nil), out...), nil
+}
+
+func (m *wazeroModule) close(ctx context.Context) error {
+	return m.runtime.Close(ctx)
+}
@@ -0,0 +1,12 @@
+//go:build !wazero
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func compileWASMPlugin(ctx context.Context, src []byte, opts WASMPluginOptions) (pluginModule, error) {
+	return nil, errors.New("WASM plugins require building with -tags wazero")
+}
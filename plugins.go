@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// pluginReloadInterval is how often plugin files are checked for changes.
+const pluginReloadInterval = time.Second
+
+// PluginRequest is the view of a request passed to plugins and scripts,
+// encoded as JSON.
+type PluginRequest struct {
+	Method   string              `json:"method"`
+	Host     string              `json:"host"`
+	Path     string              `json:"path"`
+	Query    string              `json:"query"`
+	Header   map[string][]string `json:"header"`
+	ClientIP string              `json:"client_ip"`
+	Tenant   string              `json:"tenant,omitempty"`
+}
+
+func newPluginRequest(r *http.Request) PluginRequest {
+	return PluginRequest{
+		Method:   r.Method,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		Query:    r.URL.RawQuery,
+		Header:   r.Header,
+		ClientIP: clientIP(r),
+		Tenant:   Tenant(r.Context()),
+	}
+}
+
+// PluginDecision is what a plugin returns for a request. The zero value
+// lets the request through unchanged.
+type PluginDecision struct {
+	// SetHeader and DelHeader edit the request headers.
+	SetHeader map[string]string `json:"set_header,omitempty"`
+	DelHeader []string          `json:"del_header,omitempty"`
+	// Path, if set, rewrites the request path before routing.
+	Path string `json:"path,omitempty"`
+	// Status, if set, answers the request instead of passing it on.
+	Status         int               `json:"status,omitempty"`
+	ResponseHeader map[string]string `json:"response_header,omitempty"`
+	Body           string            `json:"body,omitempty"`
+}
+
+// apply carries out d, writing the response and returning nil if the
+// plugin answered the request, or returning the request to continue with.
+func (d *PluginDecision) apply(w http.ResponseWriter, r *http.Request) *http.Request {
+	if d.Status != 0 {
+		for k, v := range d.ResponseHeader {
+			w.Header().Set(k, v)
+		}
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.WriteHeader(d.Status)
+		_, _ = w.Write([]byte(d.Body))
+		return nil
+	}
+	if len(d.SetHeader) == 0 && len(d.DelHeader) == 0 && d.Path == "" {
+		return r
+	}
+	r = r.Clone(r.Context())
+	for _, k := range d.DelHeader {
+		r.Header.Del(k)
+	}
+	for k, v := range d.SetHeader {
+		r.Header.Set(k, v)
+	}
+	if d.Path != "" && strings.HasPrefix(d.Path, "/") {
+		r.URL.Path, r.URL.RawPath = d.Path, ""
+	}
+	return r
+}
+
+// pluginModule runs a compiled plugin for one request: it takes a JSON
+// PluginRequest and returns a JSON PluginDecision.
+type pluginModule interface {
+	call(ctx context.Context, req []byte) ([]byte, error)
+	close(ctx context.Context) error
+}
+
+// WASMPluginOptions bounds what a WASM plugin may use.
+type WASMPluginOptions struct {
+	// Timeout bounds one call; a plugin still running is aborted.
+	Timeout time.Duration
+	// MaxMemoryMiB caps the plugin's linear memory.
+	MaxMemoryMiB int
+}
+
+// wasmPlugin is a WASM module loaded from a file and reloaded when the file
+// changes. Failures are logged and let the request through, so a broken
+// plugin cannot take the site down.
+type wasmPlugin struct {
+	name    string
+	path    string
+	opts    WASMPluginOptions
+	metrics *Metrics
+
+	module  atomic.Pointer[pluginModule]
+	modTime time.Time
+}
+
+func newWASMPlugin(name, path string, opts WASMPluginOptions, m *Metrics) (*wasmPlugin, error) {
+	p := &wasmPlugin{name: name, path: path, opts: opts, metrics: m}
+	return p, p.load()
+}
+
+// load compiles the plugin file, replacing the running module on success.
+func (p *wasmPlugin) load() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	src, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	mod, err := compileWASMPlugin(context.Background(), src, p.opts)
+	if err != nil {
+		return fmt.Errorf("loading WASM plugin %s: %w", p.name, err)
+	}
+	p.modTime = info.ModTime()
+	if old := p.module.Swap(&mod); old != nil {
+		// Calls still in the old module end within the timeout.
+		time.AfterFunc(p.opts.Timeout, func() { _ = (*old).close(context.Background()) })
+	}
+	return nil
+}
+
+// watch reloads the plugin whenever its file changes.
+func (p *wasmPlugin) watch(ctx context.Context) error {
+	ticker := time.NewTicker(pluginReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if mod := p.module.Load(); mod != nil {
+				_ = (*mod).close(context.Background())
+			}
+			return nil
+		case <-ticker.C:
+		}
+		info, err := os.Stat(p.path)
+		if err != nil || info.ModTime().Equal(p.modTime) {
+			continue
+		}
+		if err := p.load(); err != nil {
+			slog.Warn("Failed to reload WASM plugin", "plugin", p.name, "error", err)
+			p.modTime = info.ModTime()
+			continue
+		}
+		slog.Info("Reloaded WASM plugin", "plugin", p.name)
+	}
+}
+
+// decide runs the plugin for r. A plugin that fails or times out yields
+// the zero decision.
+func (p *wasmPlugin) decide(r *http.Request) *PluginDecision {
+	var d PluginDecision
+	req, err := json.Marshal(newPluginRequest(r))
+	if err != nil {
+		return &d
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), p.opts.Timeout)
+	defer cancel()
+	start := time.Now()
+	out, err := (*p.module.Load()).call(ctx, req)
+	p.metrics.Observe("server_plugin_call_seconds", time.Since(start).Seconds(), "plugin", p.name)
+	if err == nil {
+		err = json.Unmarshal(out, &d)
+	}
+	if err != nil {
+		p.metrics.Add("server_plugin_errors_total", 1, "plugin", p.name)
+		slog.Warn("WASM plugin failed", "plugin", p.name, "error", err)
+		return &PluginDecision{}
+	}
+	return &d
+}
+
+// middleware runs the plugin ahead of routing, so it can rewrite, annotate
+// or answer requests.
+func (p *wasmPlugin) middleware() Middleware {
+	return Middleware{Name: "wasm:" + p.name, Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r = p.decide(r).apply(w, r); r != nil {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}}
+}
+
+// ServeHTTP runs the plugin as a handler; a request it lets through is not
+// found.
+func (p *wasmPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.decide(r).apply(w, r) != nil {
+		http.NotFound(w, r)
+	}
+}
+
+// parsePluginFiles parses "name=path" entries.
+func parsePluginFiles(what string, entries []string) ([][2]string, error) {
+	var out [][2]string
+	for _, e := range entries {
+		name, path, ok := strings.Cut(e, "=")
+		name, path = strings.TrimSpace(name), strings.TrimSpace(path)
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("invalid %s %q: want name=path", what, e)
+		}
+		out = append(out, [2]string{name, path})
+	}
+	return out, nil
+}
+
+// loadWASMPlugins loads the configured plugins as listener middleware, in
+// order, and registers each as a handler routes can be swapped to.
+func (s *Server) loadWASMPlugins() {
+	files, err := parsePluginFiles("WASM plugin", s.config.WASMPlugins)
+	if err != nil {
+		slog.Warn("Ignoring invalid WASM plugins", "error", err)
+		return
+	}
+	opts := WASMPluginOptions{Timeout: s.config.WASMPluginTimeout, MaxMemoryMiB: s.config.WASMPluginMaxMemoryMiB}
+	for _, f := range files {
+		p, err := newWASMPlugin(f[0], f[1], opts, s.metrics)
+		if err != nil {
+			slog.Warn("Not loading WASM plugin", "plugin", f[0], "error", err)
+			continue
+		}
+		s.Use(p.middleware())
+		s.RegisterHandler("wasm:"+p.name, p)
+		s.Supervise("wasm-plugin-"+p.name, RestartPolicy{Mode: RestartOnFailure}, p.watch)
+	}
+}
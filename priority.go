@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Priority orders requests waiting for admission.
+type Priority int
+
+// Priority classes, lowest first.
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+	PriorityCritical
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"low", "normal", "high", "critical"}
+
+func (p Priority) String() string {
+	if p < 0 || p >= numPriorities {
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+func parsePriority(s string) (Priority, error) {
+	for p, name := range priorityNames {
+		if strings.EqualFold(strings.TrimSpace(s), name) {
+			return Priority(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q: want low, normal, high or critical", s)
+}
+
+// PriorityFunc classifies a request, reporting false to leave it to the
+// configured client rules.
+type PriorityFunc func(r *http.Request) (Priority, bool)
+
+// WithPriorityFunc sets how clients are classified for admission, for
+// example by looking up a paid plan from an API key.
+func WithPriorityFunc(fn PriorityFunc) Option {
+	return func(s *Server) { s.priorityFunc = fn }
+}
+
+// AdmissionOptions sizes the admission controller.
+type AdmissionOptions struct {
+	// MaxConcurrent is how many requests are served at once.
+	MaxConcurrent int
+	// MaxQueue is how many more may wait. When it is full, a request
+	// displaces the lowest-priority waiter if it outranks it, and is
+	// rejected otherwise.
+	MaxQueue int
+	// QueueTimeout bounds the wait for admission.
+	QueueTimeout time.Duration
+	// Aging raises a waiting request one priority class per interval, so
+	// low-priority traffic is delayed under load but never starved.
+	Aging time.Duration
+}
+
+var (
+	errQueueFull = errors.New("admission queue full")
+	errDisplaced = errors.New("displaced by a higher-priority request")
+)
+
+// admission limits concurrent requests and, when saturated, admits queued
+// requests by priority. Within a class, clients take turns, so one client
+// flooding the queue delays only itself.
+type admission struct {
+	opts    AdmissionOptions
+	metrics *Metrics
+
+	mu       sync.Mutex
+	inFlight int
+	classes  [numPriorities]admissionClass
+	queued   int
+
+	// serviceTime is a moving average of request durations in nanoseconds.
+	serviceTime atomic.Int64
+}
+
+type admissionWaiter struct {
+	prio     Priority
+	client   string
+	enqueued time.Time
+	done     chan error // receives nil once admitted
+}
+
+// admissionClass queues the waiters of one priority, FIFO per client, with
+// the clients served round-robin.
+type admissionClass struct {
+	clients map[string][]*admissionWaiter
+	turns   []string // clients with waiters; the first is served next
+	len     int
+}
+
+func (c *admissionClass) push(w *admissionWaiter) {
+	if c.clients == nil {
+		c.clients = make(map[string][]*admissionWaiter)
+	}
+	if len(c.clients[w.client]) == 0 {
+		c.turns = append(c.turns, w.client)
+	}
+	c.clients[w.client] = append(c.clients[w.client], w)
+	c.len++
+}
+
+// head returns the waiter whose turn it is, or nil.
+func (c *admissionClass) head() *admissionWaiter {
+	if len(c.turns) == 0 {
+		return nil
+	}
+	return c.clients[c.turns[0]][0]
+}
+
+// remove takes w off the queue, reporting whether it was queued. When w was
+// at the front of its client's turn, the client moves to the back.
+func (c *admissionClass) remove(w *admissionWaiter) bool {
+	q := c.clients[w.client]
+	i := slices.Index(q, w)
+	if i < 0 {
+		return false
+	}
+	q = slices.Delete(q, i, i+1)
+	c.len--
+	t := slices.Index(c.turns, w.client)
+	c.turns = slices.Delete(c.turns, t, t+1)
+	if len(q) == 0 {
+		delete(c.clients, w.client)
+		return true
+	}
+	c.clients[w.client] = q
+	if t == 0 && i == 0 {
+		c.turns = append(c.turns, w.client)
+	} else {
+		c.turns = slices.Insert(c.turns, t, w.client)
+	}
+	return true
+}
+
+// busiest returns the client with the most waiters, or "".
+func (c *admissionClass) busiest() string {
+	var client string
+	for k, q := range c.clients {
+		if client == "" || len(q) > len(c.clients[client]) {
+			client = k
+		}
+	}
+	return client
+}
+
+func newAdmission(opts AdmissionOptions, m *Metrics) *admission {
+	return &admission{opts: opts, metrics: m}
+}
+
+// acquire waits for a slot for a request from client. It returns nil once
+// the caller holds one, which it must give back with release.
+func (a *admission) acquire(ctx context.Context, prio Priority, client string) error {
+	a.mu.Lock()
+	if a.inFlight < a.opts.MaxConcurrent && a.queued == 0 {
+		a.inFlight++
+		a.metrics.Set("server_admission_in_flight", float64(a.inFlight))
+		a.mu.Unlock()
+		return nil
+	}
+	if a.queued >= a.opts.MaxQueue && !a.displaceLocked(prio) {
+		a.mu.Unlock()
+		return errQueueFull
+	}
+	w := &admissionWaiter{prio: prio, client: client, enqueued: time.Now(), done: make(chan error, 1)}
+	a.classes[prio].push(w)
+	a.queued++
+	a.setQueuedLocked(prio)
+	a.mu.Unlock()
+
+	timer := time.NewTimer(a.opts.QueueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-w.done:
+		a.metrics.Observe("server_admission_wait_seconds", time.Since(w.enqueued).Seconds(), "priority", prio.String())
+		return err
+	case <-timer.C:
+		err = context.DeadlineExceeded
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.removeLocked(w) {
+		// Admitted or displaced while giving up; honor the outcome.
+		return <-w.done
+	}
+	return err
+}
+
+// release gives back a slot held for took, handing it to the waiter with
+// the highest aged priority.
+func (a *admission) release(took time.Duration) {
+	for {
+		old := a.serviceTime.Load()
+		avg := int64(took)
+		if old > 0 {
+			avg = old + (int64(took)-old)/5
+		}
+		if a.serviceTime.CompareAndSwap(old, avg) {
+			break
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if w := a.nextLocked(time.Now()); w != nil {
+		a.removeLocked(w)
+		w.done <- nil
+		return
+	}
+	a.inFlight--
+	a.metrics.Set("server_admission_in_flight", float64(a.inFlight))
+}
+
+// nextLocked picks the head of the class whose head has the highest
+// priority once aged, preferring the longest-waiting on ties.
+func (a *admission) nextLocked(now time.Time) *admissionWaiter {
+	var best *admissionWaiter
+	bestPrio := Priority(-1)
+	for i := range a.classes {
+		w := a.classes[i].head()
+		if w == nil {
+			continue
+		}
+		p := a.agedPriority(w, now)
+		if p > bestPrio || (p == bestPrio && w.enqueued.Before(best.enqueued)) {
+			best, bestPrio = w, p
+		}
+	}
+	return best
+}
+
+func (a *admission) agedPriority(w *admissionWaiter, now time.Time) Priority {
+	p := w.prio
+	if a.opts.Aging > 0 {
+		p += Priority(now.Sub(w.enqueued) / a.opts.Aging)
+	}
+	return min(p, PriorityCritical)
+}
+
+// displaceLocked rejects the newest waiter of the busiest client in the
+// lowest class below prio to make room, reporting whether it found one.
+func (a *admission) displaceLocked(prio Priority) bool {
+	for p := PriorityLow; p < prio; p++ {
+		if client := a.classes[p].busiest(); client != "" {
+			q := a.classes[p].clients[client]
+			w := q[len(q)-1]
+			a.removeLocked(w)
+			w.done <- errDisplaced
+			return true
+		}
+	}
+	return false
+}
+
+// removeLocked takes w off its queue, reporting whether it was queued.
+func (a *admission) removeLocked(w *admissionWaiter) bool {
+	if !a.classes[w.prio].remove(w) {
+		return false
+	}
+	a.queued--
+	a.setQueuedLocked(w.prio)
+	return true
+}
+
+func (a *admission) setQueuedLocked(p Priority) {
+	a.metrics.Set("server_admission_queued", float64(a.classes[p].len), "priority", p.String())
+	a.metrics.Set("server_admission_queued_clients", float64(len(a.classes[p].turns)), "priority", p.String())
+}
+
+// retryAfter estimates when a rejected client could be admitted: each
+// queued request needs a turn on one of MaxConcurrent slots.
+func (a *admission) retryAfter() time.Duration {
+	avg := time.Duration(a.serviceTime.Load())
+	if avg <= 0 {
+		avg = a.opts.QueueTimeout
+	}
+	a.mu.Lock()
+	queued := a.queued
+	a.mu.Unlock()
+	return time.Duration((queued+a.opts.MaxConcurrent)/a.opts.MaxConcurrent) * avg
+}
+
+// middleware admits each request by its priority: the route's configured
+// class if it has one, else the client's, else normal. Clients are told
+// apart by tenant, or by address for requests outside any tenant. Requests
+// not admitted get 503 with Retry-After.
+func (a *admission) middleware(routes map[string]Priority, classify PriorityFunc, clients []clientPriority) Middleware {
+	return Middleware{Name: "admission", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			prio := requestPriority(r, routes, classify, clients)
+			client := Tenant(r.Context())
+			if client == "" {
+				client = clientIP(r)
+			}
+			if err := a.acquire(r.Context(), prio, client); err != nil {
+				reason := "timeout"
+				switch {
+				case errors.Is(err, errQueueFull):
+					reason = "queue_full"
+				case errors.Is(err, errDisplaced):
+					reason = "displaced"
+				case errors.Is(err, context.Canceled):
+					reason = "canceled"
+				}
+				a.metrics.Add("server_admission_rejected_total", 1, "priority", prio.String(), "reason", reason)
+				setRetryAfter(w, a.retryAfter(), a.metrics, "admission")
+				http.Error(w, "server busy", http.StatusServiceUnavailable)
+				return
+			}
+			start := time.Now()
+			defer func() { a.release(time.Since(start)) }()
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// clientPriority assigns a class to client addresses in prefix.
+type clientPriority struct {
+	prefix netip.Prefix
+	prio   Priority
+}
+
+func requestPriority(r *http.Request, routes map[string]Priority, classify PriorityFunc, clients []clientPriority) Priority {
+	if p, ok := routes[r.Pattern]; ok {
+		return p
+	}
+	if classify != nil {
+		if p, ok := classify(r); ok {
+			return p
+		}
+	}
+	if addr, err := netip.ParseAddr(clientIP(r)); err == nil {
+		for _, c := range clients {
+			if c.prefix.Contains(addr.Unmap()) {
+				return c.prio
+			}
+		}
+	}
+	return PriorityNormal
+}
+
+// parsePriorityRoutes parses "pattern=class" entries.
+func parsePriorityRoutes(entries []string) (map[string]Priority, error) {
+	out := make(map[string]Priority, len(entries))
+	for _, e := range entries {
+		pattern, class, ok := strings.Cut(e, "=")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid priority route %q: want pattern=class", e)
+		}
+		p, err := parsePriority(class)
+		if err != nil {
+			return nil, fmt.Errorf("priority route %q: %w", e, err)
+		}
+		out[pattern] = p
+	}
+	return out, nil
+}
+
+// parsePriorityClients parses "cidr=class" entries; the first match wins.
+func parsePriorityClients(entries []string) ([]clientPriority, error) {
+	var out []clientPriority
+	for _, e := range entries {
+		cidr, class, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid priority client %q: want cidr=class", e)
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("priority client %q: %w", e, err)
+		}
+		p, err := parsePriority(class)
+		if err != nil {
+			return nil, fmt.Errorf("priority client %q: %w", e, err)
+		}
+		out = append(out, clientPriority{prefix: prefix.Masked(), prio: p})
+	}
+	return out, nil
+}
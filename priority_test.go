@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a second passes.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestAdmissionOrdersByPriority(t *testing.T) {
+	a := newAdmission(AdmissionOptions{MaxConcurrent: 1, MaxQueue: 10, QueueTimeout: time.Second}, NewMetrics())
+	if err := a.acquire(context.Background(), PriorityNormal, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan Priority, 2)
+	for _, p := range []Priority{PriorityLow, PriorityHigh} {
+		go func() {
+			if err := a.acquire(context.Background(), p, p.String()); err == nil {
+				admitted <- p
+			}
+		}()
+		waitFor(t, p.String()+" to queue", func() bool {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			return a.classes[p].len == 1
+		})
+	}
+
+	a.release(time.Millisecond)
+	if p := <-admitted; p != PriorityHigh {
+		t.Errorf("admitted %v first, want high", p)
+	}
+	a.release(time.Millisecond)
+	if p := <-admitted; p != PriorityLow {
+		t.Errorf("admitted %v second, want low", p)
+	}
+}
+
+func TestAdmissionDisplacesLowerPriority(t *testing.T) {
+	a := newAdmission(AdmissionOptions{MaxConcurrent: 1, MaxQueue: 1, QueueTimeout: time.Second}, NewMetrics())
+	if err := a.acquire(context.Background(), PriorityNormal, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	low := make(chan error, 1)
+	go func() { low <- a.acquire(context.Background(), PriorityLow, "b") }()
+	waitFor(t, "low to queue", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.queued == 1
+	})
+
+	if err := a.acquire(context.Background(), PriorityLow, "c"); !errors.Is(err, errQueueFull) {
+		t.Errorf("equal priority with a full queue: %v, want errQueueFull", err)
+	}
+	high := make(chan error, 1)
+	go func() { high <- a.acquire(context.Background(), PriorityHigh, "d") }()
+	if err := <-low; !errors.Is(err, errDisplaced) {
+		t.Errorf("low waiter: %v, want errDisplaced", err)
+	}
+	a.release(time.Millisecond)
+	if err := <-high; err != nil {
+		t.Errorf("high waiter: %v", err)
+	}
+}
+
+func TestAdmissionRoutePriority(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.AdmissionMaxConcurrent = 1
+		c.PriorityRoutes = []string{"GET /vip/{id}=critical"}
+	})
+	release := make(chan struct{})
+	order := make(chan string, 3)
+	s.HandleFunc(ListenerHTTP, "GET /slow", func(w http.ResponseWriter, r *http.Request) { <-release })
+	s.HandleFunc(ListenerHTTP, "GET /plain", func(w http.ResponseWriter, r *http.Request) { order <- "plain" })
+	s.HandleFunc(ListenerHTTP, "GET /vip/{id}", func(w http.ResponseWriter, r *http.Request) { order <- "vip" })
+
+	done := make(chan struct{}, 3)
+	serve := func(target string) {
+		serveListener(s, ListenerHTTP, httptest.NewRequest(http.MethodGet, target, nil))
+		done <- struct{}{}
+	}
+	queued := func(p string) func() bool {
+		return func() bool { return s.metrics.Value("server_admission_queued", "priority", p) == 1 }
+	}
+
+	go serve("/slow")
+	waitFor(t, "the slot to be taken", func() bool { return s.metrics.Value("server_admission_in_flight") == 1 })
+	go serve("/plain")
+	waitFor(t, "the plain request to queue", queued("normal"))
+	// Classified by its route pattern, which the admission middleware only
+	// sees once pattern tracking has run.
+	go serve("/vip/1")
+	waitFor(t, "the vip request to queue", queued("critical"))
+
+	close(release)
+	for range 3 {
+		<-done
+	}
+	if first := <-order; first != "vip" {
+		t.Errorf("%s admitted first, want the critical route", first)
+	}
+}
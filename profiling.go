@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	runtimedebug "runtime/debug"
+	runtimepprof "runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProfilerOptions configures continuous profiling.
+type ProfilerOptions struct {
+	// URL is the Pyroscope server profiles are pushed to.
+	URL       string
+	AuthToken string
+	// AppName names the application; Labels, version and instance are
+	// attached to every profile.
+	AppName  string
+	Instance string
+	Labels   map[string]string
+	// Interval is how long each CPU profile runs, and how often a heap
+	// profile is taken.
+	Interval time.Duration
+}
+
+// profiler pushes a CPU and a heap profile every interval, in pprof format
+// over Pyroscope's ingest API.
+type profiler struct {
+	opts    ProfilerOptions
+	name    string
+	client  *http.Client
+	metrics *Metrics
+}
+
+func newProfiler(opts ProfilerOptions, client *http.Client, m *Metrics) *profiler {
+	labels := map[string]string{"version": buildVersion(), "instance": opts.Instance}
+	for k, v := range opts.Labels {
+		labels[k] = v
+	}
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	slices.Sort(pairs)
+	return &profiler{opts: opts, name: opts.AppName + "{" + strings.Join(pairs, ",") + "}", client: client, metrics: m}
+}
+
+// parseProfilingLabels parses "key=value" label entries.
+func parseProfilingLabels(entries []string) (map[string]string, error) {
+	out := make(map[string]string, len(entries))
+	for _, e := range entries {
+		k, v, ok := strings.Cut(e, "=")
+		if !ok || strings.TrimSpace(k) == "" || strings.ContainsAny(e, "{},") {
+			return nil, fmt.Errorf("profiling label %q: expected key=value", e)
+		}
+		out[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return out, nil
+}
+
+// buildVersion returns the module version the binary was built from, or
+// its VCS revision for development builds.
+func buildVersion() string {
+	info, ok := runtimedebug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value[:min(len(s.Value), 12)]
+		}
+	}
+	return "devel"
+}
+
+// run profiles until ctx is cancelled. A CPU profile already running, such
+// as one requested from /debug/pprof, skips that round.
+func (p *profiler) run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		var cpu bytes.Buffer
+		from := time.Now()
+		cpuErr := runtimepprof.StartCPUProfile(&cpu)
+		select {
+		case <-ctx.Done():
+		case <-time.After(p.opts.Interval):
+		}
+		if cpuErr == nil {
+			runtimepprof.StopCPUProfile()
+		}
+		until := time.Now()
+
+		if cpuErr != nil {
+			slog.Warn("Skipping CPU profile", "error", cpuErr)
+		} else {
+			p.upload(ctx, "cpu", &cpu, from, until)
+		}
+		var heap bytes.Buffer
+		if err := runtimepprof.Lookup("heap").WriteTo(&heap, 0); err == nil {
+			p.upload(ctx, "heap", &heap, from, until)
+		}
+	}
+	return nil
+}
+
+// upload pushes one profile, logging rather than failing so a collector
+// outage does not restart the task.
+func (p *profiler) upload(ctx context.Context, kind string, profile *bytes.Buffer, from, until time.Time) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("profile", "profile.pprof")
+	if err == nil {
+		_, err = profile.WriteTo(fw)
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	if err != nil {
+		slog.Warn("Encoding profile failed", "profile", kind, "error", err)
+		return
+	}
+
+	q := url.Values{
+		"name":       {p.name},
+		"from":       {strconv.FormatInt(from.Unix(), 10)},
+		"until":      {strconv.FormatInt(until.Unix(), 10)},
+		"format":     {"pprof"},
+		"spyName":    {"gospy"},
+		"sampleRate": {"100"},
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(p.opts.URL, "/")+"/ingest?"+q.Encode(), &body)
+	if err != nil {
+		slog.Warn("Uploading profile failed", "profile", kind, "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if p.opts.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.opts.AuthToken)
+	}
+	resp, err := p.client.Do(req)
+	if err == nil {
+		_ = resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}
+	if err != nil {
+		p.metrics.Add("server_profile_uploads_total", 1, "profile", kind, "result", "error")
+		slog.Warn("Uploading profile failed", "profile", kind, "error", err)
+		return
+	}
+	p.metrics.Add("server_profile_uploads_total", 1, "profile", kind, "result", "ok")
+}
+
+// registerPprof serves the runtime profiles on the admin listener, for
+// pull-based profilers such as Parca to scrape.
+func (s *Server) registerPprof() {
+	s.HandleFunc(ListenerAdmin, "GET /debug/pprof/", pprof.Index)
+	s.HandleFunc(ListenerAdmin, "GET /debug/pprof/cmdline", pprof.Cmdline)
+	s.HandleFunc(ListenerAdmin, "GET /debug/pprof/profile", longProfile(pprof.Profile))
+	s.HandleFunc(ListenerAdmin, "GET /debug/pprof/symbol", pprof.Symbol)
+	s.HandleFunc(ListenerAdmin, "GET /debug/pprof/trace", longProfile(pprof.Trace))
+}
+
+// longProfile lets a timed profile outlast the listener's WriteTimeout,
+// which pprof otherwise refuses to start against.
+func longProfile(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		h(w, r.WithContext(context.WithValue(r.Context(), http.ServerContextKey, nil)))
+	}
+}
+
+// profilingInstance is the default instance label.
+func profilingInstance() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
@@ -0,0 +1,66 @@
+//go:build protobuf || grpc
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Protobuf renderers, for values that are generated message types. They
+// pair as NewNegotiator(RenderProtoJSON, RenderProtobuf), so a handler
+// accepts and returns either encoding of the same message; RenderProtoJSON
+// uses the canonical JSON mapping rather than encoding/json.
+var (
+	RenderProtobuf = Renderer{MediaType: "application/x-protobuf", Encode: func(w io.Writer, v any) error {
+		m, err := protoMessage(v)
+		if err != nil {
+			return err
+		}
+		raw, err := proto.Marshal(m)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(raw)
+		return err
+	}, Decode: func(r io.Reader, v any) error {
+		return decodeProto(r, v, proto.Unmarshal)
+	}}
+	RenderProtoJSON = Renderer{MediaType: "application/json", Encode: func(w io.Writer, v any) error {
+		m, err := protoMessage(v)
+		if err != nil {
+			return err
+		}
+		raw, err := protojson.Marshal(m)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(raw)
+		return err
+	}, Decode: func(r io.Reader, v any) error {
+		return decodeProto(r, v, protojson.Unmarshal)
+	}}
+)
+
+func protoMessage(v any) (proto.Message, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", v)
+	}
+	return m, nil
+}
+
+func decodeProto(r io.Reader, v any, unmarshal func([]byte, proto.Message) error) error {
+	m, err := protoMessage(v)
+	if err != nil {
+		return err
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return unmarshal(raw, m)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// proxyMethods are the methods a proxy mount forwards; GET also covers HEAD.
+var proxyMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// shadowTimeout bounds a mirrored request, whose response nobody waits for.
+const shadowTimeout = 10 * time.Second
+
+// maxShadowInFlight caps mirrored requests so a slow shadow upstream cannot
+// pile up goroutines; requests beyond it are not mirrored.
+const maxShadowInFlight = 64
+
+// ProxyOptions configures a reverse-proxy mount.
+type ProxyOptions struct {
+	// HashKey selects how requests are spread over several upstreams:
+	// "ip", "cookie:NAME" or "header:NAME". The same key always reaches the
+	// same upstream while the pool is unchanged.
+	HashKey string
+	// HedgeAfter, when several upstreams are given, sends a GET or HEAD not
+	// answered within it to the next upstream as well; zero disables.
+	HedgeAfter time.Duration
+
+	// Shadow, when set, receives a copy of ShadowPercent of requests. Its
+	// responses are discarded.
+	Shadow        *url.URL
+	ShadowPercent float64
+	// ShadowMaxBody skips mirroring requests with larger or unknown-length
+	// bodies, as mirrored bodies are buffered in memory.
+	ShadowMaxBody int64
+
+	// Green, when set, makes the mount a blue/green pair with upstream as
+	// blue; see Server.BlueGreen.
+	Green            *url.URL
+	BlueGreenOptions BlueGreenOptions
+
+	// Canary, when set, receives a share of traffic as configured by
+	// CanaryOptions.
+	Canary        *url.URL
+	CanaryOptions CanaryOptions
+}
+
+// Proxy forwards requests under prefix on the named listener to upstreams,
+// with the prefix stripped.
+func (s *Server) Proxy(listener, prefix string, upstreams []*url.URL, opts ProxyOptions) {
+	prefix = "/" + strings.Trim(prefix, "/") + "/"
+	var h http.Handler = s.newReverseProxy(upstreams[0])
+	if len(upstreams) > 1 {
+		h = s.hashProxy(upstreams, hashKeyFunc(opts.HashKey), opts.HedgeAfter)
+	}
+	if opts.Green != nil {
+		h = s.BlueGreen(h, s.newReverseProxy(opts.Green), opts.BlueGreenOptions)
+	}
+	if opts.Canary != nil {
+		h = s.Canary(h, s.newReverseProxy(opts.Canary), opts.CanaryOptions)
+	}
+	if opts.Shadow != nil && opts.ShadowPercent > 0 {
+		h = s.shadow(h, opts)
+	}
+	h = http.StripPrefix(strings.TrimSuffix(prefix, "/"), h)
+	for _, method := range proxyMethods {
+		s.Handle(listener, method+" "+prefix, h)
+	}
+}
+
+func (s *Server) newReverseProxy(upstream *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Transport: s.transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(upstream)
+			pr.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("Proxy upstream failed", "upstream", upstream.Host, "path", r.URL.Path, "error", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// hashProxy picks an upstream per request by consistent hash of key. With
+// hedgeAfter, each upstream hedges to the next one in the list.
+func (s *Server) hashProxy(upstreams []*url.URL, key func(*http.Request) string, hedgeAfter time.Duration) http.Handler {
+	proxies := make([]http.Handler, len(upstreams))
+	names := make([]string, len(upstreams))
+	for i, u := range upstreams {
+		p := s.newReverseProxy(u)
+		if hedgeAfter > 0 {
+			p.Transport = &hedgedTransport{base: s.transport, primary: u, alternate: upstreams[(i+1)%len(upstreams)], after: hedgeAfter, metrics: s.metrics}
+		}
+		proxies[i] = p
+		names[i] = u.String()
+	}
+	ring := newHashRing(names)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxies[ring.get(key(r))].ServeHTTP(w, r)
+	})
+}
+
+// shadow mirrors a sample of requests to opts.Shadow in the background.
+func (s *Server) shadow(next http.Handler, opts ProxyOptions) http.Handler {
+	sem := make(chan struct{}, maxShadowInFlight)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !roll(opts.ShadowPercent) || r.ContentLength < 0 || r.ContentLength > opts.ShadowMaxBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		if r.ContentLength > 0 {
+			var err error
+			body, err = io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "reading request body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		select {
+		case sem <- struct{}{}:
+		default:
+			s.metrics.Add("server_proxy_shadow_total", 1, "result", "dropped")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		target := opts.Shadow.JoinPath(r.URL.Path)
+		target.RawQuery = r.URL.RawQuery
+		method, header := r.Method, r.Header.Clone()
+		header.Set("X-Shadow-Request", "1")
+		go func() {
+			defer func() { <-sem }()
+			ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+			if err != nil {
+				return
+			}
+			req.Header = header
+			resp, err := s.client.Do(req)
+			if err != nil {
+				s.metrics.Add("server_proxy_shadow_total", 1, "result", "error")
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			s.metrics.Add("server_proxy_shadow_total", 1, "result", "sent")
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
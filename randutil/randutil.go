@@ -0,0 +1,110 @@
+// Package randutil generates cryptographically random strings over an
+// arbitrary alphabet without modulo bias.
+package randutil
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Common alphabets.
+const (
+	Hex       = "0123456789abcdef"
+	Base62    = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	Base64URL = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+)
+
+var (
+	ErrEmptyAlphabet   = errors.New("randutil: alphabet is empty")
+	ErrAlphabetTooLong = errors.New("randutil: alphabet longer than 256 symbols")
+	ErrDuplicateSymbol = errors.New("randutil: alphabet contains a duplicate symbol")
+	ErrNegativeLength  = errors.New("randutil: negative length")
+)
+
+// Generator draws symbols from a fixed alphabet. Random bytes are masked down
+// to the smallest power of two covering the alphabet and values outside it
+// are rejected, so every symbol is equally likely. Bytes are read from the
+// source in batches rather than one big.Int per symbol.
+type Generator struct {
+	alphabet string
+	mask     byte
+	source   io.Reader
+}
+
+// New returns a Generator over alphabet reading from crypto/rand.
+func New(alphabet string) (*Generator, error) {
+	return NewWithSource(alphabet, rand.Reader)
+}
+
+// NewWithSource is like New but reads randomness from source.
+func NewWithSource(alphabet string, source io.Reader) (*Generator, error) {
+	switch {
+	case len(alphabet) == 0:
+		return nil, ErrEmptyAlphabet
+	case len(alphabet) > 256:
+		return nil, ErrAlphabetTooLong
+	}
+	var seen [256]bool
+	for i := 0; i < len(alphabet); i++ {
+		if seen[alphabet[i]] {
+			return nil, fmt.Errorf("%w: %q", ErrDuplicateSymbol, alphabet[i])
+		}
+		seen[alphabet[i]] = true
+	}
+
+	mask := byte(1<<bits.Len8(uint8(len(alphabet)-1)) - 1)
+	return &Generator{alphabet: alphabet, mask: mask, source: source}, nil
+}
+
+// MustNew is like New but panics on an invalid alphabet. It is intended for
+// package-level generators over constant alphabets.
+func MustNew(alphabet string) *Generator {
+	g, err := New(alphabet)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// Alphabet returns the generator's alphabet.
+func (g *Generator) Alphabet() string {
+	return g.alphabet
+}
+
+// String returns n random symbols.
+func (g *Generator) String(n int) (string, error) {
+	if n < 0 {
+		return "", ErrNegativeLength
+	}
+	out := make([]byte, 0, n)
+
+	// Expected bytes per accepted symbol is (mask+1)/len(alphabet), at most
+	// two; over-read a little so one batch is usually enough.
+	batch := make([]byte, n*(int(g.mask)+1)/len(g.alphabet)+n/4+8)
+	for len(out) < n {
+		if _, err := io.ReadFull(g.source, batch); err != nil {
+			return "", fmt.Errorf("randutil: reading random bytes: %w", err)
+		}
+		for _, b := range batch {
+			if idx := int(b & g.mask); idx < len(g.alphabet) {
+				out = append(out, g.alphabet[idx])
+				if len(out) == n {
+					break
+				}
+			}
+		}
+	}
+	return string(out), nil
+}
+
+// String returns n random symbols from alphabet using crypto/rand.
+func String(n int, alphabet string) (string, error) {
+	g, err := New(alphabet)
+	if err != nil {
+		return "", err
+	}
+	return g.String(n)
+}
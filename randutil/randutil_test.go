@@ -0,0 +1,177 @@
+package randutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// chiSquareCritical approximates the chi-square critical value for df
+// degrees of freedom at the upper-tail probability of z standard deviations
+// (Wilson–Hilferty).
+func chiSquareCritical(df int, z float64) float64 {
+	k := float64(df)
+	return k * math.Pow(1-2/(9*k)+z*math.Sqrt(2/(9*k)), 3)
+}
+
+func TestStringUniform(t *testing.T) {
+	alphabets := map[string]string{
+		"hex":       Hex,
+		"base62":    Base62,
+		"base64url": Base64URL,
+		"three":     "abc",
+		"129":       alphabetOfSize(129),
+		"256":       alphabetOfSize(256),
+	}
+	for name, alphabet := range alphabets {
+		t.Run(name, func(t *testing.T) {
+			// A seeded source keeps the test deterministic; the property
+			// under test is the sampling, not the source.
+			g, err := NewWithSource(alphabet, rand.NewChaCha8([32]byte{byte(len(alphabet))}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			const perSymbol = 2000
+			s, err := g.String(perSymbol * len(alphabet))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			counts := make(map[byte]int, len(alphabet))
+			for i := 0; i < len(s); i++ {
+				counts[s[i]]++
+			}
+			var chi2 float64
+			for i := 0; i < len(alphabet); i++ {
+				d := float64(counts[alphabet[i]] - perSymbol)
+				chi2 += d * d / perSymbol
+			}
+			if len(counts) != len(alphabet) {
+				t.Fatalf("%d distinct symbols, want %d", len(counts), len(alphabet))
+			}
+			if limit := chiSquareCritical(len(alphabet)-1, 4.26); chi2 > limit {
+				t.Errorf("chi-square %.1f exceeds %.1f (p < 1e-5)", chi2, limit)
+			}
+		})
+	}
+}
+
+func alphabetOfSize(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return string(b)
+}
+
+// cycleReader repeats data forever.
+type cycleReader struct {
+	data []byte
+	off  int
+}
+
+func (c *cycleReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = c.data[c.off%len(c.data)]
+		c.off++
+	}
+	return len(p), nil
+}
+
+func TestStringRejectsOutOfRange(t *testing.T) {
+	// Three symbols mask to two bits: 3 is out of range, as is any byte
+	// whose low bits are 3. Only 0, 1 and 2 may be mapped.
+	src := &cycleReader{data: []byte{3, 0x07, 0xff, 0, 0x41, 0x82}}
+	g, err := NewWithSource("abc", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := g.String(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "abcabcabc" {
+		t.Errorf("String(9) = %q, want %q", s, "abcabcabc")
+	}
+}
+
+func TestStringRereadsWhenBatchRejected(t *testing.T) {
+	// A whole batch of out-of-range bytes must lead to another read, not
+	// a short or biased result.
+	src := io.MultiReader(bytes.NewReader(bytes.Repeat([]byte{0xff}, 4096)), &cycleReader{data: []byte{1}})
+	g, err := NewWithSource("ab", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := g.String(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != strings.Repeat("b", 16) {
+		t.Errorf("String(16) = %q", s)
+	}
+}
+
+type failingReader struct{ err error }
+
+func (f failingReader) Read([]byte) (int, error) { return 0, f.err }
+
+func TestStringReaderError(t *testing.T) {
+	errBroken := errors.New("entropy source broken")
+	g, err := NewWithSource(Hex, failingReader{errBroken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := g.String(8)
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("String(8) error = %v, want it to wrap the reader's error", err)
+	}
+	if s != "" {
+		t.Errorf("String(8) = %q alongside an error", s)
+	}
+
+	// A source that runs dry part way is an error too.
+	g, _ = NewWithSource(Hex, bytes.NewReader([]byte{1, 2, 3}))
+	if _, err := g.String(8); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("short source error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestNewValidatesAlphabet(t *testing.T) {
+	tests := []struct {
+		alphabet string
+		want     error
+	}{
+		{"", ErrEmptyAlphabet},
+		{alphabetOfSize(256) + "x", ErrAlphabetTooLong},
+		{"abca", ErrDuplicateSymbol},
+		{"a", nil},
+		{alphabetOfSize(256), nil},
+	}
+	for _, tt := range tests {
+		_, err := New(tt.alphabet)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("New(%d symbols) error = %v, want %v", len(tt.alphabet), err, tt.want)
+		}
+	}
+}
+
+func TestStringLength(t *testing.T) {
+	g := MustNew(Base62)
+	if _, err := g.String(-1); !errors.Is(err, ErrNegativeLength) {
+		t.Errorf("String(-1) error = %v, want ErrNegativeLength", err)
+	}
+	for _, n := range []int{0, 1, 7, 1000} {
+		s, err := g.String(n)
+		if err != nil || len(s) != n {
+			t.Errorf("String(%d) = %q, %v", n, s, err)
+		}
+		if strings.Trim(s, Base62) != "" {
+			t.Errorf("String(%d) = %q has symbols outside the alphabet", n, s)
+		}
+	}
+}
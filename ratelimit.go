@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a keyed token bucket limiter. Buckets that have been full
+// for a while are swept so scanners cycling through addresses cannot grow
+// the map without bound.
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+// allow takes a token for key, returning how long to wait when none is left.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimit rejects requests beyond rate per second (with the given burst)
+// per client IP with 429 and a Retry-After header. A non-positive rate
+// disables limiting.
+func rateLimit(rate float64, burst int) Middleware {
+	l := newRateLimiter(rate, max(burst, 1))
+	return Middleware{Name: "rate-limit", Wrap: func(next http.Handler) http.Handler {
+		if rate <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, wait := l.allow(clientIP(r)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// RateLimit is a token bucket rate in requests per second with its burst.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// parseRateLimits parses "key=rate[/burst]" entries; burst defaults to the
+// rate rounded up. what names the option in errors.
+func parseRateLimits(what string, entries []string) (map[string]RateLimit, error) {
+	out := make(map[string]RateLimit)
+	for _, e := range entries {
+		key, spec, ok := strings.Cut(strings.TrimSpace(e), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid %s %q: want key=rate[/burst]", what, e)
+		}
+		rateStr, burstStr, hasBurst := strings.Cut(spec, "/")
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid %s %q: bad rate", what, e)
+		}
+		l := RateLimit{Rate: rate, Burst: int(math.Ceil(rate))}
+		if hasBurst {
+			if l.Burst, err = strconv.Atoi(burstStr); err != nil || l.Burst < 1 {
+				return nil, fmt.Errorf("invalid %s %q: bad burst", what, e)
+			}
+		}
+		out[key] = l
+	}
+	return out, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rbacReloadInterval is how often the policy file is checked for changes.
+const rbacReloadInterval = 5 * time.Second
+
+// Special role names in policy rules.
+const (
+	// RoleAnonymous lets requests without an identity through.
+	RoleAnonymous = "anonymous"
+	// RoleAuthenticated lets any identity through.
+	RoleAuthenticated = "authenticated"
+)
+
+// RBACRule grants the listed roles access to the routes it covers.
+type RBACRule struct {
+	ID string `json:"id"`
+	// Paths are globs matched against the request path, where * matches
+	// one segment and ** any number.
+	Paths []string `json:"paths"`
+	// Methods limits the rule to these methods; empty means any.
+	Methods []string `json:"methods,omitempty"`
+	// Roles may access the routes; see RoleAnonymous and
+	// RoleAuthenticated.
+	Roles []string `json:"roles"`
+}
+
+func (rule *RBACRule) covers(r *http.Request) bool {
+	if len(rule.Methods) > 0 && !slices.Contains(rule.Methods, r.Method) {
+		return false
+	}
+	return slices.ContainsFunc(rule.Paths, func(p string) bool { return matchPathGlob(p, r.URL.Path) })
+}
+
+// rbacPolicy is the parsed policy file. The first rule covering a request
+// decides it; requests no rule covers are allowed only if Default is
+// "allow".
+type rbacPolicy struct {
+	Default string `json:"default"`
+	// Roles maps a role to the roles it includes, so "admin": ["editor"]
+	// grants admins everything editors may do.
+	Roles map[string][]string `json:"roles,omitempty"`
+	Rules []RBACRule          `json:"rules"`
+}
+
+func parseRBACPolicy(data []byte) (*rbacPolicy, error) {
+	p := &rbacPolicy{Default: "deny"}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	if p.Default != "allow" && p.Default != "deny" {
+		return nil, fmt.Errorf("default must be allow or deny, not %q", p.Default)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.ID == "" {
+			rule.ID = fmt.Sprintf("rule-%d", i+1)
+		}
+		if len(rule.Paths) == 0 {
+			return nil, fmt.Errorf("rule %q has no paths", rule.ID)
+		}
+		for j, m := range rule.Methods {
+			rule.Methods[j] = strings.ToUpper(m)
+		}
+	}
+	return p, nil
+}
+
+// expand returns roles with every role they include, transitively.
+func (p *rbacPolicy) expand(roles []string) []string {
+	out := slices.Clone(roles)
+	for i := 0; i < len(out); i++ {
+		for _, inc := range p.Roles[out[i]] {
+			if !slices.Contains(out, inc) {
+				out = append(out, inc)
+			}
+		}
+	}
+	return out
+}
+
+// decide returns whether id may make r, and the rule that decided it, or
+// "default".
+func (p *rbacPolicy) decide(r *http.Request, id *Identity) (bool, string) {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.covers(r) {
+			continue
+		}
+		if slices.Contains(rule.Roles, RoleAnonymous) {
+			return true, rule.ID
+		}
+		if id == nil {
+			return false, rule.ID
+		}
+		if slices.Contains(rule.Roles, RoleAuthenticated) {
+			return true, rule.ID
+		}
+		held := p.expand(id.Roles)
+		return slices.ContainsFunc(rule.Roles, func(role string) bool { return slices.Contains(held, role) }), rule.ID
+	}
+	return p.Default == "allow", "default"
+}
+
+// RBAC checks requests against a hot-reloadable role policy, using the
+// identity set by the auth middlewares ahead of it.
+type RBAC struct {
+	path         string
+	logDecisions bool
+	metrics      *Metrics
+
+	mu      sync.RWMutex
+	policy  *rbacPolicy
+	modTime time.Time
+}
+
+func NewRBAC(path string, logDecisions bool, m *Metrics) *RBAC {
+	return &RBAC{path: path, logDecisions: logDecisions, metrics: m, policy: &rbacPolicy{Default: "deny"}}
+}
+
+// Load reads and parses the policy file. On error the current policy stays
+// in effect.
+func (a *RBAC) Load() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	policy, err := parseRBACPolicy(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+	a.mu.Lock()
+	a.policy = policy
+	a.modTime = info.ModTime()
+	a.mu.Unlock()
+	return nil
+}
+
+// watch reloads the policy file whenever its modification time changes.
+func (a *RBAC) watch(ctx context.Context) error {
+	ticker := time.NewTicker(rbacReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(a.path)
+		if err != nil {
+			continue
+		}
+		a.mu.RLock()
+		changed := !info.ModTime().Equal(a.modTime)
+		a.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := a.Load(); err != nil {
+			slog.Warn("Failed to reload RBAC policy", "path", a.path, "error", err)
+			continue
+		}
+		slog.Info("Reloaded RBAC policy", "path", a.path)
+	}
+}
+
+// Middleware answers requests the policy denies with 401 when they carry
+// no identity and 403 when they do. Denials are always logged; allowed
+// requests only with rbac_log_decisions.
+func (a *RBAC) Middleware() Middleware {
+	return Middleware{Name: "rbac", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			a.mu.RLock()
+			policy := a.policy
+			a.mu.RUnlock()
+			id := IdentityFrom(r.Context())
+			allowed, rule := policy.decide(r, id)
+
+			subject := ""
+			if id != nil {
+				subject = id.Subject
+			}
+			attrs := []any{"subject", subject, "method", r.Method, "path", r.URL.Path, "rule", rule}
+			if allowed {
+				a.metrics.Add("server_rbac_decisions_total", 1, "result", "allowed", "rule", rule)
+				if a.logDecisions {
+					slog.Info("RBAC allowed request", attrs...)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			a.metrics.Add("server_rbac_decisions_total", 1, "result", "denied", "rule", rule)
+			slog.Warn("RBAC denied request", attrs...)
+			if id == nil {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		})
+	}}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayRequest is one request read from a HAR or access-log file.
+type replayRequest struct {
+	method string
+	uri    string // path and query
+	header http.Header
+	body   string
+}
+
+// replayHopHeaders are not copied from recordings; the client sets them.
+var replayHopHeaders = []string{"Host", "Content-Length", "Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade", "Te", "Trailer", "Proxy-Connection"}
+
+// accessLogRequest matches the quoted request line of Common/Combined Log
+// Format entries, e.g. "GET /index.html HTTP/1.1".
+var accessLogRequest = regexp.MustCompile(`"([A-Z]+) (\S+) HTTP/[0-9.]+"`)
+
+// runReplay implements the replay subcommand:
+//
+//	replay [-target URL] [-concurrency N] [-rate R] [-repeat N] FILE...
+//
+// FILE is a HAR recording or an access log. A summary is written to out.
+func runReplay(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	target := fs.String("target", "http://localhost:8081", "base URL requests are sent to")
+	concurrency := fs.Int("concurrency", 4, "requests in flight at once")
+	rate := fs.Float64("rate", 0, "maximum requests per second (0 is unlimited)")
+	repeat := fs.Int("repeat", 1, "times to replay the input")
+	timeout := fs.Duration("timeout", 30*time.Second, "per-request timeout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("replay: no input files")
+	}
+	base, err := url.Parse(*target)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return fmt.Errorf("replay: invalid target %q", *target)
+	}
+
+	var reqs []replayRequest
+	for _, name := range fs.Args() {
+		r, err := readReplayFile(name)
+		if err != nil {
+			return err
+		}
+		reqs = append(reqs, r...)
+	}
+	if len(reqs) == 0 {
+		return errors.New("replay: no requests found")
+	}
+
+	work := make(chan replayRequest)
+	go func() {
+		defer close(work)
+		var tick <-chan time.Time
+		if *rate > 0 {
+			t := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+			defer t.Stop()
+			tick = t.C
+		}
+		for range *repeat {
+			for _, r := range reqs {
+				if tick != nil {
+					select {
+					case <-ctx.Done():
+						return
+					case <-tick:
+					}
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case work <- r:
+				}
+			}
+		}
+	}()
+
+	client := &http.Client{
+		Timeout: *timeout,
+		// Report redirects as recorded rather than following them.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	stats := newTrafficStats()
+	var wg sync.WaitGroup
+	for range max(*concurrency, 1) {
+		wg.Go(func() {
+			for r := range work {
+				began := time.Now()
+				status, err := replayOne(ctx, client, base, r)
+				stats.record(status, err, time.Since(began))
+			}
+		})
+	}
+	wg.Wait()
+
+	stats.write(out)
+	return ctx.Err()
+}
+
+func replayOne(ctx context.Context, client *http.Client, base *url.URL, r replayRequest) (int, error) {
+	u, err := base.Parse(r.uri)
+	if err != nil {
+		return 0, err
+	}
+	var body io.Reader
+	if r.body != "" {
+		body = strings.NewReader(r.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, u.String(), body)
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// trafficStats collects results for the replay and loadtest subcommands.
+type trafficStats struct {
+	start time.Time
+
+	mu        sync.Mutex
+	statuses  map[int]int
+	errs      int
+	latencies []time.Duration
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{start: time.Now(), statuses: make(map[int]int)}
+}
+
+func (t *trafficStats) record(status int, err error, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.errs++
+		return
+	}
+	t.statuses[status]++
+	t.latencies = append(t.latencies, elapsed)
+}
+
+// write prints status counts and latency percentiles.
+func (t *trafficStats) write(out io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elapsed := time.Since(t.start)
+	total := t.errs + len(t.latencies)
+	fmt.Fprintf(out, "requests: %d in %s (%.1f/s)\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+	for _, code := range slices.Sorted(maps.Keys(t.statuses)) {
+		fmt.Fprintf(out, "  %d: %d\n", code, t.statuses[code])
+	}
+	if t.errs > 0 {
+		fmt.Fprintf(out, "  errors: %d\n", t.errs)
+	}
+	if len(t.latencies) == 0 {
+		return
+	}
+	slices.Sort(t.latencies)
+	pct := func(p float64) time.Duration {
+		return t.latencies[min(int(p*float64(len(t.latencies))), len(t.latencies)-1)]
+	}
+	fmt.Fprintf(out, "latency: p50 %s  p95 %s  p99 %s  p99.9 %s  max %s\n", pct(0.50), pct(0.95), pct(0.99), pct(0.999), t.latencies[len(t.latencies)-1])
+}
+
+// readReplayFile reads a HAR recording or, failing that, an access log.
+func readReplayFile(name string) ([]replayRequest, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		reqs, err := parseHAR(data)
+		if err != nil {
+			return nil, fmt.Errorf("replay: %s: %w", name, err)
+		}
+		return reqs, nil
+	}
+	return parseAccessLog(bytes.NewReader(data)), nil
+}
+
+func parseHAR(data []byte) ([]replayRequest, error) {
+	var doc harLog
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var reqs []replayRequest
+	for _, e := range doc.Log.Entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			return nil, err
+		}
+		r := replayRequest{method: e.Request.Method, uri: u.RequestURI(), header: make(http.Header)}
+		for _, h := range e.Request.Headers {
+			// Redacted values would only be rejected by the target.
+			if h.Value == harRedacted || slices.Contains(replayHopHeaders, http.CanonicalHeaderKey(h.Name)) || strings.HasPrefix(h.Name, ":") {
+				continue
+			}
+			r.header.Add(h.Name, h.Value)
+		}
+		if e.Request.PostData != nil {
+			r.body = e.Request.PostData.Text
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
+
+// parseAccessLog extracts request lines; entries it cannot parse are skipped.
+func parseAccessLog(r io.Reader) []replayRequest {
+	var reqs []replayRequest
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		m := accessLogRequest.FindStringSubmatch(sc.Text())
+		if m == nil || !strings.HasPrefix(m[2], "/") {
+			continue
+		}
+		reqs = append(reqs, replayRequest{method: m[1], uri: m[2]})
+	}
+	return reqs
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ResolverOptions configures the caching resolver used for upstream dials.
+type ResolverOptions struct {
+	// Cache enables caching. Without it only Overrides are applied.
+	Cache bool
+	// MinTTL and MaxTTL clamp record TTLs; NegativeTTL caches failures.
+	MinTTL      time.Duration
+	MaxTTL      time.Duration
+	NegativeTTL time.Duration
+	// Overrides pin hosts to fixed addresses, like an /etc/hosts that only
+	// applies to this server.
+	Overrides map[string][]netip.Addr
+}
+
+// Resolver resolves upstream hosts, caching answers for their record TTL.
+// The standard library does not expose TTLs, so A and AAAA queries are sent
+// directly to the nameservers in /etc/resolv.conf; anything that cannot be
+// answered that way (no nameservers, truncation, search-domain names, hosts
+// file entries) goes through net.DefaultResolver and is cached for MinTTL.
+type Resolver struct {
+	opts    ResolverOptions
+	servers []string
+	metrics *Metrics
+
+	mu    sync.Mutex
+	cache map[string]dnsEntry
+	group singleflight.Group
+}
+
+type dnsEntry struct {
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+}
+
+func NewResolver(opts ResolverOptions, m *Metrics) *Resolver {
+	return &Resolver{opts: opts, servers: resolvConfServers("/etc/resolv.conf"), metrics: m, cache: make(map[string]dnsEntry)}
+}
+
+// LookupHost returns the addresses for host.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	if addrs, ok := r.opts.Overrides[host]; ok {
+		r.metrics.Add("server_dns_lookups_total", 1, "result", "override")
+		return addrs, nil
+	}
+	if !r.opts.Cache {
+		return r.systemLookup(ctx, host)
+	}
+
+	r.mu.Lock()
+	e, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		r.metrics.Add("server_dns_lookups_total", 1, "result", "hit")
+		return e.addrs, e.err
+	}
+
+	r.metrics.Add("server_dns_lookups_total", 1, "result", "miss")
+	v, err, _ := r.group.Do(host, func() (any, error) {
+		// Detached so one caller giving up does not fail the others.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		addrs, ttl, err := r.lookup(ctx, host)
+		if err != nil {
+			ttl = r.opts.NegativeTTL
+		}
+		ttl = min(max(ttl, r.opts.MinTTL), r.opts.MaxTTL)
+		r.mu.Lock()
+		r.cache[host] = dnsEntry{addrs: addrs, err: err, expires: time.Now().Add(ttl)}
+		r.mu.Unlock()
+		return addrs, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]netip.Addr), nil
+}
+
+func (r *Resolver) lookup(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	if len(r.servers) > 0 && strings.Contains(host, ".") {
+		addrs, ttl, err := r.query(ctx, host)
+		if err == nil && len(addrs) > 0 {
+			return addrs, ttl, nil
+		}
+	}
+	addrs, err := r.systemLookup(ctx, host)
+	return addrs, r.opts.MinTTL, err
+}
+
+func (r *Resolver) systemLookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		r.metrics.Add("server_dns_lookups_total", 1, "result", "error")
+	}
+	return addrs, err
+}
+
+// query asks the first responsive nameserver for A and AAAA records and
+// returns them with the smallest TTL seen.
+func (r *Resolver) query(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	var lastErr error
+	for _, server := range r.servers {
+		var (
+			addrs []netip.Addr
+			ttl   = time.Duration(-1)
+			err   error
+		)
+		for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			a, t, qerr := dnsExchange(ctx, server, host, qtype)
+			if qerr != nil {
+				err = qerr
+				break
+			}
+			addrs = append(addrs, a...)
+			if len(a) > 0 && (ttl < 0 || t < ttl) {
+				ttl = t
+			}
+		}
+		if err == nil {
+			return addrs, max(ttl, 0), nil
+		}
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+)
+
+var errDNSTruncated = errors.New("dns: truncated response")
+
+// dnsExchange sends a single UDP query and parses the answer section.
+func dnsExchange(ctx context.Context, server, host string, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	id := uint16(rand.Uint32())
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0) // RD, one question
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("dns: invalid name %q", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n >= 12 && binary.BigEndian.Uint16(buf) == id {
+			return parseDNSAnswer(buf[:n], qtype)
+		}
+	}
+}
+
+func parseDNSAnswer(b []byte, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	flags := binary.BigEndian.Uint16(b[2:])
+	if flags&0x0200 != 0 {
+		return nil, 0, errDNSTruncated
+	}
+	if rcode := flags & 0x000f; rcode != 0 {
+		return nil, 0, fmt.Errorf("dns: rcode %d", rcode)
+	}
+	qd, an := binary.BigEndian.Uint16(b[4:]), binary.BigEndian.Uint16(b[6:])
+	off := 12
+	for range qd {
+		var ok bool
+		if off, ok = skipDNSName(b, off); !ok || off+4 > len(b) {
+			return nil, 0, errors.New("dns: malformed question")
+		}
+		off += 4
+	}
+
+	var addrs []netip.Addr
+	ttl := time.Duration(-1)
+	for range an {
+		var ok bool
+		if off, ok = skipDNSName(b, off); !ok || off+10 > len(b) {
+			return nil, 0, errors.New("dns: malformed answer")
+		}
+		typ := binary.BigEndian.Uint16(b[off:])
+		recTTL := time.Duration(binary.BigEndian.Uint32(b[off+4:])) * time.Second
+		rdlen := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10
+		if off+rdlen > len(b) {
+			return nil, 0, errors.New("dns: malformed answer")
+		}
+		if typ == qtype {
+			if addr, ok := netip.AddrFromSlice(b[off : off+rdlen]); ok {
+				addrs = append(addrs, addr.Unmap())
+				if ttl < 0 || recTTL < ttl {
+					ttl = recTTL
+				}
+			}
+		}
+		off += rdlen
+	}
+	return addrs, max(ttl, 0), nil
+}
+
+// skipDNSName returns the offset just past the (possibly compressed) name
+// starting at off.
+func skipDNSName(b []byte, off int) (int, bool) {
+	for off < len(b) {
+		l := int(b[off])
+		switch {
+		case l == 0:
+			return off + 1, true
+		case l&0xc0 == 0xc0:
+			return off + 2, off+2 <= len(b)
+		default:
+			off += 1 + l
+		}
+	}
+	return 0, false
+}
+
+func resolvConfServers(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if addr, err := netip.ParseAddr(fields[1]); err == nil {
+				servers = append(servers, netip.AddrPortFrom(addr, 53).String())
+			}
+		}
+	}
+	return servers
+}
+
+// DialContext resolves the host through r and dials each address in turn.
+func (r *Resolver) DialContext(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := r.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var lastErr error = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+		for _, a := range addrs {
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(a.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+// parseDNSOverrides parses "host=addr|addr" entries.
+func parseDNSOverrides(entries []string) (map[string][]netip.Addr, error) {
+	out := make(map[string][]netip.Addr)
+	for _, e := range entries {
+		host, list, ok := strings.Cut(strings.TrimSpace(e), "=")
+		if !ok || host == "" {
+			return nil, fmt.Errorf("invalid dns override %q: want host=addr", e)
+		}
+		for _, s := range strings.Split(list, "|") {
+			addr, err := netip.ParseAddr(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("invalid dns override %q: %w", e, err)
+			}
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			out[host] = append(out[host], addr)
+		}
+	}
+	return out, nil
+}
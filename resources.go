@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// resourceOpenTimeout bounds opening a managed resource at startup.
+const resourceOpenTimeout = 30 * time.Second
+
+// Pinger is implemented by resources that can check their own health, as
+// *sql.DB does; managed resources that implement it get a health check.
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+type resource struct {
+	name   string
+	open   func(ctx context.Context) (io.Closer, error)
+	closer io.Closer
+}
+
+// Manage hands c, such as a database pool, to the server: it is checked by
+// /readyz if it implements Pinger and closed once the listeners have
+// drained. Resources are closed in reverse registration order. It must be
+// called before Run.
+func (s *Server) Manage(name string, c io.Closer) {
+	s.resources = append(s.resources, &resource{name: name, closer: c})
+	if p, ok := c.(Pinger); ok {
+		s.HealthCheck(name, p.PingContext, HealthCheckOptions{})
+	}
+}
+
+// ManageFunc is like Manage, but open is called by Run before the
+// listeners start; if it fails, Run closes the resources opened so far and
+// returns the error.
+func (s *Server) ManageFunc(name string, open func(ctx context.Context) (io.Closer, error)) {
+	s.resources = append(s.resources, &resource{name: name, open: open})
+}
+
+// openResources opens the resources registered with ManageFunc, in order.
+func (s *Server) openResources(ctx context.Context) error {
+	for i, res := range s.resources {
+		if res.open == nil {
+			continue
+		}
+		openCtx, cancel := context.WithTimeout(ctx, resourceOpenTimeout)
+		c, err := res.open(openCtx)
+		cancel()
+		if err != nil {
+			s.closeResources(s.resources[:i])
+			return fmt.Errorf("opening %s: %w", res.name, err)
+		}
+		res.closer = c
+		if p, ok := c.(Pinger); ok {
+			s.HealthCheck(res.name, p.PingContext, HealthCheckOptions{})
+		}
+		slog.Info("Opened resource", "resource", res.name)
+	}
+	return nil
+}
+
+// closeResources closes resources in reverse order, logging failures so
+// one stuck resource does not keep the others open.
+func (s *Server) closeResources(resources []*resource) {
+	for _, res := range slices.Backward(resources) {
+		if res.closer == nil {
+			continue
+		}
+		if err := res.closer.Close(); err != nil {
+			slog.Error("Failed to close resource", "resource", res.name, "error", err)
+			continue
+		}
+		slog.Info("Closed resource", "resource", res.name)
+	}
+}
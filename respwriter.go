@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// responseWrapper is what every middleware response wrapper implements, so
+// streaming and protocol upgrades work through any chain of them: Flusher
+// and Hijacker for code that type-asserts them, and FlushError and Unwrap
+// for http.ResponseController.
+type responseWrapper interface {
+	http.ResponseWriter
+	http.Flusher
+	http.Hijacker
+	FlushError() error
+	Unwrap() http.ResponseWriter
+}
+
+var (
+	_ responseWrapper = (*InstrumentedWriter)(nil)
+	_ responseWrapper = (*harRecorder)(nil)
+	_ responseWrapper = (*throttledWriter)(nil)
+	_ responseWrapper = (*truncatingWriter)(nil)
+	_ responseWrapper = (*cacheRecorder)(nil)
+	_ responseWrapper = (*cacheControlWriter)(nil)
+	_ responseWrapper = (*etagRecorder)(nil)
+	_ responseWrapper = (*luaResponseWriter)(nil)
+	_ responseWrapper = (*headWriter)(nil)
+)
+
+// InstrumentedWriter records the status and body bytes of a response for
+// middleware that reports on it. It passes Flush, Hijack and, through
+// Unwrap, the rest of http.ResponseController on to the wrapped writer.
+type InstrumentedWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+// NewInstrumentedWriter wraps w, or returns w itself when it already is an
+// InstrumentedWriter, so stacked middleware share one.
+func NewInstrumentedWriter(w http.ResponseWriter) *InstrumentedWriter {
+	if iw, ok := w.(*InstrumentedWriter); ok {
+		return iw
+	}
+	return &InstrumentedWriter{ResponseWriter: w}
+}
+
+// Status returns the final status written, 200 when the handler wrote a
+// body or nothing at all, or 101 when it hijacked the connection.
+func (w *InstrumentedWriter) Status() int {
+	switch {
+	case w.status != 0:
+		return w.status
+	case w.hijacked:
+		return http.StatusSwitchingProtocols
+	}
+	return http.StatusOK
+}
+
+// BytesWritten returns the number of body bytes written.
+func (w *InstrumentedWriter) BytesWritten() int64 {
+	return w.bytes
+}
+
+// WroteHeader reports whether the final status has been sent.
+func (w *InstrumentedWriter) WroteHeader() bool {
+	return w.status != 0
+}
+
+func (w *InstrumentedWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *InstrumentedWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// FlushError passes flushes through, for http.ResponseController.
+func (w *InstrumentedWriter) FlushError() error {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Flush implements http.Flusher for code that type-asserts it.
+func (w *InstrumentedWriter) Flush() {
+	_ = w.FlushError()
+}
+
+// Hijack implements http.Hijacker for code that type-asserts it.
+func (w *InstrumentedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (w *InstrumentedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newWrappedServer returns a running listener for a dev-mode server with
+// every middleware that wraps the ResponseWriter switched on, and the
+// streaming route pattern given the per-route wrappers too.
+// The server's error log fails the test, so a wrapper writing to a hijacked
+// connection is caught.
+func newWrappedServer(t *testing.T, pattern string, handler http.HandlerFunc) (*Server, *httptest.Server) {
+	t.Helper()
+	s := newTestServer(t, func(c *Config) {
+		c.Mode = ModeDev
+		c.HARDir = t.TempDir()
+		c.HARSamplePercent = 100
+		c.CacheEnabled = true
+		c.CacheTTL = time.Minute
+		c.CacheControlRules = []string{"/**=no-store"}
+		c.ETagPatterns = []string{pattern}
+		c.ThrottleConnRate = 1 << 20
+		c.ThrottleRoutes = []string{pattern + "=1048576"}
+		c.BrokerPath = "/events"
+	})
+	s.HandleFunc(ListenerHTTP, pattern, handler)
+
+	tracker := newActivityTracker()
+	ts := httptest.NewUnstartedServer(s.handler(ListenerHTTP, s.mux(ListenerHTTP), tracker))
+	ts.Config.ConnState = tracker.connState
+	ts.Config.ConnContext = s.connContext(tracker, nil)
+	ts.Config.ErrorLog = log.New(testLogWriter{t}, "", 0)
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+type testLogWriter struct{ t *testing.T }
+
+func (w testLogWriter) Write(p []byte) (int, error) {
+	w.t.Errorf("server error log: %s", p)
+	return len(p), nil
+}
+
+func TestResponseControllerThroughMiddleware(t *testing.T) {
+	received := make(chan struct{})
+	errs := make(chan error, 1)
+	_, ts := newWrappedServer(t, "GET /stream", func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		errs <- errors.Join(
+			rc.SetWriteDeadline(time.Now().Add(time.Minute)),
+			rc.SetReadDeadline(time.Now().Add(time.Minute)),
+			rc.EnableFullDuplex(),
+		)
+		_, _ = io.WriteString(w, "first\n")
+		if err := rc.Flush(); err != nil {
+			t.Errorf("ResponseController.Flush: %v", err)
+		}
+		// The client can only see the first line if the flush reached the
+		// connection.
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Error("flushed line never reached the client")
+		}
+		_, _ = io.WriteString(w, "second\n")
+		w.(http.Flusher).Flush()
+	})
+
+	resp, err := ts.Client().Get(ts.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := <-errs; err != nil {
+		t.Errorf("ResponseController deadlines and full duplex: %v", err)
+	}
+	br := bufio.NewReader(resp.Body)
+	if line, err := br.ReadString('\n'); line != "first\n" {
+		t.Fatalf("first line %q, %v", line, err)
+	}
+	close(received)
+	if rest, _ := io.ReadAll(br); string(rest) != "second\n" {
+		t.Errorf("rest of body %q", rest)
+	}
+}
+
+func TestHijackThroughMiddleware(t *testing.T) {
+	var calls atomic.Int32
+	_, ts := newWrappedServer(t, "GET /raw", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Errorf("%T does not implement http.Hijacker", w)
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: close\r\n\r\nraw ok")
+		_ = brw.Flush()
+	})
+
+	// The second request must reach the handler too, not a cached copy of
+	// the first.
+	for range 2 {
+		resp, err := ts.Client().Get(ts.URL + "/raw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "raw ok" {
+			t.Errorf("hijacked response body %q", body)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("handler ran %d times, want 2", n)
+	}
+}
+
+func TestCacheSkipsStreamedResponses(t *testing.T) {
+	var calls atomic.Int32
+	c := newResponseCache(CacheOptions{TTL: time.Minute}, NewMetrics())
+	h := c.middleware().Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "event %d\n", calls.Add(1))
+		http.NewResponseController(w).Flush()
+	}))
+
+	for i := range 2 {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+		if want := fmt.Sprintf("event %d\n", i+1); rec.Body.String() != want {
+			t.Errorf("request %d got %q, want a fresh stream", i+1, rec.Body.String())
+		}
+	}
+}
+
+func TestSSEThroughMiddleware(t *testing.T) {
+	_, ts := newWrappedServer(t, "GET /unused", func(http.ResponseWriter, *http.Request) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/debug/stream", nil)
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	// The stream never ends, so the event only arrives if each flush does.
+	br := bufio.NewReader(resp.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		if line == "event: token\n" {
+			return
+		}
+	}
+}
+
+func TestWebSocketThroughMiddleware(t *testing.T) {
+	s, ts := newWrappedServer(t, "GET /unused", func(http.ResponseWriter, *http.Request) {})
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /events?topic=news HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", key)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("handshake: %s %v", resp.Status, resp.Header)
+	}
+
+	if err := s.broker.Publish("news", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 0x80|wsText {
+		t.Fatalf("frame header %#x, want a final text frame", header[0])
+	}
+	payload := make([]byte, header[1]&0x7f)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(payload), `"hello"`) {
+		t.Errorf("message %s", payload)
+	}
+}
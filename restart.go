@@ -0,0 +1,29 @@
+package main
+
+import "time"
+
+// RestartMode selects when a service in the group is restarted.
+type RestartMode int
+
+const (
+	// RestartNever lets any error bring down the whole server (the default).
+	RestartNever RestartMode = iota
+	// RestartOnFailure restarts the service after it returns an error.
+	RestartOnFailure
+	// RestartAlways restarts the service whenever it returns before shutdown.
+	RestartAlways
+)
+
+// RestartPolicy controls how a single service is restarted.
+type RestartPolicy struct {
+	Mode RestartMode
+	// MaxRestarts caps consecutive restarts; zero means unlimited.
+	MaxRestarts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// WithRestartPolicy sets the restart policy for the named service ("http", "https" or "admin").
+func WithRestartPolicy(service string, p RestartPolicy) Option {
+	return func(s *Server) { s.restartPolicies[service] = p }
+}
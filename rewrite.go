@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rewriteReloadInterval is how often the rules file is checked for changes.
+const rewriteReloadInterval = 5 * time.Second
+
+// RewriteRule redirects, or rewrites before routing, the requests whose path
+// it matches.
+type RewriteRule struct {
+	ID string `json:"id"`
+	// Methods limits the rule to these methods; empty means any.
+	Methods []string `json:"methods,omitempty"`
+	// Exactly one of Prefix and Regex is set. A prefix rule replaces the
+	// prefix with To, keeping the rest of the path; a regex rule replaces
+	// the whole path with To, in which $1 or ${name} expand to groups.
+	Prefix string `json:"prefix,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+	// To is the new path, or for redirects an absolute URL, and may carry
+	// a query of its own.
+	To string `json:"to"`
+	// Status is the redirect status: 301, 302, 303, 307 or 308. Without
+	// one the path is rewritten and routed as if the client had sent it.
+	Status int `json:"status,omitempty"`
+	// DropQuery discards the request's query instead of appending it to
+	// the one in To.
+	DropQuery bool `json:"drop_query,omitempty"`
+
+	re *regexp.Regexp
+}
+
+var redirectStatuses = []int{
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusSeeOther,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+}
+
+func parseRewriteRules(data []byte) ([]RewriteRule, error) {
+	var file struct {
+		Rules []RewriteRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if rule.ID == "" {
+			rule.ID = fmt.Sprintf("rule-%d", i+1)
+		}
+		if (rule.Prefix == "") == (rule.Regex == "") {
+			return nil, fmt.Errorf("rule %q must set exactly one of prefix and regex", rule.ID)
+		}
+		if rule.Status != 0 && !slices.Contains(redirectStatuses, rule.Status) {
+			return nil, fmt.Errorf("rule %q: %d is not a redirect status", rule.ID, rule.Status)
+		}
+		if rule.Status == 0 && !strings.HasPrefix(rule.To, "/") {
+			return nil, fmt.Errorf("rule %q rewrites to %q, which is not a path", rule.ID, rule.To)
+		}
+		if rule.Regex != "" {
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q regex: %w", rule.ID, err)
+			}
+			rule.re = re
+		}
+		for j, m := range rule.Methods {
+			rule.Methods[j] = strings.ToUpper(m)
+		}
+	}
+	return file.Rules, nil
+}
+
+// apply returns the target of r under the rule, or false when the rule does
+// not match.
+func (rule *RewriteRule) apply(r *http.Request) (string, bool) {
+	if len(rule.Methods) > 0 && !slices.Contains(rule.Methods, r.Method) {
+		return "", false
+	}
+	var target string
+	if rule.re != nil {
+		m := rule.re.FindStringSubmatchIndex(r.URL.Path)
+		if m == nil {
+			return "", false
+		}
+		target = string(rule.re.ExpandString(nil, rule.To, r.URL.Path, m))
+	} else {
+		rest, ok := strings.CutPrefix(r.URL.Path, rule.Prefix)
+		if !ok {
+			return "", false
+		}
+		target = rule.To + rest
+	}
+	if !rule.DropQuery && r.URL.RawQuery != "" {
+		sep := "?"
+		if strings.Contains(target, "?") {
+			sep = "&"
+		}
+		target += sep + r.URL.RawQuery
+	}
+	return target, true
+}
+
+// Rewriter applies a hot-reloadable list of redirect and rewrite rules. The
+// first rule matching a request decides it.
+type Rewriter struct {
+	path    string
+	metrics *Metrics
+
+	mu      sync.RWMutex
+	rules   []RewriteRule
+	modTime time.Time
+}
+
+func NewRewriter(path string, m *Metrics) *Rewriter {
+	return &Rewriter{path: path, metrics: m}
+}
+
+// Load reads and parses the rules file. On error the current rules stay in
+// effect.
+func (rw *Rewriter) Load() error {
+	info, err := os.Stat(rw.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(rw.path)
+	if err != nil {
+		return err
+	}
+	rules, err := parseRewriteRules(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", rw.path, err)
+	}
+	rw.mu.Lock()
+	rw.rules = rules
+	rw.modTime = info.ModTime()
+	rw.mu.Unlock()
+	return nil
+}
+
+// watch reloads the rules file whenever its modification time changes.
+func (rw *Rewriter) watch(ctx context.Context) error {
+	ticker := time.NewTicker(rewriteReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(rw.path)
+		if err != nil {
+			continue
+		}
+		rw.mu.RLock()
+		changed := !info.ModTime().Equal(rw.modTime)
+		rw.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := rw.Load(); err != nil {
+			slog.Warn("Failed to reload rewrite rules", "path", rw.path, "error", err)
+			continue
+		}
+		slog.Info("Reloaded rewrite rules", "path", rw.path)
+	}
+}
+
+// Middleware redirects or rewrites requests before the mux routes them.
+// Rewritten requests pass through the rules once, so rules cannot loop.
+func (rw *Rewriter) Middleware() Middleware {
+	return Middleware{Name: "rewrite", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw.mu.RLock()
+			rules := rw.rules
+			rw.mu.RUnlock()
+			for i := range rules {
+				rule := &rules[i]
+				target, ok := rule.apply(r)
+				if !ok {
+					continue
+				}
+				if rule.Status != 0 {
+					rw.metrics.Add("server_rewrites_total", 1, "rule", rule.ID, "action", "redirect")
+					http.Redirect(w, r, target, rule.Status)
+					return
+				}
+				rw.metrics.Add("server_rewrites_total", 1, "rule", rule.ID, "action", "rewrite")
+				p, query, _ := strings.Cut(target, "?")
+				next.ServeHTTP(w, withPath(r, p, query))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newRewriteServer(t *testing.T, rules string) *Server {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, func(c *Config) { c.RewriteRulesFile = path })
+	if err := s.rewriter.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRewriteRoutesByRewrittenPattern(t *testing.T) {
+	s := newRewriteServer(t, `{"rules":[{"id":"v1","prefix":"/v1/","to":"/v2/"}]}`)
+	var listenerPattern string
+	s.Use(Middleware{Name: "pattern", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			listenerPattern = r.Pattern
+			next.ServeHTTP(w, r)
+		})
+	}})
+	s.HandleFunc(ListenerHTTP, "GET /v2/items", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	})
+
+	rec := serveListener(s, ListenerHTTP, httptest.NewRequest(http.MethodGet, "/v1/items", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "/v2/items" {
+		t.Fatalf("rewritten request: %d %q", rec.Code, rec.Body.String())
+	}
+	if listenerPattern != "GET /v2/items" {
+		t.Errorf("listener middleware saw pattern %q, want the rewritten route's", listenerPattern)
+	}
+	if got := s.metrics.Value("server_http_requests_total", "listener", ListenerHTTP, "route", "GET /v2/items", "method", "GET", "code", "200"); got != 1 {
+		t.Errorf("route metric for the rewritten route = %v, want 1", got)
+	}
+}
+
+func TestRewriteRedirect(t *testing.T) {
+	s := newRewriteServer(t, `{"rules":[{"prefix":"/old/","to":"/new/","status":308}]}`)
+
+	rec := serveListener(s, ListenerHTTP, httptest.NewRequest(http.MethodGet, "/old/page?x=1", nil))
+	if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != "/new/page?x=1" {
+		t.Errorf("redirect: %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestRewriteSkipsAdminListener(t *testing.T) {
+	s := newRewriteServer(t, `{"rules":[{"prefix":"/admin/","to":"/elsewhere/"}]}`)
+
+	rec := serveListener(s, ListenerAdmin, httptest.NewRequest(http.MethodGet, "/admin/routes", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("admin request: %d, want it left alone", rec.Code)
+	}
+}
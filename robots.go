@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default robots.txt bodies: production sites are open to crawlers, other
+// modes keep them out so staging copies are not indexed.
+const (
+	robotsAllowAll    = "User-agent: *\nDisallow:\n"
+	robotsDisallowAll = "User-agent: *\nDisallow: /\n"
+)
+
+// faviconMaxAge is how long clients may cache the favicon.
+const faviconMaxAge = 24 * time.Hour
+
+// defaultFavicon is a transparent 1x1 ICO, so browsers asking for
+// /favicon.ico get an image instead of a logged 404.
+var defaultFavicon = []byte{
+	0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x20, 0x00, 0x30, 0x00,
+	0x00, 0x00, 0x16, 0x00, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00,
+	0x00, 0x00, 0x01, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// registerSiteFiles serves /robots.txt and /favicon.ico on the HTTP and
+// HTTPS listeners. Each comes from its configured file, else robots_txt's
+// inline content or the built-in default.
+func (s *Server) registerSiteFiles() {
+	var robots http.Handler
+	switch {
+	case s.config.RobotsTxtFile != "":
+		robots = fileDocument("robots.txt", s.config.RobotsTxtFile)
+	case s.config.RobotsTxt != "":
+		robots = fixedDocument("text/plain; charset=utf-8", []byte(strings.TrimSuffix(s.config.RobotsTxt, "\n")+"\n"))
+	case s.config.Mode == ModeProd:
+		robots = fixedDocument("text/plain; charset=utf-8", []byte(robotsAllowAll))
+	default:
+		robots = fixedDocument("text/plain; charset=utf-8", []byte(robotsDisallowAll))
+	}
+
+	favicon := fixedDocument("image/x-icon", defaultFavicon)
+	if s.config.FaviconFile != "" {
+		favicon = fileDocument("favicon.ico", s.config.FaviconFile)
+	}
+	favicon = faviconCache(favicon)
+
+	for _, listener := range []string{ListenerHTTP, ListenerHTTPS} {
+		s.Handle(listener, "GET /robots.txt", robots)
+		s.Handle(listener, "GET /favicon.ico", favicon)
+	}
+}
+
+// fixedDocument serves body with contentType, supporting conditional and
+// range requests.
+func fixedDocument(contentType string, body []byte) http.Handler {
+	modTime := time.Now()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
+	})
+}
+
+// faviconCache lets clients keep the favicon, which browsers otherwise
+// re-request on every page load.
+func faviconCache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(faviconMaxAge.Seconds())))
+		next.ServeHTTP(w, r)
+	})
+}
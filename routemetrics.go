@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unmatchedRoute labels requests no route matched, so scanners probing
+// random paths add one series rather than one per path.
+const unmatchedRoute = "unmatched"
+
+// parseMetricRoutes maps route patterns to the route label their request
+// metrics carry: the group named by "pattern=group" entries, or "" for
+// excluded patterns. Patterns in neither keep their own label.
+func parseMetricRoutes(groups, exclude []string) (map[string]string, error) {
+	out := make(map[string]string, len(groups)+len(exclude))
+	for _, e := range groups {
+		pattern, group, ok := strings.Cut(e, "=")
+		if !ok || strings.TrimSpace(group) == "" {
+			return nil, fmt.Errorf("metrics route group %q: expected pattern=group", e)
+		}
+		out[strings.TrimSpace(pattern)] = strings.TrimSpace(group)
+	}
+	for _, pattern := range exclude {
+		out[strings.TrimSpace(pattern)] = ""
+	}
+	return out, nil
+}
+
+// requestMetrics counts and times the requests on listener by route. It
+// runs inside the activity tracker, which sets r.Pattern.
+func (s *Server) requestMetrics(listener string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		iw := NewInstrumentedWriter(w)
+		next.ServeHTTP(iw, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = unmatchedRoute
+		} else if label, ok := s.metricRoutes[route]; ok {
+			if label == "" {
+				return
+			}
+			route = label
+		}
+		s.metrics.Add("server_http_requests_total", 1, "listener", listener, "route", route, "method", metricMethod(r.Method), "code", strconv.Itoa(iw.Status()))
+		s.metrics.Observe("server_http_request_duration_seconds", time.Since(start).Seconds(), "listener", listener, "route", route)
+	})
+}
+
+// metricMethod bounds the method label to the standard methods.
+func metricMethod(method string) string {
+	if slices.Contains(standardMethods, method) || method == http.MethodConnect || method == http.MethodTrace {
+		return method
+	}
+	return "OTHER"
+}
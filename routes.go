@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// Listener names used in the route table.
+const (
+	ListenerHTTP  = "http"
+	ListenerHTTPS = "https"
+	ListenerAdmin = "admin"
+)
+
+// Middleware wraps a handler. Name is what the route listing reports.
+type Middleware struct {
+	Name string
+	Wrap func(http.Handler) http.Handler
+}
+
+func (m Middleware) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Name)
+}
+
+// Route is a registered pattern and the listener that serves it.
+type Route struct {
+	Listener   string       `json:"listener"`
+	Method     string       `json:"method"`
+	Path       string       `json:"path"`
+	Middleware []Middleware `json:"middleware"`
+
+	pattern string
+	handler http.Handler
+}
+
+// Handle registers handler for pattern on the named listener. Middleware is
+// applied in order, so the first entry is the outermost wrapper. It must be
+// called before Run.
+func (s *Server) Handle(listener, pattern string, handler http.Handler, mw ...Middleware) {
+	if slices.Contains(s.config.ETagPatterns, pattern) {
+		mw = append([]Middleware{etag(s.config.ETagMaxBytes, s.metrics)}, mw...)
+	}
+	if slices.Contains(s.config.CoalescePatterns, pattern) {
+		mw = append([]Middleware{s.coalesce}, mw...)
+	}
+	if rate, ok := s.throttleRoutes[pattern]; ok {
+		mw = append([]Middleware{throttleRoute(rate)}, mw...)
+	}
+	if budget, ok := s.deadlineRoutes[pattern]; ok {
+		mw = append([]Middleware{routeDeadline(budget, s.metrics)}, mw...)
+	}
+	if group, ok := s.bulkheadRoutes[pattern]; ok {
+		opts := s.bulkheadGroups[group]
+		opts.QueueTimeout = s.config.BulkheadQueueTimeout
+		mw = append([]Middleware{s.Bulkhead(group, opts)}, mw...)
+	}
+	if checks, ok := s.degradedRoutes[pattern]; ok {
+		// Outermost, so a degraded route answers before doing any work.
+		mw = append([]Middleware{s.Degrade(DegradeOptions{Checks: checks, RetryAfter: s.config.DegradedRetryAfter, Stale: true})}, mw...)
+	}
+	if rs, ok := s.requestSchemas[pattern]; ok {
+		// Innermost, so cheaper rejections such as rate limits come first.
+		mw = append(slices.Clip(mw), validateRequest(pattern, rs, s.metrics))
+	}
+
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		method, path = "*", pattern
+	}
+	if method == http.MethodGet {
+		if head, ok := s.headMiddleware(pattern, mw); ok {
+			// Outermost, so everything else runs as it would for GET.
+			mw = append([]Middleware{head}, mw...)
+		}
+	}
+	s.routes = append(s.routes, Route{
+		Listener:   listener,
+		Method:     method,
+		Path:       path,
+		Middleware: mw,
+		pattern:    pattern,
+		handler:    newSwappableHandler(handler),
+	})
+}
+
+func (s *Server) HandleFunc(listener, pattern string, handler http.HandlerFunc, mw ...Middleware) {
+	s.Handle(listener, pattern, handler, mw...)
+}
+
+// Use adds middleware applied to every route on the public listeners,
+// outermost first. The admin listener is left alone so that middleware such
+// as chaos injection cannot lock operators out. It must be called before Run.
+func (s *Server) Use(mw ...Middleware) {
+	s.middleware = append(s.middleware, mw...)
+}
+
+// UseAdmin adds middleware applied to every route on the admin listener,
+// for protections operators need too. It must be called before Run.
+func (s *Server) UseAdmin(mw ...Middleware) {
+	s.adminMiddleware = append(s.adminMiddleware, mw...)
+}
+
+// listenerMiddleware returns the listener-wide middleware for listener.
+func (s *Server) listenerMiddleware(listener string) []Middleware {
+	if listener == ListenerAdmin {
+		return s.adminMiddleware
+	}
+	return s.middleware
+}
+
+// activityMiddleware names the request tracking serve installs on every listener.
+var activityMiddleware = Middleware{Name: "activity"}
+
+// Routes returns the route table including listener-wide middleware.
+func (s *Server) Routes() []Route {
+	out := make([]Route, len(s.routes))
+	for i, rt := range s.routes {
+		mw := append([]Middleware{activityMiddleware}, s.listenerMiddleware(rt.Listener)...)
+		rt.Middleware = append(mw, s.routeMiddleware(rt)...)
+		out[i] = rt
+	}
+	return out
+}
+
+// mux builds the ServeMux for the named listener from the route table.
+func (s *Server) mux(listener string) *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, rt := range s.routes {
+		if rt.Listener != listener {
+			continue
+		}
+		h := rt.handler
+		mw := s.routeMiddleware(rt)
+		for i := len(mw) - 1; i >= 0; i-- {
+			h = mw[i].Wrap(h)
+		}
+		mux.Handle(rt.pattern, h)
+	}
+	return mux
+}
+
+// routeMiddleware returns rt's middleware followed, on the public
+// listeners, by response caching. Caching is innermost so that route guards
+// such as signature checks, bulkheads and rate limits apply to cache hits.
+func (s *Server) routeMiddleware(rt Route) []Middleware {
+	if rt.Listener == ListenerAdmin || len(s.caching) == 0 {
+		return rt.Middleware
+	}
+	return append(slices.Clip(rt.Middleware), s.caching...)
+}
+
+// debugMethods are the methods the debug endpoints answer; GET also covers HEAD.
+var debugMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// registerDefaultRoutes installs the built-in routes on every listener.
+func (s *Server) registerDefaultRoutes() {
+	s.HandleFunc(ListenerHTTP, "GET /", httpHandler)
+	s.HandleFunc(ListenerHTTP, "GET /error", errorHandler)
+	s.HandleFunc(ListenerHTTPS, "GET /", httpHandler)
+	s.registerWellKnown()
+	s.registerSiteFiles()
+
+	botLimits, err := parseRateLimits("bot rate limit", s.config.BotRateLimits)
+	if err != nil {
+		slog.Warn("Ignoring invalid bot rate limits", "error", err)
+	}
+	botLimit := botRateLimit(botLimits, s.metrics)
+	tokenLimit := rateLimit(s.config.TokenRate, s.config.TokenBurst)
+	s.HandleFunc(ListenerHTTP, "GET /token", tokenHandler, botLimit, tokenLimit)
+	s.HandleFunc(ListenerHTTPS, "GET /token", tokenHandler, botLimit, tokenLimit)
+	s.HandleFunc(ListenerHTTP, "GET /uuid", uuidHandler, botLimit, tokenLimit)
+	s.HandleFunc(ListenerHTTPS, "GET /uuid", uuidHandler, botLimit, tokenLimit)
+
+	if s.config.StaticDir != "" {
+		opts := StaticOptions{Hints: s.config.StaticHints, SigningKey: []byte(s.config.StaticSigningKey)}
+		st := s.storage(s.config.StaticDir)
+		if fs, ok := st.(FileStorage); ok && s.config.StaticFingerprint {
+			if m, err := NewAssetManifest(fs.Dir, s.config.StaticPrefix); err != nil {
+				slog.Warn("Not fingerprinting static assets", "dir", fs.Dir, "error", err)
+			} else {
+				s.assets = m
+				opts.Assets = m
+			}
+		}
+		s.Static(ListenerHTTP, s.config.StaticPrefix, st, opts)
+		s.Static(ListenerHTTPS, s.config.StaticPrefix, st, opts)
+	}
+
+	if s.config.UploadDir != "" {
+		s.uploadStore = s.storage(s.config.UploadDir)
+		for _, listener := range []string{ListenerHTTP, ListenerHTTPS} {
+			s.HandleFunc(listener, "POST /upload", s.uploadHandler)
+			s.HandleFunc(listener, "GET /upload/progress/{id}", s.uploadProgressHandler)
+		}
+	}
+
+	if len(s.config.ProxyUpstream) > 0 {
+		var upstreams []*url.URL
+		for _, raw := range s.config.ProxyUpstream {
+			u, _ := url.Parse(raw)
+			upstreams = append(upstreams, u)
+		}
+		opts := ProxyOptions{HashKey: s.config.ProxyHashKey, HedgeAfter: s.config.ProxyHedgeAfter, ShadowPercent: s.config.ProxyShadowPercent, ShadowMaxBody: s.config.ProxyShadowMaxBody}
+		if s.config.ProxyShadowUpstream != "" {
+			opts.Shadow, _ = url.Parse(s.config.ProxyShadowUpstream)
+		}
+		if s.config.ProxyGreenUpstream != "" {
+			opts.Green, _ = url.Parse(s.config.ProxyGreenUpstream)
+			opts.BlueGreenOptions = BlueGreenOptions{
+				RollbackErrorRate:   s.config.BlueGreenRollbackErrorRate,
+				RollbackWindow:      s.config.BlueGreenRollbackWindow,
+				RollbackMinRequests: s.config.BlueGreenRollbackMinRequests,
+			}
+		}
+		if s.config.ProxyCanaryUpstream != "" {
+			opts.Canary, _ = url.Parse(s.config.ProxyCanaryUpstream)
+			opts.CanaryOptions = CanaryOptions{
+				Percent: s.config.ProxyCanaryPercent,
+				Cookie:  s.config.ProxyCanaryCookie,
+				Header:  s.config.ProxyCanaryHeader,
+			}
+		}
+		s.Proxy(ListenerHTTP, s.config.ProxyPrefix, upstreams, opts)
+		s.Proxy(ListenerHTTPS, s.config.ProxyPrefix, upstreams, opts)
+	}
+
+	if s.config.CGIDir != "" {
+		h := s.CGI(s.config.CGIPrefix, CGIOptions{Dir: s.config.CGIDir, Timeout: s.config.CGITimeout, MaxConcurrent: s.config.CGIMaxConcurrent})
+		prefix := "/" + strings.Trim(s.config.CGIPrefix, "/") + "/"
+		for _, listener := range []string{ListenerHTTP, ListenerHTTPS} {
+			s.Handle(listener, prefix, h)
+		}
+	}
+
+	for _, path := range s.config.HoneypotPaths {
+		for _, listener := range []string{ListenerHTTP, ListenerHTTPS} {
+			for _, method := range debugMethods {
+				s.HandleFunc(listener, method+" "+path, s.honeypotHandler(path))
+			}
+		}
+	}
+
+	if s.config.WebhookSecret != "" {
+		s.webhooks = s.Webhook(WebhookOptions{
+			Scheme:       s.config.WebhookScheme,
+			Secret:       []byte(s.config.WebhookSecret),
+			MaxBodyBytes: s.config.WebhookMaxBodyBytes,
+			Tolerance:    s.config.WebhookTolerance,
+		})
+		s.Handle(ListenerHTTP, "POST "+s.config.WebhookPath, s.webhooks)
+		s.Handle(ListenerHTTPS, "POST "+s.config.WebhookPath, s.webhooks)
+	}
+
+	if s.config.BrokerPath != "" {
+		s.broker = newBroker(s.config.BrokerTopicBuffer, s.config.BrokerSubscriberBuffer, s.metrics)
+		s.HandleFunc(ListenerHTTP, "GET "+s.config.BrokerPath, s.subscribeHandler)
+		s.HandleFunc(ListenerHTTPS, "GET "+s.config.BrokerPath, s.subscribeHandler)
+	}
+
+	// The debug endpoints are dev and chaos only: echo reflects cookies and
+	// Authorization back. Method-less patterns would conflict with "GET /",
+	// so the any-method ones are registered once per method.
+	if s.config.Mode == ModeDev || s.config.Mode == ModeChaos {
+		for _, listener := range []string{ListenerHTTP, ListenerHTTPS} {
+			for _, method := range debugMethods {
+				s.HandleFunc(listener, method+" /debug/echo", echoHandler)
+				s.HandleFunc(listener, method+" /debug/delay/{ms}", delayHandler)
+				s.HandleFunc(listener, method+" /debug/status/{code}", statusHandler)
+			}
+			s.HandleFunc(listener, "GET /debug/stream", s.streamHandler)
+			s.HandleFunc(listener, "GET /debug/ndjson", s.ndjsonHandler)
+			s.HandleFunc(listener, "GET /debug/longpoll", s.longPollHandler)
+		}
+	}
+
+	s.HandleFunc(ListenerHTTP, "GET /readyz", s.readyzHandler(false))
+	s.HandleFunc(ListenerHTTPS, "GET /readyz", s.readyzHandler(false))
+	s.HandleFunc(ListenerAdmin, "GET /readyz", s.readyzHandler(true))
+	s.Handle(ListenerAdmin, "GET /admin/metrics", s.metrics)
+	s.HandleFunc(ListenerAdmin, "GET /admin/supervisor", s.supervisorHandler)
+	s.HandleFunc(ListenerAdmin, "POST /admin/drain", s.drainHandler)
+	s.HandleFunc(ListenerAdmin, "GET /admin/config", s.configHandler)
+	s.HandleFunc(ListenerAdmin, "GET /admin/routes", s.routesHandler)
+	s.RegisterHandler("unavailable", http.HandlerFunc(unavailableHandler))
+	s.HandleFunc(ListenerAdmin, "GET /admin/handlers", s.handlersHandler)
+	s.HandleFunc(ListenerAdmin, "PUT /admin/handlers", s.swapHandlerHandler)
+	s.HandleFunc(ListenerAdmin, "GET /admin/flags", s.flagsHandler)
+	s.HandleFunc(ListenerAdmin, "PUT /admin/flags/{name}", s.setFlagHandler)
+	if s.config.ProfilingPprof {
+		s.registerPprof()
+	}
+	if s.config.StaticSigningKey != "" {
+		s.HandleFunc(ListenerAdmin, "POST /admin/sign", s.signURLHandler)
+	}
+	if s.assets != nil {
+		s.HandleFunc(ListenerAdmin, "GET /admin/assets", s.assetsHandler)
+	}
+	if s.graphql != nil {
+		for _, listener := range []string{ListenerHTTP, ListenerHTTPS} {
+			s.HandleFunc(listener, "GET "+s.config.GraphQLPath, s.graphqlHandler)
+			s.HandleFunc(listener, "POST "+s.config.GraphQLPath, s.graphqlHandler)
+		}
+	}
+	if s.users != nil {
+		s.HandleFunc(ListenerAdmin, "GET /admin/users", s.usersHandler)
+		s.HandleFunc(ListenerAdmin, "GET /admin/users/{name}", s.userHandler)
+		s.HandleFunc(ListenerAdmin, "PUT /admin/users/{name}", s.putUserHandler)
+		s.HandleFunc(ListenerAdmin, "DELETE /admin/users/{name}", s.deleteUserHandler)
+	}
+	if s.tenants != nil {
+		s.HandleFunc(ListenerAdmin, "GET /admin/tenants", s.tenantsHandler)
+		s.HandleFunc(ListenerAdmin, "GET /admin/tenants/{tenant}", s.tenantHandler)
+	}
+	if s.config.CacheEnabled {
+		s.HandleFunc(ListenerAdmin, "POST /admin/cache/purge", s.purgeCacheHandler)
+	}
+	if len(s.config.HoneypotPaths) > 0 {
+		s.HandleFunc(ListenerAdmin, "GET /admin/bans", s.bansHandler)
+		s.HandleFunc(ListenerAdmin, "DELETE /admin/bans/{addr}", s.unbanHandler)
+	}
+	if s.broker != nil {
+		s.HandleFunc(ListenerAdmin, "POST /admin/broker/{topic}", s.publishHandler)
+	}
+	if s.blueGreen != nil {
+		s.HandleFunc(ListenerAdmin, "GET /admin/bluegreen", s.blueGreenHandler)
+		s.HandleFunc(ListenerAdmin, "PUT /admin/bluegreen", s.switchBlueGreenHandler)
+	}
+	if s.config.Mode == ModeChaos {
+		s.HandleFunc(ListenerAdmin, "GET /admin/chaos", s.chaosHandler)
+		s.HandleFunc(ListenerAdmin, "PUT /admin/chaos", s.setChaosHandler)
+	}
+}
+
+func (s *Server) routesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Routes())
+}
+
+// PrintRoutes writes the route table in aligned columns, for the routes subcommand.
+func (s *Server) PrintRoutes(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LISTENER\tMETHOD\tPATH\tMIDDLEWARE")
+	for _, rt := range s.Routes() {
+		names := make([]string, len(rt.Middleware))
+		for i, m := range rt.Middleware {
+			names[i] = m.Name
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", rt.Listener, rt.Method, rt.Path, strings.Join(names, ","))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What a scheduled task does when its next run comes up while the previous
+// one is still going.
+const (
+	// OverlapSkip drops the run.
+	OverlapSkip = "skip"
+	// OverlapQueue runs it as soon as the previous run finishes; further
+	// runs that come up meanwhile are merged into that one.
+	OverlapQueue = "queue"
+)
+
+// Run results reported by the schedule API.
+const (
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// TaskRun describes a finished run of a scheduled task.
+type TaskRun struct {
+	Started    time.Time `json:"started"`
+	DurationMS int64     `json:"duration_ms"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// ScheduledTaskStatus is a point-in-time view of a scheduled task, as
+// listed by GET /admin/schedule.
+type ScheduledTaskStatus struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	Overlap  string    `json:"overlap"`
+	Running  bool      `json:"running"`
+	Next     time.Time `json:"next"`
+	LastRun  *TaskRun  `json:"last_run,omitempty"`
+	Runs     int       `json:"runs"`
+	Failures int       `json:"failures"`
+	Skipped  int       `json:"skipped"`
+}
+
+type scheduledTask struct {
+	name     string
+	spec     string
+	overlap  string
+	schedule *cronSchedule
+	fn       func(ctx context.Context) error
+
+	mu      sync.Mutex
+	running bool
+	queued  bool
+	status  ScheduledTaskStatus
+}
+
+// scheduler runs registered tasks on their cron schedules as one
+// supervised task, so runs share the server's context and are waited for
+// on shutdown.
+type scheduler struct {
+	metrics *Metrics
+	tasks   []*scheduledTask
+}
+
+// Schedule registers fn to run on spec, a five-field cron expression
+// (minute hour day-of-month month day-of-week) in local time, or one of
+// @hourly, @daily, @weekly, @monthly, @yearly and "@every DURATION".
+// overlap is OverlapSkip or OverlapQueue. Errors from fn are recorded in
+// the task's status and do not stop the schedule. It must be called before
+// Run.
+func (s *Server) Schedule(name, spec, overlap string, fn func(ctx context.Context) error) error {
+	sched, err := parseCron(spec)
+	if err != nil {
+		return fmt.Errorf("schedule %q: %w", name, err)
+	}
+	if sched.next(time.Now()).IsZero() {
+		return fmt.Errorf("schedule %q: %q never fires", name, spec)
+	}
+	if overlap != OverlapSkip && overlap != OverlapQueue {
+		return fmt.Errorf("schedule %q: unknown overlap policy %q", name, overlap)
+	}
+	if s.scheduler == nil {
+		s.scheduler = &scheduler{metrics: s.metrics}
+		s.Supervise("scheduler", RestartPolicy{Mode: RestartOnFailure}, s.scheduler.run)
+		s.HandleFunc(ListenerAdmin, "GET /admin/schedule", s.scheduleHandler)
+	}
+	if slices.ContainsFunc(s.scheduler.tasks, func(t *scheduledTask) bool { return t.name == name }) {
+		return fmt.Errorf("schedule %q: already registered", name)
+	}
+	s.scheduler.tasks = append(s.scheduler.tasks, &scheduledTask{
+		name:     name,
+		spec:     spec,
+		overlap:  overlap,
+		schedule: sched,
+		fn:       fn,
+		status:   ScheduledTaskStatus{Name: name, Schedule: spec, Overlap: overlap},
+	})
+	return nil
+}
+
+func (sc *scheduler) run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, t := range sc.tasks {
+		wg.Go(func() { sc.loop(ctx, &wg, t) })
+	}
+	wg.Wait()
+	return nil
+}
+
+// loop triggers t at each scheduled time until ctx is cancelled.
+func (sc *scheduler) loop(ctx context.Context, wg *sync.WaitGroup, t *scheduledTask) {
+	for {
+		next := t.schedule.next(time.Now())
+		t.mu.Lock()
+		t.status.Next = next
+		t.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		sc.trigger(ctx, wg, t)
+	}
+}
+
+func (sc *scheduler) trigger(ctx context.Context, wg *sync.WaitGroup, t *scheduledTask) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running {
+		if t.overlap == OverlapQueue {
+			t.queued = true
+			return
+		}
+		t.status.Skipped++
+		sc.metrics.Add("server_scheduled_runs_total", 1, "task", t.name, "result", "skipped")
+		slog.Warn("Skipping scheduled run; previous run still going", "task", t.name)
+		return
+	}
+	t.running = true
+	wg.Go(func() { sc.execute(ctx, t) })
+}
+
+// execute runs t, then any run queued while it was going.
+func (sc *scheduler) execute(ctx context.Context, t *scheduledTask) {
+	for {
+		run := TaskRun{Started: time.Now(), Result: RunSucceeded}
+		err := runTask(ctx, t.fn)
+		elapsed := time.Since(run.Started)
+		run.DurationMS = elapsed.Milliseconds()
+		if err != nil {
+			run.Result, run.Error = RunFailed, err.Error()
+			slog.Error("Scheduled task failed", "task", t.name, "error", err)
+		}
+		sc.metrics.Add("server_scheduled_runs_total", 1, "task", t.name, "result", run.Result)
+		sc.metrics.Observe("server_scheduled_run_duration_seconds", elapsed.Seconds(), "task", t.name)
+
+		t.mu.Lock()
+		t.status.LastRun = &run
+		t.status.Runs++
+		if err != nil {
+			t.status.Failures++
+		}
+		if !t.queued || ctx.Err() != nil {
+			t.running, t.queued = false, false
+			t.mu.Unlock()
+			return
+		}
+		t.queued = false
+		t.mu.Unlock()
+	}
+}
+
+// runTask calls fn, turning a panic into an error so it is recorded like
+// any other failure.
+func runTask(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return fn(ctx)
+}
+
+func (sc *scheduler) statuses() []ScheduledTaskStatus {
+	out := make([]ScheduledTaskStatus, len(sc.tasks))
+	for i, t := range sc.tasks {
+		t.mu.Lock()
+		out[i] = t.status
+		out[i].Running = t.running
+		t.mu.Unlock()
+	}
+	return out
+}
+
+func (s *Server) scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.scheduler.statuses())
+}
+
+// cronSchedule is a parsed cron expression. Each field is a bitset of the
+// values it allows; every is set instead for "@every" schedules.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Per cron convention, when both day fields are restricted a day
+	// matching either one is allowed.
+	domAny, dowAny bool
+	every          time.Duration
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDays   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+func parseCron(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || every < time.Second {
+			return nil, fmt.Errorf("invalid interval %q", d)
+		}
+		return &cronSchedule{every: every}, nil
+	}
+	if expanded, ok := cronMacros[spec]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: want 5 fields", spec)
+	}
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, err
+	}
+	// Sunday is both 0 and 7.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*" || fields[2] == "?"
+	c.dowAny = fields[4] == "*" || fields[4] == "?"
+	return &c, nil
+}
+
+// parseCronField parses a comma-separated list of *, N, N-M and any of
+// those with a /STEP suffix. names, when set, are accepted in place of
+// numbers counting up from lo.
+func parseCronField(field string, lo, hi int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		if i := slices.Index(names, strings.ToLower(s)); i >= 0 {
+			return lo + i, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < lo || n > hi {
+			return 0, fmt.Errorf("invalid cron value %q: want %d-%d", s, lo, hi)
+		}
+		return n, nil
+	}
+	var set uint64
+	for part := range strings.SplitSeq(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid cron step %q", part)
+			}
+			// Any larger step selects only the first value; capping it
+			// keeps v below from overflowing.
+			step = min(step, hi+1)
+		}
+		first, last := lo, hi
+		if rng != "*" && rng != "?" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if first, err = value(a); err != nil {
+				return 0, err
+			}
+			last = first
+			if isRange {
+				if last, err = value(b); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				last = hi
+			}
+			if last < first {
+				return 0, fmt.Errorf("invalid cron range %q", part)
+			}
+		}
+		for v := first; v <= last; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// next returns the first scheduled time after t. Fields that do not match
+// are skipped a whole unit at a time, so the search is short even for
+// sparse schedules; it gives up after five years, which only schedules
+// such as February 30 never satisfy.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	if c.every > 0 {
+		return t.Add(c.every).Truncate(time.Second)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
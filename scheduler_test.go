@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"1,,2 * * * *",
+		"mon * * * *",
+		"@every 500ms",
+		"@every soon",
+		"@fortnightly",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04:05.999", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		spec string
+		from string
+		want string // "" for never
+	}{
+		{"*/15 * * * *", "2024-03-08 10:07:00", "2024-03-08 10:15:00"},
+		{"*/15 * * * *", "2024-03-08 10:15:00", "2024-03-08 10:30:00"},
+		{"0 9 * * mon-fri", "2024-03-08 10:00:00", "2024-03-11 09:00:00"},
+		{"0 0 * * 7", "2024-03-08 10:00:00", "2024-03-10 00:00:00"},
+		{"0 0 * * SUN", "2024-03-08 10:00:00", "2024-03-10 00:00:00"},
+		{"5 4 * jan,JUL *", "2024-02-01 00:00:00", "2024-07-01 04:05:00"},
+		{"30 23 31 * *", "2024-04-01 00:00:00", "2024-05-31 23:30:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00:00", "2028-02-29 00:00:00"},
+		{"0 0 13 * fri", "2024-01-01 00:00:00", "2024-01-05 00:00:00"},
+		{"0 12 1-7 * *", "2024-01-08 00:00:00", "2024-02-01 12:00:00"},
+		{"10/20 3-5/2 * * *", "2024-01-01 03:50:00", "2024-01-01 05:10:00"},
+		{"0/100 * * * *", "2024-01-01 03:50:00", "2024-01-01 04:00:00"},
+		{"@hourly", "2024-01-01 10:59:30", "2024-01-01 11:00:00"},
+		{"@yearly", "2024-01-01 00:00:00", "2025-01-01 00:00:00"},
+		{"@every 90s", "2024-01-01 10:00:00.5", "2024-01-01 10:01:30"},
+		{"0 0 30 2 *", "2024-01-01 00:00:00", ""},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.spec, err)
+			continue
+		}
+		got := c.next(at(tt.from))
+		var want time.Time
+		if tt.want != "" {
+			want = at(tt.want)
+		}
+		if !got.Equal(want) {
+			t.Errorf("%q after %s: %v, want %v", tt.spec, tt.from, got, want)
+		}
+	}
+}
+
+func FuzzParseCron(f *testing.F) {
+	for _, spec := range []string{"*/15 9-17 * * mon-fri", "0 0 29 2 *", "1,2,3/7 */5 ? jan-dec/3 0-7", "@weekly", "@every 1h30m", "50/9223372036854775800 * * * *"} {
+		f.Add(spec)
+	}
+	from := time.Date(2024, 3, 8, 10, 7, 30, 0, time.UTC)
+	f.Fuzz(func(t *testing.T, spec string) {
+		c, err := parseCron(spec)
+		if err != nil {
+			return
+		}
+		next := c.next(from)
+		if next.IsZero() {
+			return
+		}
+		if !next.After(from) || next.After(from.AddDate(5, 0, 0).Add(c.every)) {
+			t.Fatalf("%q: next %v for %v", spec, next, from)
+		}
+		if c.every == 0 && (next.Second() != 0 || !c.dayMatches(next) ||
+			c.minute&(1<<next.Minute()) == 0 || c.hour&(1<<next.Hour()) == 0 || c.month&(1<<next.Month()) == 0) {
+			t.Fatalf("%q: next %v does not match", spec, next)
+		}
+	})
+}
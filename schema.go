@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/big"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// jsonSchema is the subset of JSON Schema (draft 2020-12) used to validate
+// requests: types, object properties, arrays, enum/const, numeric and
+// string bounds, pattern, the date-time/email/uuid formats, allOf/anyOf/
+// oneOf/not and local $ref into $defs or definitions. Unknown keywords are
+// ignored, as the spec asks.
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []json.RawMessage      `json:"enum"`
+	Const                json.RawMessage        `json:"const"`
+	Minimum              json.Number            `json:"minimum"`
+	Maximum              json.Number            `json:"maximum"`
+	ExclusiveMinimum     json.Number            `json:"exclusiveMinimum"`
+	ExclusiveMaximum     json.Number            `json:"exclusiveMaximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	Format               string                 `json:"format"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	AllOf                []*jsonSchema          `json:"allOf"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+	OneOf                []*jsonSchema          `json:"oneOf"`
+	Not                  *jsonSchema            `json:"not"`
+	Ref                  string                 `json:"$ref"`
+	Defs                 map[string]*jsonSchema `json:"$defs"`
+	Definitions          map[string]*jsonSchema `json:"definitions"`
+
+	// boolean is set for the true and false schemas.
+	boolean *bool
+	pattern *regexp.Regexp
+}
+
+// schemaTypes accepts "type" as a single name or a list of names.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+func (s *jsonSchema) UnmarshalJSON(data []byte) error {
+	var b bool
+	if json.Unmarshal(data, &b) == nil {
+		s.boolean = &b
+		return nil
+	}
+	type plain jsonSchema
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// schemaError is one validation failure, located by JSON Pointer.
+type schemaError struct {
+	Pointer string `json:"pointer"`
+	Detail  string `json:"detail"`
+}
+
+// compile checks the schema's regular expressions and references ahead of
+// use, so a broken schema file fails at startup rather than per request.
+func (s *jsonSchema) compile(root *jsonSchema) error {
+	if s == nil || s.boolean != nil {
+		return nil
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	if s.Ref != "" && root.resolve(s.Ref) == nil {
+		return fmt.Errorf("unresolvable $ref %q", s.Ref)
+	}
+	children := slices.Concat(s.AllOf, s.AnyOf, s.OneOf, []*jsonSchema{s.AdditionalProperties, s.Items, s.Not})
+	for _, defs := range []map[string]*jsonSchema{s.Properties, s.Defs, s.Definitions} {
+		for _, c := range defs {
+			children = append(children, c)
+		}
+	}
+	for _, c := range children {
+		if err := c.compile(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve looks up a local reference such as "#/$defs/address".
+func (s *jsonSchema) resolve(ref string) *jsonSchema {
+	if ref == "#" {
+		return s
+	}
+	if name, ok := strings.CutPrefix(ref, "#/$defs/"); ok {
+		return s.Defs[name]
+	}
+	if name, ok := strings.CutPrefix(ref, "#/definitions/"); ok {
+		return s.Definitions[name]
+	}
+	return nil
+}
+
+// validate checks v, as decoded by decodeJSONValue, and appends failures
+// to errs.
+func (s *jsonSchema) validate(root *jsonSchema, v any, ptr string, depth int, errs []schemaError) []schemaError {
+	fail := func(format string, args ...any) {
+		errs = append(errs, schemaError{Pointer: ptr, Detail: fmt.Sprintf(format, args...)})
+	}
+	if s == nil {
+		return errs
+	}
+	if s.boolean != nil {
+		if !*s.boolean {
+			fail("not allowed")
+		}
+		return errs
+	}
+	if depth > 64 {
+		fail("schema nesting too deep")
+		return errs
+	}
+	if s.Ref != "" {
+		errs = root.resolve(s.Ref).validate(root, v, ptr, depth+1, errs)
+	}
+
+	if len(s.Type) > 0 && !slices.ContainsFunc(s.Type, func(t string) bool { return jsonTypeMatches(t, v) }) {
+		fail("must be of type %s", strings.Join(s.Type, " or "))
+		return errs
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e json.RawMessage) bool { return jsonEqual(e, v) }) {
+		fail("must be one of the allowed values")
+	}
+	if s.Const != nil && !jsonEqual(s.Const, v) {
+		fail("must be %s", s.Const)
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		n, ok := new(big.Rat).SetString(v.String())
+		if !ok {
+			// big.Rat refuses exponents too large to expand.
+			fail("is out of range")
+			break
+		}
+		cmp := func(bound json.Number) int {
+			b, _ := new(big.Rat).SetString(bound.String())
+			return n.Cmp(b)
+		}
+		switch {
+		case s.Minimum != "" && cmp(s.Minimum) < 0:
+			fail("must be >= %s", s.Minimum)
+		case s.ExclusiveMinimum != "" && cmp(s.ExclusiveMinimum) <= 0:
+			fail("must be > %s", s.ExclusiveMinimum)
+		case s.Maximum != "" && cmp(s.Maximum) > 0:
+			fail("must be <= %s", s.Maximum)
+		case s.ExclusiveMaximum != "" && cmp(s.ExclusiveMaximum) >= 0:
+			fail("must be < %s", s.ExclusiveMaximum)
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("must be at most %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match %s", s.Pattern)
+		}
+		if !formatValid(s.Format, v) {
+			fail("must be a valid %s", s.Format)
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		for i, item := range v {
+			errs = s.Items.validate(root, item, ptr+"/"+strconv.Itoa(i), depth+1, errs)
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				errs = append(errs, schemaError{Pointer: ptr + "/" + escapePointer(name), Detail: "is required"})
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(v)) {
+			child := ptr + "/" + escapePointer(name)
+			if p, ok := s.Properties[name]; ok {
+				errs = p.validate(root, v[name], child, depth+1, errs)
+			} else if s.AdditionalProperties != nil {
+				if b := s.AdditionalProperties.boolean; b != nil && !*b {
+					errs = append(errs, schemaError{Pointer: child, Detail: "is not a known property"})
+				} else {
+					errs = s.AdditionalProperties.validate(root, v[name], child, depth+1, errs)
+				}
+			}
+		}
+	}
+
+	for _, sub := range s.AllOf {
+		errs = sub.validate(root, v, ptr, depth+1, errs)
+	}
+	if len(s.AnyOf) > 0 && !slices.ContainsFunc(s.AnyOf, func(sub *jsonSchema) bool { return len(sub.validate(root, v, ptr, depth+1, nil)) == 0 }) {
+		fail("must match at least one of the allowed schemas")
+	}
+	if len(s.OneOf) > 0 {
+		matches := 0
+		for _, sub := range s.OneOf {
+			if len(sub.validate(root, v, ptr, depth+1, nil)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			fail("must match exactly one of the allowed schemas")
+		}
+	}
+	if s.Not != nil && len(s.Not.validate(root, v, ptr, depth+1, nil)) == 0 {
+		fail("must not match the disallowed schema")
+	}
+	return errs
+}
+
+func jsonTypeMatches(t string, v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case string:
+		return t == "string"
+	case []any:
+		return t == "array"
+	case map[string]any:
+		return t == "object"
+	case json.Number:
+		if t == "number" {
+			return true
+		}
+		if t == "integer" {
+			n, ok := new(big.Rat).SetString(v.String())
+			return ok && n.IsInt()
+		}
+	}
+	return false
+}
+
+// jsonEqual compares a schema literal with a decoded value.
+func jsonEqual(literal json.RawMessage, v any) bool {
+	want, err := decodeJSONValue(literal)
+	if err != nil {
+		return false
+	}
+	a, _ := json.Marshal(canonicalNumbers(want))
+	b, _ := json.Marshal(canonicalNumbers(v))
+	return bytes.Equal(a, b)
+}
+
+// canonicalNumbers rewrites numbers so 1, 1.0 and 1e0 compare equal.
+func canonicalNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, ok := new(big.Rat).SetString(v.String()); ok {
+			return json.Number(n.RatString())
+		}
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = canonicalNumbers(e)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = canonicalNumbers(e)
+		}
+		return out
+	}
+	return v
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// formatValid checks the formats worth enforcing on input; others pass.
+func formatValid(format, v string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, v)
+		return err == nil
+	case "date":
+		_, err := time.Parse(time.DateOnly, v)
+		return err == nil
+	case "email":
+		a, err := mail.ParseAddress(v)
+		return err == nil && a.Address == v
+	case "uuid":
+		return uuidPattern.MatchString(v)
+	}
+	return true
+}
+
+// escapePointer escapes a JSON Pointer reference token (RFC 6901).
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// decodeJSONValue decodes a single JSON value, keeping numbers exact.
+func decodeJSONValue(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	return v, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func mustSchema(t testing.TB, src string) *jsonSchema {
+	t.Helper()
+	var s jsonSchema
+	if err := json.Unmarshal([]byte(src), &s); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.compile(&s); err != nil {
+		t.Fatal(err)
+	}
+	return &s
+}
+
+// schemaPointers returns the pointers of the failures validating doc.
+func schemaPointers(t testing.TB, s *jsonSchema, doc string) []string {
+	t.Helper()
+	v, err := decodeJSONValue([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ptrs []string
+	for _, e := range s.validate(s, v, "", 0, nil) {
+		ptrs = append(ptrs, e.Pointer)
+	}
+	return ptrs
+}
+
+func TestSchemaValidate(t *testing.T) {
+	user := `{
+		"type": "object",
+		"required": ["name", "age"],
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "maxLength": 3, "pattern": "^[a-zé]+$"},
+			"age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+			"email": {"type": "string", "format": "email"},
+			"role": {"enum": ["admin", "user"]},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+			"home": {"$ref": "#/$defs/address"},
+			"a/b": {"const": 1}
+		},
+		"additionalProperties": false,
+		"$defs": {"address": {"type": "object", "required": ["zip"], "properties": {"zip": {"type": ["string", "null"]}}}}
+	}`
+	tests := []struct {
+		schema string
+		doc    string
+		want   []string
+	}{
+		{user, `{"name": "ann", "age": 30}`, nil},
+		{user, `{"name": "zoé", "age": 30.0, "email": "a@example.com", "role": "admin", "tags": ["x"], "home": {"zip": null}, "a/b": 1e0}`, nil},
+		{user, `{}`, []string{"/name", "/age"}},
+		{user, `{"name": "", "age": -1}`, []string{"/age", "/name", "/name"}},
+		{user, `{"name": "anne", "age": 150}`, []string{"/age", "/name"}},
+		{user, `{"name": "A1", "age": 1.5}`, []string{"/age", "/name"}},
+		{user, `{"name": "ann", "age": 1e10000000}`, []string{"/age"}},
+		{user, `{"name": "ann", "age": 1, "email": "Ann <a@example.com>"}`, []string{"/email"}},
+		{user, `{"name": "ann", "age": 1, "role": "root"}`, []string{"/role"}},
+		{user, `{"name": "ann", "age": 1, "tags": ["x", 2, "z"]}`, []string{"/tags", "/tags/1"}},
+		{user, `{"name": "ann", "age": 1, "home": {}}`, []string{"/home/zip"}},
+		{user, `{"name": "ann", "age": 1, "a/b": 2, "extra~": true}`, []string{"/a~1b", "/extra~0"}},
+		{user, `[]`, []string{""}},
+
+		{`{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `7`, nil},
+		{`{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `true`, []string{""}},
+		{`{"oneOf": [{"type": "number"}, {"type": "integer"}]}`, `7`, []string{""}},
+		{`{"oneOf": [{"type": "number"}, {"type": "integer"}]}`, `7.5`, nil},
+		{`{"allOf": [{"minimum": 1}, {"maximum": 2}]}`, `3`, []string{""}},
+		{`{"type": "number", "maximum": 10}`, `1e10000000`, []string{""}},
+		{`{"not": {"type": "null"}}`, `null`, []string{""}},
+		{`{"items": {"$ref": "#"}, "maxItems": 1}`, `[[[1, 2]]]`, []string{"/0/0"}},
+		{`{"properties": {"x": false}}`, `{"x": 1}`, []string{"/x"}},
+		{`{"format": "date-time"}`, `"2024-02-30T00:00:00Z"`, []string{""}},
+		{`{"format": "uuid"}`, `"123e4567-e89b-12d3-a456-426614174000"`, nil},
+		{`{"format": "unknown"}`, `"anything"`, nil},
+		{`true`, `{"x": 1}`, nil},
+		{`false`, `{"x": 1}`, []string{""}},
+	}
+	for _, tt := range tests {
+		got := schemaPointers(t, mustSchema(t, tt.schema), tt.doc)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: failures at %q, want %q", tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestSchemaRefCycle(t *testing.T) {
+	s := mustSchema(t, `{"$ref": "#"}`)
+	if got := schemaPointers(t, s, `1`); len(got) != 1 {
+		t.Errorf("self-reference: failures at %q, want one for the nesting limit", got)
+	}
+}
+
+func TestSchemaCompileErrors(t *testing.T) {
+	for _, src := range []string{
+		`{"pattern": "("}`,
+		`{"properties": {"a": {"items": {"pattern": "[z-a]"}}}}`,
+		`{"$ref": "#/$defs/missing"}`,
+		`{"allOf": [{"$ref": "https://example.com/schema"}]}`,
+	} {
+		var s jsonSchema
+		if err := json.Unmarshal([]byte(src), &s); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.compile(&s); err == nil {
+			t.Errorf("%s compiled", src)
+		}
+	}
+}
+
+func FuzzSchemaValidate(f *testing.F) {
+	s := mustSchema(f, `{
+		"type": "object",
+		"properties": {
+			"n": {"type": "number", "minimum": -5, "maximum": 1e3},
+			"s": {"type": "string", "pattern": "^a+$", "format": "date-time"},
+			"list": {"type": "array", "items": {"$ref": "#"}},
+			"e": {"enum": [1, "x", {"a": [null]}]}
+		},
+		"anyOf": [{"required": ["n"]}, {"not": {"required": ["s"]}}],
+		"additionalProperties": {"oneOf": [{"type": "boolean"}, {"const": 0}]}
+	}`)
+	f.Add(`{"n": 3, "s": "aaa", "list": [{"n": 1e2}], "e": {"a": [null]}, "x": true}`)
+	f.Add(`{"n": 1e10000000, "list": [[]]}`)
+	f.Fuzz(func(t *testing.T, doc string) {
+		v, err := decodeJSONValue([]byte(doc))
+		if err != nil {
+			return
+		}
+		for _, e := range s.validate(s, v, "", 0, nil) {
+			if e.Detail == "" {
+				t.Fatalf("failure at %q without detail", e.Pointer)
+			}
+		}
+	})
+}
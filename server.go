@@ -1,49 +1,591 @@
 package main
 
 import (
+	"cmp"
 	"context"
-	"crypto/rand"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/martinsre/serverConcurrent/randutil"
 	"golang.org/x/sync/errgroup"
-	"math/big"
+	"html/template"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
+// shutdownTimeout bounds how long listeners may drain in-flight requests.
+const shutdownTimeout = 30 * time.Second
+
+// StopReason describes why Run returned.
+type StopReason string
+
+const (
+	StopSignal        StopReason = "signal"
+	StopContext       StopReason = "context"
+	StopListenerError StopReason = "listener_error"
+)
+
 type Server struct {
 	httpAddr  string
 	httpsAddr string
+
+	metrics        *Metrics
+	metricsPushURL string
+	events         *EventBus
+
+	restartPolicies map[string]RestartPolicy
+	supervisor      *Supervisor
+	tasks           []task
+
+	adminAddr string
+	listeners listenerRegistry
+
+	shutdownTimeout time.Duration
+	config          Config
+
+	routes          []Route
+	middleware      []Middleware
+	adminMiddleware []Middleware
+
+	flags    *FeatureFlags
+	geoIP    *GeoIP
+	waf      *WAF
+	rbac     *RBAC
+	rewriter *Rewriter
+	certs    *certReloader
+	chaos    *chaos
+	streams  streamRegistry
+	cache    *responseCache
+	coalesce Middleware
+	// caching is the response caching middleware, which runs innermost on
+	// every public route rather than listener-wide.
+	caching []Middleware
+	// idempotencyStore is set by WithIdempotencyStore, or defaults to
+	// memory when idempotency is enabled.
+	idempotencyStore IdempotencyStore
+	templates        *Templates
+	catalog          *Catalog
+	assets           *AssetManifest
+	// priorityFunc is set by WithPriorityFunc.
+	priorityFunc PriorityFunc
+	// tenantResolver is set by WithTenantResolver, or built from
+	// tenant_source.
+	tenantResolver TenantResolver
+	tenants        *tenants
+	users          *UserStore
+	graphql        GraphQLExecutor
+	// handlerRegistry holds the handlers routes can be swapped to.
+	handlerRegistry handlerRegistry
+
+	throttleRoutes map[string]int64
+	degradedRoutes map[string][]string
+	deadlineRoutes map[string]time.Duration
+	metricRoutes   map[string]string
+	bulkheadGroups map[string]BulkheadOptions
+	bulkheadRoutes map[string]string
+	bulkheads      map[string]*bulkhead
+	requestSchemas map[string]*requestSchema
+	tcpOptions     map[string]TCPOptions
+	uploads        uploadProgress
+	uploadStore    Storage
+	blueGreen      *blueGreen
+	bans           *banList
+	tarpit         *tarpit
+	webhooks       *WebhookReceiver
+	dispatcher     *WebhookDispatcher
+	jobs           *JobQueue
+	scheduler      *scheduler
+	resources      []*resource
+	healthChecks   []*healthCheck
+	shuttingDown   atomic.Bool
+	broker         *Broker
+
+	transport http.RoundTripper
+	client    *http.Client
+}
+
+// Option configures optional Server behaviour.
+type Option func(*Server)
+
+// WithMetricsPushURL pushes the final metrics snapshot to url before Run returns.
+func WithMetricsPushURL(url string) Option {
+	return func(s *Server) { s.metricsPushURL = url }
+}
+
+// WithConfig applies the loaded configuration and keeps a copy for the admin API.
+func WithConfig(cfg Config) Option {
+	return func(s *Server) {
+		s.config = cfg
+		s.adminAddr = cfg.AdminAddr
+		s.metricsPushURL = cfg.MetricsPushURL
+		if cfg.ShutdownTimeout > 0 {
+			s.shutdownTimeout = cfg.ShutdownTimeout
+		}
+	}
+}
+
+func NewServer(httpAddr, httpsAddr string, opts ...Option) *Server {
+	s := &Server{
+		httpAddr:        httpAddr,
+		httpsAddr:       httpsAddr,
+		metrics:         NewMetrics(),
+		events:          NewEventBus(),
+		restartPolicies: make(map[string]RestartPolicy),
+		bulkheads:       make(map[string]*bulkhead),
+		bans:            newBanList(),
+		shutdownTimeout: shutdownTimeout,
+		config:          DefaultConfig(),
+	}
+	s.supervisor = newSupervisor(s)
+	s.coalesce = coalesce(s.metrics)
+	for _, opt := range opts {
+		opt(s)
+	}
+	clientOpts := ClientOptions{
+		DialTimeout:         s.config.ClientDialTimeout,
+		IdleConnTimeout:     s.config.ClientIdleConnTimeout,
+		MaxIdleConnsPerHost: s.config.ClientMaxIdleConnsPerHost,
+		MaxConnsPerHost:     s.config.ClientMaxConnsPerHost,
+		FastCGI: FastCGIOptions{
+			Root:   s.config.FastCGIRoot,
+			Index:  s.config.FastCGIIndex,
+			Socket: s.config.FastCGISocket,
+		},
+	}
+	if overrides, err := parseDNSOverrides(s.config.DNSOverrides); err != nil {
+		slog.Warn("Ignoring invalid DNS overrides", "error", err)
+	} else if s.config.DNSCache || len(overrides) > 0 {
+		clientOpts.Resolver = NewResolver(ResolverOptions{
+			Cache:       s.config.DNSCache,
+			MinTTL:      s.config.DNSMinTTL,
+			MaxTTL:      s.config.DNSMaxTTL,
+			NegativeTTL: s.config.DNSNegativeTTL,
+			Overrides:   overrides,
+		}, s.metrics)
+	}
+	s.transport = newTransport(clientOpts, s.metrics)
+	s.client = &http.Client{Transport: s.transport, Timeout: s.config.ClientTimeout}
+
+	var err error
+	if s.throttleRoutes, err = parseThrottleRoutes(s.config.ThrottleRoutes); err != nil {
+		slog.Warn("Ignoring invalid throttle routes", "error", err)
+	}
+	if s.degradedRoutes, err = parseDegradedRoutes(s.config.DegradedRoutes); err != nil {
+		slog.Warn("Ignoring invalid degraded routes", "error", err)
+	}
+	if s.deadlineRoutes, err = parseDeadlineRoutes(s.config.DeadlineRoutes); err != nil {
+		slog.Warn("Ignoring invalid deadline routes", "error", err)
+	}
+	if s.metricRoutes, err = parseMetricRoutes(s.config.MetricsRouteGroups, s.config.MetricsExcludeRoutes); err != nil {
+		slog.Warn("Ignoring invalid metrics route groups", "error", err)
+	}
+	if s.bulkheadGroups, err = parseBulkheadGroups(s.config.BulkheadGroups); err != nil {
+		slog.Warn("Ignoring invalid bulkhead groups", "error", err)
+	} else if s.bulkheadRoutes, err = parseBulkheadRoutes(s.config.BulkheadRoutes, s.bulkheadGroups); err != nil {
+		slog.Warn("Ignoring invalid bulkhead routes", "error", err)
+	}
+	if s.tcpOptions, err = parseTCPOptions(s.config.TCPOptions); err != nil {
+		slog.Warn("Ignoring invalid TCP options", "error", err)
+	}
+	if s.config.RequestSchemasFile != "" {
+		if s.requestSchemas, err = loadRequestSchemas(s.config.RequestSchemasFile); err != nil {
+			slog.Warn("Ignoring request schemas", "error", err)
+		}
+	}
+	if s.tenantResolver == nil && s.config.TenantSource != "" {
+		if s.tenantResolver, err = parseTenantSource(s.config.TenantSource, s.config.TenantAPIKeys, s.config.TenantJWTSecret); err != nil {
+			slog.Warn("Not metering tenants", "error", err)
+		}
+	}
+	if s.tenantResolver != nil {
+		quotas, err := parseTenantQuotas(s.config.TenantQuotas)
+		if err != nil {
+			slog.Warn("Ignoring invalid tenant quotas", "error", err)
+		}
+		limits, err := parseRateLimits("tenant rate limit", s.config.TenantRateLimits)
+		if err != nil {
+			slog.Warn("Ignoring invalid tenant rate limits", "error", err)
+		}
+		s.tenants = newTenants(s.tenantResolver, quotas, s.config.TenantQuotaWindow, limits, s.metrics)
+	}
+	if s.config.UserStoreFile != "" {
+		s.users = NewUserStore(s.config.UserStoreFile, s.config.UserBcryptCost, s.metrics)
+	}
+	s.registerDefaultRoutes()
+
+	s.flags = NewFeatureFlags(s.config.FeatureFlagsFile)
+	if len(s.config.AllowedHosts) > 0 {
+		// The admin listener is the usual DNS rebinding target, so it is
+		// covered as well.
+		s.Use(allowHosts(s.config.AllowedHosts))
+		s.UseAdmin(allowHosts(s.config.AllowedHosts))
+	}
+	if len(s.config.HoneypotPaths) > 0 {
+		if s.config.BanTarpitConns > 0 {
+			s.tarpit = newTarpit(s.config.BanTarpitConns, s.config.BanTarpitInterval, s.config.BanTarpitMaxDuration, s.metrics)
+		}
+		s.Use(s.rejectBanned())
+	}
+	if s.config.HARDir != "" {
+		// Outermost, so recordings show what the client actually saw.
+		s.Use(recordHAR(HAROptions{
+			Dir:           s.config.HARDir,
+			SamplePercent: s.config.HARSamplePercent,
+			MaxBodyBytes:  s.config.HARMaxBodyBytes,
+			RedactHeaders: s.config.HARRedactHeaders,
+		}))
+	}
+	if s.config.RewriteRulesFile != "" {
+		s.rewriter = NewRewriter(s.config.RewriteRulesFile, s.metrics)
+	}
+	if s.config.Tracing {
+		routes, err := parseTraceRoutes(s.config.TraceSampleRoutes)
+		if err != nil {
+			slog.Warn("Ignoring invalid trace sample routes", "error", err)
+		}
+		s.Use(tracing(TraceSampler{
+			Percent:       s.config.TraceSamplePercent,
+			RoutePercents: routes,
+			RespectParent: s.config.TraceRespectParent,
+			Errors:        s.config.TraceSampleErrors,
+		}, s.metrics))
+	}
+	if s.config.GeoIPDB != "" {
+		s.geoIP = NewGeoIP(s.config.GeoIPDB)
+		limits, err := parseRateLimits("geoip rate limit", s.config.GeoIPRateLimits)
+		if err != nil {
+			slog.Warn("Ignoring invalid GeoIP rate limits", "error", err)
+		}
+		s.Use(geoIP(s.geoIP, GeoOptions{Block: s.config.GeoIPBlockCountries, RateLimits: limits}, s.metrics))
+	}
+	if len(s.config.BotRules) > 0 {
+		rules, err := parseBotRules(s.config.BotRules)
+		if err != nil {
+			slog.Warn("Ignoring invalid bot rules", "error", err)
+		}
+		s.Use(botFilter(rules, s.metrics))
+	}
+	if s.config.WAFRulesFile != "" {
+		s.waf = NewWAF(s.config.WAFRulesFile, s.config.WAFMode, s.config.WAFMaxBodyBytes, s.metrics)
+		s.Use(s.waf.Middleware())
+	}
+	if s.config.ExtAuthzURL != "" {
+		s.Use(s.newExtAuthz().middleware())
+	}
+	if s.users != nil {
+		s.Use(s.users.Middleware())
+	}
+	if s.config.LDAPURL != "" {
+		s.Use(s.newLDAPAuth().middleware())
+	}
+	if s.config.RBACPolicyFile != "" {
+		s.rbac = NewRBAC(s.config.RBACPolicyFile, s.config.RBACLogDecisions, s.metrics)
+		s.Use(s.rbac.Middleware())
+	}
+	s.Use(requestTimeout(s.metrics))
+	s.Use(s.flags.Middleware())
+	if s.config.Mode == ModeChaos {
+		s.chaos = newChaos(s.metrics)
+		s.Use(s.chaos.middleware())
+	}
+	if s.config.ThrottleConnRate > 0 {
+		s.Use(throttleConn())
+	}
+	if s.tenants != nil {
+		s.Use(s.tenants.middleware())
+	}
+	if s.config.CacheEnabled {
+		s.cache = newResponseCache(CacheOptions{
+			MaxEntries:           s.config.CacheMaxEntries,
+			TTL:                  s.config.CacheTTL,
+			StaleWhileRevalidate: s.config.CacheStaleWhileRevalidate,
+		}, s.metrics)
+		s.caching = append(s.caching, s.cache.middleware())
+	}
+	if len(s.config.CacheControlRules) > 0 {
+		if rules, err := parseCacheControlRules(s.config.CacheControlRules); err != nil {
+			slog.Warn("Ignoring invalid cache-control rules", "error", err)
+		} else {
+			// Outside the cache, so it stores responses with their rule's
+			// Cache-Control.
+			s.caching = append([]Middleware{cacheControl(rules)}, s.caching...)
+		}
+	}
+	if s.config.AdmissionMaxConcurrent > 0 {
+		routes, err := parsePriorityRoutes(s.config.PriorityRoutes)
+		if err != nil {
+			slog.Warn("Ignoring invalid priority routes", "error", err)
+		}
+		clients, err := parsePriorityClients(s.config.PriorityClients)
+		if err != nil {
+			slog.Warn("Ignoring invalid priority clients", "error", err)
+		}
+		a := newAdmission(AdmissionOptions{
+			MaxConcurrent: s.config.AdmissionMaxConcurrent,
+			MaxQueue:      s.config.AdmissionMaxQueue,
+			QueueTimeout:  s.config.AdmissionQueueTimeout,
+			Aging:         s.config.AdmissionAging,
+		}, s.metrics)
+		s.Use(a.middleware(routes, s.priorityFunc, clients))
+	}
+	if s.config.IdempotencyEnabled {
+		if s.idempotencyStore == nil {
+			s.idempotencyStore = NewMemoryIdempotencyStore()
+		}
+		s.Use(idempotency(s.idempotencyStore, s.config.IdempotencyTTL, s.config.IdempotencyMaxBodyBytes, s.metrics))
+	}
+	if s.config.I18nDir != "" {
+		c := NewCatalog(os.DirFS(s.config.I18nDir), s.config.I18nDefaultLanguage)
+		if err := c.Load(); err != nil {
+			slog.Warn("Not localizing responses", "dir", s.config.I18nDir, "error", err)
+		} else {
+			s.catalog = c
+			s.Use(c.Middleware())
+		}
+	}
+	if len(s.config.WASMPlugins) > 0 {
+		s.loadWASMPlugins()
+	}
+	if len(s.config.LuaScripts) > 0 {
+		s.loadLuaScripts()
+	}
+	if len(s.config.Extensions) > 0 {
+		s.loadExtensions()
+	}
+	if s.config.MDNSName != "" && s.config.Mode != ModeProd {
+		if m, err := newMDNSResponder(s.config.MDNSName, s.httpAddr); err != nil {
+			slog.Warn("Not advertising via mDNS", "error", err)
+		} else {
+			s.Supervise("mdns", RestartPolicy{Mode: RestartOnFailure}, m.run)
+		}
+	}
+	if s.config.TunnelProvider != "" {
+		s.Supervise("tunnel", RestartPolicy{Mode: RestartOnFailure}, s.runTunnel)
+	}
+	if s.config.TemplatesDir != "" {
+		t, err := NewTemplates(TemplateOptions{
+			FS:     os.DirFS(s.config.TemplatesDir),
+			Layout: s.config.TemplateLayout,
+			Funcs:  template.FuncMap{"asset": s.assetURL},
+		})
+		if err != nil {
+			slog.Warn("Not rendering templates", "dir", s.config.TemplatesDir, "error", err)
+		} else {
+			s.templates = t
+			if s.config.Mode != ModeProd {
+				s.Supervise("templates", RestartPolicy{Mode: RestartOnFailure}, t.watch)
+			}
+		}
+	}
+	if s.config.FeatureFlagsFile != "" {
+		s.Supervise("feature-flags", RestartPolicy{Mode: RestartOnFailure}, s.flags.watch)
+	}
+	if s.waf != nil {
+		s.Supervise("waf", RestartPolicy{Mode: RestartOnFailure}, s.waf.watch)
+	}
+	if s.rewriter != nil {
+		s.Supervise("rewrite", RestartPolicy{Mode: RestartOnFailure}, s.rewriter.watch)
+	}
+	if s.config.TLSCertFile != "" {
+		s.certs = newCertReloader(s.config.TLSCertFile, s.config.TLSKeyFile, s.events)
+		s.Supervise("tls-cert", RestartPolicy{Mode: RestartOnFailure}, s.certs.watch)
+	}
+	if s.rbac != nil {
+		s.Supervise("rbac", RestartPolicy{Mode: RestartOnFailure}, s.rbac.watch)
+	}
+	if s.geoIP != nil {
+		s.Supervise("geoip", RestartPolicy{Mode: RestartOnFailure}, s.geoIP.watch)
+	}
+	if s.config.JobWorkers > 0 {
+		s.jobs = newJobQueue(s.config.JobWorkers, s.config.JobQueueSize, s.config.JobMaxAttempts, s.shutdownTimeout, s.config.JobCheckpointFile, s.config.JobDeadLetterFile, s.metrics)
+		s.Supervise("jobs", RestartPolicy{Mode: RestartOnFailure}, s.jobs.run)
+	}
+	if len(s.config.WebhookTargets) > 0 {
+		var targets []*url.URL
+		for _, raw := range s.config.WebhookTargets {
+			u, _ := url.Parse(raw)
+			targets = append(targets, u)
+		}
+		s.dispatcher = newWebhookDispatcher(targets, []byte(s.config.WebhookTargetSecret), s.config.WebhookQueueSize, s.config.WebhookMaxAttempts, s.shutdownTimeout, s.client, s.events, s.metrics)
+		s.Supervise("webhook-dispatcher", RestartPolicy{Mode: RestartOnFailure}, s.dispatcher.run)
+	}
+	if s.config.ProfilingURL != "" {
+		labels, err := parseProfilingLabels(s.config.ProfilingLabels)
+		if err != nil {
+			slog.Warn("Ignoring invalid profiling labels", "error", err)
+		}
+		p := newProfiler(ProfilerOptions{
+			URL:       s.config.ProfilingURL,
+			AuthToken: s.config.ProfilingAuthToken,
+			AppName:   s.config.ProfilingAppName,
+			Instance:  cmp.Or(s.config.ProfilingInstance, profilingInstance()),
+			Labels:    labels,
+			Interval:  s.config.ProfilingInterval,
+		}, s.client, s.metrics)
+		s.Supervise("profiler", RestartPolicy{Mode: RestartOnFailure}, p.run)
+	}
+	return s
+}
+
+// Flags returns the server's feature flag store.
+func (s *Server) Flags() *FeatureFlags {
+	return s.flags
 }
 
-func NewServer(httpAddr, httpsAddr string) *Server {
-	return &Server{httpAddr: httpAddr, httpsAddr: httpsAddr}
+// Templates returns the page templates loaded from templates_dir, or nil
+// when it is not set.
+func (s *Server) Templates() *Templates {
+	return s.templates
+}
+
+// Catalog returns the message catalog loaded from i18n_dir, or nil when it
+// is not set.
+func (s *Server) Catalog() *Catalog {
+	return s.catalog
+}
+
+// Broker returns the pub/sub broker, or nil when broker_path is not set.
+func (s *Server) Broker() *Broker {
+	return s.broker
+}
+
+// Jobs returns the background job queue, or nil when job_workers is 0.
+func (s *Server) Jobs() *JobQueue {
+	return s.jobs
+}
+
+// Webhooks returns the built-in webhook receiver, on which callbacks are
+// registered with On, or nil when no webhook secret is configured.
+func (s *Server) Webhooks() *WebhookReceiver {
+	return s.webhooks
+}
+
+// Events returns the bus on which lifecycle events are published.
+func (s *Server) Events() *EventBus {
+	return s.events
 }
 
 func (s *Server) Run(ctx context.Context) error {
+	if err := s.flags.Load(); err != nil {
+		return fmt.Errorf("loading feature flags: %w", err)
+	}
+	if s.geoIP != nil {
+		if err := s.geoIP.Load(); err != nil {
+			return fmt.Errorf("loading GeoIP database: %w", err)
+		}
+	}
+	if s.waf != nil {
+		if err := s.waf.Load(); err != nil {
+			return fmt.Errorf("loading WAF rules: %w", err)
+		}
+	}
+	if s.rewriter != nil {
+		if err := s.rewriter.Load(); err != nil {
+			return fmt.Errorf("loading rewrite rules: %w", err)
+		}
+	}
+	if s.certs != nil {
+		if err := s.certs.Load(); err != nil {
+			return fmt.Errorf("loading TLS certificate: %w", err)
+		}
+	}
+	if s.users != nil {
+		if err := s.users.Load(); err != nil {
+			return fmt.Errorf("loading user store: %w", err)
+		}
+	}
+	if s.rbac != nil {
+		if err := s.rbac.Load(); err != nil {
+			return fmt.Errorf("loading RBAC policy: %w", err)
+		}
+	}
+	if s.jobs != nil {
+		if err := s.jobs.Load(); err != nil {
+			return fmt.Errorf("restoring checkpointed jobs: %w", err)
+		}
+	}
+	for pattern := range s.requestSchemas {
+		if !slices.ContainsFunc(s.routes, func(rt Route) bool { return rt.pattern == pattern }) {
+			slog.Warn("Request schema matches no route", "pattern", pattern)
+		}
+	}
+	// Resources are opened before the listeners start and closed after
+	// they have drained, so no request sees them missing.
+	if err := s.openResources(ctx); err != nil {
+		return err
+	}
+	defer s.closeResources(s.resources)
+
 	signalChan := make(chan os.Signal, 1)
-	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, os.Kill, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signalChan)
+
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	var (
+		reasonOnce    sync.Once
+		reason        StopReason
+		shutdownStart time.Time
+	)
+	stop := func(r StopReason) {
+		reasonOnce.Do(func() {
+			s.shuttingDown.Store(true)
+			reason = r
+			shutdownStart = time.Now()
+			s.events.Publish(ShutdownBegan{Reason: r, Time: shutdownStart})
+		})
+	}
+
 	// Create an errgroup for managing multiple goroutines
 	g, gctx := errgroup.WithContext(ctx)
 
 	// Start two web services in separate goroutines
-	g.Go(func() error { return httpServer(gctx, s.httpAddr) })
-	g.Go(func() error { return httpsServer(gctx, s.httpsAddr) })
+	s.goTask(g, gctx, "http", func() error { return s.httpServer(gctx, s.httpAddr) })
+	s.goTask(g, gctx, "https", func() error { return s.httpsServer(gctx, s.httpsAddr) })
+	if s.adminAddr != "" {
+		s.goTask(g, gctx, "admin", func() error { return s.adminServer(gctx, s.adminAddr) })
+	}
+	for _, t := range s.tasks {
+		s.goTask(g, gctx, t.name, func() error { return t.fn(gctx) })
+	}
 
 	// Listen for OS interrupts and cancel context
 	go func() {
-		<-signalChan // Block until an OS signal is received
-		fmt.Println("Received interrupt signal, shutting down...")
-		cancel() // Cancel the context
+		select {
+		case <-signalChan: // Block until an OS signal is received
+			fmt.Println("Received interrupt signal, shutting down...")
+			stop(StopSignal)
+			cancel() // Cancel the context
+		case <-gctx.Done():
+			if ctx.Err() != nil {
+				stop(StopContext)
+			} else {
+				stop(StopListenerError)
+			}
+		}
 	}()
 
 	// Wait for all goroutines to exit
-	if err := g.Wait(); err != nil {
+	err := g.Wait()
+	if err != nil {
+		stop(StopListenerError)
+	} else {
+		stop(StopContext)
+	}
+	s.recordShutdown(reason, time.Since(shutdownStart), err)
+
+	if err != nil {
 		fmt.Println("Error:", err)
 		return err
 	}
@@ -52,89 +594,203 @@ func (s *Server) Run(ctx context.Context) error {
 	return nil
 }
 
-func httpServer(ctx context.Context, addr string) error {
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /", httpHandler)
-	mux.HandleFunc("GET /error", errorHandler)
-	mux.Handle("GET /.well-known/acme-challenge/", http.StripPrefix("/.well-known/acme-challenge/", http.FileServer(http.Dir("/challenge/.well-known/acme-challenge/"))))
+// goTask runs fn in g as a supervised child under the service's restart policy.
+func (s *Server) goTask(g *errgroup.Group, ctx context.Context, name string, fn func() error) {
+	s.supervisor.Go(g, ctx, name, s.restartPolicies[name], fn)
+}
 
-	httpServer := &http.Server{
-		Addr:         addr,
-		Handler:      mux,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  15 * time.Second,
-	}
+// recordShutdown logs the final shutdown record and pushes the last metrics
+// snapshot, since nothing will be left to scrape once the process exits.
+func (s *Server) recordShutdown(reason StopReason, drain time.Duration, err error) {
+	s.metrics.Add("server_shutdowns_total", 1, "reason", string(reason))
+	s.metrics.Set("server_shutdown_drain_seconds", drain.Seconds())
 
-	errChan := make(chan error, 1)
-	defer close(errChan)
-
-	go func() {
-		fmt.Println("Starting HTTP server on", addr)
-		// Return ListenAndServe error directly so errgroup can handle it
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			errChan <- err
-		}
-	}()
+	attrs := []any{"reason", reason, "drain", drain}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+	slog.Info("Server shutdown complete", attrs...)
 
-	select {
-	case <-ctx.Done():
-		fmt.Println("Shutting down HTTP server on", addr)
-		httpServer.SetKeepAlivesEnabled(false)
-		return httpServer.Shutdown(ctx) // Gracefully shutdown server
-	case err := <-errChan:
-		return err
+	if s.metricsPushURL == "" {
+		return
+	}
+	if err := s.metrics.Push(context.Background(), s.client, s.metricsPushURL); err != nil {
+		slog.Warn("Failed to push shutdown metrics", "error", err)
 	}
 }
 
-func httpHandler(w http.ResponseWriter, r *http.Request) {
-	_, _ = fmt.Fprintf(w, "Hello World %s", generateRandomString(10))
+func (s *Server) httpServer(ctx context.Context, addr string) error {
+	return s.serve(ctx, ListenerHTTP, addr, s.mux(ListenerHTTP))
 }
 
-func generateRandomString(n int) string {
-	const letters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-"
-	ret := make([]byte, n)
-	for i := 0; i < n; i++ {
-		num, _ := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
+func (s *Server) httpsServer(ctx context.Context, addr string) error {
+	return s.serve(ctx, ListenerHTTPS, addr, s.mux(ListenerHTTPS))
+}
 
-		ret[i] = letters[num.Int64()]
+// connContext attaches per-connection state to every request's context.
+// fingerprints is nil unless the listener terminates TLS.
+func (s *Server) connContext(tracker *activityTracker, fingerprints *tlsFingerprinter) func(context.Context, net.Conn) context.Context {
+	return func(ctx context.Context, c net.Conn) context.Context {
+		ctx = tracker.connContext(ctx, c)
+		if fingerprints != nil {
+			ctx = fingerprints.connContext(ctx, c)
+		}
+		raw := c
+		if tc, ok := c.(*tls.Conn); ok {
+			raw = tc.NetConn()
+		}
+		if tc, ok := raw.(tailnetConn); ok {
+			ctx = context.WithValue(ctx, tailnetLoginKey{}, tc.login)
+		}
+		if s.config.ThrottleConnRate > 0 {
+			ctx = context.WithValue(ctx, connLimiterKey{}, newByteLimiter(s.config.ThrottleConnRate))
+		}
+		return ctx
 	}
-	return string(ret)
 }
 
-func httpsServer(ctx context.Context, addr string) error {
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /", httpHandler)
-	mux.Handle("GET /.well-known/acme-challenge/", http.StripPrefix("/.well-known/acme-challenge/", http.FileServer(http.Dir("/challenge/.well-known/acme-challenge/"))))
+// http2Config maps the HTTP/2 tuning options onto the standard library's
+// settings. Zero values keep the Go defaults.
+func (s *Server) http2Config() *http.HTTP2Config {
+	return &http.HTTP2Config{
+		MaxConcurrentStreams:          s.config.HTTP2MaxConcurrentStreams,
+		MaxReceiveBufferPerConnection: s.config.HTTP2MaxReceiveBufferPerConn,
+		MaxReceiveBufferPerStream:     s.config.HTTP2MaxReceiveBufferPerStream,
+		SendPingTimeout:               s.config.HTTP2SendPingTimeout,
+		PingTimeout:                   s.config.HTTP2PingTimeout,
+	}
+}
 
+// serve runs mux on addr until ctx is cancelled, then drains gracefully.
+// handler wraps mux in everything a listener runs before routing.
+func (s *Server) handler(listener string, mux *http.ServeMux, tracker *activityTracker) http.Handler {
+	handler := s.autoMethods(listener, mux)
+	for _, mw := range slices.Backward(s.listenerMiddleware(listener)) {
+		handler = mw.Wrap(handler)
+	}
+	handler = tracker.wrap(mux, s.requestMetrics(listener, handler))
+	if s.rewriter != nil && listener != ListenerAdmin {
+		// Outside the tracker too, so route metrics, tracing and priority
+		// see the route the rewritten path is served by, and ahead of the
+		// access checks, so they see the rewritten path.
+		handler = s.rewriter.Middleware().Wrap(handler)
+	}
+	if s.config.PathCanonicalMode != "" && listener != ListenerAdmin {
+		// Outside the tracker, so it and the middleware see the route the
+		// canonical path is served by.
+		handler = canonicalPaths(mux, CanonicalOptions{
+			Mode:            s.config.PathCanonicalMode,
+			TrailingSlash:   s.config.PathTrailingSlash,
+			CaseInsensitive: s.config.PathCaseInsensitive,
+			CollapseSlashes: s.config.PathCollapseSlashes,
+		}, handler)
+	}
+	return handler
+}
+
+func (s *Server) serve(ctx context.Context, listener, addr string, mux *http.ServeMux) error {
+	name := strings.ToUpper(listener)
+	tracker := newActivityTracker()
+	if listener != ListenerAdmin {
+		tracker.maxAge = s.config.ConnMaxAge
+		tracker.maxRequests = s.config.ConnMaxRequests
+	}
+	handler := s.handler(listener, mux, tracker)
 	httpServer := &http.Server{
 		Addr:         addr,
-		Handler:      mux,
+		Handler:      handler,
+		ConnState:    tracker.connState,
+		ConnContext:  s.connContext(tracker, nil),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  15 * time.Second,
+		IdleTimeout:  s.config.IdleTimeout,
+		HTTP2:        s.http2Config(),
+	}
+	if s.config.H2C && listener != ListenerAdmin {
+		httpServer.Protocols = new(http.Protocols)
+		httpServer.Protocols.SetHTTP1(true)
+		httpServer.Protocols.SetUnencryptedHTTP2(true)
+	}
+	httpServer.RegisterOnShutdown(func() { s.streams.shutdown(httpServer) })
+	if s.tarpit != nil && listener != ListenerAdmin {
+		httpServer.RegisterOnShutdown(s.tarpit.close)
+	}
+	if listener == ListenerHTTPS && s.certs != nil {
+		fingerprints := &tlsFingerprinter{}
+		httpServer.TLSConfig = fingerprints.config(&tls.Config{GetCertificate: s.certs.GetCertificate})
+		httpServer.ConnContext = s.connContext(tracker, fingerprints)
+		httpServer.ConnState = func(c net.Conn, state http.ConnState) {
+			tracker.connState(c, state)
+			fingerprints.connState(c, state)
+		}
+	}
+
+	tcpOpts, ok := s.tcpOptions[listener]
+	if !ok {
+		tcpOpts = defaultTCPOptions()
+	}
+	ln, err := s.listen(ctx, addr, tcpOpts)
+	if err != nil {
+		return err
 	}
+	s.events.Publish(ListenerStarted{Addr: ln.Addr().String(), Time: time.Now()})
+
+	handle := &listenerHandle{name: listener, addr: addr, srv: httpServer, ln: ln, tracker: tracker}
+	s.listeners.add(handle)
+	defer s.listeners.remove(handle)
+
+	if s.config.ConnReapInterval > 0 {
+		reapCtx, stopReaper := context.WithCancel(ctx)
+		defer stopReaper()
+		go tracker.reapIdle(reapCtx, s.config.ConnReapInterval, httpServer.IdleTimeout)
+	}
+
 	errChan := make(chan error, 1)
 	defer close(errChan)
 
 	go func() {
-		fmt.Println("Starting HTTPS server on", addr)
-		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			//return fmt.Errorf("error starting HTTP server:%w", err)
+		fmt.Println("Starting", name, "server on", addr)
+		// Return Serve error directly so errgroup can handle it; a listener
+		// closed by an admin drain is expected to stop serving.
+		serve := httpServer.Serve
+		if httpServer.TLSConfig != nil {
+			serve = func(ln net.Listener) error { return httpServer.ServeTLS(ln, "", "") }
+		}
+		if err := serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) && !handle.drained.Load() {
 			errChan <- err
 		}
 	}()
 
 	select {
 	case <-ctx.Done():
-		fmt.Println("Shutting down HTTPS server on", addr)
+		fmt.Println("Shutting down", name, "server on", addr)
 		httpServer.SetKeepAlivesEnabled(false)
-		return httpServer.Shutdown(ctx) // Gracefully shutdown server
+		// ctx is already cancelled here, so drain against a fresh deadline
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.shutdownTimeout)
+		defer cancel()
+		go tracker.logDrainProgress(shutdownCtx, addr)
+		if s.broker != nil && listener != ListenerAdmin {
+			// Shutdown neither waits for nor closes hijacked connections.
+			s.broker.close()
+		}
+		return httpServer.Shutdown(shutdownCtx) // Gracefully shutdown server
 	case err := <-errChan:
 		return err
 	}
 }
 
+// helloGenerator produces the random suffix of the hello world response.
+var helloGenerator = randutil.MustNew(randutil.Base62 + "-")
+
+func httpHandler(w http.ResponseWriter, r *http.Request) {
+	suffix, err := helloGenerator.String(10)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	_, _ = fmt.Fprintf(w, "Hello World %s", suffix)
+}
+
 func errorHandler(w http.ResponseWriter, r *http.Request) {
 	//log.Fatalf("crash")
 	panic("simulated server crash")
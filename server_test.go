@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestServer returns a Server built from the default config as changed
+// by configure.
+func newTestServer(t *testing.T, configure func(*Config)) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	if configure != nil {
+		configure(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(cfg.HTTPAddr, cfg.HTTPSAddr, WithConfig(cfg))
+}
+
+// serveListener runs r through everything serve installs for listener,
+// without binding a socket.
+func serveListener(s *Server, listener string, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	mux := s.mux(listener)
+	s.handler(listener, mux, newActivityTracker()).ServeHTTP(rec, r)
+	return rec
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SignURL returns path with expires and sig query parameters that
+// requireSignature accepts until expires.
+func SignURL(key []byte, path string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	q := url.Values{"expires": {exp}, "sig": {urlSignature(key, path, exp)}}
+	return path + "?" + q.Encode()
+}
+
+func urlSignature(key []byte, path, expires string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requireSignature rejects requests without a valid, unexpired signature
+// for their exact path, as produced by SignURL.
+func requireSignature(key []byte) Middleware {
+	return Middleware{Name: "signed-url", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			exp, sig := q.Get("expires"), q.Get("sig")
+			unix, err := strconv.ParseInt(exp, 10, 64)
+			if err != nil || sig == "" {
+				http.Error(w, "missing or malformed signature", http.StatusForbidden)
+				return
+			}
+			if time.Now().Unix() > unix {
+				http.Error(w, "signed URL has expired", http.StatusGone)
+				return
+			}
+			want := urlSignature(key, r.URL.Path, exp)
+			if !hmac.Equal([]byte(sig), []byte(want)) {
+				http.Error(w, "invalid signature", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// signURLHandler serves POST /admin/sign?path=/static/file&ttl=1h.
+func (s *Server) signURLHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" || path[0] != '/' {
+		http.Error(w, "path must be an absolute URL path", http.StatusBadRequest)
+		return
+	}
+	ttl := time.Hour
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	expires := time.Now().Add(ttl)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"url":     SignURL([]byte(s.config.StaticSigningKey), path, expires),
+		"expires": expires.UTC(),
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireSignature(t *testing.T) {
+	key := []byte("signing key")
+	h := requireSignature(key).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	valid := SignURL(key, "/static/file.txt", time.Now().Add(time.Hour))
+	query := valid[strings.Index(valid, "?"):]
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"valid", valid, http.StatusOK},
+		{"unsigned", "/static/file.txt", http.StatusForbidden},
+		{"malformed expiry", "/static/file.txt?expires=soon&sig=abc", http.StatusForbidden},
+		{"other path", "/static/other.txt" + query, http.StatusForbidden},
+		{"other key", SignURL([]byte("other key"), "/static/file.txt", time.Now().Add(time.Hour)), http.StatusForbidden},
+		{"extended expiry", strings.Replace(valid, "expires=", "expires=9", 1), http.StatusForbidden},
+		{"expired", SignURL(key, "/static/file.txt", time.Now().Add(-time.Second)), http.StatusGone},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestSignURLHandler(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.StaticSigningKey = "signing key" })
+
+	for _, target := range []string{"/admin/sign?path=relative", "/admin/sign?path=/f&ttl=-1h", "/admin/sign?path=/f&ttl=soon"} {
+		rec := httptest.NewRecorder()
+		s.signURLHandler(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", target, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.signURLHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/sign?path="+url.QueryEscape("/static/file.txt")+"&ttl=1m", nil))
+	var resp struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%d %q: %v", rec.Code, rec.Body.String(), err)
+	}
+	if d := time.Until(resp.Expires); d <= 0 || d > time.Minute {
+		t.Errorf("expires in %v, want within the requested minute", d)
+	}
+	rec = httptest.NewRecorder()
+	requireSignature([]byte("signing key")).Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).
+		ServeHTTP(rec, httptest.NewRequest(http.MethodGet, resp.URL, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("issued URL %q rejected with %d", resp.URL, rec.Code)
+	}
+}
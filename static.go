@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// StaticOptions configures a static file mount.
+type StaticOptions struct {
+	// Hints are asset URLs sent as 103 Early Hints preloads before HTML
+	// pages under the mount are served.
+	Hints []string
+	// SigningKey, when set, requires every request to carry a URL signed
+	// with SignURL.
+	SigningKey []byte
+	// Assets, when set, serves the manifest's fingerprinted names as
+	// immutable aliases of the files.
+	Assets *AssetManifest
+}
+
+// Static serves objects from st under prefix on the named listener. Local
+// directories keep http.FileServer's index and directory handling.
+func (s *Server) Static(listener, prefix string, st Storage, opts StaticOptions) {
+	prefix = "/" + strings.Trim(prefix, "/") + "/"
+	var h http.Handler
+	if fs, ok := st.(FileStorage); ok {
+		h = http.StripPrefix(prefix, http.FileServer(http.Dir(fs.Dir)))
+	} else {
+		h = http.StripPrefix(prefix, storageHandler(st))
+	}
+
+	var mw []Middleware
+	if len(opts.SigningKey) > 0 {
+		mw = append(mw, requireSignature(opts.SigningKey))
+	}
+	if len(opts.Hints) > 0 {
+		mw = append(mw, earlyHints(opts.Hints))
+	}
+	if opts.Assets != nil {
+		mw = append(mw, opts.Assets.middleware())
+	}
+	s.Handle(listener, "GET "+prefix, h, mw...)
+}
+
+// EarlyHints sends a 103 Early Hints response preloading links, so the
+// client can start fetching them while the handler is still working. It is
+// a no-op for HTTP/1.0 clients, which cannot receive informational responses.
+func EarlyHints(w http.ResponseWriter, r *http.Request, links ...string) {
+	if len(links) == 0 || (r.ProtoMajor == 1 && r.ProtoMinor == 0) {
+		return
+	}
+	for _, link := range links {
+		w.Header().Add("Link", preloadLink(link))
+	}
+	w.WriteHeader(http.StatusEarlyHints)
+}
+
+// earlyHints sends hints ahead of requests that look like page loads.
+func earlyHints(links []string) Middleware {
+	return Middleware{Name: "early-hints", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if wantsHTML(r) {
+				EarlyHints(w, r, links...)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+func wantsHTML(r *http.Request) bool {
+	if strings.HasSuffix(r.URL.Path, "/") || strings.HasSuffix(r.URL.Path, ".html") {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// preloadLink formats a Link header value, guessing the destination type
+// from the file extension as browsers ignore preloads without one.
+func preloadLink(url string) string {
+	var as string
+	switch path.Ext(strings.SplitN(url, "?", 2)[0]) {
+	case ".css":
+		as = "style"
+	case ".js", ".mjs":
+		as = "script"
+	case ".woff", ".woff2", ".ttf", ".otf":
+		return fmt.Sprintf("<%s>; rel=preload; as=font; crossorigin", url)
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif", ".svg", ".ico":
+		as = "image"
+	default:
+		as = "fetch"
+	}
+	return fmt.Sprintf("<%s>; rel=preload; as=%s", url, as)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage backends.
+const (
+	StorageFS = "fs"
+	StorageS3 = "s3"
+)
+
+// ErrObjectNotFound is returned by Storage.Open for missing keys.
+var ErrObjectNotFound = errors.New("storage: object not found")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+	ETag        string
+}
+
+// Storage persists and serves objects by slash-separated key. The static and
+// upload subsystems use it so they can run against local disk or object storage.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Open(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// FileStorage stores objects as files under Dir.
+type FileStorage struct {
+	Dir string
+}
+
+func (f FileStorage) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return filepath.Join(f.Dir, filepath.FromSlash(clean)), nil
+}
+
+// Put writes to a temp file in the destination directory and renames it into
+// place, so readers never observe a partial object.
+func (f FileStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	dst, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (f FileStorage) Open(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	p, err := f.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	file, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ObjectInfo{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	st, err := file.Stat()
+	if err != nil || st.IsDir() {
+		_ = file.Close()
+		return nil, ObjectInfo{}, ErrObjectNotFound
+	}
+	return file, ObjectInfo{
+		Size:        st.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(p)),
+		ModTime:     st.ModTime(),
+	}, nil
+}
+
+func (f FileStorage) Delete(ctx context.Context, key string) error {
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// S3Storage talks to an S3-compatible API (AWS, MinIO, R2, ...) using
+// Signature Version 4. Keys are stored under Prefix in Bucket.
+type S3Storage struct {
+	Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket as a path segment rather than a
+	// subdomain, as most self-hosted implementations require.
+	PathStyle bool
+	Client    *http.Client
+}
+
+func (s *S3Storage) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	key = strings.TrimPrefix(path.Join(s.Prefix, path.Clean("/"+key)), "/")
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + "/" + key
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	return u, nil
+}
+
+func (s *S3Storage) do(ctx context.Context, method, key string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	h := http.Header{}
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, r, size, h)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *S3Storage) Open(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, 0, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ObjectInfo{}, ErrObjectNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, ObjectInfo{}, s3Error(resp)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.Body, ObjectInfo{
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+		ModTime:     modTime,
+		ETag:        resp.Header.Get("ETag"),
+	}, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("storage: s3 %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// sign adds SigV4 headers. Unless the caller set X-Amz-Content-Sha256, the
+// payload is sent unsigned, which S3 permits and which lets bodies stream
+// without being hashed up front. The path is sent exactly as it is signed,
+// since Go would otherwise leave characters such as '$' unescaped.
+func (s *S3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	payload := req.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = "UNSIGNED-PAYLOAD"
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	req.Header.Set("Host", req.URL.Host)
+	req.URL.RawPath = awsURIEncode(req.URL.Path, false)
+
+	var names []string
+	for k := range req.Header {
+		switch lk := strings.ToLower(k); {
+		case lk == "host", lk == "content-type", lk == "content-md5", lk == "date", lk == "range", strings.HasPrefix(lk, "x-amz-"):
+			names = append(names, lk)
+		}
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		awsCanonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signed,
+		payload,
+	}, "\n")
+
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Del("Host")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKey, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent-encodes everything except RFC 3986 unreserved
+// characters (and '/' unless encodeSlash), as SigV4 requires.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// awsCanonicalQuery sorts and encodes q as SigV4 requires; unlike
+// url.Values.Encode it escapes spaces as %20.
+func awsCanonicalQuery(q url.Values) string {
+	var pairs []string
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// storage returns the configured backend rooted at dir, which is a local
+// directory for the fs backend and a key prefix for s3.
+func (s *Server) storage(dir string) Storage {
+	if s.config.StorageBackend != StorageS3 {
+		return FileStorage{Dir: dir}
+	}
+	return &S3Storage{
+		Endpoint:  s.config.S3Endpoint,
+		Region:    s.config.S3Region,
+		Bucket:    s.config.S3Bucket,
+		Prefix:    dir,
+		AccessKey: s.config.S3AccessKey,
+		SecretKey: s.config.S3SecretKey,
+		PathStyle: s.config.S3PathStyle,
+		// Objects stream to and from clients, so only the transport is shared.
+		Client: &http.Client{Transport: s.transport},
+	}
+}
+
+// storageHandler serves GET requests for objects, using the request path
+// (after any StripPrefix) as the key.
+func storageHandler(st Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, info, err := st.Open(r.Context(), r.URL.Path)
+		if errors.Is(err, ErrObjectNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		defer body.Close()
+
+		if info.ContentType != "" {
+			w.Header().Set("Content-Type", info.ContentType)
+		}
+		if info.ETag != "" {
+			w.Header().Set("ETag", info.ETag)
+		}
+		if rs, ok := body.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, path.Base(r.URL.Path), info.ModTime, rs)
+			return
+		}
+		if !info.ModTime.IsZero() {
+			w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+		}
+		if info.Size >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		_, _ = io.Copy(w, body)
+	})
+}
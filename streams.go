@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamRegistry tracks long-lived streaming responses so shutdown can end
+// them cleanly instead of waiting for WriteTimeout to cut them off.
+type streamRegistry struct {
+	mu      sync.Mutex
+	streams map[*Stream]struct{}
+}
+
+// Stream is a registered streaming response. Its context is cancelled when
+// the client goes away or the serving listener starts shutting down, after
+// the stream's final frame has been written.
+type Stream struct {
+	w   http.ResponseWriter
+	rc  *http.ResponseController
+	srv *http.Server
+
+	mu     sync.Mutex
+	closed bool
+	final  func(w http.ResponseWriter)
+	cancel context.CancelFunc
+}
+
+// OpenStream registers a streaming response. final, if non-nil, is written
+// once when shutdown begins. Handlers must write through the Stream (or hold
+// its lock via Write) and call Close when done.
+func (s *Server) OpenStream(w http.ResponseWriter, r *http.Request, final func(w http.ResponseWriter)) (*Stream, context.Context) {
+	ctx, cancel := context.WithCancel(r.Context())
+	srv, _ := r.Context().Value(http.ServerContextKey).(*http.Server)
+	st := &Stream{w: w, rc: http.NewResponseController(w), srv: srv, final: final, cancel: cancel}
+
+	// Streams must outlive WriteTimeout; shutdown is what ends them.
+	_ = st.rc.SetWriteDeadline(time.Time{})
+
+	s.streams.mu.Lock()
+	if s.streams.streams == nil {
+		s.streams.streams = make(map[*Stream]struct{})
+	}
+	s.streams.streams[st] = struct{}{}
+	s.streams.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		s.streams.mu.Lock()
+		delete(s.streams.streams, st)
+		s.streams.mu.Unlock()
+	})
+	return st, ctx
+}
+
+// Write calls fn with the response writer under the stream lock and flushes.
+func (st *Stream) Write(fn func(w http.ResponseWriter) error) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return http.ErrServerClosed
+	}
+	if err := fn(st.w); err != nil {
+		return err
+	}
+	return st.rc.Flush()
+}
+
+// Close unregisters the stream.
+func (st *Stream) Close() {
+	st.mu.Lock()
+	st.closed = true
+	st.mu.Unlock()
+	st.cancel()
+}
+
+// shutdown writes the final frame to every stream served by srv and cancels
+// them. It is registered with http.Server.RegisterOnShutdown.
+func (reg *streamRegistry) shutdown(srv *http.Server) {
+	reg.mu.Lock()
+	var streams []*Stream
+	for st := range reg.streams {
+		if st.srv == srv {
+			streams = append(streams, st)
+		}
+	}
+	reg.mu.Unlock()
+
+	for _, st := range streams {
+		st.mu.Lock()
+		if !st.closed && st.final != nil {
+			st.final(st.w)
+			_ = st.rc.Flush()
+		}
+		st.closed = true
+		st.mu.Unlock()
+		st.cancel()
+	}
+}
+
+// SSE wraps a Stream with Server-Sent Events framing. On shutdown clients
+// receive a "shutdown" event with a retry hint so they reconnect elsewhere.
+type SSE struct {
+	*Stream
+}
+
+func (s *Server) OpenSSE(w http.ResponseWriter, r *http.Request) (*SSE, context.Context) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	st, ctx := s.OpenStream(w, r, func(w http.ResponseWriter) {
+		_, _ = fmt.Fprint(w, "retry: 1000\nevent: shutdown\ndata: {}\n\n")
+	})
+	return &SSE{Stream: st}, ctx
+}
+
+// Send writes one event. Multi-line data is split into several data fields.
+func (e *SSE) Send(event, data string) error {
+	return e.SendID("", event, data)
+}
+
+// SendID writes one event with an id, which the browser sends back as
+// Last-Event-ID when it reconnects.
+func (e *SSE) SendID(id, event, data string) error {
+	return e.Write(func(w http.ResponseWriter) error {
+		var sb strings.Builder
+		if id != "" {
+			fmt.Fprintf(&sb, "id: %s\n", id)
+		}
+		if event != "" {
+			fmt.Fprintf(&sb, "event: %s\n", event)
+		}
+		for _, line := range strings.Split(data, "\n") {
+			fmt.Fprintf(&sb, "data: %s\n", line)
+		}
+		sb.WriteByte('\n')
+		_, err := w.Write([]byte(sb.String()))
+		return err
+	})
+}
+
+// streamHandler emits a random string every second over SSE until the client
+// leaves or the server shuts down; it exists to exercise the stream registry.
+func (s *Server) streamHandler(w http.ResponseWriter, r *http.Request) {
+	sse, ctx := s.OpenSSE(w, r)
+	defer sse.Close()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			token, err := helloGenerator.String(10)
+			if err != nil {
+				return
+			}
+			if err := sse.Send("token", token); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Child states reported by the supervisor.
+const (
+	ChildRunning = "running"
+	ChildBackoff = "backoff"
+	ChildFailed  = "failed"
+	ChildStopped = "stopped"
+)
+
+// ChildStatus is a point-in-time view of a supervised child.
+type ChildStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Restarts  int       `json:"restarts"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// Supervisor runs named children in an errgroup, restarting them according
+// to their RestartPolicy. Once the tree as a whole has seen more than
+// maxFailures failures it escalates by returning an error, which cancels the
+// group and shuts the server down.
+type Supervisor struct {
+	server      *Server
+	maxFailures int
+
+	mu       sync.Mutex
+	order    []string
+	children map[string]*ChildStatus
+	failures int
+}
+
+func newSupervisor(s *Server) *Supervisor {
+	return &Supervisor{server: s, children: make(map[string]*ChildStatus)}
+}
+
+// WithMaxFailures escalates to a full shutdown once supervised children have
+// failed more than n times in total. Zero disables escalation.
+func WithMaxFailures(n int) Option {
+	return func(s *Server) { s.supervisor.maxFailures = n }
+}
+
+// Supervise registers a background task to be run alongside the listeners.
+// It must be called before Run.
+func (s *Server) Supervise(name string, p RestartPolicy, fn func(ctx context.Context) error) {
+	s.restartPolicies[name] = p
+	s.tasks = append(s.tasks, task{name: name, fn: fn})
+}
+
+type task struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Status returns the state of every child in registration order.
+func (sv *Supervisor) Status() []ChildStatus {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	out := make([]ChildStatus, 0, len(sv.order))
+	for _, name := range sv.order {
+		out = append(out, *sv.children[name])
+	}
+	return out
+}
+
+func (sv *Supervisor) setState(name, state string, err error) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	c, ok := sv.children[name]
+	if !ok {
+		c = &ChildStatus{Name: name}
+		sv.children[name] = c
+		sv.order = append(sv.order, name)
+	}
+	c.State = state
+	c.Since = time.Now()
+	if err != nil {
+		c.LastError = err.Error()
+	}
+}
+
+// recordFailure counts a failure and reports whether the tree should escalate.
+func (sv *Supervisor) recordFailure(name string) bool {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	sv.children[name].Failures++
+	sv.failures++
+	return sv.maxFailures > 0 && sv.failures > sv.maxFailures
+}
+
+// Go starts the named child in g.
+func (sv *Supervisor) Go(g *errgroup.Group, ctx context.Context, name string, p RestartPolicy, fn func() error) {
+	sv.setState(name, ChildRunning, nil)
+	g.Go(func() error {
+		err := sv.run(ctx, name, p, fn)
+		if err != nil && ctx.Err() == nil {
+			sv.setState(name, ChildFailed, err)
+		} else {
+			sv.setState(name, ChildStopped, nil)
+		}
+		return err
+	})
+}
+
+// run calls fn until it succeeds or fails in a way the policy does not cover.
+// Errors are only returned to the errgroup once the policy gives up.
+func (sv *Supervisor) run(ctx context.Context, name string, p RestartPolicy, fn func() error) error {
+	s := sv.server
+	backoff := p.InitialBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+
+	restarts := 0
+	for {
+		started := time.Now()
+		err := fn()
+		if ctx.Err() != nil {
+			return err
+		}
+		if err != nil {
+			s.events.Publish(TaskFailed{Task: name, Err: err, Time: time.Now()})
+			if sv.recordFailure(name) {
+				return fmt.Errorf("supervisor: escalating after %d failures, last from %s: %w", sv.maxFailures+1, name, err)
+			}
+		}
+
+		switch {
+		case p.Mode == RestartNever:
+			return err
+		case p.Mode == RestartOnFailure && err == nil:
+			return nil
+		case p.MaxRestarts > 0 && restarts >= p.MaxRestarts && time.Since(started) <= maxBackoff:
+			return err
+		}
+
+		// A service that stayed up for a while earns a fresh backoff.
+		if time.Since(started) > maxBackoff {
+			backoff = p.InitialBackoff
+			if backoff <= 0 {
+				backoff = time.Second
+			}
+			restarts = 0
+		}
+		restarts++
+
+		slog.Warn("Restarting service", "service", name, "error", err, "backoff", backoff)
+		s.metrics.Add("server_service_restarts_total", 1, "service", name)
+		sv.setState(name, ChildBackoff, err)
+		sv.mu.Lock()
+		sv.children[name].Restarts++
+		sv.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+		sv.setState(name, ChildRunning, nil)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// tailnetConn is a connection accepted on a tsnet listener, tagged with the
+// tailnet login of the peer.
+type tailnetConn struct {
+	net.Conn
+	login string
+}
+
+type tailnetLoginKey struct{}
+
+// TailnetLogin returns the tailnet user behind a request that arrived on a
+// tsnet listener, e.g. "alice@example.com".
+func TailnetLogin(ctx context.Context) (string, bool) {
+	login, ok := ctx.Value(tailnetLoginKey{}).(string)
+	return login, ok
+}
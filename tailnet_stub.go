@@ -0,0 +1,13 @@
+//go:build !tsnet
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+func (s *Server) listenTailnet(ctx context.Context, addr string) (net.Listener, error) {
+	return nil, errors.New("tsnet listeners require building with -tags tsnet")
+}
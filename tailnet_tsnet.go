@@ -0,0 +1,98 @@
+//go:build tsnet
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+var (
+	tsnetMu      sync.Mutex
+	tsnetServers = make(map[string]*tsnet.Server)
+)
+
+// tailnetNode returns the tsnet node for hostname, starting it on first use
+// so several listeners can share one tailnet identity.
+func (s *Server) tailnetNode(hostname string) *tsnet.Server {
+	tsnetMu.Lock()
+	defer tsnetMu.Unlock()
+	if ts, ok := tsnetServers[hostname]; ok {
+		return ts
+	}
+	ts := &tsnet.Server{
+		Hostname: hostname,
+		AuthKey:  s.config.TSNetAuthKey,
+		Logf:     func(string, ...any) {},
+	}
+	if s.config.TSNetStateDir != "" {
+		ts.Dir = filepath.Join(s.config.TSNetStateDir, hostname)
+	}
+	tsnetServers[hostname] = ts
+	return ts
+}
+
+// listenTailnet listens on the tailnet as hostname:port. Peers are
+// identified with WhoIs as they connect; when tsnet_allowed_logins is set,
+// anyone else is disconnected before a request is read.
+func (s *Server) listenTailnet(ctx context.Context, addr string) (net.Listener, error) {
+	hostname, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ts := s.tailnetNode(hostname)
+	ln, err := ts.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	lc, err := ts.LocalClient()
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	whoIs := func(ctx context.Context, remote string) (string, error) {
+		who, err := lc.WhoIs(ctx, remote)
+		if err != nil {
+			return "", err
+		}
+		if who.UserProfile == nil {
+			return "", errors.New("tailnet peer has no user profile")
+		}
+		return who.UserProfile.LoginName, nil
+	}
+	return &tailnetListener{Listener: ln, whoIs: whoIs, allowed: s.config.TSNetAllowedLogins}, nil
+}
+
+type tailnetListener struct {
+	net.Listener
+	whoIs   func(ctx context.Context, remote string) (string, error)
+	allowed []string
+}
+
+func (l *tailnetListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		// WhoIs is answered locally by the tsnet node, so it is cheap
+		// enough to run on the accept path.
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		login, err := l.whoIs(ctx, c.RemoteAddr().String())
+		cancel()
+		if err != nil || (len(l.allowed) > 0 && !slices.Contains(l.allowed, login)) {
+			slog.Warn("Rejected tailnet connection", "remote", c.RemoteAddr(), "login", login, "error", err)
+			_ = c.Close()
+			continue
+		}
+		return tailnetConn{Conn: c, login: login}, nil
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tarpit holds banned clients on their connection by answering one byte at
+// a time, so a scanner's sockets and workers are tied up instead of moving
+// on to the next target. It costs a goroutine and a socket per client, so
+// the number of clients held is capped; past the cap clients get a plain
+// 403.
+type tarpit struct {
+	interval    time.Duration
+	maxDuration time.Duration
+	metrics     *Metrics
+	slots       chan struct{}
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newTarpit(maxConns int, interval, maxDuration time.Duration, m *Metrics) *tarpit {
+	return &tarpit{
+		interval:    interval,
+		maxDuration: maxDuration,
+		metrics:     m,
+		slots:       make(chan struct{}, maxConns),
+		conns:       make(map[net.Conn]struct{}),
+	}
+}
+
+// hold tarpits the request's connection and reports whether it did; it
+// returns false when the budget is exhausted or the connection cannot be
+// taken over (HTTP/2), leaving the response to the caller.
+func (t *tarpit) hold(w http.ResponseWriter) bool {
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		t.metrics.Add("server_tarpit_total", 1, "result", "overflow")
+		return false
+	}
+	defer func() { <-t.slots }()
+
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		t.metrics.Add("server_tarpit_total", 1, "result", "unsupported")
+		return false
+	}
+	defer conn.Close()
+	t.metrics.Add("server_tarpit_total", 1, "result", "held")
+
+	t.mu.Lock()
+	t.conns[conn] = struct{}{}
+	t.metrics.Set("server_tarpit_active", float64(len(t.conns)))
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.conns, conn)
+		t.metrics.Set("server_tarpit_active", float64(len(t.conns)))
+		t.mu.Unlock()
+	}()
+
+	_ = conn.SetDeadline(time.Time{})
+	t.drip(conn, buf.Writer)
+	return true
+}
+
+// drip writes a status line and then an endless header block, one byte per
+// interval, until the client gives up, maxDuration passes or the tarpit is
+// closed.
+func (t *tarpit) drip(conn net.Conn, w *bufio.Writer) {
+	start := time.Now()
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	line := []byte("HTTP/1.1 200 OK\r\n")
+	for time.Since(start) < t.maxDuration {
+		for _, b := range line {
+			_ = conn.SetWriteDeadline(time.Now().Add(t.interval + 10*time.Second))
+			if w.WriteByte(b) != nil || w.Flush() != nil {
+				return
+			}
+			<-ticker.C
+			if time.Since(start) >= t.maxDuration {
+				return
+			}
+		}
+		line = fmt.Appendf(line[:0], "X-%x: %x\r\n", rand.Uint32(), rand.Uint32())
+	}
+}
+
+// close drops every held connection; it is called when the listener shuts
+// down so tarpitted clients do not outlive the server.
+func (t *tarpit) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c := range t.conns {
+		_ = c.Close()
+	}
+}
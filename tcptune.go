@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TCPOptions tunes a listener's sockets.
+type TCPOptions struct {
+	// KeepAlive is the TCP keep-alive period for accepted connections; zero
+	// uses the Go default and a negative value disables keep-alives.
+	KeepAlive time.Duration
+	// NoDelay disables Nagle's algorithm, as Go does by default. Turning it
+	// off can help throughput for bulk transfers on long-lived connections.
+	NoDelay bool
+	// Backlog sets the accept queue length; zero keeps the system default.
+	Backlog int
+}
+
+func defaultTCPOptions() TCPOptions {
+	return TCPOptions{NoDelay: true}
+}
+
+// parseTCPOptions parses "listener.option=value" entries, where listener is
+// http, https, admin or * for all, and option is keepalive, nodelay or
+// backlog. Entries for a specific listener override * entries.
+func parseTCPOptions(entries []string) (map[string]TCPOptions, error) {
+	type setting struct{ listener, option, value string }
+	var wildcard, specific []setting
+	for _, e := range entries {
+		key, value, ok := strings.Cut(strings.TrimSpace(e), "=")
+		listener, option, ok2 := strings.Cut(key, ".")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("tcp option %q: expected listener.option=value", e)
+		}
+		switch listener {
+		case "*":
+			wildcard = append(wildcard, setting{listener, option, value})
+		case ListenerHTTP, ListenerHTTPS, ListenerAdmin:
+			specific = append(specific, setting{listener, option, value})
+		default:
+			return nil, fmt.Errorf("tcp option %q: unknown listener %q", e, listener)
+		}
+	}
+
+	out := make(map[string]TCPOptions)
+	for _, l := range []string{ListenerHTTP, ListenerHTTPS, ListenerAdmin} {
+		out[l] = defaultTCPOptions()
+	}
+	for _, st := range append(wildcard, specific...) {
+		targets := []string{st.listener}
+		if st.listener == "*" {
+			targets = []string{ListenerHTTP, ListenerHTTPS, ListenerAdmin}
+		}
+		for _, l := range targets {
+			opts := out[l]
+			var err error
+			switch st.option {
+			case "keepalive":
+				opts.KeepAlive, err = time.ParseDuration(st.value)
+			case "nodelay":
+				opts.NoDelay, err = strconv.ParseBool(st.value)
+			case "backlog":
+				opts.Backlog, err = strconv.Atoi(st.value)
+				if err == nil && opts.Backlog < 0 {
+					err = fmt.Errorf("must not be negative")
+				}
+			default:
+				return nil, fmt.Errorf("tcp option %s.%s: unknown option", st.listener, st.option)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("tcp option %s.%s: %v", st.listener, st.option, err)
+			}
+			out[l] = opts
+		}
+	}
+	return out, nil
+}
+
+// tuneListener applies the options that cannot be set through
+// net.ListenConfig.
+func tuneListener(ln net.Listener, opts TCPOptions) (net.Listener, error) {
+	if opts.Backlog > 0 {
+		if err := setBacklog(ln, opts.Backlog); err != nil {
+			return nil, err
+		}
+	}
+	if !opts.NoDelay {
+		ln = noDelayListener{ln}
+	}
+	return ln, nil
+}
+
+// noDelayListener re-enables Nagle's algorithm on accepted connections.
+type noDelayListener struct {
+	net.Listener
+}
+
+func (l noDelayListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if tc, ok := c.(*net.TCPConn); ok {
+		_ = tc.SetNoDelay(false)
+	}
+	return c, err
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func setBacklog(ln net.Listener, backlog int) error {
+	return errors.New("backlog: not supported on this platform")
+}
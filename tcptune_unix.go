@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// setBacklog re-issues listen(2) with a new backlog, which updates the
+// accept queue of an already listening socket.
+func setBacklog(ln net.Listener, backlog int) error {
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("backlog: unsupported listener %T", ln)
+	}
+	rc, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var lerr error
+	if err := rc.Control(func(fd uintptr) {
+		lerr = syscall.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return lerr
+}
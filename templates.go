@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/martinsre/serverConcurrent/randutil"
+)
+
+// Template directories with a special role; every other .html file is a
+// page.
+const (
+	templateLayoutDir  = "layouts"
+	templatePartialDir = "partials"
+)
+
+// templateReloadInterval is how often templates are checked for changes in
+// dev mode.
+const templateReloadInterval = time.Second
+
+// flashCookie carries flash messages to the next rendered page.
+const flashCookie = "flash"
+
+// TemplateOptions configures a template set.
+type TemplateOptions struct {
+	// FS holds the templates, e.g. os.DirFS(dir) or an embed.FS.
+	FS fs.FS
+	// Layout names the layout pages are rendered in, such as
+	// "layouts/base.html"; it renders the page through {{block "content" .}}.
+	// Empty, or a layout that does not exist, renders pages on their own.
+	Layout string
+	// Funcs are made available to every template.
+	Funcs template.FuncMap
+}
+
+// TemplateData is what templates are executed with.
+type TemplateData struct {
+	// RequestID is the request's X-Request-Id, or a new ID sent back in
+	// that header when the request had none.
+	RequestID string
+	// Flash holds the messages queued with SetFlash for this client.
+	Flash []string
+	// Path is the request path, for navigation highlighting.
+	Path string
+	// Lang is the language negotiated for the request, for <html lang>; it
+	// is empty without a message catalog.
+	Lang string
+	// Data is the value passed to Render.
+	Data any
+
+	ctx context.Context
+}
+
+// T translates key into the request's language, as {{.T "key" args}}.
+func (d TemplateData) T(key string, args ...any) string {
+	ctx := d.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return T(ctx, key, args...)
+}
+
+// Templates renders html/template pages composed with shared layouts and
+// partials. Each page is parsed in its own set, so pages can define the
+// same blocks without clashing. Templates are named by their slash path
+// in the FS.
+type Templates struct {
+	opts TemplateOptions
+
+	mu    sync.RWMutex
+	pages map[string]*template.Template
+	stamp uint64
+}
+
+// NewTemplates parses the templates in opts.FS.
+func NewTemplates(opts TemplateOptions) (*Templates, error) {
+	t := &Templates{opts: opts}
+	return t, t.Load()
+}
+
+// Load re-parses every template. On error the previous set stays in use.
+func (t *Templates) Load() error {
+	stamp, err := t.scan()
+	if err != nil {
+		return err
+	}
+	var shared, pages []string
+	err = fs.WalkDir(t.opts.FS, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Ext(p) != ".html" {
+			return err
+		}
+		if dir, _, _ := strings.Cut(p, "/"); dir == templateLayoutDir || dir == templatePartialDir {
+			shared = append(shared, p)
+		} else {
+			pages = append(pages, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	base := template.New("").Funcs(t.opts.Funcs)
+	for _, p := range shared {
+		if err := parseTemplateFile(base, t.opts.FS, p); err != nil {
+			return err
+		}
+	}
+	sets := make(map[string]*template.Template, len(pages))
+	for _, p := range pages {
+		set, err := base.Clone()
+		if err != nil {
+			return err
+		}
+		if err := parseTemplateFile(set, t.opts.FS, p); err != nil {
+			return err
+		}
+		sets[p] = set
+	}
+
+	t.mu.Lock()
+	t.pages = sets
+	t.stamp = stamp
+	t.mu.Unlock()
+	return nil
+}
+
+func parseTemplateFile(set *template.Template, fsys fs.FS, name string) error {
+	src, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	if _, err := set.New(name).Parse(string(src)); err != nil {
+		return fmt.Errorf("parsing template %s: %w", name, err)
+	}
+	return nil
+}
+
+// scan fingerprints the names, sizes and modification times of the
+// templates, so watch can tell when they change.
+func (t *Templates) scan() (uint64, error) {
+	h := fnv.New64a()
+	err := fs.WalkDir(t.opts.FS, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Ext(p) != ".html" {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", p, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return h.Sum64(), err
+}
+
+// watch reloads the templates whenever a file is added, removed or changed.
+func (t *Templates) watch(ctx context.Context) error {
+	ticker := time.NewTicker(templateReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		stamp, err := t.scan()
+		if err != nil {
+			continue
+		}
+		t.mu.RLock()
+		changed := stamp != t.stamp
+		t.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := t.Load(); err != nil {
+			slog.Warn("Failed to reload templates", "error", err)
+			// Do not retry the broken files until they change again.
+			t.mu.Lock()
+			t.stamp = stamp
+			t.mu.Unlock()
+			continue
+		}
+		slog.Info("Reloaded templates")
+	}
+}
+
+// Render executes page, in the layout if there is one, with data wrapped
+// in TemplateData, and writes it with status. The output is buffered, so a
+// template error becomes a 500 instead of a half-written page.
+func (t *Templates) Render(w http.ResponseWriter, r *http.Request, status int, page string, data any) {
+	t.mu.RLock()
+	set, ok := t.pages[page]
+	t.mu.RUnlock()
+	if !ok {
+		slog.Error("Unknown template", "page", page)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	name := page
+	if t.opts.Layout != "" && set.Lookup(t.opts.Layout) != nil {
+		name = t.opts.Layout
+	}
+
+	td := TemplateData{RequestID: requestID(w, r), Flash: takeFlash(w, r), Path: r.URL.Path, Lang: Language(r.Context()), Data: data, ctx: r.Context()}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := set.ExecuteTemplate(buf, name, td); err != nil {
+		slog.Error("Failed to render template", "page", page, "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// requestID returns the request's X-Request-Id, or generates one and
+// echoes it in the response so logs and pages can be correlated.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 128 && !strings.ContainsFunc(id, func(c rune) bool { return c < 0x21 || c > 0x7e }) {
+		return id
+	}
+	id, err := randutil.UUIDv7()
+	if err != nil {
+		return ""
+	}
+	w.Header().Set("X-Request-Id", id)
+	return id
+}
+
+// SetFlash queues messages for the next page rendered for the client,
+// typically after a redirect.
+func SetFlash(w http.ResponseWriter, messages ...string) {
+	raw, _ := json.Marshal(messages)
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(raw),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// takeFlash returns the queued flash messages and clears them.
+func takeFlash(w http.ResponseWriter, r *http.Request) []string {
+	c, err := r.Cookie(flashCookie)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{Name: flashCookie, Path: "/", MaxAge: -1})
+	raw, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return nil
+	}
+	var messages []string
+	_ = json.Unmarshal(raw, &messages)
+	return messages
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTenantQuota is the quota key applying to tenants without their
+// own entry.
+const defaultTenantQuota = "*"
+
+// tenantSweepThreshold is how many tenants are tracked before those idle
+// since an earlier window are forgotten.
+const tenantSweepThreshold = 10000
+
+// TenantResolver names the tenant a request belongs to, or returns "" for
+// requests outside any tenant, which are not metered.
+type TenantResolver func(r *http.Request) string
+
+// WithTenantResolver sets how requests are attributed to tenants,
+// replacing tenant_source.
+func WithTenantResolver(fn TenantResolver) Option {
+	return func(s *Server) { s.tenantResolver = fn }
+}
+
+type tenantKey struct{}
+
+// Tenant returns the tenant the request context was attributed to, or "".
+func Tenant(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey{}).(string)
+	return t
+}
+
+// parseTenantSource builds a resolver from "header:NAME", "apikey:NAME"
+// or "jwt:CLAIM". API keys are looked up in apiKeys, "key=tenant" entries.
+// JWTs are read from a Bearer Authorization header and must be HS256
+// signed with jwtSecret; an unverified claim would let clients spend
+// another tenant's quota.
+func parseTenantSource(source string, apiKeys []string, jwtSecret string) (TenantResolver, error) {
+	kind, arg, ok := strings.Cut(source, ":")
+	if !ok || arg == "" {
+		return nil, fmt.Errorf("invalid tenant source %q: want header:NAME, apikey:NAME or jwt:CLAIM", source)
+	}
+	switch kind {
+	case "header":
+		return func(r *http.Request) string { return r.Header.Get(arg) }, nil
+	case "apikey":
+		keys := make(map[string]string, len(apiKeys))
+		for _, e := range apiKeys {
+			key, tenant, ok := strings.Cut(e, "=")
+			if !ok || key == "" || tenant == "" {
+				return nil, errors.New("invalid tenant API key entry: want key=tenant")
+			}
+			keys[key] = tenant
+		}
+		return func(r *http.Request) string {
+			got := r.Header.Get(arg)
+			for key, tenant := range keys {
+				if subtle.ConstantTimeCompare([]byte(got), []byte(key)) == 1 {
+					return tenant
+				}
+			}
+			return ""
+		}, nil
+	case "jwt":
+		if jwtSecret == "" {
+			return nil, errors.New("tenant source jwt needs tenant_jwt_secret")
+		}
+		return func(r *http.Request) string {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				return ""
+			}
+			claims, err := verifyHS256(token, []byte(jwtSecret), time.Now())
+			if err != nil {
+				return ""
+			}
+			switch v := claims[arg].(type) {
+			case string:
+				return v
+			case float64:
+				return strconv.FormatFloat(v, 'f', -1, 64)
+			}
+			return ""
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid tenant source %q: unknown kind %q", source, kind)
+}
+
+// verifyHS256 checks a compact JWT's HS256 signature and its exp and nbf
+// claims, returning the claims.
+func verifyHS256(token string, secret []byte, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jwt: malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil || header.Alg != "HS256" {
+		return nil, errors.New("jwt: unsupported header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, hmacSHA256(secret, parts[0]+"."+parts[1])) {
+		return nil, errors.New("jwt: bad signature")
+	}
+	raw, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("jwt: malformed claims")
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, errors.New("jwt: malformed claims")
+	}
+	// A time claim of the wrong type must not read as absent.
+	for _, name := range []string{"exp", "nbf"} {
+		if v, ok := claims[name]; ok {
+			if _, ok := v.(float64); !ok {
+				return nil, errors.New("jwt: malformed " + name)
+			}
+		}
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.Unix() >= int64(exp) {
+		return nil, errors.New("jwt: expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Unix() < int64(nbf) {
+		return nil, errors.New("jwt: not yet valid")
+	}
+	return claims, nil
+}
+
+// TenantQuota caps what a tenant may use per quota window; zero means
+// unlimited.
+type TenantQuota struct {
+	Requests int64 `json:"requests"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// parseTenantQuotas parses "tenant=requests[/bytes]" entries; the tenant
+// "*" sets the quota for tenants without their own.
+func parseTenantQuotas(entries []string) (map[string]TenantQuota, error) {
+	out := make(map[string]TenantQuota, len(entries))
+	for _, e := range entries {
+		tenant, spec, ok := strings.Cut(strings.TrimSpace(e), "=")
+		if !ok || tenant == "" {
+			return nil, fmt.Errorf("invalid tenant quota %q: want tenant=requests[/bytes]", e)
+		}
+		reqStr, bytesStr, hasBytes := strings.Cut(spec, "/")
+		var q TenantQuota
+		var err error
+		if q.Requests, err = strconv.ParseInt(reqStr, 10, 64); err != nil || q.Requests < 0 {
+			return nil, fmt.Errorf("invalid tenant quota %q: bad requests", e)
+		}
+		if hasBytes {
+			if q.Bytes, err = strconv.ParseInt(bytesStr, 10, 64); err != nil || q.Bytes < 0 {
+				return nil, fmt.Errorf("invalid tenant quota %q: bad bytes", e)
+			}
+		}
+		out[tenant] = q
+	}
+	return out, nil
+}
+
+// TenantUsage is a tenant's consumption in the current quota window.
+type TenantUsage struct {
+	Tenant      string      `json:"tenant"`
+	WindowStart time.Time   `json:"window_start"`
+	Requests    int64       `json:"requests"`
+	Bytes       int64       `json:"bytes"`
+	Quota       TenantQuota `json:"quota"`
+}
+
+// tenants meters requests per tenant against rate limits and windowed
+// quotas.
+type tenants struct {
+	resolve TenantResolver
+	quotas  map[string]TenantQuota
+	window  time.Duration
+	limits  map[string]*rateLimiter // by tenant, "*" for the rest
+	metrics *Metrics
+
+	mu    sync.Mutex
+	usage map[string]*TenantUsage
+}
+
+func newTenants(resolve TenantResolver, quotas map[string]TenantQuota, window time.Duration, limits map[string]RateLimit, m *Metrics) *tenants {
+	t := &tenants{
+		resolve: resolve,
+		quotas:  quotas,
+		window:  window,
+		limits:  make(map[string]*rateLimiter, len(limits)),
+		metrics: m,
+		usage:   make(map[string]*TenantUsage),
+	}
+	for tenant, l := range limits {
+		t.limits[tenant] = newRateLimiter(l.Rate, l.Burst)
+	}
+	return t
+}
+
+func (t *tenants) quota(tenant string) TenantQuota {
+	if q, ok := t.quotas[tenant]; ok {
+		return q
+	}
+	return t.quotas[defaultTenantQuota]
+}
+
+// usageLocked returns tenant's usage, starting a new window if the last
+// one has ended.
+func (t *tenants) usageLocked(tenant string, now time.Time) *TenantUsage {
+	start := now.Truncate(t.window)
+	u, ok := t.usage[tenant]
+	if !ok || u.WindowStart.Before(start) {
+		if !ok && len(t.usage) >= tenantSweepThreshold {
+			for name, old := range t.usage {
+				if old.WindowStart.Before(start) {
+					delete(t.usage, name)
+				}
+			}
+		}
+		u = &TenantUsage{Tenant: tenant, WindowStart: start, Quota: t.quota(tenant)}
+		t.usage[tenant] = u
+	}
+	return u
+}
+
+// admit counts a request against tenant, returning why it was refused and
+// when to retry, or "" if it may proceed.
+func (t *tenants) admit(tenant string, r *http.Request) (string, time.Duration) {
+	l, ok := t.limits[tenant]
+	if !ok {
+		l = t.limits[defaultTenantQuota]
+	}
+	if l != nil {
+		if ok, wait := l.allow(tenant); !ok {
+			return "rate_limit", wait
+		}
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.usageLocked(tenant, now)
+	retry := u.WindowStart.Add(t.window).Sub(now)
+	if u.Quota.Requests > 0 && u.Requests >= u.Quota.Requests {
+		return "requests", retry
+	}
+	if u.Quota.Bytes > 0 && u.Bytes >= u.Quota.Bytes {
+		return "bytes", retry
+	}
+	u.Requests++
+	u.Bytes += max(r.ContentLength, 0)
+	return "", 0
+}
+
+func (t *tenants) addBytes(tenant string, n int64) {
+	t.mu.Lock()
+	t.usageLocked(tenant, time.Now()).Bytes += n
+	t.mu.Unlock()
+}
+
+// snapshot returns every tenant's usage in the current window, sorted by
+// tenant.
+func (t *tenants) snapshot() []TenantUsage {
+	now := time.Now()
+	t.mu.Lock()
+	out := make([]TenantUsage, 0, len(t.usage))
+	for name := range t.usage {
+		out = append(out, *t.usageLocked(name, now))
+	}
+	t.mu.Unlock()
+	slices.SortFunc(out, func(a, b TenantUsage) int { return strings.Compare(a.Tenant, b.Tenant) })
+	return out
+}
+
+// middleware attributes requests to tenants, rejecting those over their
+// rate limit or quota with 429, and counts request and response bytes
+// toward the bandwidth quota.
+func (t *tenants) middleware() Middleware {
+	return Middleware{Name: "tenants", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant := t.resolve(r)
+			if tenant == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if reason, wait := t.admit(tenant, r); reason != "" {
+				t.metrics.Add("server_tenant_rejected_total", 1, "reason", reason)
+				if reason == "rate_limit" {
+					setRetryAfter(w, wait, t.metrics, "tenant", "reason", reason)
+				} else {
+					// An exhausted quota only resets with the window, so the
+					// usual cap would just invite futile retries.
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				}
+				http.Error(w, "tenant "+reason+" quota exceeded", http.StatusTooManyRequests)
+				return
+			}
+			cw := NewInstrumentedWriter(w)
+			defer func() { t.addBytes(tenant, cw.BytesWritten()) }()
+			next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+		})
+	}}
+}
+
+// tenantsHandler serves GET /admin/tenants.
+func (s *Server) tenantsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.tenants.snapshot())
+}
+
+// tenantHandler serves GET /admin/tenants/{tenant}.
+func (s *Server) tenantHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("tenant")
+	for _, u := range s.tenants.snapshot() {
+		if u.Tenant == name {
+			writeJSON(w, http.StatusOK, u)
+			return
+		}
+	}
+	http.Error(w, "no usage recorded for tenant", http.StatusNotFound)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT builds a compact JWT with the given header and claims JSON,
+// signed with HS256 under secret.
+func signJWT(header, claims string, secret []byte) string {
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString([]byte(claims))
+	return unsigned + "." + enc.EncodeToString(hmacSHA256(secret, unsigned))
+}
+
+func TestVerifyHS256(t *testing.T) {
+	secret := []byte("tenant secret")
+	now := time.Unix(1700000000, 0)
+	hs256 := `{"alg":"HS256","typ":"JWT"}`
+	enc := base64.RawURLEncoding
+	unsigned := func(header string) string {
+		return enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString([]byte(`{"sub":"acme"}`))
+	}
+	valid := signJWT(hs256, `{"sub":"acme"}`, secret)
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"alg none", unsigned(`{"alg":"none"}`) + ".", false},
+		{"alg none signed", signJWT(`{"alg":"none"}`, `{"sub":"acme"}`, secret), false},
+		{"alg RS256", signJWT(`{"alg":"RS256"}`, `{"sub":"acme"}`, secret), false},
+		{"alg lowercase", signJWT(`{"alg":"hs256"}`, `{"sub":"acme"}`, secret), false},
+		{"wrong secret", signJWT(hs256, `{"sub":"acme"}`, []byte("other")), false},
+		{"tampered claims", strings.Replace(valid, enc.EncodeToString([]byte(`{"sub":"acme"}`)), enc.EncodeToString([]byte(`{"sub":"evil"}`)), 1), false},
+		{"empty signature", unsigned(hs256) + ".", false},
+		{"two parts", unsigned(hs256), false},
+		{"four parts", valid + ".x", false},
+		{"header not json", signJWT(`alg`, `{"sub":"acme"}`, secret), false},
+		{"claims not json", signJWT(hs256, `["acme"]`, secret), false},
+		{"exp one second ahead", signJWT(hs256, `{"exp":1700000001}`, secret), true},
+		{"exp now", signJWT(hs256, `{"exp":1700000000}`, secret), false},
+		{"exp passed", signJWT(hs256, `{"exp":1699999999}`, secret), false},
+		{"exp string", signJWT(hs256, `{"exp":"1600000000"}`, secret), false},
+		{"nbf now", signJWT(hs256, `{"nbf":1700000000}`, secret), true},
+		{"nbf one second ahead", signJWT(hs256, `{"nbf":1700000001}`, secret), false},
+		{"nbf null", signJWT(hs256, `{"nbf":null}`, secret), false},
+	}
+	for _, tt := range tests {
+		if _, err := verifyHS256(tt.token, secret, now); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestJWTTenantResolver(t *testing.T) {
+	secret := []byte("tenant secret")
+	resolve, err := parseTenantSource("jwt:tenant", nil, string(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs256 := `{"alg":"HS256"}`
+	tests := []struct {
+		name, authorization, want string
+	}{
+		{"string claim", "Bearer " + signJWT(hs256, `{"tenant":"acme"}`, secret), "acme"},
+		{"number claim", "Bearer " + signJWT(hs256, `{"tenant":42}`, secret), "42"},
+		{"bool claim", "Bearer " + signJWT(hs256, `{"tenant":true}`, secret), ""},
+		{"object claim", "Bearer " + signJWT(hs256, `{"tenant":{"id":"acme"}}`, secret), ""},
+		{"array claim", "Bearer " + signJWT(hs256, `{"tenant":["acme"]}`, secret), ""},
+		{"missing claim", "Bearer " + signJWT(hs256, `{"sub":"acme"}`, secret), ""},
+		{"expired", "Bearer " + signJWT(hs256, `{"tenant":"acme","exp":1}`, secret), ""},
+		{"unverified", "Bearer " + signJWT(hs256, `{"tenant":"acme"}`, []byte("forged")), ""},
+		{"not bearer", "Basic " + signJWT(hs256, `{"tenant":"acme"}`, secret), ""},
+		{"no header", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		if got := resolve(r); got != tt.want {
+			t.Errorf("%s: tenant %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := parseTenantSource("jwt:tenant", nil, ""); err == nil {
+		t.Error("jwt source accepted without a secret")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// byteLimiter is a token bucket over bytes. Callers reserve what they are
+// about to send and sleep off any debt, so concurrent writers sharing a
+// limiter are served in arrival order.
+type byteLimiter struct {
+	rate  float64 // bytes per second
+	burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newByteLimiter(rate int64) *byteLimiter {
+	// A quarter second of data per chunk keeps writes reasonably large
+	// without letting a connection burst far above its rate.
+	burst := int(max(rate/4, 1024))
+	return &byteLimiter{rate: float64(rate), burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+func (l *byteLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(float64(l.burst), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	debt := l.tokens
+	l.mu.Unlock()
+
+	if debt >= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(-debt / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledWriter paces the body through one or more limiters.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*byteLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	chunk := len(p)
+	for _, l := range t.limiters {
+		chunk = min(chunk, l.burst)
+	}
+
+	written := 0
+	for written < len(p) {
+		n := min(chunk, len(p)-written)
+		for _, l := range t.limiters {
+			if err := l.wait(t.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := t.ResponseWriter.Write(p[written : written+n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+func (t *throttledWriter) FlushError() error {
+	return http.NewResponseController(t.ResponseWriter).Flush()
+}
+
+func (t *throttledWriter) Flush() {
+	_ = t.FlushError()
+}
+
+func (t *throttledWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(t.ResponseWriter).Hijack()
+}
+
+type connLimiterKey struct{}
+
+// throttleConn paces every response on a connection through the limiter
+// attached to it by serve, so one client cannot exceed rate in total even
+// over multiplexed HTTP/2 streams.
+func throttleConn() Middleware {
+	return Middleware{Name: "throttle-conn", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if l, ok := r.Context().Value(connLimiterKey{}).(*byteLimiter); ok {
+				w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), limiters: []*byteLimiter{l}}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// throttleRoute caps each response on a route at rate bytes per second.
+// Throttled responses are expected to be slow, so the listener's
+// WriteTimeout is lifted for them.
+func throttleRoute(rate int64) Middleware {
+	return Middleware{Name: "throttle", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+			w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), limiters: []*byteLimiter{newByteLimiter(rate)}}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// parseThrottleRoutes parses "pattern=bytesPerSecond" entries.
+func parseThrottleRoutes(entries []string) (map[string]int64, error) {
+	out := make(map[string]int64, len(entries))
+	for _, e := range entries {
+		pattern, raw, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("throttle route %q: expected pattern=bytes_per_second", e)
+		}
+		rate, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("throttle route %q: invalid rate", e)
+		}
+		out[strings.TrimSpace(pattern)] = rate
+	}
+	return out, nil
+}
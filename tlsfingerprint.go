@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TLSFingerprint identifies the TLS client library behind a connection from
+// its ClientHello. Clients that claim to be a browser in their User-Agent
+// but hand-roll their TLS stack stand out here.
+type TLSFingerprint struct {
+	JA3     string `json:"ja3"`
+	JA3Hash string `json:"ja3_hash"`
+	JA4     string `json:"ja4"`
+}
+
+type tlsFingerprintKey struct{}
+
+// ClientTLSFingerprint returns the fingerprint of the TLS connection a
+// request arrived on.
+func ClientTLSFingerprint(ctx context.Context) (TLSFingerprint, bool) {
+	fp, ok := ctx.Value(tlsFingerprintKey{}).(*TLSFingerprint)
+	if !ok || fp.JA3 == "" {
+		return TLSFingerprint{}, false
+	}
+	return *fp, true
+}
+
+// tlsFingerprinter hands each connection's ClientHello to the fingerprint
+// its context carries. connContext runs before the handshake, so it
+// registers a placeholder under the raw connection, which is all the
+// ClientHello callback can see.
+type tlsFingerprinter struct {
+	pending sync.Map // net.Conn -> *TLSFingerprint
+}
+
+// config returns base set up to fingerprint every handshake.
+func (f *tlsFingerprinter) config(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if fp, ok := f.pending.LoadAndDelete(hello.Conn); ok {
+			*fp.(*TLSFingerprint) = fingerprintHello(hello)
+		}
+		return nil, nil
+	}
+	return cfg
+}
+
+func (f *tlsFingerprinter) connContext(ctx context.Context, c net.Conn) context.Context {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return ctx
+	}
+	fp := new(TLSFingerprint)
+	f.pending.Store(tc.NetConn(), fp)
+	return context.WithValue(ctx, tlsFingerprintKey{}, fp)
+}
+
+// connState forgets connections that closed before finishing a handshake.
+func (f *tlsFingerprinter) connState(c net.Conn, state http.ConnState) {
+	if tc, ok := c.(*tls.Conn); ok && (state == http.StateClosed || state == http.StateHijacked) {
+		f.pending.Delete(tc.NetConn())
+	}
+}
+
+// isGREASE reports whether v is one of the reserved GREASE values (RFC
+// 8701), which clients randomise and fingerprints ignore.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(vs []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(vs), isGREASE)
+}
+
+// fingerprintHello computes JA3 and JA4 (TCP) fingerprints. The standard
+// library does not expose the legacy ClientHello version JA3 starts with;
+// it is TLS 1.2 whenever the supported_versions extension is present, and
+// the client's only version otherwise.
+func fingerprintHello(hello *tls.ClientHelloInfo) TLSFingerprint {
+	ciphers := withoutGREASE(hello.CipherSuites)
+	exts := withoutGREASE(hello.Extensions)
+	curves := make([]uint16, 0, len(hello.SupportedCurves))
+	for _, c := range hello.SupportedCurves {
+		if !isGREASE(uint16(c)) {
+			curves = append(curves, uint16(c))
+		}
+	}
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, p := range hello.SupportedPoints {
+		points[i] = uint16(p)
+	}
+	sigAlgs := make([]uint16, 0, len(hello.SignatureSchemes))
+	for _, s := range hello.SignatureSchemes {
+		if !isGREASE(uint16(s)) {
+			sigAlgs = append(sigAlgs, uint16(s))
+		}
+	}
+	versions := withoutGREASE(hello.SupportedVersions)
+	maxVersion := uint16(0)
+	if len(versions) > 0 {
+		maxVersion = slices.Max(versions)
+	}
+
+	legacyVersion := maxVersion
+	if slices.Contains(exts, 43) {
+		legacyVersion = tls.VersionTLS12
+	}
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(legacyVersion)),
+		joinUint16(ciphers, "-", "%d"),
+		joinUint16(exts, "-", "%d"),
+		joinUint16(curves, "-", "%d"),
+		joinUint16(points, "-", "%d"),
+	}, ",")
+	sum := md5.Sum([]byte(ja3))
+
+	return TLSFingerprint{JA3: ja3, JA3Hash: hex.EncodeToString(sum[:]), JA4: ja4(maxVersion, ciphers, exts, sigAlgs, hello.SupportedProtos)}
+}
+
+// ja4 builds the JA4 fingerprint: a readable prefix describing the hello,
+// then truncated hashes of the sorted cipher suites and of the sorted
+// extensions followed by the signature algorithms.
+func ja4(version uint16, ciphers, exts, sigAlgs []uint16, alpn []string) string {
+	ver := map[uint16]string{tls.VersionTLS13: "13", tls.VersionTLS12: "12", tls.VersionTLS11: "11", tls.VersionTLS10: "10", 0x0300: "s3"}[version]
+	if ver == "" {
+		ver = "00"
+	}
+	sni := "i"
+	if slices.Contains(exts, 0) {
+		sni = "d"
+	}
+	proto := "00"
+	if len(alpn) > 0 && alpn[0] != "" {
+		first, last := alpn[0][0], alpn[0][len(alpn[0])-1]
+		if isAlnum(first) && isAlnum(last) {
+			proto = string([]byte{first, last})
+		} else {
+			h := hex.EncodeToString([]byte{first, last})
+			proto = h[:1] + h[3:]
+		}
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ver, sni, min(len(ciphers), 99), min(len(exts), 99), proto)
+
+	sortedCiphers := slices.Sorted(slices.Values(ciphers))
+	sortedExts := slices.DeleteFunc(slices.Sorted(slices.Values(exts)), func(e uint16) bool { return e == 0 || e == 16 })
+	c := joinUint16(sortedExts, ",", "%04x")
+	if len(sigAlgs) > 0 {
+		c += "_" + joinUint16(sigAlgs, ",", "%04x")
+	}
+	return a + "_" + ja4Hash(len(sortedCiphers), joinUint16(sortedCiphers, ",", "%04x")) + "_" + ja4Hash(len(sortedExts), c)
+}
+
+func ja4Hash(n int, s string) string {
+	if n == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+func joinUint16(vs []uint16, sep, format string) string {
+	parts := make([]string, len(vs))
+	for i, v := range vs {
+		parts[i] = fmt.Sprintf(format, v)
+	}
+	return strings.Join(parts, sep)
+}
+
+func isAlnum(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+
+	"github.com/martinsre/serverConcurrent/randutil"
+)
+
+// Limits for /token parameters.
+const (
+	maxTokenLength = 256
+	maxTokenCount  = 100
+)
+
+// tokenAlphabets are the alphabets /token accepts by name.
+var tokenAlphabets = map[string]*randutil.Generator{
+	"hex":       randutil.MustNew(randutil.Hex),
+	"base62":    randutil.MustNew(randutil.Base62),
+	"base64url": randutil.MustNew(randutil.Base64URL),
+}
+
+// apiNegotiator renders /token and /uuid responses in the format the
+// client asks for, JSON by default.
+var apiNegotiator = NewNegotiator(RenderJSON, RenderXML, RenderMsgPack, RenderCBOR)
+
+type tokenResponse struct {
+	XMLName  xml.Name `json:"-" xml:"tokens"`
+	Alphabet string   `json:"alphabet" xml:"alphabet,attr"`
+	Length   int      `json:"length" xml:"length,attr"`
+	Tokens   []string `json:"tokens" xml:"token"`
+}
+
+// tokenHandler serves GET /token?length=32&alphabet=base62&count=1.
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	length, err := intParam(q.Get("length"), 32)
+	if err != nil || length < 1 || length > maxTokenLength {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "length must be between 1 and " + strconv.Itoa(maxTokenLength)})
+		return
+	}
+	count, err := intParam(q.Get("count"), 1)
+	if err != nil || count < 1 || count > maxTokenCount {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "count must be between 1 and " + strconv.Itoa(maxTokenCount)})
+		return
+	}
+	name := q.Get("alphabet")
+	if name == "" {
+		name = "base62"
+	}
+	gen, ok := tokenAlphabets[name]
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "alphabet must be one of hex, base62, base64url"})
+		return
+	}
+
+	resp := tokenResponse{Alphabet: name, Length: length, Tokens: make([]string, count)}
+	for i := range resp.Tokens {
+		if resp.Tokens[i], err = gen.String(length); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	apiNegotiator.Render(w, r, http.StatusOK, resp)
+}
+
+func intParam(raw string, def int) (int, error) {
+	if raw == "" {
+		return def, nil
+	}
+	return strconv.Atoi(raw)
+}
+
+type uuidResponse struct {
+	XMLName xml.Name `json:"-" xml:"uuids"`
+	Version int      `json:"version" xml:"version,attr"`
+	UUIDs   []string `json:"uuids" xml:"uuid"`
+}
+
+// uuidHandler serves GET /uuid?version=4|7&count=1.
+func uuidHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	version, err := intParam(q.Get("version"), 4)
+	if err != nil || (version != 4 && version != 7) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "version must be 4 or 7"})
+		return
+	}
+	count, err := intParam(q.Get("count"), 1)
+	if err != nil || count < 1 || count > maxTokenCount {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "count must be between 1 and " + strconv.Itoa(maxTokenCount)})
+		return
+	}
+
+	gen := randutil.UUIDv4
+	if version == 7 {
+		gen = randutil.UUIDv7
+	}
+	resp := uuidResponse{Version: version, UUIDs: make([]string, count)}
+	for i := range resp.UUIDs {
+		if resp.UUIDs[i], err = gen(); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	apiNegotiator.Render(w, r, http.StatusOK, resp)
+}
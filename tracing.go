@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// traceparentHeader carries W3C trace context.
+const traceparentHeader = "Traceparent"
+
+// SpanContext identifies a request's span within its trace.
+type SpanContext struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+	// Sampled is the head-based decision, which outbound calls carry on.
+	Sampled bool
+}
+
+// traceparent formats sc for the traceparent header.
+func (sc SpanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
+}
+
+// parseTraceparent returns the trace ID, parent span ID and sampled flag of
+// a version 00 traceparent value.
+func parseTraceparent(v string) (traceID, parentID string, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) != 4 || parts[0] != "00" || !isHexID(parts[1], 32) || !isHexID(parts[2], 16) || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return "", "", false, false
+	}
+	return parts[1], parts[2], flags&1 == 1, true
+}
+
+// isHexID reports whether s is n lowercase hex digits and not all zero.
+func isHexID(s string, n int) bool {
+	if len(s) != n || strings.Trim(s, "0") == "" {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// newTraceID returns n random bytes in hex, for trace (16) and span (8)
+// IDs.
+func newTraceID(n int) string {
+	b := make([]byte, 0, n)
+	for len(b) < n {
+		b = binary.BigEndian.AppendUint64(b, rand.Uint64())
+	}
+	return hex.EncodeToString(b[:n])
+}
+
+type spanKey struct{}
+
+// SpanFrom returns the span of the request ctx belongs to.
+func SpanFrom(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanKey{}).(SpanContext)
+	return sc, ok
+}
+
+// TraceSampler decides which requests are traced. Head-based sampling
+// decides when a request arrives: a caller's decision in traceparent is
+// followed when RespectParent is set, otherwise the route's rate or
+// Percent applies. Tail-based error sampling also records requests the head
+// decision skipped once they end in a 5xx, so failures are never lost to a
+// low rate.
+type TraceSampler struct {
+	Percent       float64
+	RoutePercents map[string]float64
+	RespectParent bool
+	Errors        bool
+}
+
+// parseTraceRoutes parses "pattern=percent" sampling overrides.
+func parseTraceRoutes(entries []string) (map[string]float64, error) {
+	out := make(map[string]float64, len(entries))
+	for _, e := range entries {
+		pattern, raw, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("trace sample route %q: expected pattern=percent", e)
+		}
+		p, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("trace sample route %q: percent must be between 0 and 100", e)
+		}
+		out[strings.TrimSpace(pattern)] = p
+	}
+	return out, nil
+}
+
+// sampleHead makes the head-based decision for r, given an incoming
+// traceparent's sampled flag if there was one.
+func (ts TraceSampler) sampleHead(r *http.Request, hasParent, parentSampled bool) bool {
+	if hasParent && ts.RespectParent {
+		return parentSampled
+	}
+	percent := ts.Percent
+	if p, ok := ts.RoutePercents[r.Pattern]; ok {
+		percent = p
+	}
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// tracing gives every request a span, continuing the caller's trace when it
+// sent a valid traceparent, and logs the spans the sampler keeps.
+func tracing(ts TraceSampler, m *Metrics) Middleware {
+	return Middleware{Name: "tracing", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			traceID, parentID, parentSampled, hasParent := parseTraceparent(r.Header.Get(traceparentHeader))
+			if !hasParent {
+				traceID, parentID = newTraceID(16), ""
+			}
+			sc := SpanContext{TraceID: traceID, SpanID: newTraceID(8), ParentID: parentID}
+			sc.Sampled = ts.sampleHead(r, hasParent, parentSampled)
+
+			iw := NewInstrumentedWriter(w)
+			next.ServeHTTP(iw, r.WithContext(context.WithValue(r.Context(), spanKey{}, sc)))
+
+			reason := ""
+			switch {
+			case sc.Sampled:
+				reason = "head"
+			case ts.Errors && iw.Status() >= 500:
+				reason = "error"
+			default:
+				m.Add("server_trace_spans_total", 1, "result", "dropped")
+				return
+			}
+			m.Add("server_trace_spans_total", 1, "result", reason)
+			slog.Info("Trace span",
+				"trace_id", sc.TraceID, "span_id", sc.SpanID, "parent_id", sc.ParentID,
+				"method", r.Method, "route", r.Pattern, "path", r.URL.Path,
+				"status", iw.Status(), "duration", time.Since(start), "sampled", reason)
+		})
+	}}
+}
+
+// propagateTrace sets traceparent on an outbound request made on behalf of
+// a traced request, naming that request's span as the parent. A proxied
+// request's copy of the inbound header is replaced.
+func propagateTrace(req *http.Request) *http.Request {
+	sc, ok := SpanFrom(req.Context())
+	if !ok {
+		return req
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set(traceparentHeader, sc.traceparent())
+	return req
+}
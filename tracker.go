@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// drainLogInterval is how often shutdown progress is logged while draining.
+const drainLogInterval = 2 * time.Second
+
+// activityTracker follows open connections and in-flight requests per route
+// so a draining listener can report what it is still waiting on. It also
+// enforces connection lifetime limits, so long-lived keep-alive connections
+// get rebalanced across instances behind a load balancer.
+type activityTracker struct {
+	// maxAge and maxRequests close a keep-alive connection after the
+	// response that crosses either limit; zero disables a limit.
+	maxAge      time.Duration
+	maxRequests int
+
+	mu     sync.Mutex
+	conns  map[net.Conn]*connInfo
+	routes map[string]int
+}
+
+type connInfo struct {
+	state    http.ConnState
+	since    time.Time // last state change
+	opened   time.Time
+	requests int
+}
+
+type connKey struct{}
+
+func newActivityTracker() *activityTracker {
+	return &activityTracker{conns: make(map[net.Conn]*connInfo), routes: make(map[string]int)}
+}
+
+// connContext is installed as http.Server.ConnContext so requests can be
+// matched to their connection.
+func (t *activityTracker) connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// connState is installed as http.Server.ConnState.
+func (t *activityTracker) connState(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		delete(t.conns, c)
+	case http.StateNew:
+		now := time.Now()
+		t.conns[c] = &connInfo{state: state, since: now, opened: now}
+	default:
+		if info, ok := t.conns[c]; ok {
+			info.state = state
+			info.since = time.Now()
+		}
+	}
+}
+
+// countRequest records a request on the connection and reports whether the
+// connection has reached its age or request limit.
+func (t *activityTracker) countRequest(r *http.Request) (expired bool) {
+	c, ok := r.Context().Value(connKey{}).(net.Conn)
+	if !ok {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, ok := t.conns[c]
+	if !ok {
+		return false
+	}
+	info.requests++
+	return (t.maxRequests > 0 && info.requests >= t.maxRequests) ||
+		(t.maxAge > 0 && time.Since(info.opened) >= t.maxAge)
+}
+
+// reapIdle closes idle connections past their max age, or idle for longer
+// than idleTimeout, every interval until ctx is done. Busy connections are
+// left to countRequest, which closes them after their current response.
+func (t *activityTracker) reapIdle(ctx context.Context, interval, idleTimeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var stale []net.Conn
+		t.mu.Lock()
+		for c, info := range t.conns {
+			if info.state != http.StateIdle {
+				continue
+			}
+			if (t.maxAge > 0 && now.Sub(info.opened) >= t.maxAge) || (idleTimeout > 0 && now.Sub(info.since) >= idleTimeout) {
+				stale = append(stale, c)
+			}
+		}
+		t.mu.Unlock()
+
+		for _, c := range stale {
+			_ = c.Close()
+		}
+		if len(stale) > 0 {
+			slog.Debug("Reaped idle connections", "count", len(stale))
+		}
+	}
+}
+
+// wrap counts in-flight requests to next under the mux pattern that will
+// serve them.
+func (t *activityTracker) wrap(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t.countRequest(r) && r.ProtoMajor == 1 {
+			w.Header().Set("Connection", "close")
+		}
+
+		_, pattern := mux.Handler(r)
+		// Expose the route to listener-wide middleware, which runs before
+		// the mux would set it.
+		r.Pattern = pattern
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+
+		t.mu.Lock()
+		t.routes[pattern]++
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			if t.routes[pattern]--; t.routes[pattern] <= 0 {
+				delete(t.routes, pattern)
+			}
+			t.mu.Unlock()
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// snapshot returns the number of non-idle connections and in-flight requests by route.
+func (t *activityTracker) snapshot() (active int, routes map[string]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, info := range t.conns {
+		if info.state != http.StateIdle {
+			active++
+		}
+	}
+	routes = make(map[string]int, len(t.routes))
+	for pattern, n := range t.routes {
+		routes[pattern] = n
+	}
+	return active, routes
+}
+
+// inFlight returns the number of requests currently being served.
+func (t *activityTracker) inFlight() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, c := range t.routes {
+		n += c
+	}
+	return n
+}
+
+// logDrainProgress logs remaining activity every drainLogInterval until ctx is done.
+func (t *activityTracker) logDrainProgress(ctx context.Context, addr string) {
+	ticker := time.NewTicker(drainLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			active, routes := t.snapshot()
+			slog.Info("Draining connections", "addr", addr, "active", active, "routes", routes)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// binaryFormat writes JSON-shaped values in a binary encoding.
+type binaryFormat interface {
+	// container writes the header of an object (map) or array of n
+	// elements; the elements follow.
+	container(buf *bytes.Buffer, object bool, n int)
+	str(buf *bytes.Buffer, s string)
+	number(buf *bytes.Buffer, n json.Number) error
+	boolean(buf *bytes.Buffer, b bool)
+	null(buf *bytes.Buffer)
+}
+
+// transcodeJSON writes v in format. v is marshalled to JSON first, so json
+// struct tags and Marshalers apply, and the JSON is then transcoded token by
+// token, keeping object keys in order.
+func transcodeJSON(w io.Writer, v any, format binaryFormat) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var buf bytes.Buffer
+	if err := transcodeValue(&buf, dec, format); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// transcodeValue transcodes the next JSON value from dec into buf.
+func transcodeValue(buf *bytes.Buffer, dec *json.Decoder, format binaryFormat) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		// Container headers carry the element count, so elements are
+		// encoded first.
+		var body bytes.Buffer
+		n := 0
+		for dec.More() {
+			if t == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				format.str(&body, key.(string))
+			}
+			if err := transcodeValue(&body, dec, format); err != nil {
+				return err
+			}
+			n++
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		format.container(buf, t == '{', n)
+		buf.Write(body.Bytes())
+	case string:
+		format.str(buf, t)
+	case json.Number:
+		return format.number(buf, t)
+	case bool:
+		format.boolean(buf, t)
+	case nil:
+		format.null(buf)
+	default:
+		return fmt.Errorf("transcoding: unexpected JSON token %v", tok)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Tunnel providers.
+const (
+	TunnelCloudflared = "cloudflared"
+	TunnelNgrok       = "ngrok"
+)
+
+// tunnelURL picks the public URL out of a tunnel client's log output.
+var tunnelURL = regexp.MustCompile(`https://[A-Za-z0-9.-]+\.(trycloudflare\.com|ngrok(-free)?\.(app|io|dev))`)
+
+// runTunnel runs the configured tunnel client, forwarding its public
+// endpoint to the HTTP listener, so the existing mux is reachable without
+// binding a public port. It is supervised and restarted if the client exits.
+func (s *Server) runTunnel(ctx context.Context) error {
+	target, err := tunnelTarget(s.httpAddr)
+	if err != nil {
+		return err
+	}
+
+	bin := s.config.TunnelBinary
+	if bin == "" {
+		bin = s.config.TunnelProvider
+	}
+	var args []string
+	env := os.Environ()
+	switch s.config.TunnelProvider {
+	case TunnelCloudflared:
+		// Without a token this is a throwaway trycloudflare.com quick tunnel.
+		args = []string{"tunnel", "--no-autoupdate", "--url", target}
+		if s.config.TunnelToken != "" {
+			args = append(args, "run", "--token", s.config.TunnelToken)
+		}
+	case TunnelNgrok:
+		args = []string{"http", target, "--log", "stdout", "--log-format", "logfmt"}
+		if s.config.TunnelToken != "" {
+			env = append(env, "NGROK_AUTHTOKEN="+s.config.TunnelToken)
+		}
+	default:
+		return fmt.Errorf("unknown tunnel provider %q", s.config.TunnelProvider)
+	}
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Env = env
+	cmd.Stdout, cmd.Stderr = pw, pw
+	// Don't let a child that inherited the output keep Wait blocked.
+	cmd.WaitDelay = 2 * time.Second
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting %s: %w", bin, err)
+	}
+	slog.Info("Starting tunnel", "provider", s.config.TunnelProvider, "target", target)
+
+	go func() {
+		var once sync.Once
+		sc := bufio.NewScanner(pr)
+		for sc.Scan() {
+			if url := tunnelURL.FindString(sc.Text()); url != "" {
+				once.Do(func() { slog.Info("Tunnel established", "url", url) })
+			}
+		}
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("%s exited: %w", bin, err)
+}
+
+// tunnelTarget returns a local URL for the first TCP bind of addr, using
+// loopback for wildcard hosts.
+func tunnelTarget(addr string) (string, error) {
+	binds, err := parseBindAddrs(addr)
+	if err != nil {
+		return "", err
+	}
+	for _, b := range binds {
+		if b[0] == "tsnet" {
+			continue
+		}
+		host, port, _ := net.SplitHostPort(b[1])
+		if ip, err := netip.ParseAddr(host); host == "" || (err == nil && ip.IsUnspecified()) {
+			host = "127.0.0.1"
+			if b[0] == "tcp6" {
+				host = "::1"
+			}
+		}
+		return "http://" + net.JoinHostPort(host, port), nil
+	}
+	return "", fmt.Errorf("no local bind in %q to tunnel to", addr)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/martinsre/serverConcurrent/randutil"
+)
+
+// uploadProgressTTL is how long finished uploads stay visible to the
+// progress endpoint.
+const uploadProgressTTL = time.Minute
+
+// uploadProgress tracks bytes received for uploads that carry an
+// X-Upload-ID header, so clients can poll /upload/progress/{id}.
+type uploadProgress struct {
+	mu      sync.Mutex
+	uploads map[string]*uploadState
+}
+
+type uploadState struct {
+	received atomic.Int64
+	total    int64
+	done     atomic.Bool
+	err      atomic.Value // string
+}
+
+func (p *uploadProgress) start(id string, total int64) *uploadState {
+	st := &uploadState{total: total}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.uploads == nil {
+		p.uploads = make(map[string]*uploadState)
+	}
+	p.uploads[id] = st
+	return st
+}
+
+func (p *uploadProgress) finish(id string, st *uploadState, err error) {
+	if err != nil {
+		st.err.Store(err.Error())
+	}
+	st.done.Store(true)
+	time.AfterFunc(uploadProgressTTL, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.uploads[id] == st {
+			delete(p.uploads, id)
+		}
+	})
+}
+
+func (p *uploadProgress) get(id string) (*uploadState, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st, ok := p.uploads[id]
+	return st, ok
+}
+
+// countingReader reports bytes read into an uploadState.
+type countingReader struct {
+	r  io.Reader
+	st *uploadState
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.st.received.Add(int64(n))
+	return n, err
+}
+
+type storedFile struct {
+	Field       string `json:"field"`
+	Filename    string `json:"filename"`
+	StoredAs    string `json:"stored_as"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// uploadHandler streams multipart file parts to the upload store. Each part
+// is spooled to a local temp file and only handed to the store once it has
+// been fully received and validated, so failed uploads never leave partial
+// objects; spooling also gives object stores the length they need up front.
+func (s *Server) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	// Uploads legitimately outlast the listener's read and write timeouts.
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Now().Add(s.config.UploadTimeout))
+	_ = rc.SetWriteDeadline(time.Now().Add(s.config.UploadTimeout))
+
+	if r.ContentLength > s.config.UploadMaxBytes {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.UploadMaxBytes)
+
+	if id := r.Header.Get("X-Upload-ID"); id != "" {
+		st := s.uploads.start(id, r.ContentLength)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{countingReader{r: r.Body, st: st}, r.Body}
+		stored, err := s.receiveUpload(r)
+		s.uploads.finish(id, st, err)
+		s.writeUploadResult(w, stored, err)
+		return
+	}
+
+	stored, err := s.receiveUpload(r)
+	s.writeUploadResult(w, stored, err)
+}
+
+var (
+	errContentType  = errors.New("content type not allowed")
+	errNoFiles      = errors.New("no file parts in upload")
+	errNotMultipart = errors.New("expected multipart/form-data")
+)
+
+func (s *Server) receiveUpload(r *http.Request) ([]storedFile, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotMultipart, err)
+	}
+
+	var stored []storedFile
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stored, err
+		}
+		if part.FileName() == "" {
+			_ = part.Close()
+			continue
+		}
+
+		f, err := s.storePart(r.Context(), part)
+		_ = part.Close()
+		if err != nil {
+			return stored, err
+		}
+		stored = append(stored, f)
+	}
+
+	if len(stored) == 0 {
+		return nil, errNoFiles
+	}
+	return stored, nil
+}
+
+func (s *Server) storePart(ctx context.Context, part *multipart.Part) (storedFile, error) {
+	f := storedFile{Field: part.FormName(), Filename: part.FileName()}
+
+	// Sniff instead of trusting the part's declared Content-Type.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(part, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return f, err
+	}
+	head = head[:n]
+	f.ContentType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	if allowed := s.config.UploadAllowedTypes; len(allowed) > 0 && !slices.Contains(allowed, f.ContentType) {
+		return f, fmt.Errorf("%w: %s", errContentType, f.ContentType)
+	}
+
+	tmp, err := os.CreateTemp("", ".upload-*")
+	if err != nil {
+		return f, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, io.MultiReader(bytes.NewReader(head), part))
+	if err != nil {
+		return f, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return f, err
+	}
+
+	prefix, err := randutil.String(8, randutil.Base62)
+	if err != nil {
+		return f, err
+	}
+	name := strings.Trim(unsafeFilename.ReplaceAllString(filepath.Base(f.Filename), "_"), ".")
+	f.StoredAs = prefix + "-" + name
+	if err := s.uploadStore.Put(ctx, f.StoredAs, tmp, size, f.ContentType); err != nil {
+		return f, err
+	}
+	f.Size = size
+	slog.Info("Stored upload", "file", f.StoredAs, "size", size, "content_type", f.ContentType)
+	return f, nil
+}
+
+func (s *Server) writeUploadResult(w http.ResponseWriter, stored []storedFile, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusCreated, stored)
+	case errors.As(err, &tooLarge):
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errContentType):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.Is(err, errNoFiles), errors.Is(err, errNotMultipart):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		slog.Warn("Upload failed", "error", err)
+		http.Error(w, "upload failed", http.StatusBadRequest)
+	}
+}
+
+// uploadProgressHandler serves GET /upload/progress/{id}.
+func (s *Server) uploadProgressHandler(w http.ResponseWriter, r *http.Request) {
+	st, ok := s.uploads.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "unknown upload", http.StatusNotFound)
+		return
+	}
+	resp := map[string]any{
+		"received": st.received.Load(),
+		"total":    st.total,
+		"done":     st.done.Load(),
+	}
+	if msg, ok := st.err.Load().(string); ok {
+		resp["error"] = msg
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
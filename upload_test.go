@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func newUploadServer(t *testing.T, configure func(*Config)) (*Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	s := newTestServer(t, func(c *Config) {
+		c.UploadDir = dir
+		c.UploadMaxBytes = 4096
+		if configure != nil {
+			configure(c)
+		}
+	})
+	return s, dir
+}
+
+// multipartBody returns a form with one file part per name/content pair.
+func multipartBody(t *testing.T, files ...string) (*bytes.Buffer, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for i := 0; i+1 < len(files); i += 2 {
+		fw, err := mw.CreateFormFile("file", files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(fw, files[i+1])
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf, mw.FormDataContentType()
+}
+
+func postUpload(s *Server, body io.Reader, contentType string, contentLength int64) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/upload", body)
+	r.Header.Set("Content-Type", contentType)
+	r.ContentLength = contentLength
+	rec := httptest.NewRecorder()
+	s.mux(ListenerHTTP).ServeHTTP(rec, r)
+	return rec
+}
+
+func storedNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestUploadStoresSanitizedName(t *testing.T) {
+	s, dir := newUploadServer(t, nil)
+	body, ct := multipartBody(t, "../../etc/pass wd", "hello")
+
+	rec := postUpload(s, body, ct, int64(body.Len()))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload: %d %q", rec.Code, rec.Body.String())
+	}
+	var stored []storedFile
+	if err := json.Unmarshal(rec.Body.Bytes(), &stored); err != nil {
+		t.Fatal(err)
+	}
+	names := storedNames(t, dir)
+	if len(stored) != 1 || len(names) != 1 || names[0] != stored[0].StoredAs {
+		t.Fatalf("stored %+v, directory holds %q", stored, names)
+	}
+	if want := "-pass_wd"; len(names[0]) != 8+len(want) || names[0][8:] != want {
+		t.Errorf("stored as %q, want a random prefix and %q", names[0], want)
+	}
+	if stored[0].Size != 5 || stored[0].ContentType != "text/plain" {
+		t.Errorf("stored %+v", stored[0])
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	big := string(bytes.Repeat([]byte("x"), 8192))
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		files     []string
+		chunked   bool
+		want      int
+	}{
+		{"declared too large", nil, []string{"big.txt", big}, false, http.StatusRequestEntityTooLarge},
+		{"chunked too large", nil, []string{"big.txt", big}, true, http.StatusRequestEntityTooLarge},
+		{"disallowed type", func(c *Config) { c.UploadAllowedTypes = []string{"image/png"} }, []string{"notes.txt", "hello"}, false, http.StatusUnsupportedMediaType},
+		{"no files", nil, nil, false, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		s, dir := newUploadServer(t, tt.configure)
+		body, ct := multipartBody(t, tt.files...)
+		length := int64(body.Len())
+		if tt.chunked {
+			length = -1
+		}
+		if rec := postUpload(s, body, ct, length); rec.Code != tt.want {
+			t.Errorf("%s: %d %q, want %d", tt.name, rec.Code, rec.Body.String(), tt.want)
+		}
+		if names := storedNames(t, dir); len(names) != 0 {
+			t.Errorf("%s: rejected upload left %q behind", tt.name, names)
+		}
+	}
+
+	s, _ := newUploadServer(t, nil)
+	if rec := postUpload(s, bytes.NewReader([]byte("hello")), "text/plain", 5); rec.Code != http.StatusBadRequest {
+		t.Errorf("non-multipart upload: %d, want 400", rec.Code)
+	}
+}
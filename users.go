@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// userAuthCacheTTL is how long a verified Basic-auth password is trusted
+// without running bcrypt again, which takes tens of milliseconds.
+const userAuthCacheTTL = time.Minute
+
+// User is an account in the embedded user store.
+type User struct {
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	Roles        []string  `json:"roles,omitempty"`
+	Disabled     bool      `json:"disabled,omitempty"`
+	Created      time.Time `json:"created"`
+	Updated      time.Time `json:"updated"`
+}
+
+// UserStore keeps accounts with bcrypt-hashed passwords in a JSON file, so
+// small deployments can authenticate users without an identity provider.
+// Every change is written through to the file.
+type UserStore struct {
+	path    string
+	cost    int
+	metrics *Metrics
+
+	mu    sync.RWMutex
+	users map[string]*User
+	// verified caches successful password checks by user, keyed by the
+	// password's HMAC under cacheKey.
+	verified map[string]userVerified
+	cacheKey []byte
+	// dummyHash is compared against for unknown users, so response times
+	// do not reveal which accounts exist.
+	dummyHash []byte
+}
+
+type userVerified struct {
+	mac     string
+	expires time.Time
+}
+
+func NewUserStore(path string, cost int, m *Metrics) *UserStore {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	dummy, _ := bcrypt.GenerateFromPassword(key, cost)
+	return &UserStore{
+		path:      path,
+		cost:      cost,
+		metrics:   m,
+		users:     make(map[string]*User),
+		verified:  make(map[string]userVerified),
+		cacheKey:  key,
+		dummyHash: dummy,
+	}
+}
+
+// Load reads the store file; a missing file is an empty store.
+func (s *UserStore) Load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var users []*User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.users)
+	for _, u := range users {
+		s.users[u.Name] = u
+	}
+	return nil
+}
+
+// saveLocked writes the store to a temp file and renames it into place, so
+// a crash never leaves a partial file.
+func (s *UserStore) saveLocked() error {
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	slices.SortFunc(users, func(a, b *User) int { return strings.Compare(a.Name, b.Name) })
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".users-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// List returns every user without password hashes, sorted by name.
+func (s *UserStore) List() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		c := *u
+		c.PasswordHash = ""
+		out = append(out, c)
+	}
+	slices.SortFunc(out, func(a, b User) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+// Get returns the named user without the password hash.
+func (s *UserStore) Get(name string) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[name]
+	if !ok {
+		return User{}, false
+	}
+	c := *u
+	c.PasswordHash = ""
+	return c, true
+}
+
+// UserUpdate changes an account; nil fields are left as they are.
+type UserUpdate struct {
+	Password *string   `json:"password"`
+	Roles    *[]string `json:"roles"`
+	Disabled *bool     `json:"disabled"`
+}
+
+// Put creates or updates the named user, reporting whether it was created.
+// New users need a password.
+func (s *UserStore) Put(name string, up UserUpdate) (bool, error) {
+	if name == "" || strings.ContainsAny(name, ":/") {
+		return false, fmt.Errorf("invalid user name %q", name)
+	}
+	var hash []byte
+	if up.Password != nil {
+		if *up.Password == "" {
+			return false, errors.New("password must not be empty")
+		}
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(*up.Password), s.cost); err != nil {
+			return false, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	u, ok := s.users[name]
+	if !ok {
+		if hash == nil {
+			return false, errors.New("new users need a password")
+		}
+		u = &User{Name: name, Created: now}
+	}
+	prev := *u
+	if hash != nil {
+		u.PasswordHash = string(hash)
+	}
+	if up.Roles != nil {
+		u.Roles = slices.Clone(*up.Roles)
+	}
+	if up.Disabled != nil {
+		u.Disabled = *up.Disabled
+	}
+	u.Updated = now
+	s.users[name] = u
+	if err := s.saveLocked(); err != nil {
+		if ok {
+			*u = prev
+		} else {
+			delete(s.users, name)
+		}
+		return false, err
+	}
+	delete(s.verified, name)
+	return !ok, nil
+}
+
+// Delete removes the named user, reporting whether it existed.
+func (s *UserStore) Delete(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return false, nil
+	}
+	delete(s.users, name)
+	if err := s.saveLocked(); err != nil {
+		s.users[name] = u
+		return false, err
+	}
+	delete(s.verified, name)
+	return true, nil
+}
+
+// Authenticate checks a password, returning the user's identity, or
+// errInvalidCredentials for a wrong password or a disabled account. ok is
+// false when there is no such user.
+func (s *UserStore) Authenticate(name, password string) (id *Identity, ok bool, err error) {
+	s.mu.RLock()
+	u, found := s.users[name]
+	var user User
+	if found {
+		user = *u
+	}
+	v, cached := s.verified[name]
+	s.mu.RUnlock()
+	if !found {
+		_ = bcrypt.CompareHashAndPassword(s.dummyHash, []byte(password))
+		return nil, false, nil
+	}
+	if user.Disabled {
+		return nil, true, errInvalidCredentials
+	}
+
+	mac := string(hmacSHA256(s.cacheKey, password))
+	if !cached || v.mac != mac || time.Now().After(v.expires) {
+		if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+			return nil, true, errInvalidCredentials
+		}
+		s.mu.Lock()
+		// Skip caching if the user changed while the hash was compared.
+		if cur, ok := s.users[name]; ok && cur.PasswordHash == user.PasswordHash {
+			s.verified[name] = userVerified{mac: mac, expires: time.Now().Add(userAuthCacheTTL)}
+		}
+		s.mu.Unlock()
+	}
+	return &Identity{Subject: name, Roles: user.Roles, Source: "users"}, true, nil
+}
+
+// Middleware authenticates Basic credentials of users in the store.
+// Credentials for other users pass through, so a directory behind it can
+// check them; requests with neither stay anonymous.
+func (s *UserStore) Middleware() Middleware {
+	return Middleware{Name: "users", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, password, ok := r.BasicAuth()
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			id, known, err := s.Authenticate(name, password)
+			if !known {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err != nil {
+				s.metrics.Add("server_user_auth_total", 1, "result", "invalid")
+				slog.Warn("User authentication failed", "user", name, "client", clientIP(r))
+				w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			s.metrics.Add("server_user_auth_total", 1, "result", "ok")
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+		})
+	}}
+}
+
+// usersHandler serves GET /admin/users.
+func (s *Server) usersHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.users.List())
+}
+
+// userHandler serves GET /admin/users/{name}.
+func (s *Server) userHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.users.Get(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, u)
+}
+
+// putUserHandler serves PUT /admin/users/{name} with
+// {"password": "...", "roles": [...], "disabled": false}, creating the
+// user or changing the fields given.
+func (s *Server) putUserHandler(w http.ResponseWriter, r *http.Request) {
+	var up UserUpdate
+	if err := json.NewDecoder(r.Body).Decode(&up); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	name := r.PathValue("name")
+	created, err := s.users.Put(name, up)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("User saved", "user", name, "created", created)
+	u, _ := s.users.Get(name)
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, u)
+}
+
+// deleteUserHandler serves DELETE /admin/users/{name}.
+func (s *Server) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	ok, err := s.users.Delete(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	slog.Info("User deleted", "user", name)
+	w.WriteHeader(http.StatusNoContent)
+}
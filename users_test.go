@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestUserStore(t *testing.T) *UserStore {
+	t.Helper()
+	return NewUserStore(filepath.Join(t.TempDir(), "users.json"), bcrypt.MinCost, NewMetrics())
+}
+
+func TestUserStoreAuthenticate(t *testing.T) {
+	s := newTestUserStore(t)
+	password, roles := "hunter2", []string{"admin"}
+	if created, err := s.Put("alice", UserUpdate{Password: &password, Roles: &roles}); err != nil || !created {
+		t.Fatalf("Put: %v, %v", created, err)
+	}
+
+	tests := []struct {
+		name, password string
+		known          bool
+		err            error
+	}{
+		{"alice", "hunter2", true, nil},
+		{"alice", "hunter2", true, nil}, // from the verification cache
+		{"alice", "hunter3", true, errInvalidCredentials},
+		{"alice", "", true, errInvalidCredentials},
+		{"bob", "hunter2", false, nil},
+	}
+	for _, tt := range tests {
+		id, known, err := s.Authenticate(tt.name, tt.password)
+		if known != tt.known || !errors.Is(err, tt.err) {
+			t.Errorf("%s/%s: known %v, err %v; want %v, %v", tt.name, tt.password, known, err, tt.known, tt.err)
+		}
+		if valid := err == nil && known; valid && (id == nil || id.Subject != tt.name || !slices.Equal(id.Roles, roles)) || !valid && id != nil {
+			t.Errorf("%s/%s: identity %+v", tt.name, tt.password, id)
+		}
+	}
+
+	// Changing the password drops the cached verification of the old one.
+	password = "correct horse"
+	if _, err := s.Put("alice", UserUpdate{Password: &password}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Authenticate("alice", "hunter2"); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("old password after change: %v", err)
+	}
+	if _, _, err := s.Authenticate("alice", "correct horse"); err != nil {
+		t.Errorf("new password: %v", err)
+	}
+
+	disabled := true
+	if _, err := s.Put("alice", UserUpdate{Disabled: &disabled}); err != nil {
+		t.Fatal(err)
+	}
+	if _, known, err := s.Authenticate("alice", "correct horse"); !known || !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("disabled user: known %v, err %v", known, err)
+	}
+}
+
+func TestUserStorePut(t *testing.T) {
+	s := newTestUserStore(t)
+	password, empty := "pw", ""
+	roles := []string{"reader"}
+	tests := []struct {
+		name string
+		up   UserUpdate
+		ok   bool
+	}{
+		{"", UserUpdate{Password: &password}, false},
+		{"a:b", UserUpdate{Password: &password}, false},
+		{"a/b", UserUpdate{Password: &password}, false},
+		{"carol", UserUpdate{Roles: &roles}, false},
+		{"carol", UserUpdate{Password: &empty}, false},
+		{"carol", UserUpdate{Password: &password}, true},
+		{"carol", UserUpdate{Roles: &roles}, true},
+	}
+	for _, tt := range tests {
+		if _, err := s.Put(tt.name, tt.up); (err == nil) != tt.ok {
+			t.Errorf("Put(%q, %+v): %v, want ok %v", tt.name, tt.up, err, tt.ok)
+		}
+	}
+	if got := s.List(); len(got) != 1 || got[0].Name != "carol" || !slices.Equal(got[0].Roles, roles) {
+		t.Errorf("List = %+v", got)
+	}
+}
+
+func TestUserStorePersists(t *testing.T) {
+	s := newTestUserStore(t)
+	password := "pw"
+	for _, name := range []string{"dave", "erin", "frank"} {
+		if _, err := s.Put(name, UserUpdate{Password: &password}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := s.Delete("erin"); !ok || err != nil {
+		t.Fatalf("Delete: %v, %v", ok, err)
+	}
+	if ok, err := s.Delete("erin"); ok || err != nil {
+		t.Errorf("second Delete: %v, %v", ok, err)
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), password) || !strings.Contains(string(data), "$2a$") {
+		t.Errorf("store file does not hold bcrypt hashes only:\n%s", data)
+	}
+	for _, u := range s.List() {
+		if u.PasswordHash != "" {
+			t.Errorf("List leaks the hash of %s", u.Name)
+		}
+	}
+	if u, ok := s.Get("dave"); !ok || u.PasswordHash != "" {
+		t.Errorf("Get = %+v, %v", u, ok)
+	}
+
+	loaded := NewUserStore(s.path, bcrypt.MinCost, NewMetrics())
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, u := range loaded.List() {
+		names = append(names, u.Name)
+	}
+	if !slices.Equal(names, []string{"dave", "frank"}) {
+		t.Errorf("reloaded users %q", names)
+	}
+	if _, _, err := loaded.Authenticate("frank", password); err != nil {
+		t.Errorf("reloaded user: %v", err)
+	}
+
+	if err := os.WriteFile(s.path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Load(); err == nil {
+		t.Error("loaded a malformed store")
+	}
+	if err := NewUserStore(filepath.Join(t.TempDir(), "missing.json"), bcrypt.MinCost, NewMetrics()).Load(); err != nil {
+		t.Errorf("missing store file: %v", err)
+	}
+}
+
+func TestUserStoreMiddleware(t *testing.T) {
+	s := newTestUserStore(t)
+	password := "pw"
+	if _, err := s.Put("gina", UserUpdate{Password: &password}); err != nil {
+		t.Fatal(err)
+	}
+	h := s.Middleware().Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := IdentityFrom(r.Context()); id != nil {
+			_, _ = w.Write([]byte(id.Subject))
+		}
+	}))
+	tests := []struct {
+		name, user, password string
+		status               int
+		body                 string
+	}{
+		{"valid", "gina", "pw", http.StatusOK, "gina"},
+		{"wrong password", "gina", "nope", http.StatusUnauthorized, "Unauthorized\n"},
+		{"unknown user", "hank", "pw", http.StatusOK, ""},
+		{"anonymous", "", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.password)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tt.status || rec.Body.String() != tt.body {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, rec.Code, rec.Body, tt.status, tt.body)
+		}
+		if (rec.Code == http.StatusUnauthorized) != (rec.Header().Get("WWW-Authenticate") != "") {
+			t.Errorf("%s: WWW-Authenticate %q", tt.name, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
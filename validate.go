@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxValidatedBody caps the request bodies read for schema validation.
+const maxValidatedBody = 1 << 20
+
+// requestSchema holds the schemas a route's requests must satisfy. Query
+// and path parameters are validated as an object of parameter name to
+// value, with values converted to the type their property schema asks for.
+type requestSchema struct {
+	Body  *jsonSchema `json:"body"`
+	Query *jsonSchema `json:"query"`
+	Path  *jsonSchema `json:"path"`
+}
+
+// loadRequestSchemas reads a JSON file mapping route patterns, as passed to
+// Handle (e.g. "POST /upload"), to their request schemas.
+func loadRequestSchemas(path string) (map[string]*requestSchema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schemas map[string]*requestSchema
+	if err := json.Unmarshal(data, &schemas); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for pattern, rs := range schemas {
+		if rs == nil {
+			return nil, fmt.Errorf("%s: %q: no schemas", path, pattern)
+		}
+		for _, s := range []*jsonSchema{rs.Body, rs.Query, rs.Path} {
+			if err := s.compile(s); err != nil {
+				return nil, fmt.Errorf("%s: %q: %w", path, pattern, err)
+			}
+		}
+	}
+	return schemas, nil
+}
+
+// problem is an RFC 9457 problem details response.
+type problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []paramError `json:"errors,omitempty"`
+}
+
+// paramError locates a validation failure: In is body, query or path, and
+// Pointer is a JSON Pointer into the body or the parameter object.
+type paramError struct {
+	In string `json:"in"`
+	schemaError
+}
+
+func writeProblem(w http.ResponseWriter, status int, detail string, errs []paramError) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false) // details quote bounds such as "must be <= 10"
+	if err := enc.Encode(problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: detail, Errors: errs}); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// validateRequest rejects requests that do not match rs with a 400 problem
+// listing every failure, before the handler sees them.
+func validateRequest(pattern string, rs *requestSchema, m *Metrics) Middleware {
+	return Middleware{Name: "validate", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var errs []paramError
+			add := func(in string, es []schemaError) {
+				for _, e := range es {
+					errs = append(errs, paramError{In: in, schemaError: e})
+				}
+			}
+			if rs.Path != nil {
+				add("path", rs.Path.validate(rs.Path, paramsObject(rs.Path, func(name string) []string {
+					if v := r.PathValue(name); v != "" {
+						return []string{v}
+					}
+					return nil
+				}), "", 0, nil))
+			}
+			if rs.Query != nil {
+				query := r.URL.Query()
+				add("query", rs.Query.validate(rs.Query, paramsObject(rs.Query, func(name string) []string { return query[name] }, slices.Collect(maps.Keys(query))...), "", 0, nil))
+			}
+			if rs.Body != nil {
+				body, status, detail := readJSONBody(r)
+				if status != 0 {
+					m.Add("server_validation_failures_total", 1, "route", pattern, "in", "body")
+					writeProblem(w, status, detail, nil)
+					return
+				}
+				add("body", rs.Body.validate(rs.Body, body, "", 0, nil))
+			}
+			if len(errs) > 0 {
+				for _, e := range errs {
+					m.Add("server_validation_failures_total", 1, "route", pattern, "in", e.In)
+				}
+				writeProblem(w, http.StatusBadRequest, "request does not match the schema", errs)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// readJSONBody decodes the request body and puts it back for the handler.
+// A non-zero status means the body cannot be validated at all.
+func readJSONBody(r *http.Request) (any, int, string) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return nil, http.StatusUnsupportedMediaType, "request body must be JSON"
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxValidatedBody+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, "reading request body failed"
+	}
+	if len(data) > maxValidatedBody {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxValidatedBody)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, http.StatusBadRequest, "request body is required"
+	}
+	v, err := decodeJSONValue(data)
+	if err != nil {
+		return nil, http.StatusBadRequest, "invalid JSON: " + err.Error()
+	}
+	return v, 0, ""
+}
+
+// paramsObject gathers parameters into an object for validation. The
+// names are those present in the request plus every declared property.
+func paramsObject(s *jsonSchema, values func(string) []string, names ...string) map[string]any {
+	for name := range s.Properties {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	obj := make(map[string]any)
+	for _, name := range names {
+		vs := values(name)
+		if len(vs) == 0 {
+			continue
+		}
+		prop := s.Properties[name]
+		if prop != nil && slices.Contains(prop.Type, "array") {
+			items := make([]any, len(vs))
+			for i, v := range vs {
+				items[i] = coerceParam(prop.Items, v)
+			}
+			obj[name] = items
+			continue
+		}
+		obj[name] = coerceParam(prop, vs[0])
+	}
+	return obj
+}
+
+// coerceParam converts a parameter string to the scalar type s asks for;
+// values that do not convert stay strings so the type check reports them.
+func coerceParam(s *jsonSchema, v string) any {
+	if s == nil {
+		return v
+	}
+	for _, t := range s.Type {
+		switch t {
+		case "integer", "number":
+			if n, err := decodeJSONValue([]byte(v)); err == nil {
+				if _, ok := n.(json.Number); ok {
+					return n
+				}
+			}
+		case "boolean":
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b
+			}
+		case "string":
+			return v
+		}
+	}
+	return v
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadRequestSchemas(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"not json":   `{`,
+		"no schemas": `{"GET /": null}`,
+		"bad schema": `{"GET /": {"query": {"pattern": "("}}}`,
+	} {
+		path := filepath.Join(dir, "schemas.json")
+		if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadRequestSchemas(path); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schemas.json")
+	if err := os.WriteFile(path, []byte(`{"POST /items/{id}": {
+		"path": {"properties": {"id": {"type": "integer", "minimum": 1}}},
+		"query": {"properties": {"dry": {"type": "boolean"}, "tag": {"type": "array", "items": {"type": "string", "maxLength": 3}}}},
+		"body": {"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}}}
+	}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	schemas, err := loadRequestSchemas(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen string
+	mux := http.NewServeMux()
+	mux.Handle("POST /items/{id}", validateRequest("POST /items/{id}", schemas["POST /items/{id}"], NewMetrics()).Wrap(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			seen = string(b)
+		})))
+
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		want        int
+		errors      []string // in and pointer of each reported failure
+	}{
+		{"valid", "/items/7?dry=true&tag=a&tag=bc", "application/json", `{"name": "x"}`, http.StatusOK, nil},
+		{"json suffix", "/items/7", "application/merge-patch+json; charset=utf-8", `{"name": "x"}`, http.StatusOK, nil},
+		{"bad params", "/items/0?dry=maybe&tag=long", "application/json", `{"name": "x"}`, http.StatusBadRequest,
+			[]string{"path /id", "query /dry", "query /tag/0"}},
+		{"bad body", "/items/x", "application/json", `{"name": 1}`, http.StatusBadRequest, []string{"path /id", "body /name"}},
+		{"not json", "/items/7", "text/plain", `{"name": "x"}`, http.StatusUnsupportedMediaType, nil},
+		{"empty", "/items/7", "application/json", ` `, http.StatusBadRequest, nil},
+		{"malformed", "/items/7", "application/json", `{"name": "x"} {}`, http.StatusBadRequest, nil},
+		{"too large", "/items/7", "application/json", `"` + strings.Repeat("x", maxValidatedBody) + `"`, http.StatusRequestEntityTooLarge, nil},
+	}
+	for _, tt := range tests {
+		seen = ""
+		r := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, tt.want)
+			continue
+		}
+		if rec.Code == http.StatusOK {
+			if seen != tt.body {
+				t.Errorf("%s: handler read %q, want the body", tt.name, seen)
+			}
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s: Content-Type %q", tt.name, ct)
+		}
+		var p problem
+		if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || p.Status != tt.want {
+			t.Errorf("%s: problem %s: %v", tt.name, rec.Body, err)
+		}
+		var got []string
+		for _, e := range p.Errors {
+			got = append(got, e.In+" "+e.Pointer)
+		}
+		if !slices.Equal(got, tt.errors) {
+			t.Errorf("%s: errors %q, want %q", tt.name, got, tt.errors)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WAF modes.
+const (
+	WAFBlock = "block"
+	WAFLog   = "log"
+)
+
+// wafReloadInterval is how often the rules file is checked for changes.
+const wafReloadInterval = 5 * time.Second
+
+// wafDefaultScore is the score of a rule that does not set one, and the
+// default threshold, so by default any single match is an anomaly.
+const wafDefaultScore = 5
+
+// WAFRule is one entry of the rules file. Every condition it sets must
+// match for the rule to fire; patterns are Go regular expressions and can
+// be made case-insensitive with (?i).
+type WAFRule struct {
+	ID string `json:"id"`
+	// Methods limits the rule to these methods; empty means any.
+	Methods []string `json:"methods,omitempty"`
+	// Path is matched against the decoded path, Query against the decoded
+	// query string and Body against the start of the request body.
+	Path  string `json:"path,omitempty"`
+	Query string `json:"query,omitempty"`
+	Body  string `json:"body,omitempty"`
+	// Headers maps header names to patterns one of their values must
+	// match; an empty pattern only requires the header to be present.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Score is added to the request's anomaly score when the rule fires.
+	Score int `json:"score,omitempty"`
+
+	path, query, body *regexp.Regexp
+	headers           map[string]*regexp.Regexp
+}
+
+// wafRuleSet is the parsed rules file.
+type wafRuleSet struct {
+	// Threshold is the anomaly score at which a request is blocked (or
+	// logged, in log mode).
+	Threshold int       `json:"threshold"`
+	Rules     []WAFRule `json:"rules"`
+
+	inspectBody bool
+}
+
+func parseWAFRules(data []byte) (*wafRuleSet, error) {
+	set := &wafRuleSet{Threshold: wafDefaultScore}
+	if err := json.Unmarshal(data, set); err != nil {
+		return nil, err
+	}
+	compile := func(id, field, pattern string) (*regexp.Regexp, error) {
+		if pattern == "" {
+			return nil, nil
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q %s: %w", id, field, err)
+		}
+		return re, nil
+	}
+	for i := range set.Rules {
+		rule := &set.Rules[i]
+		if rule.ID == "" {
+			rule.ID = fmt.Sprintf("rule-%d", i+1)
+		}
+		if rule.Score == 0 {
+			rule.Score = wafDefaultScore
+		}
+		for j, m := range rule.Methods {
+			rule.Methods[j] = strings.ToUpper(m)
+		}
+		var err error
+		if rule.path, err = compile(rule.ID, "path", rule.Path); err != nil {
+			return nil, err
+		}
+		if rule.query, err = compile(rule.ID, "query", rule.Query); err != nil {
+			return nil, err
+		}
+		if rule.body, err = compile(rule.ID, "body", rule.Body); err != nil {
+			return nil, err
+		}
+		rule.headers = make(map[string]*regexp.Regexp, len(rule.Headers))
+		for name, pattern := range rule.Headers {
+			if rule.headers[http.CanonicalHeaderKey(name)], err = compile(rule.ID, "header "+name, pattern); err != nil {
+				return nil, err
+			}
+		}
+		set.inspectBody = set.inspectBody || rule.body != nil
+	}
+	return set, nil
+}
+
+func (rule *WAFRule) match(r *http.Request, query string, body []byte) bool {
+	if len(rule.Methods) > 0 && !slices.Contains(rule.Methods, r.Method) {
+		return false
+	}
+	if rule.path != nil && !rule.path.MatchString(r.URL.Path) {
+		return false
+	}
+	if rule.query != nil && !rule.query.MatchString(query) {
+		return false
+	}
+	if rule.body != nil && !rule.body.Match(body) {
+		return false
+	}
+	for name, re := range rule.headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 || re != nil && !slices.ContainsFunc(values, re.MatchString) {
+			return false
+		}
+	}
+	return true
+}
+
+// WAF scores requests against a hot-reloadable rules file and blocks or
+// logs those reaching the threshold.
+type WAF struct {
+	path         string
+	mode         string
+	maxBodyBytes int
+	metrics      *Metrics
+
+	mu      sync.RWMutex
+	rules   *wafRuleSet
+	modTime time.Time
+}
+
+func NewWAF(path, mode string, maxBodyBytes int, m *Metrics) *WAF {
+	return &WAF{path: path, mode: mode, maxBodyBytes: maxBodyBytes, metrics: m, rules: &wafRuleSet{}}
+}
+
+// Load reads and compiles the rules file. On error the current rules stay
+// in effect.
+func (w *WAF) Load() error {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return err
+	}
+	rules, err := parseWAFRules(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", w.path, err)
+	}
+	w.mu.Lock()
+	w.rules = rules
+	w.modTime = info.ModTime()
+	w.mu.Unlock()
+	return nil
+}
+
+// watch reloads the rules file whenever its modification time changes.
+func (w *WAF) watch(ctx context.Context) error {
+	ticker := time.NewTicker(wafReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(w.path)
+		if err != nil {
+			continue
+		}
+		w.mu.RLock()
+		changed := !info.ModTime().Equal(w.modTime)
+		w.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := w.Load(); err != nil {
+			slog.Warn("Failed to reload WAF rules", "path", w.path, "error", err)
+			continue
+		}
+		slog.Info("Reloaded WAF rules", "path", w.path)
+	}
+}
+
+// Middleware inspects requests before they reach the handler.
+func (w *WAF) Middleware() Middleware {
+	return Middleware{Name: "waf", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			w.mu.RLock()
+			rules := w.rules
+			w.mu.RUnlock()
+			if len(rules.Rules) == 0 {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			var body []byte
+			if rules.inspectBody && r.Body != nil && r.Body != http.NoBody {
+				var err error
+				body, err = io.ReadAll(io.LimitReader(r.Body, int64(w.maxBodyBytes)))
+				if err != nil {
+					http.Error(rw, "reading request body", http.StatusBadRequest)
+					return
+				}
+				// Put back what was read; the rest is still unread.
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			}
+			query, err := url.QueryUnescape(r.URL.RawQuery)
+			if err != nil {
+				query = r.URL.RawQuery
+			}
+
+			score := 0
+			var matched []string
+			for i := range rules.Rules {
+				rule := &rules.Rules[i]
+				if rule.match(r, query, body) {
+					score += rule.Score
+					matched = append(matched, rule.ID)
+					w.metrics.Add("server_waf_rule_matches_total", 1, "rule", rule.ID)
+				}
+			}
+			if score < rules.Threshold {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			attrs := []any{"client", clientIP(r), "method", r.Method, "path", r.URL.Path, "score", score, "rules", matched}
+			if w.mode == WAFLog {
+				w.metrics.Add("server_waf_anomalies_total", 1, "action", "logged")
+				slog.Warn("WAF anomaly", attrs...)
+				next.ServeHTTP(rw, r)
+				return
+			}
+			w.metrics.Add("server_waf_anomalies_total", 1, "action", "blocked")
+			slog.Warn("WAF blocked request", attrs...)
+			http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		})
+	}}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseWAFRules(t *testing.T) {
+	set, err := parseWAFRules([]byte(`{"rules": [
+		{"methods": ["post"], "path": "^/login$"},
+		{"id": "ua", "headers": {"user-agent": "(?i)sqlmap", "x-probe": ""}, "score": 2}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Threshold != wafDefaultScore || set.inspectBody {
+		t.Errorf("threshold %d, inspectBody %v", set.Threshold, set.inspectBody)
+	}
+	first, second := set.Rules[0], set.Rules[1]
+	if first.ID != "rule-1" || first.Score != wafDefaultScore || first.Methods[0] != "POST" {
+		t.Errorf("defaults not applied: %+v", first)
+	}
+	if second.Score != 2 || second.headers["User-Agent"] == nil || second.headers["X-Probe"] != nil {
+		t.Errorf("headers not canonicalized: %+v", second.headers)
+	}
+
+	for _, tt := range []struct {
+		rules string
+		err   string
+	}{
+		{`{"rules": [`, "unexpected end"},
+		{`{"rules": [{"id": "p", "path": "("}]}`, `rule "p" path`},
+		{`{"rules": [{"query": "[a-"}]}`, `rule "rule-1" query`},
+		{`{"rules": [{"id": "h", "headers": {"Cookie": "*"}}]}`, `rule "h" header Cookie`},
+	} {
+		if _, err := parseWAFRules([]byte(tt.rules)); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want one mentioning %q", tt.rules, err, tt.err)
+		}
+	}
+}
+
+func TestWAFMiddleware(t *testing.T) {
+	rules, err := parseWAFRules([]byte(`{"threshold": 5, "rules": [
+		{"id": "traversal", "path": "\\.\\./"},
+		{"id": "union", "query": "(?i)union\\s+select"},
+		{"id": "scanner", "headers": {"User-Agent": "(?i)nikto"}, "score": 3},
+		{"id": "admin", "methods": ["DELETE"], "path": "^/admin", "score": 2},
+		{"id": "shell", "methods": ["POST"], "body": "<\\?php"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		ua     string
+		body   string
+		want   int
+	}{
+		{"clean", "GET", "/index.html", "curl", "", http.StatusOK},
+		{"path", "GET", "/static/%2e%2e/etc/passwd", "", "", http.StatusForbidden},
+		{"decoded query", "GET", "/search?q=1%20UNION%20SELECT%20password", "", "", http.StatusForbidden},
+		{"below threshold", "GET", "/", "Nikto/2.5", "", http.StatusOK},
+		{"scores add up", "DELETE", "/admin/users", "Nikto/2.5", "", http.StatusForbidden},
+		{"method mismatch", "GET", "/admin/users", "Nikto/2.5", "", http.StatusOK},
+		{"body", "POST", "/upload", "", "x=<?php system($_GET['c']);", http.StatusForbidden},
+		{"body past limit", "POST", "/upload", "", strings.Repeat(" ", 64) + "<?php", http.StatusOK},
+	}
+	for _, mode := range []string{WAFBlock, WAFLog} {
+		w := NewWAF("", mode, 32, NewMetrics())
+		w.rules = rules
+		for _, tt := range tests {
+			var seen string
+			h := w.Middleware().Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				seen = string(b)
+			}))
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.ua != "" {
+				r.Header.Set("User-Agent", tt.ua)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+
+			want := tt.want
+			if mode == WAFLog {
+				want = http.StatusOK
+			}
+			if rec.Code != want {
+				t.Errorf("%s mode, %s: %d, want %d", mode, tt.name, rec.Code, want)
+			}
+			if rec.Code == http.StatusOK && seen != tt.body {
+				t.Errorf("%s mode, %s: handler read %q, want the whole body", mode, tt.name, seen)
+			}
+		}
+	}
+}
+
+func FuzzParseWAFRules(f *testing.F) {
+	f.Add([]byte(`{"threshold": 3, "rules": [{"methods": ["get"], "path": "^/a", "headers": {"x": ""}, "body": "b"}]}`))
+	f.Add([]byte(`{"rules": [{"query": "(?i)select", "score": -1}]}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rules, err := parseWAFRules(data)
+		if err != nil {
+			return
+		}
+		w := NewWAF("", WAFBlock, 16, NewMetrics())
+		w.rules = rules
+		h := w.Middleware().Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		r := httptest.NewRequest("GET", "/a?select=1", strings.NewReader("body"))
+		r.Header.Set("X", "1")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook signature schemes.
+const (
+	// WebhookGitHub expects X-Hub-Signature-256: sha256=HEX, an HMAC of the
+	// body, with the event in X-GitHub-Event and the delivery ID in
+	// X-GitHub-Delivery. Only the body is signed: the event and delivery
+	// headers can be altered by anyone replaying a captured delivery, so
+	// replays are recognised by the signature instead, and callbacks should
+	// check that the payload has the shape of the event they handle. GitHub
+	// signs no timestamp either, so a delivery replayed after Tolerance has
+	// passed is accepted again.
+	WebhookGitHub = "github"
+	// WebhookStripe expects Stripe-Signature: t=UNIX,v1=HEX, an HMAC of
+	// "UNIX.body", with the event type and ID in the JSON body.
+	WebhookStripe = "stripe"
+)
+
+// WebhookOptions configures a WebhookReceiver.
+type WebhookOptions struct {
+	Scheme string
+	Secret []byte
+	// MaxBodyBytes caps the payload size; larger deliveries get 413.
+	MaxBodyBytes int64
+	// Tolerance is how far a signed timestamp may be from now, and how long
+	// deliveries are remembered to reject replays.
+	Tolerance time.Duration
+}
+
+// WebhookDelivery is a verified delivery passed to callbacks.
+type WebhookDelivery struct {
+	ID        string
+	Event     string
+	Timestamp time.Time // zero for schemes without a signed timestamp
+	Payload   []byte
+	Header    http.Header
+}
+
+// WebhookFunc handles a delivery. An error answers the sender with 500 so
+// that it retries, and forgets the delivery so the retry is accepted.
+type WebhookFunc func(ctx context.Context, d WebhookDelivery) error
+
+// WebhookReceiver verifies signed webhook deliveries and dispatches them to
+// the callbacks registered for their event.
+type WebhookReceiver struct {
+	opts    WebhookOptions
+	metrics *Metrics
+
+	mu        sync.RWMutex
+	callbacks map[string][]WebhookFunc
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// Webhook returns a receiver for opts; register callbacks with On and
+// mount it with Handle, e.g. on "POST /webhooks/github".
+func (s *Server) Webhook(opts WebhookOptions) *WebhookReceiver {
+	return &WebhookReceiver{
+		opts:      opts,
+		metrics:   s.metrics,
+		callbacks: make(map[string][]WebhookFunc),
+		seen:      make(map[string]time.Time),
+	}
+}
+
+// On registers fn for deliveries of event; "*" matches every event. Callbacks
+// run in registration order, those for the event before the catch-all ones.
+func (wr *WebhookReceiver) On(event string, fn WebhookFunc) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.callbacks[event] = append(wr.callbacks[event], fn)
+}
+
+var (
+	errWebhookSignature = errors.New("missing or invalid signature")
+	errWebhookStale     = errors.New("timestamp outside the tolerance")
+)
+
+func (wr *WebhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, wr.opts.MaxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			wr.reject(w, "too_large", "payload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		wr.reject(w, "bad_request", "reading payload", http.StatusBadRequest)
+		return
+	}
+
+	d, key, err := wr.verify(r.Header, payload)
+	switch {
+	case errors.Is(err, errWebhookStale):
+		wr.reject(w, "stale", err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		wr.reject(w, "invalid_signature", err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if !wr.remember(key) {
+		wr.metrics.Add("server_webhooks_total", 1, "event", d.Event, "result", "duplicate")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	wr.mu.RLock()
+	fns := slices.Concat(wr.callbacks[d.Event], wr.callbacks["*"])
+	wr.mu.RUnlock()
+	if len(fns) == 0 {
+		wr.metrics.Add("server_webhooks_total", 1, "event", d.Event, "result", "unhandled")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	for _, fn := range fns {
+		if err := fn(r.Context(), d); err != nil {
+			wr.forget(key)
+			wr.metrics.Add("server_webhooks_total", 1, "event", d.Event, "result", "failed")
+			slog.Error("Webhook callback failed", "event", d.Event, "id", d.ID, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	wr.metrics.Add("server_webhooks_total", 1, "event", d.Event, "result", "accepted")
+	w.WriteHeader(http.StatusOK)
+}
+
+// reject answers a delivery that failed before verification; its event is
+// not trusted, so it is not used as a label.
+func (wr *WebhookReceiver) reject(w http.ResponseWriter, result, msg string, status int) {
+	wr.metrics.Add("server_webhooks_total", 1, "event", "", "result", result)
+	http.Error(w, msg, status)
+}
+
+// verify checks the payload's signature according to the scheme and
+// extracts the delivery's identity. key identifies the delivery for replay
+// detection and is derived only from signed data.
+func (wr *WebhookReceiver) verify(h http.Header, payload []byte) (d WebhookDelivery, key string, err error) {
+	d = WebhookDelivery{Payload: payload, Header: h}
+	switch wr.opts.Scheme {
+	case WebhookGitHub:
+		want := webhookSignature(wr.opts.Secret, "", payload)
+		sig, ok := strings.CutPrefix(h.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok || !hmac.Equal([]byte(sig), []byte(want)) {
+			return d, "", errWebhookSignature
+		}
+		d.ID, d.Event = h.Get("X-GitHub-Delivery"), h.Get("X-GitHub-Event")
+		if d.ID == "" {
+			d.ID = want
+		}
+		key = want
+	case WebhookStripe:
+		var ts string
+		var sigs []string
+		for part := range strings.SplitSeq(h.Get("Stripe-Signature"), ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch k {
+			case "t":
+				ts = v
+			case "v1":
+				sigs = append(sigs, v)
+			}
+		}
+		unix, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil || len(sigs) == 0 {
+			return d, "", errWebhookSignature
+		}
+		want := []byte(webhookSignature(wr.opts.Secret, ts+".", payload))
+		valid := false
+		for _, sig := range sigs {
+			valid = valid || hmac.Equal([]byte(sig), want)
+		}
+		if !valid {
+			return d, "", errWebhookSignature
+		}
+		// Checked after the signature so the timestamp is known to be genuine.
+		d.Timestamp = time.Unix(unix, 0)
+		if age := time.Since(d.Timestamp); age > wr.opts.Tolerance || age < -wr.opts.Tolerance {
+			return d, "", errWebhookStale
+		}
+		var event struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		}
+		_ = json.Unmarshal(payload, &event)
+		d.ID, d.Event = event.ID, event.Type
+		if d.ID == "" {
+			d.ID = string(want)
+		}
+		key = d.ID
+	default:
+		return d, "", errWebhookSignature
+	}
+	return d, key, nil
+}
+
+// webhookSignature is the hex HMAC-SHA256 of prefix followed by payload.
+func webhookSignature(secret []byte, prefix string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(prefix))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// remember records a delivery's replay key and reports whether it is new.
+// Keys are only recorded for verified deliveries, so the set is bounded by
+// the senders' legitimate rate over the tolerance window.
+func (wr *WebhookReceiver) remember(key string) bool {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	now := time.Now()
+	if now.Sub(wr.lastSweep) > time.Minute {
+		wr.lastSweep = now
+		maps.DeleteFunc(wr.seen, func(_ string, until time.Time) bool { return now.After(until) })
+	}
+	if until, ok := wr.seen[key]; ok && now.Before(until) {
+		return false
+	}
+	wr.seen[key] = now.Add(wr.opts.Tolerance)
+	return true
+}
+
+func (wr *WebhookReceiver) forget(key string) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	delete(wr.seen, key)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookReceiver(t *testing.T) {
+	secret := []byte("s3cret")
+	github := func(payload, delivery, event string, sign []byte) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(payload))
+		r.Header.Set("X-Hub-Signature-256", "sha256="+webhookSignature(sign, "", []byte(payload)))
+		r.Header.Set("X-GitHub-Delivery", delivery)
+		r.Header.Set("X-GitHub-Event", event)
+		return r
+	}
+	stripe := func(payload string, at time.Time, sign []byte) *http.Request {
+		ts := strconv.FormatInt(at.Unix(), 10)
+		r := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(payload))
+		r.Header.Set("Stripe-Signature", "t="+ts+",v1=deadbeef,v1="+webhookSignature(sign, ts+".", []byte(payload)))
+		return r
+	}
+	now := time.Now()
+	push := `{"ref":"refs/heads/main"}`
+	charge := `{"id":"evt_1","type":"charge.succeeded"}`
+
+	tests := []struct {
+		name       string
+		scheme     string
+		deliveries []*http.Request
+		want       []int
+		calls      []string // events dispatched, in order
+	}{
+		{"github valid", WebhookGitHub,
+			[]*http.Request{github(push, "d1", "push", secret)},
+			[]int{http.StatusOK}, []string{"push"}},
+		{"github tampered", WebhookGitHub,
+			[]*http.Request{func() *http.Request {
+				r := github(push, "d1", "push", secret)
+				r.Body = io.NopCloser(strings.NewReader(`{"ref":"refs/heads/evil"}`))
+				return r
+			}()},
+			[]int{http.StatusUnauthorized}, nil},
+		{"github wrong secret", WebhookGitHub,
+			[]*http.Request{github(push, "d1", "push", []byte("other"))},
+			[]int{http.StatusUnauthorized}, nil},
+		{"github replayed", WebhookGitHub,
+			[]*http.Request{github(push, "d1", "push", secret), github(push, "d1", "push", secret)},
+			[]int{http.StatusOK, http.StatusOK}, []string{"push"}},
+		{"github replayed with new headers", WebhookGitHub,
+			[]*http.Request{github(push, "d1", "push", secret), github(push, "d2", "release", secret)},
+			[]int{http.StatusOK, http.StatusOK}, []string{"push"}},
+		{"github distinct bodies", WebhookGitHub,
+			[]*http.Request{github(push, "d1", "push", secret), github(`{"ref":"refs/heads/dev"}`, "d1", "push", secret)},
+			[]int{http.StatusOK, http.StatusOK}, []string{"push", "push"}},
+		{"stripe valid", WebhookStripe,
+			[]*http.Request{stripe(charge, now, secret)},
+			[]int{http.StatusOK}, []string{"charge.succeeded"}},
+		{"stripe tampered", WebhookStripe,
+			[]*http.Request{func() *http.Request {
+				r := stripe(charge, now, secret)
+				r.Body = io.NopCloser(strings.NewReader(`{"id":"evt_1","type":"charge.refunded"}`))
+				return r
+			}()},
+			[]int{http.StatusUnauthorized}, nil},
+		{"stripe stale", WebhookStripe,
+			[]*http.Request{stripe(charge, now.Add(-10*time.Minute), secret)},
+			[]int{http.StatusBadRequest}, nil},
+		{"stripe future", WebhookStripe,
+			[]*http.Request{stripe(charge, now.Add(10*time.Minute), secret)},
+			[]int{http.StatusBadRequest}, nil},
+		{"stripe replayed", WebhookStripe,
+			[]*http.Request{stripe(charge, now, secret), stripe(charge, now.Add(time.Second), secret)},
+			[]int{http.StatusOK, http.StatusOK}, []string{"charge.succeeded"}},
+		{"unknown scheme", "gitlab",
+			[]*http.Request{github(push, "d1", "push", secret)},
+			[]int{http.StatusUnauthorized}, nil},
+	}
+	s := newTestServer(t, nil)
+	for _, tt := range tests {
+		wr := s.Webhook(WebhookOptions{Scheme: tt.scheme, Secret: secret, MaxBodyBytes: 1 << 10, Tolerance: 5 * time.Minute})
+		var calls []string
+		wr.On("*", func(_ context.Context, d WebhookDelivery) error {
+			calls = append(calls, d.Event)
+			return nil
+		})
+		for i, r := range tt.deliveries {
+			rec := httptest.NewRecorder()
+			wr.ServeHTTP(rec, r)
+			if rec.Code != tt.want[i] {
+				t.Errorf("%s: delivery %d: %d %s, want %d", tt.name, i, rec.Code, rec.Body, tt.want[i])
+			}
+		}
+		if !slices.Equal(calls, tt.calls) {
+			t.Errorf("%s: dispatched %q, want %q", tt.name, calls, tt.calls)
+		}
+	}
+}
+
+func TestWebhookRetryAfterFailure(t *testing.T) {
+	secret := []byte("s3cret")
+	wr := newTestServer(t, nil).Webhook(WebhookOptions{Scheme: WebhookGitHub, Secret: secret, MaxBodyBytes: 8, Tolerance: time.Minute})
+	fail := true
+	wr.On("push", func(context.Context, WebhookDelivery) error {
+		if fail {
+			fail = false
+			return errors.New("busy")
+		}
+		return nil
+	})
+	deliver := func(payload string) int {
+		r := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(payload))
+		r.Header.Set("X-Hub-Signature-256", "sha256="+webhookSignature(secret, "", []byte(payload)))
+		r.Header.Set("X-GitHub-Event", "push")
+		rec := httptest.NewRecorder()
+		wr.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	if got := deliver("{}"); got != http.StatusInternalServerError {
+		t.Errorf("failing callback: %d, want 500", got)
+	}
+	if got := deliver("{}"); got != http.StatusOK {
+		t.Errorf("retry: %d, want 200", got)
+	}
+	if got := deliver(`{"a":"long"}`); got != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized payload: %d, want 413", got)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to the client key to form Sec-WebSocket-Accept.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	wsText   = 0x1
+	wsBinary = 0x2
+	wsClose  = 0x8
+	wsPing   = 0x9
+	wsPong   = 0xA
+)
+
+// WebSocket close codes.
+const (
+	wsCloseNormal        = 1000
+	wsCloseGoingAway     = 1001
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+	wsCloseTryAgainLater = 1013
+)
+
+// wsMaxMessage caps incoming messages; the broker's clients only send
+// control frames, so anything large is a misbehaving peer.
+const wsMaxMessage = 64 << 10
+
+// wsWriteTimeout bounds a single frame write so a peer that stops reading
+// cannot hold a writer forever.
+const wsWriteTimeout = 10 * time.Second
+
+// wsConn is a server-side WebSocket connection (RFC 6455). It is enough
+// for pushing messages to browsers: no extensions, no fragmented sends.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	mu     sync.Mutex // serialises frame writes
+	closed bool
+}
+
+// isWebSocketUpgrade reports whether r asks to switch to WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") && headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for t := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptWebSocket completes the opening handshake and takes over the
+// connection. On error a response has already been written.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" {
+		http.Error(w, "bad WebSocket handshake", http.StatusBadRequest)
+		return nil, errors.New("bad WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		// HTTP/2 connections cannot be hijacked; clients fall back to SSE.
+		http.Error(w, "WebSocket needs HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	_, _ = fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+// writeFrame sends one unfragmented, unmasked frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := (&net.Buffers{header, payload}).WriteTo(c.conn)
+	return err
+}
+
+// readMessage returns the next data message, answering pings along the way.
+// A close frame from the peer is echoed and reported as io.EOF.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var msg []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			code := uint16(wsCloseNormal)
+			if len(payload) >= 2 {
+				code = binary.BigEndian.Uint16(payload)
+			}
+			c.close(code, "")
+			return 0, nil, io.EOF
+		case 0: // continuation
+			if opcode == 0 {
+				return 0, nil, c.fail(wsCloseProtocolError, "unexpected continuation frame")
+			}
+		case wsText, wsBinary:
+			if opcode != 0 {
+				return 0, nil, c.fail(wsCloseProtocolError, "expected continuation frame")
+			}
+			opcode = op
+		default:
+			return 0, nil, c.fail(wsCloseProtocolError, "unknown opcode")
+		}
+		if len(msg)+len(payload) > wsMaxMessage {
+			return 0, nil, c.fail(wsCloseTooBig, "message too big")
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return opcode, msg, nil
+		}
+	}
+}
+
+// readFrame reads one frame and unmasks it; clients must mask every frame.
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode = head[0]&0x80 != 0, head[0]&0x0F
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "reserved bits set")
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "unmasked client frame")
+	}
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (n > 125 || !fin) {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "invalid control frame")
+	}
+	if n > wsMaxMessage {
+		return false, 0, nil, c.fail(wsCloseTooBig, "message too big")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// fail closes the connection with code and returns an error describing why.
+func (c *wsConn) fail(code uint16, reason string) error {
+	c.close(code, reason)
+	return errors.New("websocket: " + reason)
+}
+
+// close sends a close frame, if none has been sent, and closes the
+// connection. It is safe to call more than once.
+func (c *wsConn) close(code uint16, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	_ = c.writeFrame(wsClose, append(payload, reason...))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		_ = c.conn.Close()
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// wellKnownPrefix is the RFC 8615 path prefix for site-wide metadata.
+const wellKnownPrefix = "/.well-known/"
+
+// acmeChallengeDir holds HTTP-01 challenge responses written by the ACME
+// client.
+const acmeChallengeDir = "/challenge/.well-known/acme-challenge/"
+
+// WellKnownDocument is a fixed document served under /.well-known/, such as
+// content from an embed.FS.
+type WellKnownDocument struct {
+	// ContentType is sent with the document; empty means guessed from the
+	// name's extension, or from the content.
+	ContentType string
+	Body        []byte
+}
+
+// WellKnown serves doc at /.well-known/name on the HTTP and HTTPS
+// listeners. Like any route, a name can only be registered once.
+func (s *Server) WellKnown(name string, doc WellKnownDocument) {
+	contentType := doc.ContentType
+	if contentType == "" {
+		contentType = documentContentType(name, doc.Body)
+	}
+	s.handleWellKnown(name, fixedDocument(contentType, doc.Body))
+}
+
+func (s *Server) handleWellKnown(name string, h http.Handler) {
+	s.Handle(ListenerHTTP, "GET "+wellKnownPrefix+name, h)
+	s.Handle(ListenerHTTPS, "GET "+wellKnownPrefix+name, h)
+}
+
+// registerWellKnown installs the configured /.well-known/ documents: the
+// ACME challenge directory, files from well_known_documents, and the
+// generated security.txt and change-password redirect unless a file
+// replaces them.
+func (s *Server) registerWellKnown() {
+	s.handleWellKnown("acme-challenge/", http.StripPrefix(wellKnownPrefix+"acme-challenge/", http.FileServer(http.Dir(acmeChallengeDir))))
+
+	files, err := parseWellKnownDocuments(s.config.WellKnownDocuments)
+	if err != nil {
+		slog.Warn("Ignoring invalid well-known documents", "error", err)
+	}
+	for name, file := range files {
+		s.handleWellKnown(name, fileDocument(name, file))
+	}
+	if _, ok := files["security.txt"]; !ok && len(s.config.SecurityContacts) > 0 {
+		s.handleWellKnown("security.txt", securityTxt(s.config.SecurityContacts, s.config.SecurityPolicyURL, s.config.SecurityTxtExpiry))
+	}
+	if _, ok := files["change-password"]; !ok && s.config.ChangePasswordURL != "" {
+		s.handleWellKnown("change-password", http.RedirectHandler(s.config.ChangePasswordURL, http.StatusFound))
+	}
+}
+
+// parseWellKnownDocuments parses "name=file" entries, where name is the
+// path below /.well-known/.
+func parseWellKnownDocuments(entries []string) (map[string]string, error) {
+	out := make(map[string]string, len(entries))
+	for _, e := range entries {
+		name, file, ok := strings.Cut(e, "=")
+		name, file = strings.TrimSpace(name), strings.TrimSpace(file)
+		if !ok || name == "" || file == "" {
+			return nil, fmt.Errorf("invalid well-known document %q: want name=file", e)
+		}
+		if path.Clean("/"+name) != "/"+name || strings.HasSuffix(name, "/") {
+			return nil, fmt.Errorf("well-known document %q: name must be a clean relative path", e)
+		}
+		if _, dup := out[name]; dup {
+			return nil, fmt.Errorf("well-known document %q: %s listed twice", e, name)
+		}
+		out[name] = file
+	}
+	return out, nil
+}
+
+// fileDocument serves file as the document name, read on each request so
+// edits need no restart.
+func fileDocument(name, file string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			slog.Warn("Failed to read document", "name", name, "file", file, "error", err)
+			http.NotFound(w, r)
+			return
+		}
+		var modTime time.Time
+		if info, err := os.Stat(file); err == nil {
+			modTime = info.ModTime()
+		}
+		w.Header().Set("Content-Type", documentContentType(name, data))
+		http.ServeContent(w, r, name, modTime, bytes.NewReader(data))
+	})
+}
+
+// documentContentType guesses a document's type. Many well-known names
+// have no extension, so JSON documents such as apple-app-site-association
+// are recognized by their content.
+func documentContentType(name string, body []byte) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	if json.Valid(body) {
+		return "application/json"
+	}
+	return http.DetectContentType(body)
+}
+
+// securityTxt serves an RFC 9116 security.txt. Expires is required and
+// must not lie far ahead, so it is computed per request as expiry from
+// now, rounded down to the day.
+func securityTxt(contacts []string, policy string, expiry time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		for _, c := range contacts {
+			fmt.Fprintf(&b, "Contact: %s\n", c)
+		}
+		fmt.Fprintf(&b, "Expires: %s\n", time.Now().Add(expiry).UTC().Truncate(24*time.Hour).Format(time.RFC3339))
+		if policy != "" {
+			fmt.Fprintf(&b, "Policy: %s\n", policy)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(b.String()))
+	})
+}